@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	_ "time/tzdata" // schedule timezones must resolve in images without /usr/share/zoneinfo
 
 	"cloud/internal/api"
+	"cloud/internal/auth"
 	"cloud/internal/autoscaler"
+	"cloud/internal/loadbalancer"
+	"cloud/internal/ratelimit"
 	"cloud/internal/scheduler"
+	"cloud/internal/storage"
+	"cloud/internal/tlsconf"
+	"cloud/internal/webhook"
 	"cloud/pkg/models"
 )
 
@@ -26,16 +36,47 @@ func main() {
 	maxWorkers := getEnvInt("MAX_WORKERS", 4)
 	validateConfig(queueThresholdHigh, queueThresholdLow, minWorkers, maxWorkers)
 
-	store := models.NewJobStore()
+	stores := openStores()
+	defer stores.close()
+	store, workerRegistry := stores.jobs, stores.workers
+	lbStrategy := loadbalancer.Strategy(getEnv("LB_STRATEGY", string(loadbalancer.RoundRobin)))
+	balancer, err := loadbalancer.New(lbStrategy)
+	if err != nil {
+		log.Fatalf("config invalid: LB_STRATEGY: %v", err)
+	}
+	log.Printf("event=load_balancer strategy=%s", lbStrategy)
 	queue := scheduler.NewQueue()
-	workerRegistry := models.NewWorkerRegistry()
-	sched := scheduler.New(queue, store, workerRegistry)
+	sched := scheduler.New(queue, store, workerRegistry, stores.schedules, balancer)
+	sched.SetTenantQuotas(tenantQuotas())
+	priorities := priorityRange()
+	sched.SetPriorityAging(time.Duration(getEnvCount("PRIORITY_AGING_SEC", 0))*time.Second, priorities.Highest())
+	webhooks, err := webhook.New(stores.webhooks, webhook.Config{
+		Secret:      os.Getenv("WEBHOOK_SECRET"),
+		MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		AllowHosts:  strings.Split(os.Getenv("WEBHOOK_ALLOW_HOSTS"), ","),
+	})
+	if err != nil {
+		log.Fatalf("config invalid: WEBHOOK_ALLOW_HOSTS: %v", err)
+	}
+	defer webhooks.Close()
+	sched.OnFinish(webhooks.Notify)
+	tlsCfg := tlsconf.FromEnv()
+	if tlsCfg.Enabled() {
+		transport, err := tlsCfg.Transport()
+		if err != nil {
+			log.Fatalf("config invalid: TLS: %v", err)
+		}
+		sched.UseTransport(transport)
+	}
+	if n := sched.Recover(); n > 0 {
+		log.Printf("event=jobs_recovered count=%d queue_depth=%d", n, queue.Depth())
+	}
 	sched.Start()
 	defer sched.Stop()
 
 	var scaler autoscaler.Scaler
 	if img := os.Getenv("WORKER_IMAGE"); img != "" {
-		if s, err := autoscaler.NewDockerScaler(img); err != nil {
+		if s, err := autoscaler.NewDockerScaler(img, os.Getenv("WORKER_API_KEY")); err != nil {
 			log.Printf("autoscaler: Docker unavailable: %v", err)
 		} else {
 			scaler = s
@@ -63,16 +104,47 @@ func main() {
 		}
 	}()
 
+	var authn *auth.Authenticator
+	if getEnv("AUTH_ENABLED", "false") == "true" {
+		authn = auth.New(stores.apiKeys, auth.Config{AdminKey: os.Getenv("ADMIN_API_KEY"), WorkerKey: os.Getenv("WORKER_API_KEY")})
+		if os.Getenv("ADMIN_API_KEY") == "" && len(stores.apiKeys.List()) == 0 {
+			log.Printf("event=auth_no_keys warning=\"AUTH_ENABLED is set but there is no ADMIN_API_KEY and no stored key; every request will be refused\"")
+		}
+		log.Printf("event=auth_enabled")
+	}
+	limiter, err := ratelimit.NewLimiter(rateLimitConfig())
+	if err != nil {
+		log.Fatalf("config invalid: RATE_LIMIT: %v", err)
+	}
 	apiCfg := &api.HandlerConfig{
-		StartTime:         startTime,
-		RateLimitPerMin:   getEnvInt("RATE_LIMIT_JOBS_PER_MIN", 120),
-		IdempotencyTTLSec: getEnvInt("IDEMPOTENCY_TTL_SEC", 86400),
+		StartTime:          startTime,
+		RateLimit:          limiter,
+		TrustForwardedFor:  getEnv("RATE_LIMIT_TRUST_PROXY", "false") == "true",
+		IdempotencyTTLSec:  getEnvInt("IDEMPOTENCY_TTL_SEC", 86400),
+		Idempotency:        stores.idem,
+		Webhooks:           webhooks,
+		Auth:               authn,
+		Priorities:         priorities,
+		WorkerCertRequired: tlsCfg.Mutual(),
 	}
 	handler := api.NewHandler(store, queue, workerRegistry, sched, apiCfg)
 	srv := &http.Server{Addr: ":8080", Handler: handler}
+	if tlsCfg.Enabled() {
+		if srv.TLSConfig, err = tlsCfg.Server(); err != nil {
+			log.Fatalf("config invalid: TLS: %v", err)
+		}
+	}
+	srv.RegisterOnShutdown(handler.CloseStreams)
 	go func() {
-		log.Println("API listening on :8080")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			log.Printf("API listening on :8080 (tls, client_certs=%t)", tlsCfg.Mutual())
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Println("API listening on :8080")
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -89,6 +161,140 @@ func main() {
 	log.Println("API stopped")
 }
 
+// stores are the persistent stores selected by JOB_STORE
+type stores struct {
+	jobs      *models.JobStore
+	workers   *models.WorkerRegistry
+	schedules *models.ScheduleStore
+	webhooks  *models.WebhookStore
+	apiKeys   *models.APIKeyStore
+	idem      *models.IdempotencyStore
+	close     func() // flushes and closes the backends
+}
+
+// open stores builds the stores from JOB_STORE (memory, wal or sqlite)
+func openStores() *stores {
+	dir := getEnv("JOB_STORE_DIR", "./state")
+	switch backend := getEnv("JOB_STORE", "memory"); backend {
+	case "memory":
+		return &stores{jobs: models.NewJobStore(), workers: models.NewWorkerRegistry(), schedules: models.NewScheduleStore(), webhooks: models.NewWebhookStore(), apiKeys: models.NewAPIKeyStore(), idem: models.NewIdempotencyStore(), close: func() {}}
+	case "wal":
+		wal, err := storage.OpenWAL(dir)
+		if err != nil {
+			log.Fatalf("job store: %v", err)
+		}
+		wal.StartSnapshots(time.Duration(getEnvInt("JOB_STORE_SNAPSHOT_SEC", 300)) * time.Second)
+		schedules, err := storage.OpenScheduleFile(dir)
+		if err != nil {
+			log.Fatalf("schedule store: %v", err)
+		}
+		webhooks, err := storage.OpenWebhookFile(dir)
+		if err != nil {
+			log.Fatalf("webhook store: %v", err)
+		}
+		apiKeys, err := storage.OpenAPIKeyFile(dir)
+		if err != nil {
+			log.Fatalf("api key store: %v", err)
+		}
+		idem, err := storage.OpenIdempotencyLog(dir)
+		if err != nil {
+			log.Fatalf("idempotency store: %v", err)
+		}
+		return &stores{
+			jobs:      models.NewJobStoreWithBackend(wal),
+			workers:   models.NewWorkerRegistry(),
+			schedules: models.NewScheduleStoreWithBackend(schedules),
+			webhooks:  models.NewWebhookStoreWithBackend(webhooks),
+			apiKeys:   models.NewAPIKeyStoreWithBackend(apiKeys),
+			idem:      models.NewIdempotencyStoreWithBackend(idem),
+			close: func() {
+				if err := wal.Close(); err != nil {
+					log.Printf("job store close: %v", err)
+				}
+				if err := idem.Close(); err != nil {
+					log.Printf("idempotency store close: %v", err)
+				}
+			},
+		}
+	case "sqlite":
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Fatalf("job store: %v", err)
+		}
+		db, err := storage.OpenSQLite(filepath.Join(dir, "cloud.db"))
+		if err != nil {
+			log.Fatalf("job store: %v", err)
+		}
+		return &stores{
+			jobs:      models.NewJobStoreWithBackend(db.Jobs()),
+			workers:   models.NewWorkerRegistryWithBackend(db.Workers()),
+			schedules: models.NewScheduleStoreWithBackend(db.Schedules()),
+			webhooks:  models.NewWebhookStoreWithBackend(db.Webhooks()),
+			apiKeys:   models.NewAPIKeyStoreWithBackend(db.APIKeys()),
+			idem:      models.NewIdempotencyStoreWithBackend(db.Idempotency()),
+			close: func() {
+				if err := db.Close(); err != nil {
+					log.Printf("job store close: %v", err)
+				}
+			},
+		}
+	default:
+		log.Fatalf("config invalid: JOB_STORE must be memory, wal or sqlite, got %q", backend)
+		return nil
+	}
+}
+
+// tenant quotas reads TENANT_MAX_QUEUED and TENANT_MAX_RUNNING, the limits for every tenant, and
+// TENANT_QUOTAS, per-tenant overrides as json: {"team-a": {"max_queued": 500, "max_running": 8, "weight": 2}}
+func tenantQuotas() scheduler.TenantQuotas {
+	q := scheduler.TenantQuotas{Default: scheduler.TenantQuota{
+		MaxQueued:  getEnvInt("TENANT_MAX_QUEUED", 0),
+		MaxRunning: getEnvInt("TENANT_MAX_RUNNING", 0),
+	}}
+	if v := os.Getenv("TENANT_QUOTAS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &q.Tenants); err != nil {
+			log.Fatalf("config invalid: TENANT_QUOTAS: %v", err)
+		}
+		for name, t := range q.Tenants {
+			if err := models.ValidateTenant(name); err != nil {
+				log.Fatalf("config invalid: TENANT_QUOTAS: %v", err)
+			}
+			if t.MaxQueued < 0 || t.MaxRunning < 0 || t.Weight < 0 {
+				log.Fatalf("config invalid: TENANT_QUOTAS: tenant %s: limits and weight must not be negative", name)
+			}
+		}
+	}
+	if q.Default.MaxQueued > 0 || q.Default.MaxRunning > 0 || len(q.Tenants) > 0 {
+		log.Printf("event=tenant_quotas max_queued=%d max_running=%d overrides=%d", q.Default.MaxQueued, q.Default.MaxRunning, len(q.Tenants))
+	}
+	return q
+}
+
+// rate limit config reads RATE_LIMIT_KEY_BY (api_key, tenant or ip) and the per-minute rate and
+// burst of the submit and read buckets. RATE_LIMIT_JOBS_PER_MIN is the old name of the submit rate.
+// a rate of 0 turns the class off; a burst of 0 means the same as the rate.
+func rateLimitConfig() ratelimit.Config {
+	return ratelimit.Config{
+		KeyBy: ratelimit.KeyBy(getEnv("RATE_LIMIT_KEY_BY", string(ratelimit.KeyByAPIKey))),
+		Rules: map[ratelimit.Class]ratelimit.Rule{
+			ratelimit.ClassSubmit: {
+				PerMinute: getEnvCount("RATE_LIMIT_SUBMIT_PER_MIN", getEnvCount("RATE_LIMIT_JOBS_PER_MIN", 120)),
+				Burst:     getEnvCount("RATE_LIMIT_SUBMIT_BURST", 0),
+			},
+			ratelimit.ClassRead: {
+				PerMinute: getEnvCount("RATE_LIMIT_READ_PER_MIN", 1200),
+				Burst:     getEnvCount("RATE_LIMIT_READ_BURST", 0),
+			},
+		},
+	}
+}
+
+func getEnv(key, defaultVal string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultVal
+}
+
 func getEnvInt(key string, defaultVal int) int {
 	s := os.Getenv(key)
 	if s == "" {
@@ -101,6 +307,44 @@ func getEnvInt(key string, defaultVal int) int {
 	return n
 }
 
+// priority range reads PRIORITY_MIN and PRIORITY_MAX, the highest and lowest priority a job may
+// have (default 0 and 2); any integers with min below max
+func priorityRange() models.PriorityRange {
+	r := models.PriorityRange{Min: models.PriorityHigh, Max: models.PriorityLow}
+	for _, v := range []struct {
+		key string
+		dst *int
+	}{{"PRIORITY_MIN", &r.Min}, {"PRIORITY_MAX", &r.Max}} {
+		s := os.Getenv(v.key)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("config invalid: %s must be a number, got %q", v.key, s)
+		}
+		*v.dst = n
+	}
+	if r.Min >= r.Max {
+		log.Fatalf("config invalid: PRIORITY_MIN (%d) must be below PRIORITY_MAX (%d)", r.Min, r.Max)
+	}
+	return r
+}
+
+// get env count is like get env int but keeps an explicit 0, and stops on anything that isn't a
+// non-negative number
+func getEnvCount(key string, defaultVal int) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Fatalf("config invalid: %s must be a non-negative number, got %q", key, s)
+	}
+	return n
+}
+
 func validateConfig(thresholdHigh, thresholdLow, minWorkers, maxWorkers int) {
 	if minWorkers > maxWorkers {
 		log.Fatalf("config invalid: MIN_WORKERS (%d) must be <= MAX_WORKERS (%d)", minWorkers, maxWorkers)
@@ -0,0 +1,122 @@
+// devca writes a throwaway certificate authority and certificates signed by it, for running the
+// api and workers with mutual tls on one machine or in docker compose without any other tooling.
+// never use its output in production.
+//
+//	go run ./cmd/devca -out ./certs -names api,worker1,worker2
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const validFor = 365 * 24 * time.Hour
+
+func main() {
+	out := flag.String("out", "./certs", "directory to write the pem files to")
+	names := flag.String("names", "api,worker", "comma-separated identities to issue certificates for; each is also a dns name on its certificate")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma-separated dns names and ips added to every certificate")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "cloud dev ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		log.Fatal(err)
+	}
+	write(filepath.Join(*out, "ca.pem"), "CERTIFICATE", caDER, 0o644)
+	writeKey(filepath.Join(*out, "ca-key.pem"), caKey)
+
+	for _, name := range split(*names) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: serial(),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validFor),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			// every process both serves and calls out, so each certificate works on both ends
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, h := range append([]string{name}, split(*hosts)...) {
+			if ip := net.ParseIP(h); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else {
+				tmpl.DNSNames = append(tmpl.DNSNames, h)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		write(filepath.Join(*out, name+".pem"), "CERTIFICATE", der, 0o644)
+		writeKey(filepath.Join(*out, name+"-key.pem"), key)
+	}
+	log.Printf("wrote ca.pem and certificates for %s to %s", *names, *out)
+}
+
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func split(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	write(path, "PRIVATE KEY", der, 0o600)
+}
+
+func write(path, typ string, der []byte, mode os.FileMode) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, data, mode); err != nil {
+		log.Fatal(err)
+	}
+}
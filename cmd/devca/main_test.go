@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"cloud/internal/tlsconf"
+)
+
+func TestWritesCertificatesSignedByTheCA(t *testing.T) {
+	dir := t.TempDir()
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = savedArgs, savedFlags }()
+	flag.CommandLine = flag.NewFlagSet("devca", flag.ExitOnError)
+	os.Args = []string{"devca", "-out", dir, "-names", "api, worker1", "-hosts", "localhost,127.0.0.1"}
+	main()
+
+	roots := x509.NewCertPool()
+	caPEM, _ := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("ca.pem holds no certificate")
+	}
+	for _, name := range []string{"api", "worker1"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(cert.DNSNames, []string{name, "localhost"}) || len(cert.IPAddresses) != 1 || cert.Subject.CommonName != name {
+			t.Fatalf("%s: names %v %v cn %s", name, cert.DNSNames, cert.IPAddresses, cert.Subject.CommonName)
+		}
+		// each certificate works on both ends of a connection
+		for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+			if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: name, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+				t.Fatalf("%s does not verify against the ca for %v: %v", name, usage, err)
+			}
+		}
+		// and loads as the tls config the api and workers use
+		cfg := tlsconf.Config{CertFile: filepath.Join(dir, name+".pem"), KeyFile: filepath.Join(dir, name+"-key.pem"), CAFile: filepath.Join(dir, "ca.pem"), ClientAuth: tlsconf.ClientAuthRequire}
+		if _, err := cfg.Server(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for _, key := range []string{"ca-key.pem", "api-key.pem", "worker1-key.pem"} {
+		if info, err := os.Stat(filepath.Join(dir, key)); err != nil || info.Mode().Perm() != 0o600 {
+			t.Fatalf("%s: %v, want it readable by the owner only", key, err)
+		}
+	}
+}
@@ -41,7 +41,7 @@ func main() {
 
 	if *payload == "" {
 		fmt.Fprintln(os.Stderr, "missing --payload")
-		os.Exit(1)
+		os.Exit(exitInvalidPayload)
 	}
 
 	var err error
@@ -65,10 +65,30 @@ func main() {
 	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		var invalid invalidPayloadError
+		if errors.As(err, &invalid) {
+			os.Exit(exitInvalidPayload)
+		}
 		os.Exit(1)
 	}
 }
 
+// exit code for payloads that can never succeed; the worker reports these as validation
+// errors so they fail fast instead of being retried. other failures exit 1.
+const exitInvalidPayload = 2
+
+// invalid payload error marks an error caused by the job's payload rather than the environment
+type invalidPayloadError struct {
+	err error
+}
+
+func (e invalidPayloadError) Error() string { return e.err.Error() }
+func (e invalidPayloadError) Unwrap() error { return e.err }
+
+func invalidPayload(format string, args ...interface{}) error {
+	return invalidPayloadError{err: fmt.Errorf(format, args...)}
+}
+
 // --- hash -----------------------------------------------------------------
 
 type hashPayload struct {
@@ -78,10 +98,10 @@ type hashPayload struct {
 func runHash(raw string) error {
 	var p hashPayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid hash payload: %w", err)
+		return invalidPayload("invalid hash payload: %w", err)
 	}
 	if p.Input == "" {
-		return fmt.Errorf("hash payload requires non-empty \"input\" field")
+		return invalidPayload("hash payload requires non-empty \"input\" field")
 	}
 	h := sha256.Sum256([]byte(p.Input))
 	fmt.Printf("%x\n", h)
@@ -99,14 +119,14 @@ const maxPrimeN = 100_000_000
 func runPrime(raw string) error {
 	var p primePayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid prime payload: %w", err)
+		return invalidPayload("invalid prime payload: %w", err)
 	}
 	if p.N < 2 {
 		fmt.Println("primes_up_to=0 count=0 elapsed=0ms")
 		return nil
 	}
 	if p.N > maxPrimeN {
-		return fmt.Errorf("n=%d exceeds maximum allowed value of %d", p.N, maxPrimeN)
+		return invalidPayload("n=%d exceeds maximum allowed value of %d", p.N, maxPrimeN)
 	}
 
 	start := time.Now()
@@ -161,10 +181,10 @@ const (
 func runFetch(raw string) error {
 	var p fetchPayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid fetch payload: %w", err)
+		return invalidPayload("invalid fetch payload: %w", err)
 	}
 	if p.URL == "" {
-		return fmt.Errorf("fetch payload requires non-empty \"url\" field")
+		return invalidPayload("fetch payload requires non-empty \"url\" field")
 	}
 	method := strings.ToUpper(p.Method)
 	if method == "" {
@@ -209,11 +229,11 @@ func runFetch(raw string) error {
 func validateFetchURL(rawURL string) error {
 	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("invalid url: %w", err)
+		return invalidPayload("invalid url: %w", err)
 	}
 	scheme := strings.ToLower(parsed.Scheme)
 	if scheme != "http" && scheme != "https" {
-		return fmt.Errorf("only http and https schemes are allowed, got %q", scheme)
+		return invalidPayload("only http and https schemes are allowed, got %q", scheme)
 	}
 
 	host := parsed.Hostname()
@@ -221,7 +241,7 @@ func validateFetchURL(rawURL string) error {
 	blockedHosts := []string{"localhost", "127.0.0.1", "::1", "0.0.0.0"}
 	for _, b := range blockedHosts {
 		if strings.EqualFold(host, b) {
-			return fmt.Errorf("fetching %s is not allowed (private/loopback address)", host)
+			return invalidPayload("fetching %s is not allowed (private/loopback address)", host)
 		}
 	}
 
@@ -232,7 +252,7 @@ func validateFetchURL(rawURL string) error {
 	}
 	for _, ip := range ips {
 		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-			return fmt.Errorf("fetching %s (%s) is not allowed (private/internal address)", host, ip)
+			return invalidPayload("fetching %s (%s) is not allowed (private/internal address)", host, ip)
 		}
 	}
 
@@ -250,13 +270,13 @@ const maxSleepSeconds = 300
 func runSleep(raw string) error {
 	var p sleepPayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid sleep payload: %w", err)
+		return invalidPayload("invalid sleep payload: %w", err)
 	}
 	if p.Seconds <= 0 {
-		return fmt.Errorf("sleep seconds must be > 0")
+		return invalidPayload("sleep seconds must be > 0")
 	}
 	if p.Seconds > maxSleepSeconds {
-		return fmt.Errorf("sleep seconds %.0f exceeds maximum of %d", p.Seconds, maxSleepSeconds)
+		return invalidPayload("sleep seconds %.0f exceeds maximum of %d", p.Seconds, maxSleepSeconds)
 	}
 
 	dur := time.Duration(p.Seconds * float64(time.Second))
@@ -286,25 +306,25 @@ const maxImageDimension = 8000
 func runImageResize(raw string) error {
 	var p imageResizePayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid image-resize payload: %w", err)
+		return invalidPayload("invalid image-resize payload: %w", err)
 	}
 	if p.InputPath == "" || p.OutputPath == "" {
-		return fmt.Errorf("image-resize payload requires non-empty \"input_path\" and \"output_path\"")
+		return invalidPayload("image-resize payload requires non-empty \"input_path\" and \"output_path\"")
 	}
 	if p.Width <= 0 || p.Height <= 0 {
-		return fmt.Errorf("image-resize payload requires width and height > 0")
+		return invalidPayload("image-resize payload requires width and height > 0")
 	}
 	if p.Width > maxImageDimension || p.Height > maxImageDimension {
-		return fmt.Errorf("image dimensions exceed max %dx%d", maxImageDimension, maxImageDimension)
+		return invalidPayload("image dimensions exceed max %dx%d", maxImageDimension, maxImageDimension)
 	}
 
 	inPath, err := resolveUnderDataRoot(p.InputPath, true)
 	if err != nil {
-		return fmt.Errorf("invalid input_path: %w", err)
+		return invalidPayload("invalid input_path: %w", err)
 	}
 	outPath, err := resolveUnderDataRoot(p.OutputPath, false)
 	if err != nil {
-		return fmt.Errorf("invalid output_path: %w", err)
+		return invalidPayload("invalid output_path: %w", err)
 	}
 	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
@@ -370,7 +390,7 @@ func encodeByOutputExtension(w io.Writer, outPath string, img image.Image) (stri
 	case ".gif":
 		return "gif", gif.Encode(w, img, nil)
 	default:
-		return "", fmt.Errorf("unsupported output image extension %q (use .png, .jpg/.jpeg, or .gif)", ext)
+		return "", invalidPayload("unsupported output image extension %q (use .png, .jpg/.jpeg, or .gif)", ext)
 	}
 }
 
@@ -403,13 +423,13 @@ const (
 func runCompress(raw string) error {
 	var p compressPayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid compress payload: %w", err)
+		return invalidPayload("invalid compress payload: %w", err)
 	}
 	if len(p.InputPaths) == 0 {
-		return fmt.Errorf("compress payload requires non-empty \"input_paths\"")
+		return invalidPayload("compress payload requires non-empty \"input_paths\"")
 	}
 	if p.OutputPath == "" {
-		return fmt.Errorf("compress payload requires non-empty \"output_path\"")
+		return invalidPayload("compress payload requires non-empty \"output_path\"")
 	}
 
 	format := strings.ToLower(strings.TrimSpace(p.Format))
@@ -417,12 +437,12 @@ func runCompress(raw string) error {
 		format = "zip"
 	}
 	if format != "zip" && format != "tar.gz" {
-		return fmt.Errorf("unsupported format %q (use \"zip\" or \"tar.gz\")", format)
+		return invalidPayload("unsupported format %q (use \"zip\" or \"tar.gz\")", format)
 	}
 
 	outPathAbs, err := resolveUnderDataRoot(p.OutputPath, false)
 	if err != nil {
-		return fmt.Errorf("invalid output_path: %w", err)
+		return invalidPayload("invalid output_path: %w", err)
 	}
 	if err := os.MkdirAll(filepath.Dir(outPathAbs), 0o755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
@@ -553,10 +573,10 @@ func buildArchiveFile(absPath, dataRootAbs string) (archiveFile, error) {
 
 func checkArchiveLimits(count int, totalBytes int64) error {
 	if count > maxCompressEntries {
-		return fmt.Errorf("too many files to compress (%d > %d)", count, maxCompressEntries)
+		return invalidPayload("too many files to compress (%d > %d)", count, maxCompressEntries)
 	}
 	if totalBytes > maxCompressTotalBytes {
-		return fmt.Errorf("input size exceeds limit (%d > %d bytes)", totalBytes, maxCompressTotalBytes)
+		return invalidPayload("input size exceeds limit (%d > %d bytes)", totalBytes, maxCompressTotalBytes)
 	}
 	return nil
 }
@@ -671,28 +691,28 @@ const (
 func runEmail(raw string) error {
 	var p emailPayload
 	if err := json.Unmarshal([]byte(raw), &p); err != nil {
-		return fmt.Errorf("invalid email payload: %w", err)
+		return invalidPayload("invalid email payload: %w", err)
 	}
 	p.To = strings.TrimSpace(p.To)
 	p.Subject = strings.TrimSpace(p.Subject)
 	if p.To == "" {
-		return fmt.Errorf("email payload requires non-empty \"to\"")
+		return invalidPayload("email payload requires non-empty \"to\"")
 	}
 	if !strings.Contains(p.To, "@") {
-		return fmt.Errorf("email \"to\" must contain @")
+		return invalidPayload("email \"to\" must contain @")
 	}
 	if p.Subject == "" {
-		return fmt.Errorf("email payload requires non-empty \"subject\"")
+		return invalidPayload("email payload requires non-empty \"subject\"")
 	}
 	if p.Text == "" && p.HTML == "" {
-		return fmt.Errorf("email payload requires at least one of \"text\" or \"html\"")
+		return invalidPayload("email payload requires at least one of \"text\" or \"html\"")
 	}
 	if len(p.Subject) > maxEmailSubjectLen {
-		return fmt.Errorf("subject length %d exceeds max %d", len(p.Subject), maxEmailSubjectLen)
+		return invalidPayload("subject length %d exceeds max %d", len(p.Subject), maxEmailSubjectLen)
 	}
 	totalBody := len(p.Text) + len(p.HTML)
 	if totalBody > maxEmailBodyLen {
-		return fmt.Errorf("total body size %d exceeds max %d", totalBody, maxEmailBodyLen)
+		return invalidPayload("total body size %d exceeds max %d", totalBody, maxEmailBodyLen)
 	}
 
 	host := getEnv("SMTP_HOST", "")
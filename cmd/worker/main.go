@@ -5,10 +5,12 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"cloud/internal/executor"
+	"cloud/internal/tlsconf"
 	worker "cloud/internal/worker"
 )
 
@@ -18,7 +20,15 @@ func main() {
 	execPath := getEnv("EXECUTION_BINARY", "/app/runner")
 
 	execRunner := executor.NewRunner(execPath)
+	if sec, err := strconv.Atoi(getEnv("CANCEL_GRACE_SEC", "")); err == nil && sec >= 0 {
+		execRunner.GracePeriod = time.Duration(sec) * time.Second
+	}
 	w := worker.New(apiURL, workerID, execRunner)
+	if tc := tlsconf.FromEnv(); tc.Enabled() {
+		if err := w.EnableTLS(tc); err != nil {
+			log.Fatalf("config invalid: TLS: %v", err)
+		}
+	}
 	if err := w.Start(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cloud/internal/auth"
+	"cloud/pkg/models"
+)
+
+var errAuthDisabled = errors.New("authentication is not enabled")
+
+type apiKeyContextKey struct{}
+
+// api key of returns the key that authenticated the request, or nil when auth is off or the route is public
+func apiKeyOf(r *http.Request) *models.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*models.APIKey)
+	return key
+}
+
+// route role returns the role a request needs, or "" for the public endpoints (health, readiness
+// and the dashboard page, which asks for a key itself). anything not listed as worker or admin
+// needs viewer to read and submitter to change.
+func routeRole(method, path string, parts []string) models.Role {
+	switch {
+	case method == http.MethodGet && (path == "health" || path == "ready" || path == "dashboard"):
+		return ""
+	case method == http.MethodPost && (path == "workers" || path == "workers/heartbeat" || path == "workers/lease"):
+		return models.RoleWorker
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "jobs" &&
+		(parts[2] == "complete" || parts[2] == "lease" || parts[2] == "ack" || parts[2] == "nack"):
+		return models.RoleWorker
+	case parts[0] == "keys" || parts[0] == "webhooks" || parts[0] == "ratelimit":
+		return models.RoleAdmin
+	case parts[0] == "dlq" && method != http.MethodGet:
+		return models.RoleAdmin
+	case method == http.MethodGet:
+		return models.RoleViewer
+	default:
+		return models.RoleSubmitter
+	}
+}
+
+// authorize checks the request's api key against the role its route needs and answers 401 or 403
+// when it falls short. with worker certificates required, worker routes also need a verified
+// client certificate. without either it lets everything through. the key is returned when one was checked.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, path string, parts []string) (*models.APIKey, bool) {
+	need := routeRole(r.Method, path, parts)
+	if need == models.RoleWorker && h.workerCerts && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		respondJSON(w, http.StatusForbidden, map[string]string{"error": "worker endpoints need a verified client certificate"})
+		return nil, false
+	}
+	if h.auth == nil || need == "" {
+		return nil, true
+	}
+	key, ok := h.auth.Authenticate(r, path == "events")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cloud"`)
+		respondJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid api key"})
+		return nil, false
+	}
+	if !key.Role.Allows(need) {
+		respondJSON(w, http.StatusForbidden, map[string]string{"error": "api key role " + string(key.Role) + " may not call this endpoint (needs " + string(need) + ")"})
+		return nil, false
+	}
+	return key, true
+}
+
+// create api key handles post /keys. the response is the only place the key appears.
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if h.auth == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": errAuthDisabled.Error()})
+		return
+	}
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	key, err := h.auth.Create(&req)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusCreated, key)
+}
+
+// list api keys handles get /keys
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, _ *http.Request) {
+	if h.auth == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": errAuthDisabled.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, h.auth.Keys())
+}
+
+// delete api key handles delete /keys/:id
+func (h *Handler) DeleteAPIKey(w http.ResponseWriter, _ *http.Request, id string) {
+	if h.auth == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": errAuthDisabled.Error()})
+		return
+	}
+	switch err := h.auth.Revoke(id); {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+	}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud/internal/auth"
+	"cloud/pkg/models"
+)
+
+func TestRouteRole(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		want         models.Role
+	}{
+		{http.MethodGet, "health", ""},
+		{http.MethodGet, "ready", ""},
+		{http.MethodGet, "dashboard", ""},
+		{http.MethodGet, "jobs", models.RoleViewer},
+		{http.MethodGet, "jobs/j1", models.RoleViewer},
+		{http.MethodGet, "events", models.RoleViewer},
+		{http.MethodGet, "dlq", models.RoleViewer},
+		{http.MethodPost, "jobs", models.RoleSubmitter},
+		{http.MethodDelete, "jobs/j1", models.RoleSubmitter},
+		{http.MethodPatch, "jobs/j1", models.RoleSubmitter},
+		{http.MethodPost, "schedules", models.RoleSubmitter},
+		{http.MethodPost, "workers", models.RoleWorker},
+		{http.MethodPost, "workers/heartbeat", models.RoleWorker},
+		{http.MethodPost, "workers/lease", models.RoleWorker},
+		{http.MethodPost, "jobs/j1/complete", models.RoleWorker},
+		{http.MethodPost, "jobs/j1/lease", models.RoleWorker},
+		{http.MethodPost, "jobs/j1/ack", models.RoleWorker},
+		{http.MethodPost, "jobs/j1/nack", models.RoleWorker},
+		{http.MethodGet, "keys", models.RoleAdmin},
+		{http.MethodPost, "keys", models.RoleAdmin},
+		{http.MethodGet, "webhooks", models.RoleAdmin},
+		{http.MethodPut, "ratelimit", models.RoleAdmin},
+		{http.MethodPost, "dlq/j1/replay", models.RoleAdmin},
+		{http.MethodDelete, "dlq/j1", models.RoleAdmin},
+	} {
+		if got := routeRole(tc.method, tc.path, strings.Split(tc.path, "/")); got != tc.want {
+			t.Errorf("routeRole(%s %s) = %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAPIKeysAreEnforcedPerRoute(t *testing.T) {
+	a := auth.New(models.NewAPIKeyStore(), auth.Config{AdminKey: "admin-secret"})
+	h, _ := newTestHandler(t, &HandlerConfig{Auth: a})
+	bearer := func(key string) []string { return []string{"Authorization", "Bearer " + key} }
+	admin := bearer("admin-secret")
+	newKey := func(role models.Role) (string, string) {
+		t.Helper()
+		w := do(t, h, http.MethodPost, "/keys", `{"name":"test","role":"`+string(role)+`"}`, admin...)
+		key := decode[models.APIKey](t, w)
+		if w.Code != http.StatusCreated || key.Key == "" {
+			t.Fatalf("create %s key: %d %s", role, w.Code, w.Body)
+		}
+		return key.ID, key.Key
+	}
+	_, viewer := newKey(models.RoleViewer)
+	submitterID, submitter := newKey(models.RoleSubmitter)
+	_, worker := newKey(models.RoleWorker)
+
+	if w := do(t, h, http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Fatalf("health without a key: %d, want 200", w.Code)
+	}
+	w := do(t, h, http.MethodGet, "/jobs", "")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("jobs without a key: %d, want 401 with a challenge", w.Code)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs", "", bearer("ck_wrong")...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("jobs with an unknown key: %d, want 401", w.Code)
+	}
+
+	for _, tc := range []struct {
+		name, method, target, body string
+		key                        string
+		want                       int
+	}{
+		{"viewer lists jobs", http.MethodGet, "/jobs", "", viewer, http.StatusOK},
+		{"viewer submits", http.MethodPost, "/jobs", `{"payload":"p"}`, viewer, http.StatusForbidden},
+		{"submitter submits", http.MethodPost, "/jobs", `{"payload":"p"}`, submitter, http.StatusAccepted},
+		{"admin submits", http.MethodPost, "/jobs", `{"payload":"p"}`, "admin-secret", http.StatusAccepted},
+		{"worker submits", http.MethodPost, "/jobs", `{"payload":"p"}`, worker, http.StatusForbidden},
+		{"worker lists jobs", http.MethodGet, "/jobs", "", worker, http.StatusForbidden},
+		{"submitter registers a worker", http.MethodPost, "/workers", `{"id":"w1"}`, submitter, http.StatusForbidden},
+		{"admin registers a worker", http.MethodPost, "/workers", `{"id":"w1"}`, "admin-secret", http.StatusForbidden},
+		{"worker registers", http.MethodPost, "/workers", `{"id":"w1"}`, worker, http.StatusOK},
+		{"worker heartbeats", http.MethodPost, "/workers/heartbeat", `{"id":"w1"}`, worker, http.StatusOK},
+		{"submitter lists keys", http.MethodGet, "/keys", "", submitter, http.StatusForbidden},
+	} {
+		if w := do(t, h, tc.method, tc.target, tc.body, bearer(tc.key)...); w.Code != tc.want {
+			t.Errorf("%s: %d, want %d (%s)", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+
+	// keys are listed without hashes, and a revoked key stops working
+	keys := decode[[]models.APIKey](t, do(t, h, http.MethodGet, "/keys", "", admin...))
+	if len(keys) != 4 {
+		t.Fatalf("listed %d keys, want the env admin key and 3 created", len(keys))
+	}
+	for _, k := range keys {
+		if k.Hash != "" || k.Key != "" {
+			t.Fatalf("listed key %+v carries its hash or plaintext", k)
+		}
+	}
+	if w := do(t, h, http.MethodDelete, "/keys/"+submitterID, "", admin...); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, bearer(submitter)...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("submit with a revoked key: %d, want 401", w.Code)
+	}
+	if w := do(t, h, http.MethodDelete, "/keys/env-admin", "", admin...); w.Code != http.StatusBadRequest {
+		t.Fatalf("revoke the env key: %d, want 400", w.Code)
+	}
+	if w := do(t, h, http.MethodDelete, "/keys/nope", "", admin...); w.Code != http.StatusNotFound {
+		t.Fatalf("revoke an unknown key: %d, want 404", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/keys", `{"role":"root"}`, admin...); w.Code != http.StatusBadRequest {
+		t.Fatalf("create a key with an unknown role: %d, want 400", w.Code)
+	}
+}
+
+func TestKeysEndpointsWithoutAuth(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodGet, "/keys", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("list keys with auth off: %d, want 404", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("submit with auth off: %d, want 202", w.Code)
+	}
+}
+
+func TestWorkerRoutesNeedAVerifiedCertificate(t *testing.T) {
+	h, _ := newTestHandler(t, &HandlerConfig{WorkerCertRequired: true})
+	register := func(state *tls.ConnectionState) int {
+		r := httptest.NewRequest(http.MethodPost, "/workers", strings.NewReader(`{"id":"w1","capacity":1}`))
+		r.TLS = state
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := register(nil); code != http.StatusForbidden {
+		t.Fatalf("register over plain http: %d, want 403", code)
+	}
+	// a tls connection whose client certificate did not verify (or was not sent) has no chains
+	if code := register(&tls.ConnectionState{}); code != http.StatusForbidden {
+		t.Fatalf("register without a verified certificate: %d, want 403", code)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	if code := register(verified); code != http.StatusOK {
+		t.Fatalf("register with a verified certificate: %d, want 200", code)
+	}
+	// other routes don't ask for one
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("submit without a certificate: %d, want 202", w.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+func TestCancelQueuedAndRunningJobs(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	running := submitJob(t, h, `{"payload":"p"}`)
+	got := leaseJob(t, h, "w1")
+	queued := submitJob(t, h, `{"payload":"p"}`)
+
+	w := do(t, h, http.MethodDelete, "/jobs/"+queued.ID, "")
+	if job := decode[*models.Job](t, w); w.Code != http.StatusOK || job.Status != models.JobStatusCancelled || h.queue.Depth() != 0 {
+		t.Fatalf("cancel queued: %d %s, want 200 and out of the queue", w.Code, job.Status)
+	}
+
+	// a running job is flagged and its worker told; it is cancelled once the worker stops it
+	w = do(t, h, http.MethodDelete, "/jobs/"+running.ID, "")
+	if job := decode[*models.Job](t, w); w.Code != http.StatusAccepted || job.Status != models.JobStatusRunning || !job.CancelRequested {
+		t.Fatalf("cancel running: %d %+v, want 202 with cancel_requested", w.Code, job)
+	}
+	extended := decode[map[string]any](t, do(t, h, http.MethodPost, "/jobs/"+running.ID+"/lease", `{"lease_id":"`+got.Lease.ID+`"}`))
+	if extended["cancel_requested"] != true {
+		t.Fatalf("lease extension = %v, want cancel_requested for the pull worker", extended)
+	}
+	do(t, h, http.MethodPost, "/jobs/"+running.ID+"/complete",
+		`{"success":false,"result":"partial","error":"cancelled","error_class":"cancelled","attempt_token":"`+got.Job.AttemptToken+`"}`)
+	job := decode[*models.Job](t, do(t, h, http.MethodGet, "/jobs/"+running.ID, ""))
+	if job.Status != models.JobStatusCancelled || job.Result != "partial" || job.Attempts[0].ErrorClass != models.ErrorClassCancelled {
+		t.Fatalf("job after the worker stopped it = %s %q %+v, want cancelled with the partial output", job.Status, job.Result, job.Attempts)
+	}
+	if workers := decode[[]models.Worker](t, do(t, h, http.MethodGet, "/workers", "")); len(workers[0].RunningJobs) != 0 {
+		t.Fatalf("worker slot not freed: %v", workers[0].RunningJobs)
+	}
+
+	if w := do(t, h, http.MethodDelete, "/jobs/"+running.ID, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("cancel a finished job: %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"cloud/pkg/models"
+)
+
+// cursor token is the opaque next_cursor handed to clients. it records the sort it was issued
+// for so a token cannot be replayed against a different ordering.
+type cursorToken struct {
+	Sort   models.JobSortField `json:"s"`
+	Desc   bool                `json:"d,omitempty"`
+	Cursor models.JobCursor    `json:"c"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(c *models.JobCursor, sortBy models.JobSortField, desc bool) string {
+	b, _ := json.Marshal(cursorToken{Sort: sortBy, Desc: desc, Cursor: *c})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string, sortBy models.JobSortField, desc bool) (*models.JobCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var t cursorToken
+	if err := json.Unmarshal(b, &t); err != nil || t.Cursor.ID == "" {
+		return nil, errInvalidCursor
+	}
+	if t.Sort != sortBy || t.Desc != desc {
+		return nil, errors.New("cursor was issued for a different sort or order")
+	}
+	return &t.Cursor, nil
+}
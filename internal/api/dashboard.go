@@ -16,7 +16,7 @@ a{color:#58a6ff;text-decoration:none}
 header{display:flex;justify-content:space-between;align-items:center;margin-bottom:24px}
 header h1{font-size:20px;font-weight:600;color:#e6edf3}
 header span{font-size:12px;color:#8b949e}
-.stats{display:grid;grid-template-columns:repeat(5,1fr);gap:12px;margin-bottom:24px}
+.stats{display:grid;grid-template-columns:repeat(6,1fr);gap:12px;margin-bottom:24px}
 .stat-card{background:#161b22;border:1px solid #30363d;border-radius:8px;padding:16px;text-align:center}
 .stat-card .label{font-size:11px;text-transform:uppercase;letter-spacing:.5px;color:#8b949e;margin-bottom:6px}
 .stat-card .value{font-size:28px;font-weight:700;color:#e6edf3}
@@ -46,8 +46,8 @@ tr:hover{background:#1c2129}
 .status-completed{color:#3fb950}
 .status-running,.status-queued{color:#d29922}
 .status-failed{color:#f85149}
-.status-pending{color:#8b949e}
-.status-cancelled{color:#8b949e}
+.status-pending,.status-scheduled{color:#8b949e}
+.status-cancelled,.status-skipped{color:#8b949e}
 .worker-idle{color:#3fb950}
 .worker-busy{color:#d29922}
 .empty{padding:32px;text-align:center;color:#484f58}
@@ -75,6 +75,7 @@ td.clickable:hover{color:#58a6ff}
 <div class="stat-card"><div class="label">workers</div><div class="value" id="s-workers">-</div></div>
 <div class="stat-card"><div class="label">total jobs</div><div class="value" id="s-jobs">-</div></div>
 <div class="stat-card"><div class="label">success rate</div><div class="value" id="s-rate">-</div></div>
+<div class="stat-card"><div class="label">dead letters</div><div class="value" id="s-dlq">-</div></div>
 <div class="stat-card"><div class="label">uptime</div><div class="value" id="s-uptime">-</div></div>
 </div>
 
@@ -112,7 +113,7 @@ td.clickable:hover{color:#58a6ff}
 <div class="panel">
 <h2>workers <span class="count" id="worker-count">0</span></h2>
 <div id="worker-table-wrap">
-<table><thead><tr><th>id</th><th>status</th><th>current job</th><th>last heartbeat</th></tr></thead><tbody id="worker-rows"></tbody></table>
+<table><thead><tr><th>id</th><th>status</th><th>slots</th><th>running jobs</th><th>last heartbeat</th></tr></thead><tbody id="worker-rows"></tbody></table>
 </div>
 </div>
 </div>
@@ -163,31 +164,45 @@ function fmtUptime(sec){
 }
 function trunc(s,n){if(!s||s.length<=n)return s;return s.slice(0,n)+'...';}
 
+// api key for servers with AUTH_ENABLED; asked for on the first 401 and kept in local storage
+var apiKey=localStorage.getItem('api_key')||'',askedKey=false;
+async function api(path,opts){
+  opts=opts||{};opts.headers=Object.assign({},opts.headers);
+  if(apiKey)opts.headers['Authorization']='Bearer '+apiKey;
+  var r=await fetch(path,opts);
+  if(r.status===401&&!askedKey){
+    askedKey=true;var k=prompt('API key (viewer, or submitter to submit jobs)');
+    if(k){localStorage.setItem('api_key',k);location.reload();}
+  }
+  return r;
+}
+
 async function fetchStats(){
   try{
-    const r=await fetch('/stats');const d=await r.json();
+    const r=await api('/stats');const d=await r.json();
     document.getElementById('s-queue').textContent=d.queue_depth;
     document.getElementById('s-workers').textContent=d.workers;
     document.getElementById('s-jobs').textContent=d.jobs_total;
     document.getElementById('s-rate').textContent=d.success_rate_pct.toFixed(0)+'%';
+    document.getElementById('s-dlq').textContent=d.dlq_size;
+    document.getElementById('s-dlq').style.color=d.dlq_size>0?'#f85149':'';
     document.getElementById('s-uptime').textContent=fmtUptime(d.uptime_seconds);
   }catch(e){}
 }
 
 async function fetchJobs(){
   try{
-    const r=await fetch('/jobs?limit=200');const d=await r.json();
+    const r=await api('/jobs?limit=200&sort=created_at&order=desc');const d=await r.json();
     const jobs=d.jobs||[];
     document.getElementById('job-count').textContent=d.total||0;
     const tbody=document.getElementById('job-rows');
     if(!jobs.length){tbody.innerHTML='<tr><td colspan="7" class="empty">no jobs yet</td></tr>';return;}
-    jobs.sort(function(a,b){return (a.priority-b.priority)||new Date(b.created_at)-new Date(a.created_at);});
     allJobs=jobs;tbody.innerHTML=jobs.map(function(j,i){return '<tr>'+
       '<td title="'+j.id+'">'+j.id.slice(0,10)+'</td>'+
       '<td>'+typeLabel(j.type)+'</td>'+
       '<td class="clickable" onclick="showDetail('+i+',\'payload\')">'+esc(trunc(j.payload,40))+'</td>'+
       '<td>'+(priorityLabel[j.priority]||priorityLabel[1])+'</td>'+
-      '<td class="'+statusClass(j.status)+'">'+j.status+'</td>'+
+      '<td class="'+statusClass(j.status)+'"'+(j.unschedulable_reason?' title="'+esc(j.unschedulable_reason)+'"':'')+'>'+j.status+(j.unschedulable_reason?' (unschedulable)':'')+'</td>'+
       '<td class="clickable" onclick="showDetail('+i+',\'result\')">'+esc(trunc(j.result||j.error||'-',50))+'</td>'+
       '<td>'+ago(j.created_at)+'</td>'+
     '</tr>';}).join('');
@@ -196,15 +211,16 @@ async function fetchJobs(){
 
 async function fetchWorkers(){
   try{
-    const r=await fetch('/workers');const d=await r.json();
+    const r=await api('/workers');const d=await r.json();
     const workers=d||[];
     document.getElementById('worker-count').textContent=workers.length;
     const tbody=document.getElementById('worker-rows');
-    if(!workers.length){tbody.innerHTML='<tr><td colspan="4" class="empty">no workers registered</td></tr>';return;}
+    if(!workers.length){tbody.innerHTML='<tr><td colspan="5" class="empty">no workers registered</td></tr>';return;}
     tbody.innerHTML=workers.map(w=>'<tr>'+
       '<td title="'+w.id+'">'+w.id.slice(0,16)+'</td>'+
       '<td class="'+workerClass(w.status)+'">'+w.status+'</td>'+
-      '<td>'+(w.current_job_id||'-')+'</td>'+
+      '<td>'+(w.running_jobs||[]).length+'/'+(w.capacity||1)+'</td>'+
+      '<td>'+((w.running_jobs||[]).join(', ')||'-')+'</td>'+
       '<td>'+ago(w.last_heartbeat)+'</td>'+
     '</tr>').join('');
   }catch(e){}
@@ -230,19 +246,31 @@ async function submitJob(){
   var body={payload:payload,priority:priority};
   if(type)body.type=type;
   try{
-    var r=await fetch('/jobs',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify(body)});
+    var r=await api('/jobs',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify(body)});
     var d=await r.json();
+    if(!r.ok)throw new Error(d.error);
     document.getElementById('f-msg').textContent='submitted: '+d.id;
     document.getElementById('f-msg').style.color='#3fb950';
     document.getElementById('f-payload').value='';
     setTimeout(function(){document.getElementById('f-msg').textContent='';},3000);
     refresh();
-  }catch(e){document.getElementById('f-msg').textContent='error';document.getElementById('f-msg').style.color='#f85149';}
+  }catch(e){document.getElementById('f-msg').textContent=e.message||'error';document.getElementById('f-msg').style.color='#f85149';}
 }
 
 function refresh(){fetchStats();fetchJobs();fetchWorkers();document.getElementById('updated').textContent='updated '+new Date().toLocaleTimeString();}
 refresh();
-setInterval(refresh,2000);
+// live updates from the event stream, coalesced into one refresh per burst
+var live=false,pendingRefresh=null;
+function scheduleRefresh(){if(pendingRefresh)return;pendingRefresh=setTimeout(function(){pendingRefresh=null;refresh();},250);}
+if(window.EventSource){
+  var es=new EventSource('/events'+(apiKey?'?api_key='+encodeURIComponent(apiKey):''));
+  es.onopen=function(){live=true;scheduleRefresh();};
+  es.onerror=function(){live=false;};
+  ['job.submitted','job.queued','job.assigned','job.dispatched','job.completed','job.retrying','job.failed','job.cancelled','job.skipped','job.replayed','job.reprioritized','job.unschedulable','worker.registered','worker.reaped','reset'].forEach(function(t){es.addEventListener(t,scheduleRefresh);});
+}
+// poll while the stream is down; otherwise refresh now and then for uptime and heartbeat ages
+setInterval(function(){if(!live)refresh();},2000);
+setInterval(function(){if(live)refresh();},15000);
 </script>
 </body>
 </html>`
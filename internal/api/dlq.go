@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+// replay request is the body for post /dlq/replay and post /dlq/:id/replay. payload and priority,
+// when set, replace the job's before it is re-queued.
+type replayRequest struct {
+	JobIDs   []string `json:"job_ids,omitempty"`
+	All      bool     `json:"all,omitempty"`
+	Payload  *string  `json:"payload,omitempty"`
+	Priority *int     `json:"priority,omitempty"`
+}
+
+func (req replayRequest) options(priorities models.PriorityRange) scheduler.ReplayOptions {
+	opts := scheduler.ReplayOptions{Payload: req.Payload}
+	if req.Priority != nil {
+		p := priorities.Clamp(*req.Priority)
+		opts.Priority = &p
+	}
+	return opts
+}
+
+// list dead letters handles get /dlq (newest first, paged with limit and offset)
+func (h *Handler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntParam(r, "limit", 50, 1, 500)
+	offset := parseIntParam(r, "offset", 0, 0, 10000)
+	var jobs []*models.Job
+	for _, job := range h.sched.ListDeadLetters() {
+		if visible(r, job.Tenant) {
+			jobs = append(jobs, job)
+		}
+	}
+	total := len(jobs)
+	if offset > total {
+		offset = total
+	}
+	jobs = jobs[offset:]
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	if jobs == nil {
+		jobs = []*models.Job{}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs":   jobs,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// replay dead letter handles post /dlq/:id/replay. the replay counts against the tenant's queued
+// quota like a submit: 429 when the tenant is at it.
+func (h *Handler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request, id string) {
+	var req replayRequest
+	// the body is optional: an empty one replays the job unchanged
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if job, ok := h.store.Get(id); !ok || !visible(r, job.Tenant) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": scheduler.ErrNotDeadLettered.Error()})
+		return
+	}
+	job, err := h.sched.Replay(id, req.options(h.priorities))
+	if errors.Is(err, scheduler.ErrTenantQueueFull) {
+		respondJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, job)
+}
+
+// replay dead letters handles post /dlq/replay for the listed job_ids, or every entry with all, of
+// the caller's tenant. ids that are not dead-lettered are reported in not_found rather than failing
+// the batch. the batch stops at the first job its tenant's queued quota refuses and answers 429 with
+// what was replayed up to there.
+func (h *Handler) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	ids := req.JobIDs
+	if req.All {
+		ids = nil
+		for _, job := range h.sched.ListDeadLetters() {
+			if visible(r, job.Tenant) {
+				ids = append(ids, job.ID)
+			}
+		}
+	} else if len(ids) == 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "job_ids or all required"})
+		return
+	}
+	opts := req.options(h.priorities)
+	replayed := []*models.Job{}
+	notFound := []string{}
+	for _, id := range ids {
+		if job, ok := h.store.Get(id); !ok || !visible(r, job.Tenant) {
+			notFound = append(notFound, id)
+			continue
+		}
+		job, err := h.sched.Replay(id, opts)
+		if errors.Is(err, scheduler.ErrTenantQueueFull) {
+			respondJSON(w, http.StatusTooManyRequests, map[string]interface{}{"error": err.Error(), "replayed": replayed, "not_found": notFound})
+			return
+		}
+		if err != nil {
+			notFound = append(notFound, id)
+			continue
+		}
+		replayed = append(replayed, job)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"replayed": replayed, "not_found": notFound})
+}
+
+// purge dead letter handles delete /dlq/:id
+func (h *Handler) PurgeDeadLetter(w http.ResponseWriter, _ *http.Request, id string) {
+	if err := h.sched.Purge(id); err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"purged": 1})
+}
+
+// purge dead letters handles delete /dlq. with job_id query params only those entries are purged,
+// otherwise the whole queue is emptied.
+func (h *Handler) PurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ids := r.URL.Query()["job_id"]
+	if len(ids) == 0 {
+		respondJSON(w, http.StatusOK, map[string]int{"purged": h.sched.PurgeAll()})
+		return
+	}
+	n := 0
+	for _, id := range ids {
+		if h.sched.Purge(id) == nil {
+			n++
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+// dead letter job submits a job and has a pull worker fail it with a class that is never retried
+func deadLetterJob(t *testing.T, h http.Handler, payload string, header ...string) *models.Job {
+	t.Helper()
+	w := do(t, h, http.MethodPost, "/jobs", `{"payload":"`+payload+`"}`, header...)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit: %d %s", w.Code, w.Body)
+	}
+	job := decode[*models.Job](t, w)
+	got := leaseJob(t, h, "w1")
+	w = do(t, h, http.MethodPost, "/jobs/"+got.Job.ID+"/nack", `{"lease_id":"`+got.Lease.ID+`","error":"bad payload","error_class":"validation"}`)
+	if failed := decode[*models.Job](t, w); failed.DeadLetter == nil {
+		t.Fatalf("job %s not dead-lettered: %s", job.ID, w.Body)
+	}
+	return job
+}
+
+func TestDeadLetterReplayAndPurge(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	a := deadLetterJob(t, h, "a")
+	b := deadLetterJob(t, h, "b")
+	c := deadLetterJob(t, h, "c")
+
+	list := decode[jobPage](t, do(t, h, http.MethodGet, "/dlq?limit=2", ""))
+	if list.Total != 3 || len(list.Jobs) != 2 || list.Jobs[0].ID != c.ID {
+		t.Fatalf("dlq = %d jobs of %d, first %s; want 2 of 3 starting with %s", len(list.Jobs), list.Total, list.Jobs[0].ID, c.ID)
+	}
+
+	w := do(t, h, http.MethodPost, "/dlq/"+a.ID+"/replay", `{"payload":"fixed","priority":0}`)
+	if replayed := decode[*models.Job](t, w); w.Code != http.StatusOK || replayed.Status != models.JobStatusQueued || replayed.Payload != "fixed" || replayed.Priority != 0 {
+		t.Fatalf("replay: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, http.MethodPost, "/dlq/"+a.ID+"/replay", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("replay of a job no longer dead-lettered: %d, want 404", w.Code)
+	}
+	batch := decode[struct {
+		Replayed []*models.Job `json:"replayed"`
+		NotFound []string      `json:"not_found"`
+	}](t, do(t, h, http.MethodPost, "/dlq/replay", `{"job_ids":["`+b.ID+`","nope"]}`))
+	if len(batch.Replayed) != 1 || batch.Replayed[0].ID != b.ID || len(batch.NotFound) != 1 || batch.NotFound[0] != "nope" {
+		t.Fatalf("batch replay = %+v", batch)
+	}
+
+	if w := do(t, h, http.MethodDelete, "/dlq?job_id="+c.ID, ""); decode[map[string]int](t, w)["purged"] != 1 {
+		t.Fatalf("purge: %s", w.Body)
+	}
+	if w := do(t, h, http.MethodDelete, "/dlq/"+c.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("purge of a purged job: %d, want 404", w.Code)
+	}
+	if job := decode[*models.Job](t, do(t, h, http.MethodGet, "/jobs/"+c.ID, "")); job.Status != models.JobStatusFailed {
+		t.Fatalf("purged job is %s, want failed", job.Status)
+	}
+}
+
+func TestDeadLetterReplayKeepsToTheTenantAndItsQuota(t *testing.T) {
+	h, sched := newTestHandler(t, nil)
+	sched.SetTenantQuotas(scheduler.TenantQuotas{Tenants: map[string]scheduler.TenantQuota{"team-a": {MaxQueued: 1}}})
+	registerPullWorker(t, h, "w1")
+	theirs := deadLetterJob(t, h, "p")
+	older := deadLetterJob(t, h, "a1", "X-Tenant", "team-a")
+	newer := deadLetterJob(t, h, "a2", "X-Tenant", "team-a")
+
+	if w := do(t, h, http.MethodPost, "/dlq/"+theirs.ID+"/replay", "", "X-Tenant", "team-a"); w.Code != http.StatusNotFound {
+		t.Fatalf("replay of another tenant's job: %d, want 404", w.Code)
+	}
+	w := do(t, h, http.MethodPost, "/dlq/replay", `{"all":true}`, "X-Tenant", "team-a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("replay all past max_queued: %d, want 429", w.Code)
+	}
+	batch := decode[struct {
+		Replayed []*models.Job `json:"replayed"`
+	}](t, w)
+	// newest first: the older job is refused once the newer one took the one queued slot
+	if len(batch.Replayed) != 1 || batch.Replayed[0].ID != newer.ID {
+		t.Fatalf("replayed %+v, want only %s", batch.Replayed, newer.ID)
+	}
+	if dlq := decode[jobPage](t, do(t, h, http.MethodGet, "/dlq", "")); dlq.Total != 2 {
+		t.Fatalf("dlq holds %d jobs, want the other tenant's and the refused one", dlq.Total)
+	}
+	if job := decode[*models.Job](t, do(t, h, http.MethodGet, "/jobs/"+theirs.ID, "")); job.DeadLetter == nil {
+		t.Fatal("replay all of team-a replayed another tenant's job")
+	}
+	if w := do(t, h, http.MethodPost, "/dlq/"+older.ID+"/replay", "", "X-Tenant", "team-a"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("replay past max_queued: %d, want 429", w.Code)
+	}
+}
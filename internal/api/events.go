@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud/internal/events"
+)
+
+// streams send a comment this often so proxies keep idle connections open
+const eventKeepAlive = 15 * time.Second
+
+// event filter matches events against the job_id, type (job type), status and event (event type) query params.
+// each param may list several comma-separated values; an empty param matches everything.
+// a request confined to a tenant only gets that tenant's job events.
+type eventFilter struct {
+	jobIDs, jobTypes, statuses, eventTypes []string
+	tenant                                 string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	q := r.URL.Query()
+	return eventFilter{
+		jobIDs:     splitList(q.Get("job_id")),
+		jobTypes:   splitList(q.Get("type")),
+		statuses:   splitList(q.Get("status")),
+		eventTypes: splitList(q.Get("event")),
+		tenant:     tenantOf(r),
+	}
+}
+
+func (f eventFilter) match(e events.Event) bool {
+	return matchAny(f.jobIDs, e.JobID) && matchAny(f.jobTypes, e.JobType) &&
+		matchAny(f.statuses, e.Status) && matchAny(f.eventTypes, e.Type) &&
+		(f.tenant == "" || e.Tenant == f.tenant)
+}
+
+func matchAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// events handles get /events: a server-sent events stream of job and worker state changes.
+// a client that reconnects with last-event-id (header, or last_event_id query param) first gets
+// the events it missed from the ring buffer; if some already fell out of it, a reset event tells
+// it to reload full state.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var after uint64
+	if lastID != "" {
+		n, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid last event id"})
+			return
+		}
+		after = n
+	}
+	filter := newEventFilter(r)
+	sub, backlog, complete := h.sched.Events().Subscribe(after)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 2000\n\n")
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {\"reason\":\"missed events are no longer buffered\"}\n\n")
+	}
+	for _, e := range backlog {
+		if filter.match(e) {
+			writeEvent(w, e)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-sub.C:
+			if !ok {
+				// dropped for falling behind; the client reconnects and resumes from its last id
+				return
+			}
+			if filter.match(e) {
+				writeEvent(w, e)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
+
+// close streams ends every open event stream, so server shutdown doesn't wait on them
+func (h *Handler) CloseStreams() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
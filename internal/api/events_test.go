@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud/internal/events"
+)
+
+// sse event is one event read off a stream
+type sseEvent struct {
+	id, name string
+	data     events.Event
+}
+
+// open stream connects to get /events on a served handler and returns a function reading the next event
+func openStream(t *testing.T, h http.Handler, query string, header ...string) func() sseEvent {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+	})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events"+query, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	return func() sseEvent {
+		t.Helper()
+		var e sseEvent
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == "":
+				if e.name != "" {
+					return e
+				}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data)
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return e
+	}
+}
+
+func TestEventsStreamsFilteredJobEvents(t *testing.T) {
+	h, sched := newTestHandler(t, nil)
+	next := openStream(t, h, "?event=job.submitted&type=email")
+
+	submitJob(t, h, `{"type":"resize","payload":"p"}`)
+	job := submitJob(t, h, `{"type":"email","payload":"p"}`)
+	e := next()
+	if e.name != events.JobSubmitted || e.data.JobID != job.ID || e.data.Status != "queued" || e.id == "" {
+		t.Fatalf("event = %+v, want job.submitted for the email job", e)
+	}
+
+	// other event types are filtered out too
+	sched.Events().Publish(events.Event{Type: events.WorkerRegistered, WorkerID: "w1"})
+	job = submitJob(t, h, `{"type":"email","payload":"p"}`)
+	if e := next(); e.data.JobID != job.ID {
+		t.Fatalf("event = %+v, want the second email job", e)
+	}
+}
+
+func TestEventsResumeAfterLastEventID(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	first := submitJob(t, h, `{"payload":"p"}`)
+	second := submitJob(t, h, `{"payload":"p"}`)
+
+	// the client saw the first job's event (id 1) and reconnects
+	next := openStream(t, h, "?event=job.submitted", "Last-Event-ID", "1")
+	if e := next(); e.data.JobID != second.ID {
+		t.Fatalf("first event after resuming = %+v, want the second job (not %s)", e, first.ID)
+	}
+
+	if w := do(t, h, http.MethodGet, "/events?last_event_id=x", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid last_event_id: %d, want 400", w.Code)
+	}
+
+	// an id from before a restart can't be resumed from; the client is told to reload
+	next = openStream(t, h, "?last_event_id=1000")
+	if e := next(); e.name != "reset" {
+		t.Fatalf("first event = %q, want reset", e.name)
+	}
+}
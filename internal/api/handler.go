@@ -1,20 +1,37 @@
 package api
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud/internal/auth"
+	"cloud/internal/events"
 	"cloud/internal/ratelimit"
 	"cloud/internal/scheduler"
+	"cloud/internal/webhook"
 	"cloud/pkg/models"
 )
 
+const (
+	// jobs can be delayed by up to a year
+	maxDelaySec = 365 * 86400
+	// most slots a single worker can register
+	maxWorkerCapacity = 256
+	// reads of a job a cancel makes before giving up because the job keeps changing under it
+	cancelAttempts = 3
+)
+
 func generateRequestID() string {
 	b := make([]byte, 8)
 	_, _ = rand.Read(b)
@@ -28,35 +45,54 @@ type Handler struct {
 	workers     *models.WorkerRegistry
 	sched       *scheduler.Scheduler
 	startTime   time.Time
-	rateLimiter rateLimiterInterface
+	limiter     *ratelimit.Limiter
+	trustXFF    bool // client ips for rate limiting come from X-Forwarded-For
 	idem        *idempotency
-}
-
-type rateLimiterInterface interface {
-	Allow() bool
+	webhooks    *webhook.Dispatcher
+	auth        *auth.Authenticator
+	priorities  models.PriorityRange
+	workerCerts bool          // worker routes need a verified client certificate
+	closing     chan struct{} // closed on shutdown to end event streams
+	closeOnce   sync.Once
 }
 
 // handler config optional config for production features
 type HandlerConfig struct {
 	StartTime         time.Time
-	RateLimitPerMin   int
+	RateLimit         *ratelimit.Limiter // per-client token buckets for every route but health, dashboard and workers
+	TrustForwardedFor bool               // take the client ip from X-Forwarded-For (behind a trusted proxy)
 	IdempotencyTTLSec int
+	Idempotency       *models.IdempotencyStore // where idempotency keys are kept; in memory when nil
+	Webhooks          *webhook.Dispatcher      // enables callback_url and /webhooks
+	Auth              *auth.Authenticator      // requires an api key with the route's role on every request
+	Priorities        models.PriorityRange     // accepted job priorities; 0 to 2 when zero
+	// worker routes (register, heartbeat, lease, complete) need a tls client certificate signed by
+	// the ca, also when other clients may connect without one
+	WorkerCertRequired bool
 }
 
 // new handler returns a new api handler. cfg can be nil for defaults
 func NewHandler(store *models.JobStore, queue *scheduler.Queue, workers *models.WorkerRegistry, sched *scheduler.Scheduler, cfg *HandlerConfig) *Handler {
-	h := &Handler{store: store, queue: queue, workers: workers, sched: sched}
+	h := &Handler{store: store, queue: queue, workers: workers, sched: sched, closing: make(chan struct{})}
 	if cfg != nil {
 		h.startTime = cfg.StartTime
 		if cfg.StartTime.IsZero() {
 			h.startTime = time.Now()
 		}
-		if cfg.RateLimitPerMin > 0 {
-			h.rateLimiter = ratelimit.NewLimiter(cfg.RateLimitPerMin)
-		}
+		h.limiter = cfg.RateLimit
+		h.trustXFF = cfg.TrustForwardedFor
 		if cfg.IdempotencyTTLSec > 0 {
-			h.idem = newIdempotency(time.Duration(cfg.IdempotencyTTLSec) * time.Second)
+			keys := cfg.Idempotency
+			if keys == nil {
+				keys = models.NewIdempotencyStore()
+			}
+			h.idem = newIdempotency(keys, time.Duration(cfg.IdempotencyTTLSec)*time.Second)
+			go h.idem.sweep(h.closing)
 		}
+		h.webhooks = cfg.Webhooks
+		h.auth = cfg.Auth
+		h.workerCerts = cfg.WorkerCertRequired
+		h.priorities = cfg.Priorities
 	}
 	if h.startTime.IsZero() {
 		h.startTime = time.Now()
@@ -73,6 +109,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Request-ID", reqID)
 	path := strings.Trim(r.URL.Path, "/")
 	parts := strings.Split(path, "/")
+	key, ok := h.authorize(w, r, path, parts)
+	if !ok {
+		return
+	}
+	if key != nil {
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+	}
+	if r, ok = withTenant(w, r, key); !ok {
+		return
+	}
+	if !h.rateLimit(w, r, key, rateClass(r.Method, path, parts)) {
+		return
+	}
 
 	switch {
 	case path == "health" && r.Method == http.MethodGet:
@@ -90,6 +139,9 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case path == "dashboard" && r.Method == http.MethodGet:
 		h.Dashboard(w, r)
 		return
+	case path == "events" && r.Method == http.MethodGet:
+		h.Events(w, r)
+		return
 	case path == "workers" && r.Method == http.MethodGet:
 		h.ListWorkers(w, r)
 		return
@@ -105,6 +157,15 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodDelete:
 		h.CancelJob(w, r, parts[1])
 		return
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodPatch:
+		h.UpdateJob(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "position" && r.Method == http.MethodGet:
+		h.JobPosition(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "deliveries" && r.Method == http.MethodGet:
+		h.JobDeliveries(w, r, parts[1])
+		return
 	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "complete" && r.Method == http.MethodPost:
 		h.CompleteJob(w, r, parts[1])
 		return
@@ -114,6 +175,84 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case path == "workers/heartbeat" && r.Method == http.MethodPost:
 		h.Heartbeat(w, r)
 		return
+	case path == "workers/lease" && r.Method == http.MethodPost:
+		h.LeaseJob(w, r)
+		return
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "lease" && r.Method == http.MethodPost:
+		h.ExtendLease(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "ack" && r.Method == http.MethodPost:
+		h.AckJob(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "nack" && r.Method == http.MethodPost:
+		h.NackJob(w, r, parts[1])
+		return
+	case path == "workflows" && r.Method == http.MethodPost:
+		h.SubmitWorkflow(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "workflows" && r.Method == http.MethodGet:
+		h.GetWorkflow(w, r, parts[1])
+		return
+	case path == "schedules" && r.Method == http.MethodGet:
+		h.ListSchedules(w, r)
+		return
+	case path == "schedules" && r.Method == http.MethodPost:
+		h.CreateSchedule(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "schedules" && r.Method == http.MethodGet:
+		h.GetSchedule(w, r, parts[1])
+		return
+	case len(parts) == 2 && parts[0] == "schedules" && r.Method == http.MethodDelete:
+		h.DeleteSchedule(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "schedules" && parts[2] == "pause" && r.Method == http.MethodPost:
+		h.PauseSchedule(w, r, parts[1])
+		return
+	case len(parts) == 3 && parts[0] == "schedules" && parts[2] == "resume" && r.Method == http.MethodPost:
+		h.ResumeSchedule(w, r, parts[1])
+		return
+	case path == "webhooks" && r.Method == http.MethodGet:
+		h.ListWebhooks(w, r)
+		return
+	case path == "webhooks" && r.Method == http.MethodPost:
+		h.CreateWebhook(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "webhooks" && r.Method == http.MethodGet:
+		h.GetWebhook(w, r, parts[1])
+		return
+	case len(parts) == 2 && parts[0] == "webhooks" && r.Method == http.MethodDelete:
+		h.DeleteWebhook(w, r, parts[1])
+		return
+	case path == "ratelimit" && r.Method == http.MethodGet:
+		h.GetRateLimit(w, r)
+		return
+	case path == "ratelimit" && r.Method == http.MethodPut:
+		h.SetRateLimit(w, r)
+		return
+	case path == "keys" && r.Method == http.MethodGet:
+		h.ListAPIKeys(w, r)
+		return
+	case path == "keys" && r.Method == http.MethodPost:
+		h.CreateAPIKey(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "keys" && r.Method == http.MethodDelete:
+		h.DeleteAPIKey(w, r, parts[1])
+		return
+	case path == "dlq" && r.Method == http.MethodGet:
+		h.ListDeadLetters(w, r)
+		return
+	case path == "dlq" && r.Method == http.MethodDelete:
+		h.PurgeDeadLetters(w, r)
+		return
+	case path == "dlq/replay" && r.Method == http.MethodPost:
+		h.ReplayDeadLetters(w, r)
+		return
+	case len(parts) == 3 && parts[0] == "dlq" && parts[2] == "replay" && r.Method == http.MethodPost:
+		h.ReplayDeadLetter(w, r, parts[1])
+		return
+	case len(parts) == 2 && parts[0] == "dlq" && r.Method == http.MethodDelete:
+		h.PurgeDeadLetter(w, r, parts[1])
+		return
 	default:
 		http.NotFound(w, r)
 	}
@@ -136,68 +275,113 @@ func (h *Handler) Ready(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-// stats returns json summary for dashboards (queue, workers, jobs by status, uptime)
-func (h *Handler) Stats(w http.ResponseWriter, _ *http.Request) {
-	jobs := h.store.List("")
-	byStatus := make(map[string]int)
-	var completed, failed int
-	for _, j := range jobs {
-		byStatus[string(j.Status)]++
-		if j.Status == models.JobStatusCompleted {
-			completed++
-		}
-		if j.Status == models.JobStatusFailed {
-			failed++
-		}
-	}
-	total := len(jobs)
-	successRate := 0.0
-	if completed+failed > 0 {
-		successRate = float64(completed) / float64(completed+failed) * 100
+// stats returns json summary for dashboards (queue, workers, jobs by status, uptime). for a request
+// confined to a tenant the job figures are that tenant's, along with its quota.
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantOf(r)
+	if tenant != "" {
+		h.tenantStats(w, tenant)
+		return
 	}
+	byStatus, total, successRate := summarize(h.store.CountByStatus())
 	uptimeSec := time.Since(h.startTime).Seconds()
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"queue_depth":      h.queue.Depth(),
-		"workers":          len(h.workers.List()),
-		"jobs_total":       total,
-		"jobs_by_status":   byStatus,
-		"success_rate_pct": successRate,
-		"uptime_seconds":   uptimeSec,
+		"queue_depth":           h.queue.Depth(),
+		"queue_depth_by_tenant": h.queue.Depths(),
+		"workers":               len(h.workers.List()),
+		"jobs_total":            total,
+		"jobs_by_status":        byStatus,
+		"success_rate_pct":      successRate,
+		"dlq_size":              h.sched.DeadLetters().Size(),
+		"delayed":               h.sched.Delayed(),
+		"uptime_seconds":        uptimeSec,
 	})
 }
 
+// summarize turns job counts by status into the stats fields: counts keyed by name, the total and
+// the share of finished jobs that completed
+func summarize(counts map[models.JobStatus]int) (byStatus map[string]int, total int, successRate float64) {
+	byStatus = make(map[string]int)
+	for status, n := range counts {
+		byStatus[string(status)] = n
+		total += n
+	}
+	completed := counts[models.JobStatusCompleted]
+	failed := counts[models.JobStatusFailed]
+	if completed+failed > 0 {
+		successRate = float64(completed) / float64(completed+failed) * 100
+	}
+	return byStatus, total, successRate
+}
+
 // metrics returns prometheus-style metrics (queue depth, worker count, jobs by status, heartbeat age)
 func (h *Handler) Metrics(w http.ResponseWriter, _ *http.Request) {
 	depth := h.queue.Depth()
 	workers := h.workers.List()
-	jobs := h.store.List("")
-	statusCount := make(map[models.JobStatus]int)
-	for _, j := range jobs {
-		statusCount[j.Status]++
-	}
+	statusCount := h.store.CountByStatus()
 	var maxHeartbeatAge float64
+	var slots, slotsUsed int
 	now := time.Now()
 	for _, w := range workers {
 		age := now.Sub(w.LastHeartbeat).Seconds()
 		if age > maxHeartbeatAge {
 			maxHeartbeatAge = age
 		}
+		slots += w.Slots()
+		slotsUsed += len(w.RunningJobs)
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("# HELP job_queue_depth number of jobs waiting in queue\n# TYPE job_queue_depth gauge\njob_queue_depth " + fmtInt(depth) + "\n"))
+	h.writeWaitMetrics(w)
 	_, _ = w.Write([]byte("# HELP workers_registered number of registered workers\n# TYPE workers_registered gauge\nworkers_registered " + fmtInt(len(workers)) + "\n"))
+	_, _ = w.Write([]byte("# HELP worker_slots total job slots across registered workers\n# TYPE worker_slots gauge\nworker_slots " + fmtInt(slots) + "\n"))
+	_, _ = w.Write([]byte("# HELP worker_slots_used job slots currently running a job\n# TYPE worker_slots_used gauge\nworker_slots_used " + fmtInt(slotsUsed) + "\n"))
 	_, _ = w.Write([]byte("# HELP job_total jobs by status\n# TYPE job_total gauge\n"))
 	_, _ = w.Write([]byte("job_total{status=\"pending\"} " + fmtInt(statusCount[models.JobStatusPending]) + "\n"))
+	_, _ = w.Write([]byte("job_total{status=\"scheduled\"} " + fmtInt(statusCount[models.JobStatusScheduled]) + "\n"))
 	_, _ = w.Write([]byte("job_total{status=\"queued\"} " + fmtInt(statusCount[models.JobStatusQueued]) + "\n"))
 	_, _ = w.Write([]byte("job_total{status=\"running\"} " + fmtInt(statusCount[models.JobStatusRunning]) + "\n"))
 	_, _ = w.Write([]byte("job_total{status=\"completed\"} " + fmtInt(statusCount[models.JobStatusCompleted]) + "\n"))
 	_, _ = w.Write([]byte("job_total{status=\"failed\"} " + fmtInt(statusCount[models.JobStatusFailed]) + "\n"))
 	_, _ = w.Write([]byte("job_total{status=\"cancelled\"} " + fmtInt(statusCount[models.JobStatusCancelled]) + "\n"))
+	_, _ = w.Write([]byte("job_total{status=\"skipped\"} " + fmtInt(statusCount[models.JobStatusSkipped]) + "\n"))
+	_, _ = w.Write([]byte("# HELP job_delayed number of jobs waiting for their run time or retry backoff\n# TYPE job_delayed gauge\njob_delayed " + fmtInt(h.sched.Delayed()) + "\n"))
+	_, _ = w.Write([]byte("# HELP job_dlq_size number of failed jobs in the dead-letter queue\n# TYPE job_dlq_size gauge\njob_dlq_size " + fmtInt(h.sched.DeadLetters().Size()) + "\n"))
 	_, _ = w.Write([]byte("# HELP worker_heartbeat_age_seconds max seconds since last worker heartbeat\n# TYPE worker_heartbeat_age_seconds gauge\nworker_heartbeat_age_seconds " + fmtFloat(maxHeartbeatAge) + "\n"))
 }
 
+// write wait metrics writes the queue wait of dispatched jobs and of the oldest queued job, by original priority
+func (h *Handler) writeWaitMetrics(w http.ResponseWriter) {
+	stats := h.sched.WaitStats()
+	oldest := h.queue.OldestWaits()
+	var priorities []int
+	for p := range stats {
+		priorities = append(priorities, p)
+	}
+	for p := range oldest {
+		if _, ok := stats[p]; !ok {
+			priorities = append(priorities, p)
+		}
+	}
+	sort.Ints(priorities)
+	_, _ = w.Write([]byte("# HELP job_queue_wait_seconds time dispatched jobs spent queued, by priority\n# TYPE job_queue_wait_seconds summary\n"))
+	for _, p := range priorities {
+		label := "{priority=\"" + strconv.Itoa(p) + "\"} "
+		_, _ = w.Write([]byte("job_queue_wait_seconds_sum" + label + fmtFloat(stats[p].TotalSec) + "\n"))
+		_, _ = w.Write([]byte("job_queue_wait_seconds_count" + label + fmtInt(stats[p].Count) + "\n"))
+	}
+	_, _ = w.Write([]byte("# HELP job_queue_wait_max_seconds longest time a dispatched job spent queued, by priority\n# TYPE job_queue_wait_max_seconds gauge\n"))
+	for _, p := range priorities {
+		_, _ = w.Write([]byte("job_queue_wait_max_seconds{priority=\"" + strconv.Itoa(p) + "\"} " + fmtFloat(stats[p].MaxSec) + "\n"))
+	}
+	_, _ = w.Write([]byte("# HELP job_queue_oldest_wait_seconds how long the oldest queued job has been waiting, by priority\n# TYPE job_queue_oldest_wait_seconds gauge\n"))
+	for _, p := range priorities {
+		_, _ = w.Write([]byte("job_queue_oldest_wait_seconds{priority=\"" + strconv.Itoa(p) + "\"} " + fmtFloat(oldest[p].Seconds()) + "\n"))
+	}
+}
+
 func fmtFloat(f float64) string {
 	return strconv.FormatFloat(f, 'f', 2, 64)
 }
@@ -216,104 +400,289 @@ func fmtInt(n int) string {
 	return string(b[i+1:])
 }
 
-// submit job handles post /jobs (rate limited, optional idempotency key)
+// submit job handles post /jobs (optional idempotency key). with ?wait=30s it answers once the job is final or the wait runs out.
 func (h *Handler) SubmitJob(w http.ResponseWriter, r *http.Request) {
-	if h.rateLimiter != nil && !h.rateLimiter.Allow() {
-		w.Header().Set("Retry-After", "60")
-		respondJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+	wait, err := parseWait(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-	idemKey := r.Header.Get("X-Idempotency-Key")
-	if idemKey != "" && h.idem != nil {
-		if existingID, ok := h.idem.get(idemKey); ok {
-			job, _ := h.store.Get(existingID)
-			if job != nil {
-				respondJSON(w, http.StatusOK, job)
-				return
-			}
-		}
-	}
 	var req models.SubmitJobRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 		return
 	}
-	priority := models.PriorityNormal
-	if req.Priority != nil {
-		p := *req.Priority
-		if p < models.PriorityHigh {
-			p = models.PriorityHigh
-		}
-		if p > models.PriorityLow {
-			p = models.PriorityLow
-		}
-		priority = p
-	}
-	job := &models.Job{Type: req.Type, Payload: req.Payload, TimeoutSec: req.TimeoutSec, Priority: priority}
-	job, err := h.store.Create(job)
+	// taken before validation, which normalizes parts of the request in place
+	fingerprint := requestFingerprint(&req)
+	job, err := h.jobFromRequest(r, &req)
 	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	existing := false
+	if idemKey := r.Header.Get("X-Idempotency-Key"); idemKey != "" && h.idem != nil {
+		job, existing, err = h.idem.submit(idempotencyScope(r)+"/"+idemKey, fingerprint, h.store, func() (*models.Job, error) {
+			return h.sched.Submit(job)
+		})
+	} else {
+		job, err = h.sched.Submit(job)
+	}
+	switch {
+	case errors.Is(err, errIdempotencyConflict):
+		respondJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, scheduler.ErrTenantQueueFull):
+		respondJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
 		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
-	if idemKey != "" && h.idem != nil {
-		h.idem.set(idemKey, job.ID)
+	if !existing {
+		if job.Status == models.JobStatusScheduled {
+			log.Printf("event=job_submitted job_id=%s run_at=%s", job.ID, job.RunAt.Format(time.RFC3339))
+		} else {
+			log.Printf("event=job_submitted job_id=%s queue_depth=%d", job.ID, h.queue.Depth())
+		}
+	}
+	if wait > 0 {
+		h.respondWaited(w, r, job.ID, wait)
+		return
+	}
+	if existing {
+		respondJSON(w, http.StatusOK, job)
+		return
 	}
-	h.queue.Enqueue(job.ID, job.Priority)
-	job.Status = models.JobStatusQueued
-	h.store.Update(job)
-	log.Printf("event=job_submitted job_id=%s queue_depth=%d", job.ID, h.queue.Depth())
 	respondJSON(w, http.StatusAccepted, job)
 }
 
-// get job handles get /jobs/:id
-func (h *Handler) GetJob(w http.ResponseWriter, _ *http.Request, id string) {
+// job from request validates a submit request and builds the job it asks for
+func (h *Handler) jobFromRequest(r *http.Request, req *models.SubmitJobRequest) (*models.Job, error) {
+	priority := h.priority(req.Priority)
+	if req.Retry != nil {
+		if err := req.Retry.Normalize(); err != nil {
+			return nil, err
+		}
+	}
+	if req.Constraints != nil {
+		if err := req.Constraints.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.checkCallback(req.CallbackURL); err != nil {
+		return nil, err
+	}
+	runAt, err := runAtOf(req)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Job{Type: req.Type, Payload: req.Payload, TimeoutSec: req.TimeoutSec, Priority: priority, RetryPolicy: req.Retry, RunAt: runAt, Constraints: req.Constraints, CallbackURL: req.CallbackURL, Tenant: tenantOf(r)}, nil
+}
+
+// run at of resolves run_at or delay_sec into the time the job may first be queued (nil for now)
+func runAtOf(req *models.SubmitJobRequest) (*time.Time, error) {
+	if req.RunAt != nil && req.DelaySec != 0 {
+		return nil, errors.New("run_at and delay_sec are mutually exclusive")
+	}
+	if req.DelaySec < 0 || req.DelaySec > maxDelaySec {
+		return nil, fmt.Errorf("delay_sec must be between 0 and %d", maxDelaySec)
+	}
+	if req.DelaySec > 0 {
+		t := time.Now().Add(time.Duration(req.DelaySec) * time.Second)
+		return &t, nil
+	}
+	if req.RunAt != nil && req.RunAt.After(time.Now().Add(maxDelaySec*time.Second)) {
+		return nil, fmt.Errorf("run_at must be within %d days", maxDelaySec/86400)
+	}
+	return req.RunAt, nil
+}
+
+// priority returns the requested priority clamped into the accepted range, or the default when
+// none was requested
+func (h *Handler) priority(p *int) int {
+	if p == nil {
+		return h.priorities.Default()
+	}
+	return h.priorities.Clamp(*p)
+}
+
+// get job handles get /jobs/:id. with ?wait=30s it blocks until the job is final or the wait runs out.
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request, id string) {
+	wait, err := parseWait(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if wait > 0 {
+		h.respondWaited(w, r, id, wait)
+		return
+	}
 	job, ok := h.store.Get(id)
-	if !ok {
+	if !ok || !visible(r, job.Tenant) {
 		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
 		return
 	}
+	if expires, ok := h.sched.LeaseExpiresAt(id); ok && job.LeaseID != "" {
+		job.LeaseExpiresAt = &expires
+	}
 	respondJSON(w, http.StatusOK, job)
 }
 
-// cancel job handles delete /jobs/:id
-func (h *Handler) CancelJob(w http.ResponseWriter, _ *http.Request, id string) {
+// cancel job handles delete /jobs/:id. a running job is stopped on its worker: the answer is 202
+// with cancel_requested set, and the job turns cancelled once the worker has killed it.
+// the job may be dispatched or finish while we look at it; the cancel is then retried on a fresh copy.
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request, id string) {
+	for try := 0; try < cancelAttempts; try++ {
+		job, ok := h.store.Get(id)
+		if !ok || !visible(r, job.Tenant) {
+			respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		if job.Status == models.JobStatusRunning {
+			if !h.sched.CancelRunning(job) {
+				continue
+			}
+			if job.Status == models.JobStatusCancelled {
+				respondJSON(w, http.StatusOK, job)
+				return
+			}
+			respondJSON(w, http.StatusAccepted, job)
+			return
+		}
+		if job.Status != models.JobStatusPending && job.Status != models.JobStatusQueued && job.Status != models.JobStatusScheduled {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "job cannot be cancelled"})
+			return
+		}
+		job.Status = models.JobStatusCancelled
+		if !h.store.Update(job) {
+			continue
+		}
+		h.queue.Remove(id)
+		log.Printf("event=job_cancelled job_id=%s", id)
+		h.sched.OnJobCancelled(job)
+		respondJSON(w, http.StatusOK, job)
+		return
+	}
+	respondJSON(w, http.StatusConflict, map[string]string{"error": "job kept changing, try again"})
+}
+
+// update job handles patch /jobs/:id. only the priority can change, and only before the job starts;
+// a queued job moves to its new place in the queue right away.
+func (h *Handler) UpdateJob(w http.ResponseWriter, r *http.Request, id string) {
+	var req models.UpdateJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if req.Priority == nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "priority is required"})
+		return
+	}
 	job, ok := h.store.Get(id)
-	if !ok {
+	if !ok || !visible(r, job.Tenant) {
 		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
 		return
 	}
-	if job.Status != models.JobStatusPending && job.Status != models.JobStatusQueued {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "job cannot be cancelled"})
+	if err := h.sched.Reprioritize(job, h.priority(req.Priority)); err != nil {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": err.Error(), "status": string(job.Status)})
 		return
 	}
-	job.Status = models.JobStatusCancelled
-	h.store.Update(job)
-	h.queue.Remove(id)
-	log.Printf("event=job_cancelled job_id=%s", id)
 	respondJSON(w, http.StatusOK, job)
 }
 
-// list jobs handles get /jobs (pagination via limit and offset)
+// job position handles get /jobs/:id/position: where a queued job stands and when it should start
+func (h *Handler) JobPosition(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok := h.store.Get(id)
+	if !ok || !visible(r, job.Tenant) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+	pos, ok := h.sched.Position(job)
+	if !ok {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": "job is not waiting in the queue", "status": string(job.Status)})
+		return
+	}
+	respondJSON(w, http.StatusOK, pos)
+}
+
+// list jobs handles get /jobs. results are ordered server-side (sort=created_at|priority|finished_at,
+// order=asc|desc, default created_at desc) and filtered by status, type, worker_id, workflow_id and
+// created_after/created_before (rfc3339). pages follow next_cursor; offset is kept for old clients.
 func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
-	status := models.JobStatus(r.URL.Query().Get("status"))
-	limit := parseIntParam(r, "limit", 50, 1, 500)
-	offset := parseIntParam(r, "offset", 0, 0, 10000)
-	jobs := h.store.List(status)
-	total := len(jobs)
-	if offset >= total {
-		jobs = nil
-	} else {
-		end := offset + limit
-		if end > total {
-			end = total
+	q := r.URL.Query()
+	query := models.JobQuery{
+		Status:     models.JobStatus(q.Get("status")),
+		Type:       q.Get("type"),
+		WorkerID:   q.Get("worker_id"),
+		WorkflowID: q.Get("workflow_id"),
+		Tenant:     tenantOf(r),
+		SortBy:     models.SortByCreatedAt,
+		Desc:       q.Get("order") != "asc",
+		Limit:      parseIntParam(r, "limit", 50, 1, 500),
+		Offset:     parseIntParam(r, "offset", 0, 0, 10000),
+	}
+	if sortBy := q.Get("sort"); sortBy != "" {
+		switch models.JobSortField(sortBy) {
+		case models.SortByCreatedAt, models.SortByPriority, models.SortByFinishedAt:
+			query.SortBy = models.JobSortField(sortBy)
+		default:
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "sort must be created_at, priority or finished_at"})
+			return
 		}
-		jobs = jobs[offset:end]
+	}
+	if order := q.Get("order"); order != "" && order != "asc" && order != "desc" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "order must be asc or desc"})
+		return
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"created_after", &query.CreatedAfter}, {"created_before", &query.CreatedBefore}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]string{"error": p.name + " must be an rfc3339 timestamp"})
+				return
+			}
+			*p.dst = t
+		}
+	}
+	if token := q.Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token, query.SortBy, query.Desc)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		query.Cursor = cursor
+		query.Offset = 0
+	}
+
+	// fetch one extra row to know whether another page exists
+	limit := query.Limit
+	query.Limit++
+	jobs, total, err := h.store.Query(query)
+	if errors.Is(err, models.ErrCursorSort) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": errInvalidCursor.Error()})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	nextCursor := ""
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		nextCursor = encodeCursor(jobs[limit-1].Cursor(query.SortBy), query.SortBy, query.Desc)
+	}
+	if jobs == nil {
+		jobs = []*models.Job{}
 	}
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"jobs":   jobs,
-		"total":  total,
-		"limit":  limit,
-		"offset": offset,
+		"jobs":        jobs,
+		"total":       total,
+		"limit":       limit,
+		"offset":      query.Offset,
+		"next_cursor": nextCursor,
 	})
 }
 
@@ -332,12 +701,16 @@ func parseIntParam(r *http.Request, key string, defaultVal, min, max int) int {
 	return n
 }
 
-// complete job handles post /jobs/:id/complete (callback from worker)
+// complete job handles post /jobs/:id/complete (callback from worker). the attempt token the job was
+// dispatched with must come back with it; a callback from an earlier attempt, e.g. a worker that was
+// reaped and whose job runs elsewhere now, gets 409 and leaves the job alone.
 func (h *Handler) CompleteJob(w http.ResponseWriter, r *http.Request, id string) {
 	var req struct {
-		Success bool   `json:"success"`
-		Result  string `json:"result,omitempty"`
-		Error   string `json:"error,omitempty"`
+		Success      bool   `json:"success"`
+		Result       string `json:"result,omitempty"`
+		Error        string `json:"error,omitempty"`
+		ErrorClass   string `json:"error_class,omitempty"`
+		AttemptToken string `json:"attempt_token"`
 	}
 	_ = json.NewDecoder(r.Body).Decode(&req)
 
@@ -347,62 +720,221 @@ func (h *Handler) CompleteJob(w http.ResponseWriter, r *http.Request, id string)
 		return
 	}
 	if job.Status != models.JobStatusRunning {
+		log.Printf("event=job_complete_rejected job_id=%s status=%s attempt_token=%q reason=not_running", id, job.Status, req.AttemptToken)
 		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "job not running"})
 		return
 	}
-	now := timeNow()
-	job.FinishedAt = &now
-	if req.Success {
-		job.Status = models.JobStatusCompleted
-		job.Result = req.Result
-		log.Printf("event=job_completed job_id=%s worker_id=%s", id, job.WorkerID)
-	} else {
-		job.Status = models.JobStatusFailed
-		job.Error = req.Error
-		log.Printf("event=job_failed job_id=%s worker_id=%s error=%s", id, job.WorkerID, req.Error)
+	if req.AttemptToken != job.AttemptToken {
+		log.Printf("event=job_complete_rejected job_id=%s worker_id=%s attempt_token=%q current_token=%q reason=stale_attempt", id, job.WorkerID, req.AttemptToken, job.AttemptToken)
+		respondJSON(w, http.StatusConflict, map[string]string{"error": "attempt token does not match the job's current attempt"})
+		return
+	}
+	if !h.finishJob(job, req.Success, req.Result, req.Error, req.ErrorClass) {
+		log.Printf("event=job_complete_rejected job_id=%s worker_id=%s attempt_token=%q reason=changed_since_read", id, job.WorkerID, req.AttemptToken)
+		respondJSON(w, http.StatusConflict, map[string]string{"error": scheduler.ErrJobChanged.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, job)
+}
+
+// finish job records the outcome of a running job's attempt. failures go through the job's retry
+// policy, so the job may end up queued again rather than failed. a job cancelled while it ran ends
+// cancelled, keeping the output the worker sent. returns false when the job was written since it was
+// read (e.g. cancelled or reaped meanwhile) and the outcome was not recorded.
+func (h *Handler) finishJob(job *models.Job, success bool, result, errMsg, errClass string) bool {
+	if success {
+		return h.sched.Complete(job, result)
+	}
+	if job.CancelRequested {
+		return h.sched.FinishCancelled(job, result, "cancelled")
+	}
+	if errClass == "" {
+		errClass = models.ErrorClassExecution
+	}
+	_, ok := h.sched.FailAttempt(job, errClass, errMsg)
+	return ok
+}
+
+// lease job handles post /workers/lease (pull workers). it long-polls up to wait_sec for a queued job
+// and returns it with a lease valid for visibility_sec, or 204 when nothing arrived in time.
+func (h *Handler) LeaseJob(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		WorkerID      string `json:"worker_id"`
+		WaitSec       int    `json:"wait_sec,omitempty"`
+		VisibilitySec int    `json:"visibility_sec,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.WorkerID == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "worker_id required"})
+		return
+	}
+	if _, ok := h.workers.Get(req.WorkerID); !ok {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "worker not found"})
+		return
+	}
+	job, lease, err := h.sched.Lease(r.Context(), req.WorkerID, time.Duration(req.WaitSec)*time.Second, time.Duration(req.VisibilitySec)*time.Second)
+	if err != nil || job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"job": job, "lease": lease})
+}
+
+// extend lease handles post /jobs/:id/lease (pull worker keeps its claim while the job runs)
+func (h *Handler) ExtendLease(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		LeaseID       string `json:"lease_id"`
+		VisibilitySec int    `json:"visibility_sec,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LeaseID == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "lease_id required"})
+		return
+	}
+	lease, err := h.sched.ExtendLease(id, req.LeaseID, time.Duration(req.VisibilitySec)*time.Second)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, lease)
+}
+
+// ack job handles post /jobs/:id/ack (pull worker finished the job successfully)
+func (h *Handler) AckJob(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		LeaseID string `json:"lease_id"`
+		Result  string `json:"result,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LeaseID == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "lease_id required"})
+		return
+	}
+	job, ok := h.leasedJob(w, id, req.LeaseID)
+	if !ok {
+		return
+	}
+	if !h.finishJob(job, true, req.Result, "", "") {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": scheduler.ErrJobChanged.Error()})
+		return
 	}
-	h.store.Update(job)
-	h.sched.OnJobComplete(id, job.WorkerID)
 	respondJSON(w, http.StatusOK, job)
 }
 
-// register worker handles post /workers (worker registration)
+// nack job handles post /jobs/:id/nack (pull worker gives the job up). with requeue the job goes
+// straight back to the queue (e.g. worker shutting down), otherwise it is a failed attempt.
+func (h *Handler) NackJob(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		LeaseID    string `json:"lease_id"`
+		Result     string `json:"result,omitempty"` // output so far, kept when the job was cancelled
+		Error      string `json:"error,omitempty"`
+		ErrorClass string `json:"error_class,omitempty"`
+		Requeue    bool   `json:"requeue,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LeaseID == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "lease_id required"})
+		return
+	}
+	job, ok := h.leasedJob(w, id, req.LeaseID)
+	if !ok {
+		return
+	}
+	if req.Requeue {
+		if !h.sched.Requeue(job) {
+			respondJSON(w, http.StatusConflict, map[string]string{"error": scheduler.ErrJobChanged.Error()})
+			return
+		}
+		log.Printf("event=job_nacked job_id=%s requeue=true", id)
+		respondJSON(w, http.StatusOK, job)
+		return
+	}
+	if !h.finishJob(job, false, req.Result, req.Error, req.ErrorClass) {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": scheduler.ErrJobChanged.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, job)
+}
+
+// leased job returns the running job read under its lease, or writes the error response
+func (h *Handler) leasedJob(w http.ResponseWriter, id, leaseID string) (*models.Job, bool) {
+	if _, ok := h.store.Get(id); !ok {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return nil, false
+	}
+	job, err := h.sched.LeasedJob(id, leaseID)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if job.Status != models.JobStatusRunning {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "job not running"})
+		return nil, false
+	}
+	return job, true
+}
+
+// heartbeat handles post /workers/heartbeat: the worker is alive and reports its capacity and slots
 func (h *Handler) Heartbeat(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ID string `json:"id"`
+		ID       string   `json:"id"`
+		Capacity int      `json:"capacity,omitempty"`
+		Running  []string `json:"running"` // job ids in the worker's slots; omit to leave the api's view alone
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
 		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "id required"})
 		return
 	}
-	worker, ok := h.workers.Get(req.ID)
+	if req.Capacity < 0 || req.Capacity > maxWorkerCapacity {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "capacity must be between 1 and " + strconv.Itoa(maxWorkerCapacity)})
+		return
+	}
+	worker, ok := h.sched.WorkerHeartbeat(req.ID, req.Capacity, req.Running)
 	if !ok {
 		respondJSON(w, http.StatusNotFound, map[string]string{"error": "worker not found"})
 		return
 	}
-	worker.LastHeartbeat = timeNow()
-	h.workers.Register(worker)
-	log.Printf("event=worker_heartbeat worker_id=%s", req.ID)
+	log.Printf("event=worker_heartbeat worker_id=%s slots_used=%d/%d", req.ID, len(worker.RunningJobs), worker.Slots())
 	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
-// register worker handles post /workers
+// register worker handles post /workers. an empty endpoint registers a pull worker that leases jobs.
 func (h *Handler) RegisterWorker(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ID       string `json:"id"`
-		Endpoint string `json:"endpoint"`
+		ID       string            `json:"id"`
+		Endpoint string            `json:"endpoint,omitempty"`
+		Weight   int               `json:"weight,omitempty"`
+		Capacity int               `json:"capacity,omitempty"`
+		JobTypes []string          `json:"job_types,omitempty"`
+		Labels   map[string]string `json:"labels,omitempty"`
+		MemoryMB int               `json:"memory_mb,omitempty"`
+		CPUs     int               `json:"cpus,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == "" && req.Endpoint == "") {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "id or endpoint required"})
+		return
+	}
+	if req.Weight < 0 || req.Weight > 1000 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "weight must be between 1 and 1000"})
+		return
+	}
+	if req.Capacity < 0 || req.Capacity > maxWorkerCapacity {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "capacity must be between 1 and " + strconv.Itoa(maxWorkerCapacity)})
+		return
+	}
+	if req.Capacity == 0 {
+		req.Capacity = 1
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "id and endpoint required"})
+	if req.MemoryMB < 0 || req.CPUs < 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "memory_mb and cpus must not be negative"})
 		return
 	}
 	if req.ID == "" {
 		req.ID = models.MustGenerateID()
 	}
-	worker := &models.Worker{ID: req.ID, Endpoint: req.Endpoint, Status: models.WorkerStatusIdle}
+	worker := &models.Worker{ID: req.ID, Endpoint: req.Endpoint, Status: models.WorkerStatusIdle, Capacity: req.Capacity, Weight: req.Weight,
+		JobTypes: req.JobTypes, Labels: req.Labels, MemoryMB: req.MemoryMB, CPUs: req.CPUs}
 	worker.LastHeartbeat = timeNow()
 	h.workers.Register(worker)
-	log.Printf("event=worker_registered worker_id=%s endpoint=%s", worker.ID, worker.Endpoint)
+	h.sched.Wake()
+	log.Printf("event=worker_registered worker_id=%s endpoint=%s capacity=%d weight=%d job_types=%s labels=%v", worker.ID, worker.Endpoint, worker.Capacity, worker.Weight, strings.Join(worker.JobTypes, ","), worker.Labels)
+	h.sched.Events().Publish(events.Event{Type: events.WorkerRegistered, WorkerID: worker.ID})
 	respondJSON(w, http.StatusOK, worker)
 }
 
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+// new test handler returns a handler on in-memory stores with a scheduler that is not started,
+// so submitted jobs stay queued
+func newTestHandler(t *testing.T, cfg *HandlerConfig) (*Handler, *scheduler.Scheduler) {
+	t.Helper()
+	store := models.NewJobStore()
+	queue := scheduler.NewQueue()
+	workers := models.NewWorkerRegistry()
+	sched := scheduler.New(queue, store, workers, models.NewScheduleStore(), nil)
+	return NewHandler(store, queue, workers, sched, cfg), sched
+}
+
+// do sends one request through the handler; header pairs are name, value
+func do(t *testing.T, h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body.String(), err)
+	}
+	return v
+}
+
+func submitJob(t *testing.T, h http.Handler, body string) *models.Job {
+	t.Helper()
+	w := do(t, h, http.MethodPost, "/jobs", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit %s: %d %s", body, w.Code, w.Body)
+	}
+	return decode[*models.Job](t, w)
+}
+
+type jobPage struct {
+	Jobs       []*models.Job `json:"jobs"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+func TestListJobsFollowsNextCursor(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for i := 0; i < 7; i++ {
+		submitJob(t, h, fmt.Sprintf(`{"payload":"p","priority":%d}`, i%3))
+	}
+	for _, params := range []string{"order=asc", "sort=priority", "sort=finished_at&order=asc"} {
+		all := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?"+params, ""))
+		var want, got []string
+		for _, j := range all.Jobs {
+			want = append(want, j.ID)
+		}
+		page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?limit=3&"+params, ""))
+		for pages := 1; ; pages++ {
+			if page.Total != 7 {
+				t.Fatalf("%s: total = %d, want 7", params, page.Total)
+			}
+			for _, j := range page.Jobs {
+				got = append(got, j.ID)
+			}
+			if page.NextCursor == "" {
+				if pages != 3 {
+					t.Fatalf("%s: %d pages of 3 for 7 jobs", params, pages)
+				}
+				break
+			}
+			page = decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?limit=3&"+params+"&cursor="+url.QueryEscape(page.NextCursor), ""))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: pages %v, want %v", params, got, want)
+		}
+	}
+}
+
+func TestListJobsRejectsForeignCursors(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for i := 0; i < 3; i++ {
+		submitJob(t, h, `{"payload":"p"}`)
+	}
+	page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?limit=1", ""))
+	for _, target := range []string{
+		"/jobs?limit=1&sort=priority&cursor=" + page.NextCursor,
+		"/jobs?limit=1&order=asc&cursor=" + page.NextCursor,
+		"/jobs?limit=1&cursor=not-a-cursor",
+		// right sort, but the keys of another one
+		"/jobs?limit=1&cursor=" + encodeCursor(&models.JobCursor{Keys: []int64{1, 2}, ID: "x"}, models.SortByCreatedAt, true),
+	} {
+		if w := do(t, h, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestSubmitValidatesRetryPolicy(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p","retry":{"max_attempts":100}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("too many attempts: %d, want 400", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p","retry":{"retry_on":["oom"]}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown error class: %d, want 400", w.Code)
+	}
+	job := submitJob(t, h, `{"payload":"p","retry":{"max_attempts":5,"backoff":"fixed"}}`)
+	if p := job.RetryPolicy; p == nil || p.MaxAttempts != 5 || p.Backoff != models.BackoffFixed || len(p.RetryOn) != 3 {
+		t.Fatalf("stored policy = %+v, want normalized", p)
+	}
+}
+
+func TestRegisterAndHeartbeatWithCapacity(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for _, body := range []string{`{}`, `{"id":"w1","capacity":-1}`, `{"id":"w1","capacity":100000}`, `{"id":"w1","weight":1001}`} {
+		if w := do(t, h, http.MethodPost, "/workers", body); w.Code != http.StatusBadRequest {
+			t.Errorf("register %s: %d, want 400", body, w.Code)
+		}
+	}
+	w := do(t, h, http.MethodPost, "/workers", `{"id":"w1"}`)
+	if worker := decode[models.Worker](t, w); w.Code != http.StatusOK || worker.Capacity != 1 {
+		t.Fatalf("register without a capacity: %d capacity %d, want one slot", w.Code, worker.Capacity)
+	}
+	if w := do(t, h, http.MethodPost, "/workers", `{"id":"w1","capacity":4}`); w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+
+	if w := do(t, h, http.MethodPost, "/workers/heartbeat", `{"id":"w1","capacity":8,"running":["a","b"]}`); w.Code != http.StatusOK {
+		t.Fatalf("heartbeat: %d %s", w.Code, w.Body)
+	}
+	workers := decode[[]models.Worker](t, do(t, h, http.MethodGet, "/workers", ""))
+	if len(workers) != 1 || workers[0].Capacity != 8 || len(workers[0].RunningJobs) != 2 {
+		t.Fatalf("workers = %+v, want w1 with 8 slots and 2 running", workers)
+	}
+	if w := do(t, h, http.MethodPost, "/workers/heartbeat", `{"id":"nope"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("heartbeat of an unknown worker: %d, want 404", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/workers/heartbeat", `{"id":"w1","capacity":-1}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("heartbeat with a negative capacity: %d, want 400", w.Code)
+	}
+}
+
+func TestSubmitValidatesConstraints(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for _, body := range []string{
+		`{"payload":"p","constraints":{"min_cpus":-1}}`,
+		`{"payload":"p","constraints":{"node_selector":{"":"x"}}}`,
+	} {
+		if w := do(t, h, http.MethodPost, "/jobs", body); w.Code != http.StatusBadRequest {
+			t.Errorf("submit %s: %d, want 400", body, w.Code)
+		}
+	}
+	job := submitJob(t, h, `{"payload":"p","constraints":{"node_selector":{"zone":"a"},"min_memory_mb":512}}`)
+	if c := job.Constraints; c == nil || c.NodeSelector["zone"] != "a" || c.MinMemoryMB != 512 {
+		t.Fatalf("constraints = %+v", c)
+	}
+	if w := do(t, h, http.MethodPost, "/workers", `{"id":"w1","memory_mb":-1}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("register with negative memory: %d, want 400", w.Code)
+	}
+	w := do(t, h, http.MethodPost, "/workers", `{"id":"w1","job_types":["email"],"labels":{"zone":"a"},"memory_mb":1024,"cpus":2}`)
+	if worker := decode[models.Worker](t, w); worker.Labels["zone"] != "a" || worker.JobTypes[0] != "email" || worker.MemoryMB != 1024 || worker.CPUs != 2 {
+		t.Fatalf("registered worker = %+v", worker)
+	}
+}
+
+func TestCompleteRejectsStaleAttemptTokens(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	job := submitJob(t, h, `{"payload":"p"}`)
+	complete := func(token string) int {
+		return do(t, h, http.MethodPost, "/jobs/"+job.ID+"/complete", `{"success":true,"result":"done","attempt_token":"`+token+`"}`).Code
+	}
+	if w := do(t, h, http.MethodPost, "/jobs/nope/complete", `{"success":true}`); w.Code != http.StatusNotFound {
+		t.Fatalf("complete an unknown job: %d, want 404", w.Code)
+	}
+	if code := complete(""); code != http.StatusBadRequest {
+		t.Fatalf("complete a queued job: %d, want 400", code)
+	}
+
+	// the first attempt is given up on and the job leased again; its token is stale from then on
+	first := leaseJob(t, h, "w1")
+	do(t, h, http.MethodPost, "/jobs/"+job.ID+"/nack", `{"lease_id":"`+first.Lease.ID+`","requeue":true}`)
+	second := leaseJob(t, h, "w1")
+	if second.Job.AttemptToken == "" || second.Job.AttemptToken == first.Job.AttemptToken {
+		t.Fatalf("tokens %q then %q, want one per attempt", first.Job.AttemptToken, second.Job.AttemptToken)
+	}
+	for _, token := range []string{first.Job.AttemptToken, ""} {
+		if code := complete(token); code != http.StatusConflict {
+			t.Fatalf("complete with token %q: %d, want 409", token, code)
+		}
+	}
+	if got, _ := h.store.Get(job.ID); got.Status != models.JobStatusRunning || got.Result != "" {
+		t.Fatalf("job after stale completions = %s %q, want it still running", got.Status, got.Result)
+	}
+
+	if code := complete(second.Job.AttemptToken); code != http.StatusOK {
+		t.Fatalf("complete with the current token: %d, want 200", code)
+	}
+	if got, _ := h.store.Get(job.ID); got.Status != models.JobStatusCompleted || got.Result != "done" {
+		t.Fatalf("job = %s %q, want completed", got.Status, got.Result)
+	}
+	if code := complete(second.Job.AttemptToken); code != http.StatusBadRequest {
+		t.Fatalf("complete a finished job: %d, want 400", code)
+	}
+}
+
+func TestSubmitClampsPriorityToTheRange(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for body, want := range map[string]int{`{"payload":"p"}`: models.PriorityNormal, `{"payload":"p","priority":9}`: models.PriorityLow, `{"payload":"p","priority":-3}`: models.PriorityHigh} {
+		if job := submitJob(t, h, body); job.Priority != want {
+			t.Fatalf("%s: priority %d, want %d", body, job.Priority, want)
+		}
+	}
+
+	h, _ = newTestHandler(t, &HandlerConfig{Priorities: models.PriorityRange{Min: -10, Max: 10}})
+	for body, want := range map[string]int{`{"payload":"p"}`: 0, `{"payload":"p","priority":9}`: 9, `{"payload":"p","priority":-30}`: -10} {
+		if job := submitJob(t, h, body); job.Priority != want {
+			t.Fatalf("%s in -10..10: priority %d, want %d", body, job.Priority, want)
+		}
+	}
+}
+
+func TestMetricsReportQueueWaitByPriority(t *testing.T) {
+	h, sched := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	submitJob(t, h, `{"payload":"p","priority":0}`)
+	leaseJob(t, h, "w1")
+	submitJob(t, h, `{"payload":"p","priority":2}`)
+	if sched.WaitStats()[models.PriorityHigh].Count != 1 {
+		t.Fatalf("wait stats = %+v, want the leased job counted", sched.WaitStats())
+	}
+
+	body := do(t, h, http.MethodGet, "/metrics", "").Body.String()
+	for _, want := range []string{
+		`job_queue_wait_seconds_count{priority="0"} 1`,
+		`job_queue_wait_seconds_count{priority="2"} 0`,
+		`job_queue_wait_max_seconds{priority="0"} `,
+		`job_queue_oldest_wait_seconds{priority="0"} 0.00`,
+		`job_queue_oldest_wait_seconds{priority="2"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestReprioritizeAndPosition(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	first := submitJob(t, h, `{"payload":"p"}`)
+	second := submitJob(t, h, `{"payload":"p"}`)
+	pos := decode[models.JobPosition](t, do(t, h, http.MethodGet, "/jobs/"+second.ID+"/position", ""))
+	if pos.JobID != second.ID || pos.Position != 2 || pos.QueueDepth != 2 || pos.Priority != models.PriorityNormal || pos.EstimatedStartAt != nil {
+		t.Fatalf("position = %+v, want second of 2 with no estimate yet", pos)
+	}
+
+	for body, want := range map[string]int{`{}`: http.StatusBadRequest, `{"priority":`: http.StatusBadRequest} {
+		if w := do(t, h, http.MethodPatch, "/jobs/"+second.ID, body); w.Code != want {
+			t.Fatalf("patch %s: %d, want %d", body, w.Code, want)
+		}
+	}
+	if w := do(t, h, http.MethodPatch, "/jobs/nope", `{"priority":0}`); w.Code != http.StatusNotFound {
+		t.Fatalf("patch an unknown job: %d, want 404", w.Code)
+	}
+	// out of range is clamped, and the job goes to the front
+	w := do(t, h, http.MethodPatch, "/jobs/"+second.ID, `{"priority":-5}`)
+	if job := decode[*models.Job](t, w); w.Code != http.StatusOK || job.Priority != models.PriorityHigh {
+		t.Fatalf("patch: %d priority %d, want 200 and high", w.Code, job.Priority)
+	}
+	for id, want := range map[string]int{second.ID: 1, first.ID: 2} {
+		if pos := decode[models.JobPosition](t, do(t, h, http.MethodGet, "/jobs/"+id+"/position", "")); pos.Position != want {
+			t.Fatalf("position of %s = %d, want %d", id, pos.Position, want)
+		}
+	}
+
+	// a job that started can't be moved and has no position
+	registerPullWorker(t, h, "w1")
+	leased := leaseJob(t, h, "w1")
+	if w := do(t, h, http.MethodPatch, "/jobs/"+leased.Job.ID, `{"priority":2}`); w.Code != http.StatusConflict || decode[map[string]string](t, w)["status"] != "running" {
+		t.Fatalf("patch a running job: %d %s, want 409 with its status", w.Code, w.Body)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs/"+leased.Job.ID+"/position", ""); w.Code != http.StatusConflict {
+		t.Fatalf("position of a running job: %d, want 409", w.Code)
+	}
+	// other tenants don't see the job
+	if w := do(t, h, http.MethodPatch, "/jobs/"+first.ID, `{"priority":0}`, "X-Tenant", "other"); w.Code != http.StatusNotFound {
+		t.Fatalf("patch from another tenant: %d, want 404", w.Code)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs/"+first.ID+"/position", "", "X-Tenant", "other"); w.Code != http.StatusNotFound {
+		t.Fatalf("position from another tenant: %d, want 404", w.Code)
+	}
+}
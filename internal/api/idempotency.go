@@ -1,41 +1,93 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
 	"sync"
 	"time"
+
+	"cloud/pkg/models"
 )
 
-type idemEntry struct {
-	jobID     string
-	expiresAt time.Time
-}
+// expired idempotency keys are deleted this often
+const idempotencySweepInterval = time.Minute
 
-// idempotency stores idempotency key -> job id with ttl
+var errIdempotencyConflict = errors.New("idempotency key was already used with a different request")
+
+// idempotency makes post /jobs with X-Idempotency-Key safe to retry. the first request's job is
+// recorded under the key with a fingerprint of the request; a retry with the same request gets
+// that job back and one with a different request is refused. records live in a store next to the
+// jobs, so retries after a restart are still recognized.
 type idempotency struct {
-	mu   sync.RWMutex
-	keys map[string]idemEntry
-	ttl  time.Duration
+	mu    sync.Mutex // held from lookup to record, so concurrent retries create one job
+	store *models.IdempotencyStore
+	ttl   time.Duration
 }
 
-func newIdempotency(ttl time.Duration) *idempotency {
+func newIdempotency(store *models.IdempotencyStore, ttl time.Duration) *idempotency {
 	if ttl <= 0 {
 		ttl = 24 * time.Hour
 	}
-	return &idempotency{keys: make(map[string]idemEntry), ttl: ttl}
+	return &idempotency{store: store, ttl: ttl}
 }
 
-func (i *idempotency) get(key string) (jobID string, ok bool) {
-	i.mu.RLock()
-	defer i.mu.RUnlock()
-	e, ok := i.keys[key]
-	if !ok || time.Now().After(e.expiresAt) {
-		return "", false
+// submit returns the job recorded under key, or errIdempotencyConflict when it was recorded for a
+// different request. otherwise it runs create and records the new job. existing reports a replay.
+func (i *idempotency) submit(key, fingerprint string, jobs *models.JobStore, create func() (*models.Job, error)) (job *models.Job, existing bool, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if rec, ok := i.store.Get(key); ok {
+		if rec.Fingerprint != fingerprint {
+			return nil, false, errIdempotencyConflict
+		}
+		if job, ok := jobs.Get(rec.JobID); ok {
+			return job, true, nil
+		}
+		// the job itself is gone, e.g. jobs kept in memory across a restart; make it again
+	}
+	job, err = create()
+	if err != nil {
+		return nil, false, err
 	}
-	return e.jobID, true
+	now := time.Now()
+	i.store.Save(&models.IdempotencyRecord{Key: key, Fingerprint: fingerprint, JobID: job.ID, CreatedAt: now, ExpiresAt: now.Add(i.ttl)})
+	return job, false, nil
 }
 
-func (i *idempotency) set(key, jobID string) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	i.keys[key] = idemEntry{jobID: jobID, expiresAt: time.Now().Add(i.ttl)}
+// sweep deletes expired keys until stop is closed
+func (i *idempotency) sweep(stop <-chan struct{}) {
+	t := time.NewTicker(idempotencySweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if n := i.store.Sweep(); n > 0 {
+				log.Printf("event=idempotency_keys_expired count=%d", n)
+			}
+		}
+	}
+}
+
+// idempotency scope returns the namespace a request's idempotency keys live in, so clients can't
+// collide with, or see, each other's jobs: the tenant for keys confined to one (shared by all of
+// its keys), the api key otherwise, and the tenant when auth is off
+func idempotencyScope(r *http.Request) string {
+	if key := apiKeyOf(r); key != nil && key.Tenant == "" {
+		return "key:" + key.ID
+	}
+	return "tenant:" + models.TenantOrDefault(tenantOf(r))
+}
+
+// request fingerprint is the hex sha-256 of the request re-encoded as json, so formatting and
+// field order don't matter
+func requestFingerprint(req *models.SubmitJobRequest) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/internal/auth"
+	"cloud/internal/scheduler"
+	"cloud/internal/storage"
+	"cloud/pkg/models"
+)
+
+func TestIdempotentSubmit(t *testing.T) {
+	h, _ := newTestHandler(t, &HandlerConfig{IdempotencyTTLSec: 60})
+	t.Cleanup(h.CloseStreams)
+	submit := func(body string, header ...string) (int, *models.Job) {
+		w := do(t, h, http.MethodPost, "/jobs", body, header...)
+		if w.Code >= 300 {
+			return w.Code, nil
+		}
+		return w.Code, decode[*models.Job](t, w)
+	}
+
+	code, first := submit(`{"type":"email","payload":"p"}`, "X-Idempotency-Key", "k1")
+	if code != http.StatusAccepted {
+		t.Fatalf("first submit: %d", code)
+	}
+	// formatting and field order don't change the request
+	code, again := submit(`{ "payload": "p",  "type": "email" }`, "X-Idempotency-Key", "k1")
+	if code != http.StatusOK || again.ID != first.ID {
+		t.Fatalf("retry: %d %v, want 200 with job %s", code, again, first.ID)
+	}
+	if code, _ := submit(`{"type":"email","payload":"other"}`, "X-Idempotency-Key", "k1"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("reuse with a different payload: %d, want 422", code)
+	}
+	// keys are scoped per tenant
+	if code, job := submit(`{"type":"email","payload":"p"}`, "X-Idempotency-Key", "k1", "X-Tenant", "team-a"); code != http.StatusAccepted || job.ID == first.ID {
+		t.Fatalf("same key in another tenant: %d, want a new job", code)
+	}
+	if code, job := submit(`{"type":"email","payload":"p"}`); code != http.StatusAccepted || job.ID == first.ID {
+		t.Fatalf("submit without a key: %d, want a new job", code)
+	}
+}
+
+func TestIdempotencyKeysAreScopedPerAPIKey(t *testing.T) {
+	a := auth.New(models.NewAPIKeyStore(), auth.Config{AdminKey: "admin-secret"})
+	h, _ := newTestHandler(t, &HandlerConfig{Auth: a, IdempotencyTTLSec: 60})
+	t.Cleanup(h.CloseStreams)
+	newKey := func(body string) string {
+		return decode[models.APIKey](t, do(t, h, http.MethodPost, "/keys", body, "Authorization", "Bearer admin-secret")).Key
+	}
+	k1, k2 := newKey(`{"name":"a","role":"submitter"}`), newKey(`{"name":"b","role":"submitter"}`)
+	t1, t2 := newKey(`{"name":"c","role":"submitter","tenant":"team-a"}`), newKey(`{"name":"d","role":"submitter","tenant":"team-a"}`)
+	submit := func(key string) *models.Job {
+		return decode[*models.Job](t, do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, "Authorization", "Bearer "+key, "X-Idempotency-Key", "k"))
+	}
+
+	if submit(k1).ID == submit(k2).ID {
+		t.Fatal("two unconfined api keys share idempotency keys")
+	}
+	// keys confined to one tenant share its scope
+	if submit(t1).ID != submit(t2).ID {
+		t.Fatal("two keys of one tenant don't share idempotency keys")
+	}
+}
+
+func TestIdempotencyKeysSurviveARestart(t *testing.T) {
+	dir := t.TempDir()
+	jobs := models.NewJobStore()
+	start := func() (*Handler, *storage.IdempotencyLog) {
+		keys, err := storage.OpenIdempotencyLog(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue, workers := scheduler.NewQueue(), models.NewWorkerRegistry()
+		sched := scheduler.New(queue, jobs, workers, models.NewScheduleStore(), nil)
+		h := NewHandler(jobs, queue, workers, sched, &HandlerConfig{IdempotencyTTLSec: 60, Idempotency: models.NewIdempotencyStoreWithBackend(keys)})
+		t.Cleanup(h.CloseStreams)
+		return h, keys
+	}
+
+	h, keys := start()
+	first := decode[*models.Job](t, do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, "X-Idempotency-Key", "k1"))
+	keys.Close()
+
+	h, keys = start()
+	defer keys.Close()
+	w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, "X-Idempotency-Key", "k1")
+	if again := decode[*models.Job](t, w); w.Code != http.StatusOK || again.ID != first.ID {
+		t.Fatalf("retry after a restart: %d %s, want 200 with job %s", w.Code, again.ID, first.ID)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"q"}`, "X-Idempotency-Key", "k1"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("conflicting retry after a restart: %d, want 422", w.Code)
+	}
+}
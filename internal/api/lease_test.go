@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+type leaseResponse struct {
+	Job   *models.Job      `json:"job"`
+	Lease *scheduler.Lease `json:"lease"`
+}
+
+// lease job leases one job for the worker through post /workers/lease
+func leaseJob(t *testing.T, h http.Handler, workerID string) leaseResponse {
+	t.Helper()
+	w := do(t, h, http.MethodPost, "/workers/lease", `{"worker_id":"`+workerID+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("lease: %d %s", w.Code, w.Body)
+	}
+	return decode[leaseResponse](t, w)
+}
+
+// register pull worker registers a worker without an endpoint, which leases its jobs
+func registerPullWorker(t *testing.T, h http.Handler, id string) {
+	t.Helper()
+	if w := do(t, h, http.MethodPost, "/workers", `{"id":"`+id+`"}`); w.Code >= 300 {
+		t.Fatalf("register %s: %d %s", id, w.Code, w.Body)
+	}
+}
+
+func TestLeaseAndAck(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/workers/lease", `{"worker_id":"nobody"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("lease for an unknown worker: %d, want 404", w.Code)
+	}
+	registerPullWorker(t, h, "w1")
+	if w := do(t, h, http.MethodPost, "/workers/lease", `{"worker_id":"w1"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("lease on an empty queue: %d, want 204", w.Code)
+	}
+	job := submitJob(t, h, `{"payload":"p"}`)
+	got := leaseJob(t, h, "w1")
+	if got.Job.ID != job.ID || got.Lease.JobID != job.ID || got.Job.Status != models.JobStatusRunning {
+		t.Fatalf("lease = %+v %+v", got.Job, got.Lease)
+	}
+
+	if w := do(t, h, http.MethodPost, "/jobs/"+job.ID+"/ack", `{"lease_id":"wrong"}`); w.Code != http.StatusConflict {
+		t.Fatalf("ack with another lease: %d, want 409", w.Code)
+	}
+	w := do(t, h, http.MethodPost, "/jobs/"+job.ID+"/lease", `{"lease_id":"`+got.Lease.ID+`","visibility_sec":120}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("extend: %d %s", w.Code, w.Body)
+	}
+	extended := decode[scheduler.Lease](t, w)
+	if running := decode[*models.Job](t, do(t, h, http.MethodGet, "/jobs/"+job.ID, "")); running.LeaseExpiresAt == nil || !running.LeaseExpiresAt.Equal(extended.ExpiresAt) {
+		t.Fatalf("job lease_expires_at = %v, want the extended %v", running.LeaseExpiresAt, extended.ExpiresAt)
+	}
+	w = do(t, h, http.MethodPost, "/jobs/"+job.ID+"/ack", `{"lease_id":"`+got.Lease.ID+`","result":"done"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ack: %d %s", w.Code, w.Body)
+	}
+	if done := decode[*models.Job](t, w); done.Status != models.JobStatusCompleted || done.Result != "done" {
+		t.Fatalf("acked job = %s %q", done.Status, done.Result)
+	}
+	// the lease ended with the ack
+	if w := do(t, h, http.MethodPost, "/jobs/"+job.ID+"/ack", `{"lease_id":"`+got.Lease.ID+`"}`); w.Code != http.StatusConflict {
+		t.Fatalf("second ack: %d, want 409", w.Code)
+	}
+}
+
+func TestNack(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	job := submitJob(t, h, `{"payload":"p","retry":{"max_attempts":1}}`)
+
+	first := leaseJob(t, h, "w1")
+	w := do(t, h, http.MethodPost, "/jobs/"+job.ID+"/nack", `{"lease_id":"`+first.Lease.ID+`","requeue":true}`)
+	if w.Code != http.StatusOK || decode[*models.Job](t, w).Status != models.JobStatusQueued {
+		t.Fatalf("nack with requeue: %d %s", w.Code, w.Body)
+	}
+
+	second := leaseJob(t, h, "w1")
+	if second.Job.ID != job.ID {
+		t.Fatalf("re-leased %s, want %s", second.Job.ID, job.ID)
+	}
+	w = do(t, h, http.MethodPost, "/jobs/"+job.ID+"/nack", `{"lease_id":"`+second.Lease.ID+`","error":"boom"}`)
+	failed := decode[*models.Job](t, w)
+	if w.Code != http.StatusOK || failed.Status != models.JobStatusFailed || failed.Error != "boom" {
+		t.Fatalf("nack: %d %s %q", w.Code, failed.Status, failed.Error)
+	}
+}
+
+func TestReregisteringKeepsTheWorkersRunningJobs(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	registerPullWorker(t, h, "w1")
+	job := submitJob(t, h, `{"payload":"p"}`)
+	got := leaseJob(t, h, "w1")
+
+	w := do(t, h, http.MethodPost, "/workers", `{"id":"w1","capacity":2,"labels":{"zone":"a"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register again: %d %s", w.Code, w.Body)
+	}
+	if worker := decode[models.Worker](t, w); len(worker.RunningJobs) != 1 || worker.RunningJobs[0] != job.ID || worker.Capacity != 2 || worker.Labels["zone"] != "a" {
+		t.Fatalf("worker after registering again = %+v, want the new details and %s still running", worker, job.ID)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs/"+job.ID+"/ack", `{"lease_id":"`+got.Lease.ID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("ack: %d %s", w.Code, w.Body)
+	}
+	if workers := decode[[]models.Worker](t, do(t, h, http.MethodGet, "/workers", "")); len(workers[0].RunningJobs) != 0 {
+		t.Fatalf("slot not freed by the ack: %v", workers[0].RunningJobs)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud/internal/ratelimit"
+	"cloud/pkg/models"
+)
+
+// rate class returns the bucket class of a request, or "" for routes that are never limited:
+// health, readiness, the dashboard page, the worker endpoints and /ratelimit itself, so an admin
+// can always loosen a limit that locks clients out
+func rateClass(method, path string, parts []string) ratelimit.Class {
+	switch need := routeRole(method, path, parts); {
+	case need == "" || need == models.RoleWorker || path == "ratelimit":
+		return ""
+	case method == http.MethodGet:
+		return ratelimit.ClassRead
+	default:
+		return ratelimit.ClassSubmit
+	}
+}
+
+// rate limit takes a token from the client's bucket for the class and reports the bucket in
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (seconds until it is full). an
+// empty bucket gets 429 with Retry-After.
+func (h *Handler) rateLimit(w http.ResponseWriter, r *http.Request, key *models.APIKey, class ratelimit.Class) bool {
+	if h.limiter == nil || class == "" {
+		return true
+	}
+	res, ok := h.limiter.Take(class, h.clientOf(r, key))
+	if !ok {
+		return true
+	}
+	hdr := w.Header()
+	hdr.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	hdr.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	hdr.Set("X-RateLimit-Reset", ceilSeconds(res.Reset))
+	if !res.Allowed {
+		hdr.Set("Retry-After", ceilSeconds(res.RetryAfter))
+		respondJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+		return false
+	}
+	return true
+}
+
+// client of names the bucket a request draws from, by the limiter's key_by. requests without a
+// tenant fall back to their api key, and requests without a key to their ip.
+func (h *Handler) clientOf(r *http.Request, key *models.APIKey) string {
+	switch h.limiter.KeyBy() {
+	case ratelimit.KeyByTenant:
+		if t := tenantOf(r); t != "" {
+			return "tenant:" + t
+		}
+		fallthrough
+	case ratelimit.KeyByAPIKey:
+		if key != nil {
+			return "key:" + key.ID
+		}
+	}
+	return "ip:" + h.clientIP(r)
+}
+
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.trustXFF {
+		if v := r.Header.Get("X-Forwarded-For"); v != "" {
+			first, _, _ := strings.Cut(v, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// get rate limit handles get /ratelimit, the limiter's current config
+func (h *Handler) GetRateLimit(w http.ResponseWriter, _ *http.Request) {
+	if h.limiter == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "rate limiting is not enabled"})
+		return
+	}
+	respondJSON(w, http.StatusOK, h.limiter.Config())
+}
+
+// set rate limit handles put /ratelimit. the body is laid over the current config, so key_by or
+// a single class's rule can be changed alone. takes effect at once, without a restart.
+func (h *Handler) SetRateLimit(w http.ResponseWriter, r *http.Request) {
+	if h.limiter == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "rate limiting is not enabled"})
+		return
+	}
+	cfg := h.limiter.Config()
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := h.limiter.SetConfig(cfg); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	cfg = h.limiter.Config()
+	log.Printf("event=rate_limit_changed key_by=%s submit_per_min=%d submit_burst=%d read_per_min=%d read_burst=%d", cfg.KeyBy,
+		cfg.Rules[ratelimit.ClassSubmit].PerMinute, cfg.Rules[ratelimit.ClassSubmit].Burst,
+		cfg.Rules[ratelimit.ClassRead].PerMinute, cfg.Rules[ratelimit.ClassRead].Burst)
+	respondJSON(w, http.StatusOK, cfg)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud/internal/ratelimit"
+)
+
+func newLimitedHandler(t *testing.T, cfg ratelimit.Config, trustXFF bool) *Handler {
+	t.Helper()
+	l, err := ratelimit.NewLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := newTestHandler(t, &HandlerConfig{RateLimit: l, TrustForwardedFor: trustXFF})
+	return h
+}
+
+func TestRateClass(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		want         ratelimit.Class
+	}{
+		{http.MethodGet, "health", ""},
+		{http.MethodGet, "dashboard", ""},
+		{http.MethodPost, "workers/heartbeat", ""},
+		{http.MethodPost, "jobs/j1/complete", ""},
+		{http.MethodPut, "ratelimit", ""},
+		{http.MethodGet, "ratelimit", ""},
+		{http.MethodGet, "jobs", ratelimit.ClassRead},
+		{http.MethodGet, "events", ratelimit.ClassRead},
+		{http.MethodPost, "jobs", ratelimit.ClassSubmit},
+		{http.MethodDelete, "jobs/j1", ratelimit.ClassSubmit},
+		{http.MethodPost, "keys", ratelimit.ClassSubmit},
+	} {
+		if got := rateClass(tc.method, tc.path, strings.Split(tc.path, "/")); got != tc.want {
+			t.Errorf("rateClass(%s %s) = %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitHeadersAndRefusal(t *testing.T) {
+	h := newLimitedHandler(t, ratelimit.Config{KeyBy: ratelimit.KeyByIP, Rules: map[ratelimit.Class]ratelimit.Rule{
+		ratelimit.ClassSubmit: {PerMinute: 6, Burst: 2},
+		ratelimit.ClassRead:   {PerMinute: 60},
+	}}, false)
+
+	w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`)
+	if w.Code != http.StatusAccepted || w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != "1" || w.Header().Get("X-RateLimit-Reset") != "10" {
+		t.Fatalf("first submit: %d %v", w.Code, w.Header())
+	}
+	do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`)
+	w = do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("submit on an empty bucket: %d %v, want 429 with a token in 10s", w.Code, w.Header())
+	}
+
+	// reads draw from their own bucket; unlimited routes carry no headers
+	if w := do(t, h, http.MethodGet, "/jobs", ""); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "60" {
+		t.Fatalf("read: %d %v", w.Code, w.Header())
+	}
+	if w := do(t, h, http.MethodGet, "/health", ""); w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("health carries rate limit headers: %v", w.Header())
+	}
+}
+
+func TestRateLimitKeysByClient(t *testing.T) {
+	h := newLimitedHandler(t, ratelimit.Config{KeyBy: ratelimit.KeyByTenant, Rules: map[ratelimit.Class]ratelimit.Rule{
+		ratelimit.ClassSubmit: {PerMinute: 1},
+	}}, true)
+	submit := func(header ...string) int {
+		return do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, header...).Code
+	}
+	if submit("X-Tenant", "team-a") != http.StatusAccepted || submit("X-Tenant", "team-a") != http.StatusTooManyRequests {
+		t.Fatal("team-a's bucket did not hold one submit")
+	}
+	if submit("X-Tenant", "team-b") != http.StatusAccepted {
+		t.Fatal("team-b refused because of team-a's bucket")
+	}
+	// without a tenant or a key the client ip is the bucket, from X-Forwarded-For when trusted
+	if submit("X-Forwarded-For", "10.0.0.1, 10.9.9.9") != http.StatusAccepted || submit("X-Forwarded-For", "10.0.0.1") != http.StatusTooManyRequests {
+		t.Fatal("10.0.0.1's bucket did not hold one submit")
+	}
+	if submit("X-Forwarded-For", "10.0.0.2") != http.StatusAccepted {
+		t.Fatal("10.0.0.2 refused because of 10.0.0.1's bucket")
+	}
+}
+
+func TestSetRateLimitAtRuntime(t *testing.T) {
+	plain, _ := newTestHandler(t, nil)
+	if w := do(t, plain, http.MethodGet, "/ratelimit", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get /ratelimit without a limiter: %d, want 404", w.Code)
+	}
+	h := newLimitedHandler(t, ratelimit.Config{KeyBy: ratelimit.KeyByIP, Rules: map[ratelimit.Class]ratelimit.Rule{
+		ratelimit.ClassSubmit: {PerMinute: 1},
+	}}, false)
+	do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`)
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second submit: %d, want 429", w.Code)
+	}
+
+	if w := do(t, h, http.MethodPut, "/ratelimit", `{"rules":{"submit":{"per_minute":-5}}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid rule: %d, want 400", w.Code)
+	}
+	// the body is laid over the current config: read gets a rule, submit keeps its own
+	w := do(t, h, http.MethodPut, "/ratelimit", `{"rules":{"read":{"per_minute":100,"burst":20}}}`)
+	cfg := decode[ratelimit.Config](t, w)
+	if w.Code != http.StatusOK || cfg.KeyBy != ratelimit.KeyByIP || cfg.Rules[ratelimit.ClassSubmit].PerMinute != 1 || cfg.Rules[ratelimit.ClassRead].Burst != 20 {
+		t.Fatalf("put /ratelimit: %d %+v", w.Code, cfg)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs", ""); w.Header().Get("X-RateLimit-Limit") != "20" {
+		t.Fatalf("read after the change: %v, want the new rule applied at once", w.Header())
+	}
+	// turning submit off lets the exhausted client through
+	do(t, h, http.MethodPut, "/ratelimit", `{"rules":{"submit":{"per_minute":0}}}`)
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("submit with the limit off: %d, want 202", w.Code)
+	}
+}
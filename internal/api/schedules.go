@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+// create schedule handles post /schedules (recurring job from a cron expression)
+func (h *Handler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Cron == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "cron required"})
+		return
+	}
+	if err := h.checkCallback(req.Job.CallbackURL); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	p := h.priority(req.Job.Priority)
+	req.Job.Priority = &p
+	sch, err := h.sched.CreateSchedule(&req, tenantOf(r))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusCreated, sch)
+}
+
+// list schedules handles get /schedules
+func (h *Handler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	out := []*models.Schedule{}
+	for _, sch := range h.sched.Schedules() {
+		if visible(r, sch.Tenant) {
+			out = append(out, sch)
+		}
+	}
+	respondJSON(w, http.StatusOK, out)
+}
+
+// get schedule handles get /schedules/:id
+func (h *Handler) GetSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	sch, ok := h.ownSchedule(w, r, id)
+	if !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, sch)
+}
+
+// own schedule looks up a schedule the request may see, answering 404 when there is none
+func (h *Handler) ownSchedule(w http.ResponseWriter, r *http.Request, id string) (*models.Schedule, bool) {
+	sch, ok := h.sched.Schedule(id)
+	if !ok || !visible(r, sch.Tenant) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": scheduler.ErrScheduleNotFound.Error()})
+		return nil, false
+	}
+	return sch, true
+}
+
+// delete schedule handles delete /schedules/:id
+func (h *Handler) DeleteSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := h.ownSchedule(w, r, id); !ok {
+		return
+	}
+	if err := h.sched.DeleteSchedule(id); err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// pause schedule handles post /schedules/:id/pause
+func (h *Handler) PauseSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := h.ownSchedule(w, r, id); !ok {
+		return
+	}
+	sch, err := h.sched.PauseSchedule(id)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, sch)
+}
+
+// resume schedule handles post /schedules/:id/resume
+func (h *Handler) ResumeSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := h.ownSchedule(w, r, id); !ok {
+		return
+	}
+	sch, err := h.sched.ResumeSchedule(id)
+	if err == scheduler.ErrScheduleNotFound {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, sch)
+}
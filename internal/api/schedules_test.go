@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestSubmitDelayedJob(t *testing.T) {
+	h, sched := newTestHandler(t, nil)
+	for _, body := range []string{
+		`{"payload":"p","delay_sec":-1}`,
+		`{"payload":"p","delay_sec":31536001}`,
+		`{"payload":"p","delay_sec":10,"run_at":"2030-01-01T00:00:00Z"}`,
+		`{"payload":"p","run_at":"2999-01-01T00:00:00Z"}`,
+	} {
+		if w := do(t, h, http.MethodPost, "/jobs", body); w.Code != http.StatusBadRequest {
+			t.Errorf("submit %s: %d, want 400", body, w.Code)
+		}
+	}
+
+	before := time.Now()
+	job := submitJob(t, h, `{"payload":"p","delay_sec":60}`)
+	if job.Status != models.JobStatusScheduled || job.RunAt == nil || job.RunAt.Before(before.Add(time.Minute)) {
+		t.Fatalf("job = %s run_at %v, want scheduled a minute from now", job.Status, job.RunAt)
+	}
+	if sched.Delayed() != 1 {
+		t.Fatalf("delayed = %d, want 1", sched.Delayed())
+	}
+}
+
+func TestScheduleEndpoints(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/schedules", `{"job":{"payload":"p"}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("schedule without cron: %d, want 400", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/schedules", `{"cron":"* * *"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid cron: %d, want 400", w.Code)
+	}
+
+	w := do(t, h, http.MethodPost, "/schedules", `{"name":"nightly","cron":"@daily","timezone":"Europe/Berlin","job":{"payload":"p"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	sch := decode[models.Schedule](t, w)
+	if sch.NextRunAt == nil || sch.Job.Priority == nil || *sch.Job.Priority != models.PriorityNormal {
+		t.Fatalf("schedule = %+v, want a next run and the default priority", sch)
+	}
+	if list := decode[[]models.Schedule](t, do(t, h, http.MethodGet, "/schedules", "")); len(list) != 1 || list[0].ID != sch.ID {
+		t.Fatalf("list = %+v", list)
+	}
+
+	paused := decode[models.Schedule](t, do(t, h, http.MethodPost, "/schedules/"+sch.ID+"/pause", ""))
+	if !paused.Paused || paused.NextRunAt != nil {
+		t.Fatalf("paused = %+v", paused)
+	}
+	resumed := decode[models.Schedule](t, do(t, h, http.MethodPost, "/schedules/"+sch.ID+"/resume", ""))
+	if resumed.Paused || resumed.NextRunAt == nil {
+		t.Fatalf("resumed = %+v", resumed)
+	}
+
+	if w := do(t, h, http.MethodDelete, "/schedules/"+sch.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	for _, req := range [][2]string{
+		{http.MethodGet, "/schedules/" + sch.ID},
+		{http.MethodDelete, "/schedules/" + sch.ID},
+		{http.MethodPost, "/schedules/" + sch.ID + "/pause"},
+		{http.MethodPost, "/schedules/" + sch.ID + "/resume"},
+	} {
+		if w := do(t, h, req[0], req[1], ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s after delete: %d, want 404", req[0], req[1], w.Code)
+		}
+	}
+}
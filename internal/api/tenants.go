@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+type tenantContextKey struct{}
+
+// with tenant resolves the tenant a request acts for and stores it in the request context. a key
+// with a tenant confines the request to it. otherwise (admin and unconfined keys, or auth off) the
+// X-Tenant header or tenant query param picks one, and without either the request spans every
+// tenant and submits to the default one. answers 400 for an invalid name and 403 when a confined
+// key asks for another tenant.
+func withTenant(w http.ResponseWriter, r *http.Request, key *models.APIKey) (*http.Request, bool) {
+	asked := r.Header.Get("X-Tenant")
+	if asked == "" {
+		asked = r.URL.Query().Get("tenant")
+	}
+	if asked != "" {
+		if err := models.ValidateTenant(asked); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return r, false
+		}
+	}
+	tenant := asked
+	if key != nil && key.Tenant != "" {
+		if asked != "" && asked != key.Tenant {
+			respondJSON(w, http.StatusForbidden, map[string]string{"error": "api key is confined to tenant " + key.Tenant})
+			return r, false
+		}
+		tenant = key.Tenant
+	}
+	if tenant == "" {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)), true
+}
+
+// tenant of returns the tenant the request is confined to, or "" when it spans every tenant
+func tenantOf(r *http.Request) string {
+	t, _ := r.Context().Value(tenantContextKey{}).(string)
+	return t
+}
+
+// visible reports whether a request may see something owned by tenant
+func visible(r *http.Request, tenant string) bool {
+	t := tenantOf(r)
+	return t == "" || t == models.TenantOrDefault(tenant)
+}
+
+// tenant stats answers get /stats for a request confined to one tenant
+func (h *Handler) tenantStats(w http.ResponseWriter, tenant string) {
+	byStatus, total, successRate := summarize(h.store.CountByStatusFor(tenant))
+	dlq := 0
+	for _, job := range h.sched.ListDeadLetters() {
+		if models.TenantOrDefault(job.Tenant) == tenant {
+			dlq++
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"tenant":           tenant,
+		"quota":            h.sched.TenantQuota(tenant),
+		"queue_depth":      h.queue.DepthOf(tenant),
+		"workers":          len(h.workers.List()),
+		"jobs_total":       total,
+		"jobs_by_status":   byStatus,
+		"success_rate_pct": successRate,
+		"dlq_size":         dlq,
+		"uptime_seconds":   time.Since(h.startTime).Seconds(),
+	})
+}
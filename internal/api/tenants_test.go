@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/internal/auth"
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+func TestTenantHeaderScopesRequests(t *testing.T) {
+	h, sched := newTestHandler(t, nil)
+	sched.SetTenantQuotas(scheduler.TenantQuotas{Tenants: map[string]scheduler.TenantQuota{"team-a": {MaxQueued: 1}}})
+	registerPullWorker(t, h, "w1")
+	dead := deadLetterJob(t, h, "p")
+	mine := decode[*models.Job](t, do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, "X-Tenant", "team-a"))
+	other := submitJob(t, h, `{"payload":"p"}`)
+	if mine.Tenant != "team-a" || other.Tenant != models.DefaultTenant {
+		t.Fatalf("tenants = %q and %q, want team-a and the default", mine.Tenant, other.Tenant)
+	}
+
+	page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs", "", "X-Tenant", "team-a"))
+	if page.Total != 1 || page.Jobs[0].ID != mine.ID {
+		t.Fatalf("team-a lists %d jobs, want only its own", page.Total)
+	}
+	if page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?tenant=team-a", "")); page.Total != 1 {
+		t.Fatalf("tenant query param lists %d jobs, want 1", page.Total)
+	}
+	if page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs", "")); page.Total != 3 {
+		t.Fatalf("no tenant lists %d jobs, want every tenant's 3", page.Total)
+	}
+	for _, id := range []string{other.ID, dead.ID} {
+		if w := do(t, h, http.MethodGet, "/jobs/"+id, "", "X-Tenant", "team-a"); w.Code != http.StatusNotFound {
+			t.Fatalf("another tenant's job: %d, want 404", w.Code)
+		}
+		if w := do(t, h, http.MethodDelete, "/jobs/"+id, "", "X-Tenant", "team-a"); w.Code != http.StatusNotFound {
+			t.Fatalf("cancel another tenant's job: %d, want 404", w.Code)
+		}
+	}
+	if dlq := decode[jobPage](t, do(t, h, http.MethodGet, "/dlq", "", "X-Tenant", "team-a")); dlq.Total != 0 {
+		t.Fatalf("team-a sees %d dead letters, want none of the default tenant's", dlq.Total)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs", "", "X-Tenant", "Team A"); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid tenant: %d, want 400", w.Code)
+	}
+
+	// team-a is at its max_queued of 1; the default tenant is not limited
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, "X-Tenant", "team-a"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("submit past max_queued: %d, want 429", w.Code)
+	}
+	submitJob(t, h, `{"payload":"p"}`)
+
+	stats := decode[map[string]any](t, do(t, h, http.MethodGet, "/stats", "", "X-Tenant", "team-a"))
+	quota, _ := stats["quota"].(map[string]any)
+	if stats["tenant"] != "team-a" || stats["jobs_total"] != 1.0 || stats["queue_depth"] != 1.0 || stats["dlq_size"] != 0.0 || quota["max_queued"] != 1.0 {
+		t.Fatalf("team-a stats = %v", stats)
+	}
+	stats = decode[map[string]any](t, do(t, h, http.MethodGet, "/stats", ""))
+	if depths, _ := stats["queue_depth_by_tenant"].(map[string]any); depths["team-a"] != 1.0 || depths[models.DefaultTenant] != 2.0 {
+		t.Fatalf("queue depth by tenant = %v", stats["queue_depth_by_tenant"])
+	}
+}
+
+func TestTenantKeysAreConfined(t *testing.T) {
+	a := auth.New(models.NewAPIKeyStore(), auth.Config{AdminKey: "admin-secret"})
+	h, _ := newTestHandler(t, &HandlerConfig{Auth: a})
+	bearer := func(key string) []string { return []string{"Authorization", "Bearer " + key} }
+	newKey := func(body string) []string {
+		t.Helper()
+		w := do(t, h, http.MethodPost, "/keys", body, bearer("admin-secret")...)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create key %s: %d %s", body, w.Code, w.Body)
+		}
+		return bearer(decode[models.APIKey](t, w).Key)
+	}
+	if w := do(t, h, http.MethodPost, "/keys", `{"name":"x","role":"worker","tenant":"team-a"}`, bearer("admin-secret")...); w.Code != http.StatusBadRequest {
+		t.Fatalf("worker key with a tenant: %d, want 400", w.Code)
+	}
+	teamA := newKey(`{"name":"a","role":"submitter","tenant":"team-a"}`)
+	teamB := newKey(`{"name":"b","role":"viewer","tenant":"team-b"}`)
+
+	job := decode[*models.Job](t, do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, teamA...))
+	if job.Tenant != "team-a" {
+		t.Fatalf("job submitted with a team-a key has tenant %q", job.Tenant)
+	}
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p"}`, append(teamA, "X-Tenant", "team-b")...); w.Code != http.StatusForbidden {
+		t.Fatalf("confined key asking for another tenant: %d, want 403", w.Code)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs/"+job.ID, "", teamB...); w.Code != http.StatusNotFound {
+		t.Fatalf("team-b reads team-a's job: %d, want 404", w.Code)
+	}
+	if page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs", "", teamB...)); page.Total != 0 {
+		t.Fatalf("team-b lists %d jobs, want 0", page.Total)
+	}
+	// an admin key spans every tenant and may pick one
+	if w := do(t, h, http.MethodGet, "/jobs/"+job.ID, "", bearer("admin-secret")...); w.Code != http.StatusOK {
+		t.Fatalf("admin reads team-a's job: %d, want 200", w.Code)
+	}
+	if page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs", "", append(bearer("admin-secret"), "X-Tenant", "team-b")...)); page.Total != 0 {
+		t.Fatalf("admin scoped to team-b lists %d jobs, want 0", page.Total)
+	}
+}
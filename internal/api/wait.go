@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// longest a request may hold its connection waiting for a job; longer waits are cut to this
+const maxWait = 2 * time.Minute
+
+// parse wait reads the wait query param: a duration ("30s", "1m") or a number of seconds.
+// zero means don't wait.
+func parseWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, nerr := strconv.Atoi(v)
+		if nerr != nil {
+			return 0, fmt.Errorf("invalid wait %q: want a duration like 30s", v)
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid wait %q: must not be negative", v)
+	}
+	return min(d, maxWait), nil
+}
+
+// respond waited holds the request until the job reaches a final status, the wait runs out, the
+// client goes away or the api shuts down. it answers 200 with the final job, or 202 with the job as
+// it is when the wait ends first.
+func (h *Handler) respondWaited(w http.ResponseWriter, r *http.Request, id string, wait time.Duration) {
+	if job, ok := h.store.Get(id); !ok || !visible(r, job.Tenant) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	job, ok := h.sched.WaitFor(ctx, id)
+	if !ok {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+	if !job.Status.Final() {
+		respondJSON(w, http.StatusAccepted, job)
+		return
+	}
+	respondJSON(w, http.StatusOK, job)
+}
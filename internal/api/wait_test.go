@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestParseWait(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"":    0,
+		"0":   0,
+		"30s": 30 * time.Second,
+		"15":  15 * time.Second,
+		"1h":  maxWait,
+		"500": maxWait,
+	} {
+		got, err := parseWait(httptest.NewRequest(http.MethodGet, "/jobs/x?wait="+v, nil))
+		if err != nil || got != want {
+			t.Errorf("parseWait(%q) = %s %v, want %s", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"soon", "-1s", "-5"} {
+		if _, err := parseWait(httptest.NewRequest(http.MethodGet, "/jobs/x?wait="+v, nil)); err == nil {
+			t.Errorf("parseWait(%q) succeeded, want an error", v)
+		}
+	}
+}
+
+func TestWaitAnswersWithTheFinalJob(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	job := submitJob(t, h, `{"payload":"p"}`)
+
+	// the wait runs out first: 202 with the job as it is
+	w := do(t, h, http.MethodGet, "/jobs/"+job.ID+"?wait=20ms", "")
+	if got := decode[models.Job](t, w); w.Code != http.StatusAccepted || got.Status != models.JobStatusQueued {
+		t.Fatalf("wait that ran out: %d %s, want 202 queued", w.Code, got.Status)
+	}
+
+	// the job is cancelled while we wait: 200 with the final job, well before the wait is over
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		do(t, h, http.MethodDelete, "/jobs/"+job.ID, "")
+	}()
+	start := time.Now()
+	w = do(t, h, http.MethodGet, "/jobs/"+job.ID+"?wait=30s", "")
+	if got := decode[models.Job](t, w); w.Code != http.StatusOK || got.Status != models.JobStatusCancelled || time.Since(start) > 10*time.Second {
+		t.Fatalf("wait for a cancel: %d %s after %s, want 200 cancelled", w.Code, got.Status, time.Since(start))
+	}
+
+	if w := do(t, h, http.MethodGet, "/jobs/nope?wait=1s", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("wait for an unknown job: %d, want 404", w.Code)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs/"+job.ID+"?wait=soon", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid wait: %d, want 400", w.Code)
+	}
+}
+
+func TestSubmitWithWait(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/jobs?wait=-1s", `{"payload":"p"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("submit with an invalid wait: %d, want 400", w.Code)
+	}
+	// nothing runs it, so the wait runs out
+	w := do(t, h, http.MethodPost, "/jobs?wait=20ms", `{"payload":"p"}`)
+	if got := decode[models.Job](t, w); w.Code != http.StatusAccepted || got.ID == "" || got.Status != models.JobStatusQueued {
+		t.Fatalf("submit with wait: %d %+v, want 202 with the queued job", w.Code, got)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cloud/internal/webhook"
+	"cloud/pkg/models"
+)
+
+var errWebhooksDisabled = errors.New("webhooks are not enabled")
+
+// check callback validates a callback_url from a job, workflow or schedule submission
+func (h *Handler) checkCallback(url string) error {
+	if url == "" {
+		return nil
+	}
+	if h.webhooks == nil {
+		return errWebhooksDisabled
+	}
+	return h.webhooks.CheckCallback(url)
+}
+
+// create webhook handles post /webhooks. the response is the only one that includes the secret.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if h.webhooks == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": errWebhooksDisabled.Error()})
+		return
+	}
+	var req models.CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "url required"})
+		return
+	}
+	sub, err := h.webhooks.Subscribe(&req)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusCreated, sub)
+}
+
+// list webhooks handles get /webhooks
+func (h *Handler) ListWebhooks(w http.ResponseWriter, _ *http.Request) {
+	if h.webhooks == nil {
+		respondJSON(w, http.StatusOK, []*models.WebhookSubscription{})
+		return
+	}
+	respondJSON(w, http.StatusOK, h.webhooks.Subscriptions())
+}
+
+// get webhook handles get /webhooks/:id
+func (h *Handler) GetWebhook(w http.ResponseWriter, _ *http.Request, id string) {
+	if h.webhooks == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": webhook.ErrSubscriptionNotFound.Error()})
+		return
+	}
+	sub, ok := h.webhooks.Subscription(id)
+	if !ok {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": webhook.ErrSubscriptionNotFound.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, sub)
+}
+
+// delete webhook handles delete /webhooks/:id
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, _ *http.Request, id string) {
+	if h.webhooks == nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": webhook.ErrSubscriptionNotFound.Error()})
+		return
+	}
+	if err := h.webhooks.Unsubscribe(id); err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// job deliveries handles get /jobs/:id/deliveries, the webhook attempts made for the job
+func (h *Handler) JobDeliveries(w http.ResponseWriter, r *http.Request, id string) {
+	if job, ok := h.store.Get(id); !ok || !visible(r, job.Tenant) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+	deliveries := []webhook.Delivery{}
+	if h.webhooks != nil {
+		deliveries = h.webhooks.Deliveries(id)
+	}
+	respondJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/internal/webhook"
+	"cloud/pkg/models"
+)
+
+func TestWebhooksDisabledWithoutADispatcher(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p","callback_url":"https://example.com/hook"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("submit with callback_url: %d, want 400", w.Code)
+	}
+	if w := do(t, h, http.MethodPost, "/webhooks", `{"url":"https://example.com/hook"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("create webhook: %d, want 404", w.Code)
+	}
+	if list := decode[[]models.WebhookSubscription](t, do(t, h, http.MethodGet, "/webhooks", "")); len(list) != 0 {
+		t.Fatalf("webhooks = %+v", list)
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	d, err := webhook.New(models.NewWebhookStore(), webhook.Config{Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	h, _ := newTestHandler(t, &HandlerConfig{Webhooks: d})
+
+	if w := do(t, h, http.MethodPost, "/jobs", `{"payload":"p","callback_url":"http://127.0.0.1:9/hook"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("submit with an internal callback_url: %d, want 400", w.Code)
+	}
+	job := submitJob(t, h, `{"payload":"p","callback_url":"https://example.com/hook"}`)
+	if job.CallbackURL != "https://example.com/hook" {
+		t.Fatalf("callback_url = %q", job.CallbackURL)
+	}
+	if list := decode[[]webhook.Delivery](t, do(t, h, http.MethodGet, "/jobs/"+job.ID+"/deliveries", "")); len(list) != 0 {
+		t.Fatalf("deliveries of a queued job = %+v", list)
+	}
+	if w := do(t, h, http.MethodGet, "/jobs/nope/deliveries", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("deliveries of an unknown job: %d, want 404", w.Code)
+	}
+
+	for _, body := range []string{`{}`, `{"url":"http://localhost/hook"}`, `{"url":"https://example.com/hook","statuses":["queued"]}`} {
+		if w := do(t, h, http.MethodPost, "/webhooks", body); w.Code != http.StatusBadRequest {
+			t.Errorf("create webhook %s: %d, want 400", body, w.Code)
+		}
+	}
+	w := do(t, h, http.MethodPost, "/webhooks", `{"url":"https://example.com/hook","statuses":["failed"]}`)
+	sub := decode[models.WebhookSubscription](t, w)
+	if w.Code != http.StatusCreated || sub.Secret == "" {
+		t.Fatalf("create webhook: %d %+v, want the secret in the answer", w.Code, sub)
+	}
+	if got := decode[models.WebhookSubscription](t, do(t, h, http.MethodGet, "/webhooks/"+sub.ID, "")); got.ID != sub.ID || got.Secret != "" {
+		t.Fatalf("get webhook = %+v, want it without the secret", got)
+	}
+	if list := decode[[]models.WebhookSubscription](t, do(t, h, http.MethodGet, "/webhooks", "")); len(list) != 1 || list[0].Secret != "" {
+		t.Fatalf("webhooks = %+v", list)
+	}
+	if w := do(t, h, http.MethodDelete, "/webhooks/"+sub.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w := do(t, h, http.MethodGet, "/webhooks/"+sub.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: %d, want 404", w.Code)
+	}
+}
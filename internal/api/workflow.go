@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud/internal/scheduler"
+	"cloud/pkg/models"
+)
+
+// submit workflow handles post /workflows: a set of named jobs with depends_on edges, submitted together
+func (h *Handler) SubmitWorkflow(w http.ResponseWriter, r *http.Request) {
+	var req models.SubmitWorkflowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	ordered, err := req.Validate()
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, j := range ordered {
+		if err := h.checkCallback(j.CallbackURL); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("job %q: %v", j.Name, err)})
+			return
+		}
+		p := h.priority(j.Priority)
+		j.Priority = &p
+	}
+	wf, err := h.sched.SubmitWorkflow(&req, ordered, tenantOf(r))
+	if errors.Is(err, scheduler.ErrTenantQueueFull) {
+		respondJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusAccepted, wf)
+}
+
+// get workflow handles get /workflows/:id (overall status plus every job)
+func (h *Handler) GetWorkflow(w http.ResponseWriter, r *http.Request, id string) {
+	wf, err := h.sched.Workflow(id)
+	if err == nil && !visible(r, wf.Jobs[0].Tenant) {
+		err = scheduler.ErrWorkflowNotFound
+	}
+	if err == scheduler.ErrWorkflowNotFound {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, wf)
+}
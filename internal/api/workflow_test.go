@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+func TestSubmitWorkflow(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if w := do(t, h, http.MethodPost, "/workflows", `{"jobs":[{"name":"a","depends_on":["b"]},{"name":"b","depends_on":["a"]}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("cyclic workflow: %d, want 400", w.Code)
+	}
+	w := do(t, h, http.MethodPost, "/workflows", `{"on_failure":"skip","jobs":[{"name":"a","payload":"x"},{"name":"b","payload":"{{jobs.a.result}}","depends_on":["a"]}]}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit: %d %s", w.Code, w.Body)
+	}
+	wf := decode[models.Workflow](t, w)
+	if wf.Status != models.WorkflowStatusRunning || wf.OnFailure != models.OnFailureSkip || wf.Counts["queued"] != 1 || wf.Counts["pending"] != 1 {
+		t.Fatalf("workflow = %+v", wf)
+	}
+	if got := decode[models.Workflow](t, do(t, h, http.MethodGet, "/workflows/"+wf.ID, "")); got.ID != wf.ID || len(got.Jobs) != 2 {
+		t.Fatalf("get workflow = %+v", got)
+	}
+	if page := decode[jobPage](t, do(t, h, http.MethodGet, "/jobs?workflow_id="+wf.ID, "")); page.Total != 2 {
+		t.Fatalf("jobs of the workflow = %d, want 2", page.Total)
+	}
+	if w := do(t, h, http.MethodGet, "/workflows/nope", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown workflow: %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+// keys look like ck_<64 hex chars>; the prefix shown in listings is the first 10 characters
+const (
+	keyPrefix     = "ck_"
+	shownKeyChars = 10
+)
+
+var (
+	// err key not found is returned for an unknown key id
+	ErrKeyNotFound = errors.New("api key not found")
+	// err key from env is returned when trying to revoke a key configured through the environment
+	ErrKeyFromEnv = errors.New("api key is configured through the environment; unset it and restart instead")
+)
+
+// config configures an authenticator
+type Config struct {
+	AdminKey  string // accepted as an admin key without being stored (ADMIN_API_KEY), to create the first keys
+	WorkerKey string // accepted as a worker key without being stored (WORKER_API_KEY), shared by autoscaled workers
+}
+
+// authenticator resolves the api key on a request to its role. keys are stored as sha-256
+// hashes, so a leaked store does not leak usable keys.
+type Authenticator struct {
+	keys *models.APIKeyStore
+	env  []*models.APIKey // keys from the environment
+}
+
+// new creates an authenticator over the stored keys plus the ones in cfg
+func New(keys *models.APIKeyStore, cfg Config) *Authenticator {
+	a := &Authenticator{keys: keys}
+	for _, k := range []struct {
+		id, key string
+		role    models.Role
+	}{{"env-admin", cfg.AdminKey, models.RoleAdmin}, {"env-worker", cfg.WorkerKey, models.RoleWorker}} {
+		if k.key == "" {
+			continue
+		}
+		a.env = append(a.env, &models.APIKey{ID: k.id, Name: "environment", Role: k.role, Hash: models.HashAPIKey(k.key)})
+	}
+	return a
+}
+
+// authenticate returns the key presented on the request, from Authorization: Bearer <key> or X-API-Key.
+// allowQuery also accepts ?api_key=, for clients such as EventSource that can't set headers.
+func (a *Authenticator) Authenticate(r *http.Request, allowQuery bool) (*models.APIKey, bool) {
+	token := ""
+	if v := r.Header.Get("Authorization"); len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+		token = strings.TrimSpace(v[7:])
+	} else if v := r.Header.Get("X-API-Key"); v != "" {
+		token = v
+	} else if allowQuery {
+		token = r.URL.Query().Get("api_key")
+	}
+	if token == "" {
+		return nil, false
+	}
+	hash := models.HashAPIKey(token)
+	for _, k := range a.env {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			return k, true
+		}
+	}
+	return a.keys.GetByHash(hash)
+}
+
+// create makes a new key. the returned key carries the plaintext in Key, which is not kept anywhere.
+func (a *Authenticator) Create(req *models.CreateAPIKeyRequest) (*models.APIKey, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	plain := keyPrefix + hex.EncodeToString(b)
+	k := &models.APIKey{
+		ID:        models.MustGenerateID(),
+		Name:      req.Name,
+		Role:      req.Role,
+		Tenant:    req.Tenant,
+		Prefix:    shown(plain),
+		Hash:      models.HashAPIKey(plain),
+		CreatedAt: time.Now(),
+	}
+	if err := a.keys.Save(k); err != nil {
+		return nil, err
+	}
+	log.Printf("event=api_key_created key_id=%s role=%s tenant=%s name=%q", k.ID, k.Role, k.Tenant, k.Name)
+	out := redact(k)
+	out.Key = plain
+	return out, nil
+}
+
+// revoke deletes a stored key; requests with it are refused from then on
+func (a *Authenticator) Revoke(id string) error {
+	for _, k := range a.env {
+		if k.ID == id {
+			return ErrKeyFromEnv
+		}
+	}
+	if _, ok := a.keys.Get(id); !ok {
+		return ErrKeyNotFound
+	}
+	a.keys.Delete(id)
+	log.Printf("event=api_key_revoked key_id=%s", id)
+	return nil
+}
+
+// keys lists the environment keys and the stored ones, without hashes
+func (a *Authenticator) Keys() []*models.APIKey {
+	out := make([]*models.APIKey, 0, len(a.env))
+	for _, k := range a.env {
+		out = append(out, redact(k))
+	}
+	for _, k := range a.keys.List() {
+		out = append(out, redact(k))
+	}
+	return out
+}
+
+func shown(key string) string {
+	if len(key) <= shownKeyChars {
+		return key
+	}
+	return key[:shownKeyChars]
+}
+
+func redact(k *models.APIKey) *models.APIKey {
+	cp := *k
+	cp.Hash = ""
+	cp.Key = ""
+	return &cp
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+func request(header ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestCreateStoresOnlyTheHash(t *testing.T) {
+	keys := models.NewAPIKeyStore()
+	a := New(keys, Config{})
+	created, err := a.Create(&models.CreateAPIKeyRequest{Name: "ci", Role: models.RoleSubmitter, Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, keyPrefix) || len(created.Key) != len(keyPrefix)+64 || created.Prefix != created.Key[:shownKeyChars] || created.Hash != "" {
+		t.Fatalf("created key = %+v, want the plaintext once and no hash", created)
+	}
+	stored, ok := keys.Get(created.ID)
+	if !ok || stored.Key != "" || stored.Hash != models.HashAPIKey(created.Key) {
+		t.Fatalf("stored key = %+v, want only the hash", stored)
+	}
+	for _, k := range a.Keys() {
+		if k.Hash != "" || k.Key != "" {
+			t.Fatalf("listed key %+v carries its hash or plaintext", k)
+		}
+	}
+
+	if _, err := a.Create(&models.CreateAPIKeyRequest{Role: "root"}); err == nil {
+		t.Fatal("created a key with an unknown role")
+	}
+	if _, err := a.Create(&models.CreateAPIKeyRequest{Role: models.RoleAdmin, Tenant: "acme"}); err == nil {
+		t.Fatal("created an admin key confined to a tenant")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := New(models.NewAPIKeyStore(), Config{AdminKey: "admin-secret", WorkerKey: "worker-secret"})
+	created, _ := a.Create(&models.CreateAPIKeyRequest{Role: models.RoleViewer})
+
+	for _, tc := range []struct {
+		name  string
+		r     *http.Request
+		query bool
+		role  models.Role
+	}{
+		{"bearer", request("Authorization", "Bearer "+created.Key), false, models.RoleViewer},
+		{"bearer in any case", request("Authorization", "bearer "+created.Key), false, models.RoleViewer},
+		{"x-api-key", request("X-API-Key", created.Key), false, models.RoleViewer},
+		{"env admin", request("Authorization", "Bearer admin-secret"), false, models.RoleAdmin},
+		{"env worker", request("X-API-Key", "worker-secret"), false, models.RoleWorker},
+		{"query when allowed", httptest.NewRequest(http.MethodGet, "/events?api_key="+created.Key, nil), true, models.RoleViewer},
+		{"query when not allowed", httptest.NewRequest(http.MethodGet, "/jobs?api_key="+created.Key, nil), false, ""},
+		{"unknown key", request("Authorization", "Bearer ck_nope"), false, ""},
+		{"basic auth", request("Authorization", "Basic "+created.Key), false, ""},
+		{"none", request(), false, ""},
+	} {
+		key, ok := a.Authenticate(tc.r, tc.query)
+		if ok != (tc.role != "") || (ok && key.Role != tc.role) {
+			t.Errorf("%s: Authenticate = %+v %v, want role %q", tc.name, key, ok, tc.role)
+		}
+	}
+
+	if err := a.Revoke(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Authenticate(request("X-API-Key", created.Key), false); ok {
+		t.Fatal("a revoked key still authenticates")
+	}
+	if err := a.Revoke(created.ID); err != ErrKeyNotFound {
+		t.Fatalf("revoke twice = %v, want ErrKeyNotFound", err)
+	}
+	if err := a.Revoke("env-admin"); err != ErrKeyFromEnv {
+		t.Fatalf("revoke an env key = %v, want ErrKeyFromEnv", err)
+	}
+	if keys := a.Keys(); len(keys) != 2 || keys[0].ID != "env-admin" || keys[1].ID != "env-worker" {
+		t.Fatalf("keys = %+v, want the two env keys", keys)
+	}
+}
@@ -16,15 +16,17 @@ const labelVal = "worker"
 type DockerScaler struct {
 	client *client.Client
 	image  string
+	apiKey string // passed to workers as API_KEY when set
 }
 
-// new docker scaler creates a scaler that runs worker containers. image is the docker image name (e.g. cloud-worker)
-func NewDockerScaler(image string) (*DockerScaler, error) {
+// new docker scaler creates a scaler that runs worker containers. image is the docker image name (e.g. cloud-worker);
+// apiKey is the worker api key the containers authenticate with, empty when auth is off.
+func NewDockerScaler(image, apiKey string) (*DockerScaler, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
-	return &DockerScaler{client: cli, image: image}, nil
+	return &DockerScaler{client: cli, image: image, apiKey: apiKey}, nil
 }
 
 // start worker creates and starts a new worker container
@@ -38,6 +40,9 @@ func (d *DockerScaler) StartWorker(ctx context.Context) (string, error) {
 		},
 		Labels: map[string]string{labelKey: labelVal},
 	}
+	if d.apiKey != "" {
+		cfg.Env = append(cfg.Env, "API_KEY="+d.apiKey)
+	}
 	hostConfig := &container.HostConfig{
 		AutoRemove: true,
 	}
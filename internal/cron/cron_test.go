@@ -0,0 +1,98 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"30-10 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@every",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(y int, m time.Month, d, h, min int) time.Time { return time.Date(y, m, d, h, min, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		expr     string
+		from     time.Time
+		want     time.Time
+		describe string
+	}{
+		{"* * * * *", utc(2026, 1, 1, 10, 0).Add(30 * time.Second), utc(2026, 1, 1, 10, 1), "strictly after the start, truncated to the minute"},
+		{"*/15 * * * *", utc(2026, 1, 1, 10, 15), utc(2026, 1, 1, 10, 30), "step"},
+		{"10-30/10 * * * *", utc(2026, 1, 1, 10, 30), utc(2026, 1, 1, 11, 10), "stepped range wraps to the next hour"},
+		{"5/20 * * * *", utc(2026, 1, 1, 10, 46), utc(2026, 1, 1, 11, 5), "single value with a step runs to the end of the field"},
+		{"0 9,17 * * *", utc(2026, 1, 1, 9, 0), utc(2026, 1, 1, 17, 0), "list"},
+		{"0 0 31 * *", utc(2026, 2, 1, 0, 0), utc(2026, 3, 31, 0, 0), "months without the day are skipped"},
+		{"0 0 29 feb *", utc(2026, 1, 1, 0, 0), utc(2028, 2, 29, 0, 0), "leap day"},
+		{"0 12 * * mon-fri", utc(2026, 10, 17, 12, 0), utc(2026, 10, 19, 12, 0), "weekday names skip the weekend"},
+		{"0 0 * * 7", utc(2026, 10, 17, 0, 0), utc(2026, 10, 18, 0, 0), "7 is sunday"},
+		{"0 0 1 * 1", utc(2026, 10, 17, 0, 0), utc(2026, 10, 19, 0, 0), "restricted day of month and day of week match either"},
+		{"0 0 1 * *", utc(2026, 10, 17, 0, 0), utc(2026, 11, 1, 0, 0), "day of month only"},
+		{"0 0 * dec *", utc(2026, 12, 31, 23, 59), utc(2027, 12, 1, 0, 0), "month name across the year end"},
+		{"@hourly", utc(2026, 1, 1, 10, 0), utc(2026, 1, 1, 11, 0), "macro"},
+		{"@WEEKLY", utc(2026, 10, 17, 0, 0), utc(2026, 10, 18, 0, 0), "macros are case insensitive"},
+		{"@yearly", utc(2026, 6, 1, 0, 0), utc(2027, 1, 1, 0, 0), "yearly"},
+	} {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		if got := e.Next(tc.from); !got.Equal(tc.want) {
+			t.Errorf("%s: Next(%q, %s) = %s, want %s", tc.describe, tc.expr, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestNextNeverFires(t *testing.T) {
+	e, err := Parse("0 0 30 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Fatalf("Next of 30 feb = %s, want the zero time", got)
+	}
+}
+
+func TestNextInOffsetTimezones(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	e, _ := Parse("0 * * * *")
+	// 10:40 in kolkata: the next full hour is 11:00 local, not the next full hour utc
+	got := e.Next(time.Date(2026, 1, 1, 10, 40, 0, 0, kolkata))
+	if want := time.Date(2026, 1, 1, 11, 0, 0, 0, kolkata); !got.Equal(want) {
+		t.Fatalf("Next = %s, want %s", got, want)
+	}
+}
+
+func TestNextAcrossDSTGap(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	e, _ := Parse("30 * * * *")
+	// 2:00-3:00 does not exist on 8 mar 2026; 1:30 is followed by 3:30
+	got := e.Next(time.Date(2026, 3, 8, 1, 30, 0, 0, ny))
+	if want := time.Date(2026, 3, 8, 3, 30, 0, 0, ny); !got.Equal(want) {
+		t.Fatalf("Next = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// event types published on the bus
+const (
+	JobSubmitted     = "job.submitted"
+	JobQueued        = "job.queued" // became runnable: run time reached, workflow parents done, requeued
+	JobAssigned      = "job.assigned"
+	JobDispatched    = "job.dispatched"
+	JobCompleted     = "job.completed"
+	JobRetrying      = "job.retrying"
+	JobFailed        = "job.failed"
+	JobCancelled     = "job.cancelled"
+	JobSkipped       = "job.skipped"
+	JobReplayed      = "job.replayed"
+	JobReprioritized = "job.reprioritized"
+	JobUnschedulable = "job.unschedulable"
+	WorkerRegistered = "worker.registered"
+	WorkerReaped     = "worker.reaped"
+)
+
+// event is one state change. ids increase by one per event, so a client can resume after the last id it saw.
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	JobID    string    `json:"job_id,omitempty"`
+	JobType  string    `json:"job_type,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	WorkerID string    `json:"worker_id,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`  // owner of the job, on job events
+	Message  string    `json:"message,omitempty"` // error or reason, when there is one
+}
+
+// subscriber buffer; a subscriber that falls this far behind is dropped and has to resume
+const subscriberBuffer = 256
+
+// bus fans events out to subscribers and keeps the most recent ones in a ring buffer for resuming
+type Bus struct {
+	mu     sync.Mutex
+	ring   []Event
+	start  int // index of the oldest event in ring
+	count  int
+	nextID uint64
+	subs   map[*Subscription]struct{}
+}
+
+// subscription receives events on C until it is closed. c is closed when the subscriber is
+// closed or dropped for falling behind.
+type Subscription struct {
+	C   <-chan Event
+	ch  chan Event
+	bus *Bus
+}
+
+// new bus creates a bus that keeps the last size events
+func NewBus(size int) *Bus {
+	if size < 1 {
+		size = 1
+	}
+	return &Bus{ring: make([]Event, size), nextID: 1, subs: make(map[*Subscription]struct{})}
+}
+
+// publish stamps the event with the next id and the current time and delivers it. it never blocks.
+func (b *Bus) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e.ID = b.nextID
+	b.nextID++
+	e.Time = time.Now()
+	if b.count < len(b.ring) {
+		b.ring[(b.start+b.count)%len(b.ring)] = e
+		b.count++
+	} else {
+		b.ring[b.start] = e
+		b.start = (b.start + 1) % len(b.ring)
+	}
+	for sub := range b.subs {
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+	return e
+}
+
+// subscribe registers a subscriber. with afterID > 0 it also returns the buffered events after that id;
+// complete is false when some of them have already left the buffer.
+func (b *Bus) Subscribe(afterID uint64) (sub *Subscription, backlog []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	complete = true
+	if afterID > 0 {
+		for i := 0; i < b.count; i++ {
+			if e := b.ring[(b.start+i)%len(b.ring)]; e.ID > afterID {
+				backlog = append(backlog, e)
+			}
+		}
+		oldest := b.nextID
+		if b.count > 0 {
+			oldest = b.ring[b.start].ID
+		}
+		// an id from the future means the api restarted and ids started over
+		complete = afterID+1 >= oldest && afterID < b.nextID
+	}
+	ch := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: ch, ch: ch, bus: b}
+	b.subs[sub] = struct{}{}
+	return sub, backlog, complete
+}
+
+// close unsubscribes; it is safe to call more than once
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
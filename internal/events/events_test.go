@@ -0,0 +1,94 @@
+package events
+
+import (
+	"slices"
+	"testing"
+)
+
+func publishN(b *Bus, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(Event{Type: JobSubmitted})
+	}
+}
+
+func ids(events []Event) []uint64 {
+	var out []uint64
+	for _, e := range events {
+		out = append(out, e.ID)
+	}
+	return out
+}
+
+func TestPublishNumbersEventsAndDelivers(t *testing.T) {
+	b := NewBus(4)
+	sub, backlog, complete := b.Subscribe(0)
+	defer sub.Close()
+	if len(backlog) != 0 || !complete {
+		t.Fatalf("fresh subscription: backlog %v complete %v", backlog, complete)
+	}
+	for want := uint64(1); want <= 3; want++ {
+		e := b.Publish(Event{Type: JobQueued, JobID: "j"})
+		if e.ID != want || e.Time.IsZero() {
+			t.Fatalf("published event %d at %v, want id %d and a time", e.ID, e.Time, want)
+		}
+		if got := <-sub.C; got.ID != want || got.JobID != "j" {
+			t.Fatalf("received %+v, want event %d", got, want)
+		}
+	}
+}
+
+func TestSubscribeResumesFromTheRingBuffer(t *testing.T) {
+	b := NewBus(4)
+	publishN(b, 6) // the buffer holds 3 to 6
+
+	for _, tc := range []struct {
+		after    uint64
+		want     []uint64
+		complete bool
+	}{
+		{after: 4, want: []uint64{5, 6}, complete: true},
+		{after: 2, want: []uint64{3, 4, 5, 6}, complete: true},
+		{after: 6, want: nil, complete: true},
+		// 2 is gone
+		{after: 1, want: []uint64{3, 4, 5, 6}, complete: false},
+		// from before a restart: ids started over
+		{after: 100, want: nil, complete: false},
+	} {
+		sub, backlog, complete := b.Subscribe(tc.after)
+		sub.Close()
+		if got := ids(backlog); complete != tc.complete || !slices.Equal(got, tc.want) {
+			t.Errorf("Subscribe(%d) = %v complete=%v, want %v complete=%v", tc.after, got, complete, tc.want, tc.complete)
+		}
+	}
+
+	// any id is from before a restart while nothing has been published yet
+	if _, _, complete := NewBus(4).Subscribe(1); complete {
+		t.Error("resuming after id 1 on an empty bus counted as complete")
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := NewBus(1)
+	slow, _, _ := b.Subscribe(0)
+	fast, _, _ := b.Subscribe(0)
+	defer fast.Close()
+	received := 0
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(Event{Type: JobSubmitted})
+		<-fast.C
+		received++
+	}
+	// publish never blocked, and the slow subscriber's channel is closed after its buffer
+	n := 0
+	for range slow.C {
+		n++
+	}
+	if n != subscriberBuffer || received != subscriberBuffer+1 {
+		t.Fatalf("slow subscriber got %d events, fast %d; want %d and %d", n, received, subscriberBuffer, subscriberBuffer+1)
+	}
+	// closing a dropped subscription is harmless, and so is closing twice
+	slow.Close()
+	fast.Close()
+	fast.Close()
+	b.Publish(Event{Type: JobSubmitted})
+}
@@ -4,6 +4,7 @@ package executor
 import (
     "bytes"
     "context"
+    "errors"
     "fmt"
     "os/exec"
     "strings"
@@ -13,38 +14,56 @@ import (
 
 // runner invokes the c++ execution binary for each job
 type Runner struct {
-    BinaryPath string
-    Timeout    time.Duration
+    BinaryPath  string
+    Timeout     time.Duration
+    GracePeriod time.Duration // between sigterm and sigkill when a job is stopped
 }
 
 
 // new runner creates a runner that uses the given binary path
 func NewRunner(binaryPath string) *Runner {
     return &Runner{
-        BinaryPath: binaryPath,
-        Timeout:    5 * time.Minute,
+        BinaryPath:  binaryPath,
+        Timeout:     5 * time.Minute,
+        GracePeriod: 10 * time.Second,
     }
 }
 
 
+// error classes reported with failed results; the api's retry policy decides which are retried
+const (
+    ErrorClassTimeout    = "timeout"
+    ErrorClassValidation = "validation"
+    ErrorClassExecution  = "execution"
+    ErrorClassCancelled  = "cancelled"
+)
+
+
+// exit code the runner uses for payloads that can never succeed
+const exitInvalidPayload = 2
+
+
 // result holds the outcome of a job execution
 type Result struct {
-    Success bool
-    Output  string
-    Error   string
+    Success    bool
+    Output     string
+    Error      string
+    ErrorClass string
 }
 
 
 // run executes the job via the c++ binary. arguments are passed as --job-id, --type, --payload.
-// if timeout_sec > 0 it overrides the default runner timeout.
-func (r *Runner) Run(jobID, jobType, payload string, timeoutSec int) (*Result, error) {
+// if timeout_sec > 0 it overrides the default runner timeout. the binary runs in its own process
+// group; on timeout or when ctx is cancelled the group gets sigterm, and sigkill after the grace
+// period. a cancelled job's result carries the output written until then.
+func (r *Runner) Run(ctx context.Context, jobID, jobType, payload string, timeoutSec int) (*Result, error) {
     timeout := r.Timeout
     if timeoutSec > 0 {
         timeout = time.Duration(timeoutSec) * time.Second
     }
-    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    runCtx, cancel := context.WithTimeout(ctx, timeout)
     defer cancel()
-    cmd := exec.CommandContext(ctx, r.BinaryPath,
+    cmd := exec.Command(r.BinaryPath,
         "--job-id", jobID,
         "--type", jobType,
         "--payload", payload,
@@ -52,28 +71,66 @@ func (r *Runner) Run(jobID, jobType, payload string, timeoutSec int) (*Result, e
     var stdout, stderr bytes.Buffer
     cmd.Stdout = &stdout
     cmd.Stderr = &stderr
-    err := cmd.Run()
+    setProcessGroup(cmd)
+    err := cmd.Start()
+    if err == nil {
+        err = r.wait(runCtx, cmd)
+    }
     outStr := strings.TrimSpace(stdout.String())
     errStr := strings.TrimSpace(stderr.String())
     if err != nil {
-        if ctx.Err() == context.DeadlineExceeded {
-            return &Result{Success: false, Error: "execution timeout"}, nil
+        if ctx.Err() != nil {
+            return &Result{Success: false, Output: outStr, Error: "cancelled", ErrorClass: ErrorClassCancelled}, nil
+        }
+        if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+            return &Result{Success: false, Error: "execution timeout", ErrorClass: ErrorClassTimeout}, nil
         }
         msg := err.Error()
         if errStr != "" {
             msg = errStr
         }
-        return &Result{Success: false, Output: outStr, Error: msg}, nil
+        class := ErrorClassExecution
+        if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == exitInvalidPayload {
+            class = ErrorClassValidation
+        }
+        return &Result{Success: false, Output: outStr, Error: msg, ErrorClass: class}, nil
     }
     // exit code 0 = success
     success := cmd.ProcessState.ExitCode() == 0
     if !success {
-        return &Result{Success: false, Output: outStr, Error: fmt.Sprintf("exit code %d", cmd.ProcessState.ExitCode())}, nil
+        return &Result{Success: false, Output: outStr, Error: fmt.Sprintf("exit code %d", cmd.ProcessState.ExitCode()), ErrorClass: ErrorClassExecution}, nil
     }
     return &Result{Success: true, Output: outStr}, nil
 }
 
 
+// wait waits for the started command. once ctx is done the process group is sent sigterm, then
+// sigkill if it is still there after the grace period.
+func (r *Runner) wait(ctx context.Context, cmd *exec.Cmd) error {
+    done := make(chan error, 1)
+    go func() { done <- cmd.Wait() }()
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+    }
+    _ = terminateGroup(cmd)
+    grace := time.NewTimer(r.GracePeriod)
+    defer grace.Stop()
+    select {
+    case err := <-done:
+        return orContextErr(ctx, err)
+    case <-grace.C:
+    }
+    _ = killGroup(cmd)
+    return orContextErr(ctx, <-done)
+}
 
 
-
+// or context err makes sure a job that exited cleanly on sigterm still counts as stopped
+func orContextErr(ctx context.Context, err error) error {
+    if err != nil {
+        return err
+    }
+    return ctx.Err()
+}
@@ -0,0 +1,80 @@
+//go:build unix
+
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// script runner returns a runner whose binary is the given sh script
+func scriptRunner(t *testing.T, script string) *Runner {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "runner")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return NewRunner(bin)
+}
+
+func TestRunReportsOutcomes(t *testing.T) {
+	for _, tc := range []struct {
+		name, script string
+		want         Result
+	}{
+		{"success", "echo \"$2 $6\"\n", Result{Success: true, Output: "j1 payload"}},
+		{"failure", "echo partial; echo boom >&2; exit 1\n", Result{Output: "partial", Error: "boom", ErrorClass: ErrorClassExecution}},
+		{"invalid payload", "exit 2\n", Result{Error: "exit status 2", ErrorClass: ErrorClassValidation}},
+	} {
+		got, err := scriptRunner(t, tc.script).Run(context.Background(), "j1", "echo", "payload", 0)
+		if err != nil || *got != tc.want {
+			t.Errorf("%s: %+v %v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestCancelStopsTheWholeProcessGroup(t *testing.T) {
+	// the script and the child it spawns ignore sigterm (ignored signals are inherited), and the
+	// child holds stdout open, so run only returns once sigkill reached the whole group
+	r := scriptRunner(t, "trap '' TERM\necho partial\nsleep 60 &\nwait\n")
+	r.GracePeriod = 300 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	res, err := r.Run(ctx, "j1", "sleep", "60", 0)
+	elapsed := time.Since(start)
+	if err != nil || res.ErrorClass != ErrorClassCancelled || res.Output != "partial" {
+		t.Fatalf("cancelled run = %+v %v, want cancelled with the output so far", res, err)
+	}
+	if elapsed < 500*time.Millisecond || elapsed > 10*time.Second {
+		t.Fatalf("run returned after %s, want sigkill after the grace period", elapsed)
+	}
+}
+
+func TestCancelledJobThatExitsOnSigtermSkipsTheGracePeriod(t *testing.T) {
+	r := scriptRunner(t, "echo started\nexec sleep 60\n")
+	r.GracePeriod = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	res, err := r.Run(ctx, "j1", "sleep", "60", 0)
+	if err != nil || res.ErrorClass != ErrorClassCancelled || res.Output != "started" || time.Since(start) > 10*time.Second {
+		t.Fatalf("run = %+v %v after %s, want cancelled as soon as sigterm ended it", res, err, time.Since(start))
+	}
+}
+
+func TestTimeoutStopsTheJob(t *testing.T) {
+	r := scriptRunner(t, "trap '' TERM\nsleep 60\n")
+	r.Timeout = 200 * time.Millisecond
+	r.GracePeriod = 100 * time.Millisecond
+	res, err := r.Run(context.Background(), "j1", "sleep", "60", 0)
+	if err != nil || res.ErrorClass != ErrorClassTimeout || !strings.Contains(res.Error, "timeout") {
+		t.Fatalf("run past its timeout = %+v %v", res, err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package executor
+
+
+import "os/exec"
+
+
+// without process groups only the binary itself is stopped, and at once
+func setProcessGroup(cmd *exec.Cmd) {}
+
+
+func terminateGroup(cmd *exec.Cmd) error {
+    return cmd.Process.Kill()
+}
+
+
+func killGroup(cmd *exec.Cmd) error {
+    return cmd.Process.Kill()
+}
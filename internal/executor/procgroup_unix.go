@@ -0,0 +1,26 @@
+//go:build unix
+
+package executor
+
+
+import (
+    "os/exec"
+    "syscall"
+)
+
+
+// set process group starts the command in a process group of its own, so stopping it also stops
+// whatever it spawned
+func setProcessGroup(cmd *exec.Cmd) {
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+
+func terminateGroup(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+
+func killGroup(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
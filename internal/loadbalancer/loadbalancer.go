@@ -1,34 +1,183 @@
 package loadbalancer
 
-import "cloud/pkg/models"
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
 
-// strategy selects a worker from the list (e.g. round-robin or least connections)
-type Strategy int
+	"cloud/pkg/models"
+)
+
+// strategy names a balancer implementation (LB_STRATEGY)
+type Strategy string
 
 const (
-	RoundRobin Strategy = iota
-	LeastConnections
+	RoundRobin  Strategy = "round_robin"  // cycle through workers in id order (default)
+	LeastLoaded Strategy = "least_loaded" // prefer the worker with the most free capacity
+	Weighted    Strategy = "weighted"     // smooth weighted round robin by worker weight
+	TwoChoices  Strategy = "two_choices"  // pick two workers at random, take the less loaded one
 )
 
-// select worker returns an idle worker, or nil if none available.
-// least connections prefers workers with no current job, round robin cycles through idle workers
-func SelectWorker(workers []*models.Worker, strategy Strategy) *models.Worker {
-	var idle []*models.Worker
+// balancer picks the push worker for the next job. implementations keep state across calls
+// (cursors, weights) and must be safe for concurrent use.
+type Balancer interface {
+	// select returns a worker that can take a job now, or nil if none can. the scheduler passes
+	// only workers able to run the job at hand. pull workers (no endpoint) are never selected;
+	// they lease work themselves.
+	Select(workers []*models.Worker) *models.Worker
+}
+
+// new returns the balancer for the named strategy; an empty name means round robin
+func New(strategy Strategy) (Balancer, error) {
+	switch strategy {
+	case "", RoundRobin:
+		return &roundRobin{}, nil
+	case LeastLoaded:
+		return &leastLoaded{}, nil
+	case Weighted:
+		return &weighted{current: make(map[string]int)}, nil
+	case TwoChoices:
+		return &twoChoices{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancer strategy %q (want round_robin, least_loaded, weighted or two_choices)", strategy)
+	}
+}
+
+// candidates returns the push workers that can take a job, sorted by id so cursors are stable
+// whatever order the registry lists them in
+func candidates(workers []*models.Worker) []*models.Worker {
+	var out []*models.Worker
 	for _, w := range workers {
-		if w.Status == models.WorkerStatusIdle {
-			idle = append(idle, w)
+		if w.Endpoint != "" && w.FreeSlots() > 0 {
+			out = append(out, w)
 		}
 	}
-	if len(idle) == 0 {
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// load is the fraction of a worker's slots in use, 0 (free) to 1 (full)
+func load(w *models.Worker) float64 {
+	return float64(len(w.RunningJobs)) / float64(w.Slots())
+}
+
+func weightOf(w *models.Worker) int {
+	if w.Weight > 0 {
+		return w.Weight
+	}
+	return 1
+}
+
+// after returns the index of the first worker whose id sorts after last, wrapping to 0
+func after(list []*models.Worker, last string) int {
+	i := sort.Search(len(list), func(i int) bool { return list[i].ID > last })
+	if i == len(list) {
+		return 0
+	}
+	return i
+}
+
+// round robin remembers the last worker it picked and continues after it, so workers joining,
+// leaving or filling up don't reset the rotation
+type roundRobin struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (b *roundRobin) Select(workers []*models.Worker) *models.Worker {
+	list := candidates(workers)
+	if len(list) == 0 {
 		return nil
 	}
-	switch strategy {
-	case LeastConnections:
-		// already filtered to idle, pick first (all have 0 load)
-		return idle[0]
-	case RoundRobin:
-		return idle[0]
-	default:
-		return idle[0]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := list[after(list, b.last)]
+	b.last = w.ID
+	return w
+}
+
+// least loaded picks the worker with the lowest load; ties rotate like round robin so equally
+// loaded workers share the work
+type leastLoaded struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (b *leastLoaded) Select(workers []*models.Worker) *models.Worker {
+	list := candidates(workers)
+	if len(list) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	start := after(list, b.last)
+	var best *models.Worker
+	for i := range list {
+		w := list[(start+i)%len(list)]
+		if best == nil || load(w) < load(best) {
+			best = w
+		}
+	}
+	b.last = best.ID
+	return best
+}
+
+// the weighted balancer forgets its scores once it has tracked this many workers
+const maxWeightedScores = 1024
+
+// weighted is nginx-style smooth weighted round robin: each pick adds every candidate's weight to
+// its running score, takes the highest score and subtracts the total from it. over time each
+// worker gets jobs in proportion to its weight, interleaved rather than in bursts.
+type weighted struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (b *weighted) Select(workers []*models.Worker) *models.Worker {
+	list := candidates(workers)
+	if len(list) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// scores of workers long gone would pile up as workers come and go; start over now and then
+	if len(b.current) > maxWeightedScores {
+		b.current = make(map[string]int)
+	}
+	total := 0
+	var best *models.Worker
+	for _, w := range list {
+		weight := weightOf(w)
+		b.current[w.ID] += weight
+		total += weight
+		if best == nil || b.current[w.ID] > b.current[best.ID] {
+			best = w
+		}
+	}
+	b.current[best.ID] -= total
+	return best
+}
+
+// two choices samples two distinct workers and takes the less loaded one. it spreads load almost
+// as well as least loaded without always piling onto the same worker.
+type twoChoices struct{}
+
+func (twoChoices) Select(workers []*models.Worker) *models.Worker {
+	list := candidates(workers)
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	i := rand.Intn(len(list))
+	j := rand.Intn(len(list) - 1)
+	if j >= i {
+		j++
+	}
+	if load(list[j]) < load(list[i]) {
+		return list[j]
 	}
+	return list[i]
 }
@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+// worker returns a push worker with the given capacity and number of running jobs
+func worker(id string, capacity, running int) *models.Worker {
+	w := &models.Worker{ID: id, Endpoint: "http://" + id, Capacity: capacity}
+	for i := 0; i < running; i++ {
+		w.RunningJobs = append(w.RunningJobs, fmt.Sprintf("%s-job-%d", id, i))
+	}
+	return w
+}
+
+func newBalancer(t *testing.T, strategy Strategy) Balancer {
+	t.Helper()
+	b, err := New(strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// picks selects n times from the same workers and counts the picks per worker id
+func picks(b Balancer, workers []*models.Worker, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if w := b.Select(workers); w != nil {
+			counts[w.ID]++
+		}
+	}
+	return counts
+}
+
+func TestNewRejectsUnknownStrategies(t *testing.T) {
+	if _, err := New("random"); err == nil {
+		t.Fatal("New(random) succeeded, want an error")
+	}
+	if b := newBalancer(t, ""); fmt.Sprintf("%T", b) != "*loadbalancer.roundRobin" {
+		t.Fatalf("default balancer is %T, want round robin", b)
+	}
+}
+
+func TestEveryStrategyReturnsNilWithoutCandidates(t *testing.T) {
+	pull := &models.Worker{ID: "pull", Capacity: 1}
+	full := worker("full", 1, 1)
+	for _, strategy := range []Strategy{RoundRobin, LeastLoaded, Weighted, TwoChoices} {
+		b := newBalancer(t, strategy)
+		for _, workers := range [][]*models.Worker{nil, {}, {pull, full}} {
+			if w := b.Select(workers); w != nil {
+				t.Errorf("%s: Select(%d workers without a free push slot) = %s, want nil", strategy, len(workers), w.ID)
+			}
+		}
+	}
+}
+
+func TestRoundRobinSpreadsEvenly(t *testing.T) {
+	b := newBalancer(t, RoundRobin)
+	// listed out of id order: the rotation follows ids, not the registry's order
+	workers := []*models.Worker{worker("c", 1, 0), worker("a", 1, 0), worker("b", 1, 0)}
+	var order string
+	for i := 0; i < 6; i++ {
+		order += b.Select(workers).ID
+	}
+	if order != "abcabc" {
+		t.Fatalf("order = %s, want abcabc", order)
+	}
+
+	// a worker filling up is skipped without resetting the rotation
+	workers[1] = worker("a", 1, 1)
+	if got := b.Select(workers).ID; got != "b" {
+		t.Fatalf("after c with a full: picked %s, want b", got)
+	}
+	if got := b.Select(workers).ID; got != "c" {
+		t.Fatalf("after b: picked %s, want c", got)
+	}
+}
+
+func TestLeastLoadedPicksTheMinimumLoad(t *testing.T) {
+	b := newBalancer(t, LeastLoaded)
+	// load is the fraction of slots in use: 2/4 and 1/2 are as loaded as each other, 1/4 is less
+	workers := []*models.Worker{worker("a", 4, 2), worker("b", 2, 1), worker("c", 4, 1)}
+	for i := 0; i < 3; i++ {
+		if got := b.Select(workers).ID; got != "c" {
+			t.Fatalf("picked %s, want c (load 1/4)", got)
+		}
+	}
+}
+
+func TestLeastLoadedRotatesTies(t *testing.T) {
+	b := newBalancer(t, LeastLoaded)
+	workers := []*models.Worker{worker("a", 2, 1), worker("b", 4, 2), worker("c", 1, 0), worker("d", 2, 0)}
+	var order string
+	for i := 0; i < 4; i++ {
+		order += b.Select(workers).ID
+	}
+	// c and d are idle; a and b are half full and never picked
+	if order != "cdcd" {
+		t.Fatalf("order = %s, want cdcd", order)
+	}
+}
+
+func TestWeightedPicksInProportionToWeight(t *testing.T) {
+	b := newBalancer(t, Weighted)
+	a, c := worker("a", 10, 0), worker("c", 10, 0)
+	a.Weight, c.Weight = 5, 3
+	// b has no weight and counts as 1
+	workers := []*models.Worker{a, worker("b", 10, 0), c}
+
+	// smooth weighted round robin repeats exactly every total weight picks
+	counts := picks(b, workers, 9*100)
+	if counts["a"] != 500 || counts["b"] != 100 || counts["c"] != 300 {
+		t.Fatalf("picks = %v, want 500/100/300 for weights 5/1/3", counts)
+	}
+
+	// no worker gets a burst longer than its share calls for: a is never picked three times running
+	var order string
+	for i := 0; i < 9; i++ {
+		order += b.Select(workers).ID
+	}
+	for i := 0; i+2 < len(order); i++ {
+		if order[i:i+3] == "aaa" {
+			t.Fatalf("order %s has a burst of a", order)
+		}
+	}
+}
+
+func TestWeightedForgetsScoresPastTheLimit(t *testing.T) {
+	b := newBalancer(t, Weighted).(*weighted)
+	// scores left behind by workers that have since gone away
+	for i := 0; i <= maxWeightedScores; i++ {
+		b.current[fmt.Sprintf("gone-%d", i)] = i
+	}
+	a := worker("a", 10, 0)
+	a.Weight = 3
+	workers := []*models.Worker{a, worker("b", 10, 0)}
+
+	first := b.Select(workers)
+	if len(b.current) != 2 {
+		t.Fatalf("tracked %d scores after passing the limit, want the 2 live workers", len(b.current))
+	}
+	// the rotation starts over and keeps its proportions
+	counts := picks(b, workers, 4*50-1)
+	counts[first.ID]++
+	if counts["a"] != 150 || counts["b"] != 50 {
+		t.Fatalf("picks after the reset = %v, want 150/50 for weights 3/1", counts)
+	}
+
+	// below the limit the scores are kept
+	b.current["gone"] = 0
+	b.Select(workers)
+	if _, ok := b.current["gone"]; !ok {
+		t.Fatal("scores reset below the limit")
+	}
+}
+
+func TestTwoChoicesNeverPicksTheMoreLoadedOfTheTwo(t *testing.T) {
+	b := newBalancer(t, TwoChoices)
+	// loads 0, 1/4, 2/4, 3/4: whichever two are sampled, d loses, so it is never picked,
+	// and a wins every time it is sampled
+	workers := []*models.Worker{worker("a", 4, 0), worker("b", 4, 1), worker("c", 4, 2), worker("d", 4, 3)}
+	counts := picks(b, workers, 4000)
+	if counts["d"] != 0 {
+		t.Fatalf("the most loaded worker was picked %d times", counts["d"])
+	}
+	// a is in half of the pairs
+	if counts["a"] < 1600 || counts["a"] > 2400 {
+		t.Fatalf("picks = %v, want about half for a", counts)
+	}
+
+	two := []*models.Worker{worker("x", 2, 1), worker("y", 2, 0)}
+	if counts := picks(b, two, 100); counts["y"] != 100 {
+		t.Fatalf("picks of two = %v, want always the idle one", counts)
+	}
+	if got := b.Select([]*models.Worker{worker("only", 1, 0)}); got == nil || got.ID != "only" {
+		t.Fatalf("single worker: picked %v", got)
+	}
+}
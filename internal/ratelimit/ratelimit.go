@@ -2,50 +2,212 @@ package ratelimit
 
 
 import (
+    "fmt"
+    "math"
     "sync"
     "time"
 )
 
 
-// limiter is a fixed-window rate limiter (max n requests per window)
-type Limiter struct {
-    mu       sync.Mutex
-    max      int
-    count    int
-    windowAt time.Time
-    window   time.Duration
+// class groups the routes that share one bucket per client
+type Class string
+
+
+const (
+    ClassSubmit Class = "submit" // requests that change something: submits, cancels, admin changes
+    ClassRead   Class = "read"   // get requests
+)
+
+
+// key by picks what identifies a client. requests without the chosen identity fall back to the
+// next one: tenant, then api key, then client ip.
+type KeyBy string
+
+
+const (
+    KeyByAPIKey KeyBy = "api_key"
+    KeyByTenant KeyBy = "tenant"
+    KeyByIP     KeyBy = "ip"
+)
+
+
+// idle buckets are dropped once they would be full again, checked at most this often
+const pruneInterval = time.Minute
+
+
+var timeNow = func() time.Time { return time.Now() }
+
+
+// rule limits one class: per_minute tokens are added continuously, up to burst. a request takes
+// one token. per_minute 0 turns the limit off for the class.
+type Rule struct {
+    PerMinute int `json:"per_minute"`
+    Burst     int `json:"burst"`
 }
 
 
-// new limiter returns a limiter that allows max requests per window
-func NewLimiter(maxPerMinute int) *Limiter {
-    if maxPerMinute <= 0 {
-        maxPerMinute = 1000
+// config is the limiter setup; it can be replaced at runtime
+type Config struct {
+    KeyBy KeyBy          `json:"key_by"`
+    Rules map[Class]Rule `json:"rules"`
+}
+
+
+// validate checks the key and the rules. a burst left at 0 is set to per_minute.
+func (c *Config) Validate() error {
+    switch c.KeyBy {
+    case KeyByAPIKey, KeyByTenant, KeyByIP:
+    default:
+        return fmt.Errorf("key_by must be api_key, tenant or ip, got %q", c.KeyBy)
+    }
+    for class, rule := range c.Rules {
+        if class != ClassSubmit && class != ClassRead {
+            return fmt.Errorf("unknown rule %q: want submit or read", class)
+        }
+        if rule.PerMinute < 0 || rule.Burst < 0 {
+            return fmt.Errorf("rule %s: per_minute and burst must not be negative", class)
+        }
+        if rule.Burst == 0 {
+            rule.Burst = rule.PerMinute
+            c.Rules[class] = rule
+        }
     }
-    return &Limiter{
-        max:    maxPerMinute,
-        window: time.Minute,
+    return nil
+}
+
+
+// result is the bucket state after a request, for the X-RateLimit headers
+type Result struct {
+    Allowed    bool
+    Limit      int           // bucket size (burst)
+    Remaining  int           // whole tokens left
+    Reset      time.Duration // until the bucket is full again
+    RetryAfter time.Duration // until the next token, when refused
+}
+
+
+type bucketKey struct {
+    class  Class
+    client string
+}
+
+
+type bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+
+// limiter is a token-bucket rate limiter with one bucket per client and route class
+type Limiter struct {
+    mu        sync.Mutex
+    cfg       Config
+    buckets   map[bucketKey]*bucket
+    lastPrune time.Time
+}
+
+
+// new limiter returns a limiter for cfg
+func NewLimiter(cfg Config) (*Limiter, error) {
+    cfg = cfg.clone()
+    if err := cfg.Validate(); err != nil {
+        return nil, err
     }
+    return &Limiter{cfg: cfg, buckets: make(map[bucketKey]*bucket), lastPrune: timeNow()}, nil
 }
 
 
-// allow returns true if the request is allowed
-func (l *Limiter) Allow() bool {
+// key by returns what identifies a client
+func (l *Limiter) KeyBy() KeyBy {
     l.mu.Lock()
     defer l.mu.Unlock()
-    now := time.Now()
-    if now.Sub(l.windowAt) >= l.window {
-        l.windowAt = now
-        l.count = 0
+    return l.cfg.KeyBy
+}
+
+
+// config returns a copy of the current config
+func (l *Limiter) Config() Config {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.cfg.clone()
+}
+
+
+// set config replaces the config. buckets are kept; ones above a lowered burst are cut down to it.
+// changing key_by starts every client with a full bucket.
+func (l *Limiter) SetConfig(cfg Config) error {
+    cfg = cfg.clone()
+    if err := cfg.Validate(); err != nil {
+        return err
     }
-    if l.count >= l.max {
-        return false
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if cfg.KeyBy != l.cfg.KeyBy {
+        l.buckets = make(map[bucketKey]*bucket)
+    }
+    for k, b := range l.buckets {
+        if burst := float64(cfg.Rules[k.class].Burst); b.tokens > burst {
+            b.tokens = burst
+        }
     }
-    l.count++
-    return true
+    l.cfg = cfg
+    return nil
 }
 
 
+// take takes a token from the client's bucket for class. ok is false when the class has no limit,
+// and then there is nothing to report.
+func (l *Limiter) Take(class Class, client string) (res Result, ok bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    rule := l.cfg.Rules[class]
+    if rule.PerMinute <= 0 {
+        return Result{}, false
+    }
+    now := timeNow()
+    if now.Sub(l.lastPrune) >= pruneInterval {
+        l.pruneLocked(now)
+    }
+    rate := float64(rule.PerMinute) / float64(time.Minute) // tokens per nanosecond
+    burst := float64(rule.Burst)
+    k := bucketKey{class: class, client: client}
+    b := l.buckets[k]
+    if b == nil {
+        b = &bucket{tokens: burst, last: now}
+        l.buckets[k] = b
+    }
+    b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))*rate)
+    b.last = now
+    res = Result{Limit: rule.Burst}
+    if b.tokens >= 1 {
+        b.tokens--
+        res.Allowed = true
+    } else {
+        res.RetryAfter = time.Duration(math.Ceil((1 - b.tokens) / rate))
+    }
+    res.Remaining = int(b.tokens)
+    res.Reset = time.Duration(math.Ceil((burst - b.tokens) / rate))
+    return res, true
+}
+
 
+// prune locked drops buckets that have refilled completely; a new one starts full anyway
+func (l *Limiter) pruneLocked(now time.Time) {
+    l.lastPrune = now
+    for k, b := range l.buckets {
+        rule := l.cfg.Rules[k.class]
+        if rule.PerMinute <= 0 || b.tokens+float64(now.Sub(b.last))*float64(rule.PerMinute)/float64(time.Minute) >= float64(rule.Burst) {
+            delete(l.buckets, k)
+        }
+    }
+}
 
 
+func (c Config) clone() Config {
+    rules := make(map[Class]Rule, len(c.Rules))
+    for class, rule := range c.Rules {
+        rules[class] = rule
+    }
+    c.Rules = rules
+    return c
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fake clock sets the limiter's clock to a time the test moves by hand
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	saved := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = saved })
+	return &now
+}
+
+func newLimiter(t *testing.T, cfg Config) *Limiter {
+	t.Helper()
+	l, err := NewLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"unknown key_by": {KeyBy: "cookie"},
+		"unknown class":  {KeyBy: KeyByIP, Rules: map[Class]Rule{"write": {PerMinute: 1}}},
+		"negative rate":  {KeyBy: KeyByIP, Rules: map[Class]Rule{ClassRead: {PerMinute: -1}}},
+		"negative burst": {KeyBy: KeyByIP, Rules: map[Class]Rule{ClassRead: {PerMinute: 1, Burst: -1}}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: validated", name)
+		}
+	}
+	cfg := Config{KeyBy: KeyByTenant, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 30}, ClassRead: {PerMinute: 60, Burst: 5}}}
+	if err := cfg.Validate(); err != nil || cfg.Rules[ClassSubmit].Burst != 30 || cfg.Rules[ClassRead].Burst != 5 {
+		t.Fatalf("validate = %v, rules %v; want a burst left at 0 set to per_minute", err, cfg.Rules)
+	}
+}
+
+func TestTakeDrainsAndRefillsTheBucket(t *testing.T) {
+	now := fakeClock(t)
+	l := newLimiter(t, Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 60, Burst: 3}}})
+
+	for want := 2; want >= 0; want-- {
+		res, ok := l.Take(ClassSubmit, "c1")
+		if !ok || !res.Allowed || res.Limit != 3 || res.Remaining != want {
+			t.Fatalf("take = %+v %v, want allowed with %d left", res, ok, want)
+		}
+	}
+	res, _ := l.Take(ClassSubmit, "c1")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("take on an empty bucket = %+v, want refused, a token in 1s and full in 3s", res)
+	}
+
+	// a token a second comes back, and the bucket never holds more than burst
+	*now = now.Add(1500 * time.Millisecond)
+	if res, _ := l.Take(ClassSubmit, "c1"); !res.Allowed || res.Remaining != 0 || res.Reset != 2500*time.Millisecond {
+		t.Fatalf("take after 1.5s = %+v, want allowed with half a token left", res)
+	}
+	*now = now.Add(time.Hour)
+	if res, _ := l.Take(ClassSubmit, "c1"); res.Remaining != 2 {
+		t.Fatalf("take after an hour = %+v, want the bucket refilled to its burst", res)
+	}
+}
+
+func TestBucketsArePerClientAndClass(t *testing.T) {
+	fakeClock(t)
+	l := newLimiter(t, Config{KeyBy: KeyByAPIKey, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 1}, ClassRead: {PerMinute: 1}}})
+	if res, _ := l.Take(ClassSubmit, "a"); !res.Allowed {
+		t.Fatal("first submit refused")
+	}
+	if res, _ := l.Take(ClassSubmit, "a"); res.Allowed {
+		t.Fatal("second submit allowed past a burst of 1")
+	}
+	if res, _ := l.Take(ClassRead, "a"); !res.Allowed {
+		t.Fatal("read refused because of the submit bucket")
+	}
+	if res, _ := l.Take(ClassSubmit, "b"); !res.Allowed {
+		t.Fatal("another client refused because of a's bucket")
+	}
+
+	// a class without a rule is not limited and reports nothing
+	off := newLimiter(t, Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 1}}})
+	if _, ok := off.Take(ClassRead, "a"); ok {
+		t.Fatal("read limited without a read rule")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	fakeClock(t)
+	l := newLimiter(t, Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 60, Burst: 10}}})
+	l.Take(ClassSubmit, "c1")
+
+	if err := l.SetConfig(Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: -1}}}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	// a lowered burst cuts the bucket down to it
+	if err := l.SetConfig(Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 60, Burst: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := l.Take(ClassSubmit, "c1"); res.Limit != 2 || res.Remaining != 1 {
+		t.Fatalf("take after lowering the burst = %+v, want 1 of 2 left", res)
+	}
+	l.Take(ClassSubmit, "c1")
+	// a new key_by starts every client over
+	if err := l.SetConfig(Config{KeyBy: KeyByTenant, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 60, Burst: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := l.Take(ClassSubmit, "c1"); !res.Allowed || res.Remaining != 1 || l.KeyBy() != KeyByTenant {
+		t.Fatalf("take after changing key_by = %+v, want a full bucket", res)
+	}
+
+	// the config handed out is a copy
+	cfg := l.Config()
+	cfg.Rules[ClassSubmit] = Rule{PerMinute: 1, Burst: 1}
+	if l.Config().Rules[ClassSubmit].Burst != 2 {
+		t.Fatal("changing the returned config changed the limiter")
+	}
+}
+
+func TestIdleBucketsArePruned(t *testing.T) {
+	now := fakeClock(t)
+	l := newLimiter(t, Config{KeyBy: KeyByIP, Rules: map[Class]Rule{ClassSubmit: {PerMinute: 1, Burst: 5}}})
+	l.Take(ClassSubmit, "idle")
+	*now = now.Add(pruneInterval)
+	l.Take(ClassSubmit, "busy")
+	// idle's bucket (4 tokens plus 1 refilled) was full again; busy's was just taken from
+	if _, ok := l.buckets[bucketKey{ClassSubmit, "idle"}]; ok || len(l.buckets) != 1 {
+		t.Fatalf("buckets after prune = %v, want only busy's", l.buckets)
+	}
+}
@@ -0,0 +1,42 @@
+package scheduler
+
+import "time"
+
+// wait stat sums up how long the dispatched jobs of one priority waited in the queue
+type WaitStat struct {
+	Count    int
+	TotalSec float64
+	MaxSec   float64
+}
+
+// set priority aging makes a queued job's effective priority improve by one level for every interval
+// it waits, up to highest, so low-priority jobs are not starved by a steady stream of urgent ones.
+// jobs keep their original priority. 0 turns aging off. call it before recover and start.
+func (s *Scheduler) SetPriorityAging(interval time.Duration, highest int) {
+	s.queue.SetAging(interval, highest)
+}
+
+// record wait counts the time the job behind item spent queued, from its enqueue to its dispatch
+func (s *Scheduler) recordWait(item *queueItem, now time.Time) {
+	wait := now.Sub(item.enqueuedAt).Seconds()
+	s.waitedMu.Lock()
+	defer s.waitedMu.Unlock()
+	st := s.waited[item.priority]
+	st.Count++
+	st.TotalSec += wait
+	if wait > st.MaxSec {
+		st.MaxSec = wait
+	}
+	s.waited[item.priority] = st
+}
+
+// wait stats returns the queue wait of dispatched jobs by original priority, since the api started
+func (s *Scheduler) WaitStats() map[int]WaitStat {
+	s.waitedMu.Lock()
+	defer s.waitedMu.Unlock()
+	out := make(map[int]WaitStat, len(s.waited))
+	for p, st := range s.waited {
+		out[p] = st
+	}
+	return out
+}
@@ -0,0 +1,30 @@
+package scheduler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestTickRecordsQueueWaitByOriginalPriority(t *testing.T) {
+	s := newTestScheduler(t)
+	s.SetPriorityAging(time.Minute, models.PriorityHigh)
+	runs := make(chan RunJobRequest, 10)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 3})
+	submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityLow})
+	submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityLow})
+	submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityHigh})
+	time.Sleep(10 * time.Millisecond)
+	s.tick()
+
+	stats := s.WaitStats()
+	low, high := stats[models.PriorityLow], stats[models.PriorityHigh]
+	if len(stats) != 2 || low.Count != 2 || high.Count != 1 {
+		t.Fatalf("wait stats = %+v, want 2 low and 1 high", stats)
+	}
+	if low.MaxSec < 0.01 || low.TotalSec < 2*0.01 || low.MaxSec > low.TotalSec {
+		t.Fatalf("low wait = %+v, want at least the 10ms each waited", low)
+	}
+}
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+// how long the api waits for a push worker to take a cancel
+const cancelSignalTimeout = 5 * time.Second
+
+// cancel running marks a running job cancel_requested and asks its worker to stop it. push workers
+// are told at once through their post /cancel; pull workers see the flag in the answer to their next
+// lease extension. the worker stops the process and reports back, and the job is then recorded as
+// cancelled with the output it had so far. a job whose worker is gone or can't be reached is
+// cancelled right away. returns false when the job was written since it was read (it may have
+// finished meanwhile); the caller should read it again.
+func (s *Scheduler) CancelRunning(job *models.Job) bool {
+	job.CancelRequested = true
+	if !s.store.Update(job) {
+		return false
+	}
+	log.Printf("event=job_cancel_requested job_id=%s worker_id=%s", job.ID, job.WorkerID)
+	worker, ok := s.workers.Get(job.WorkerID)
+	if !ok {
+		s.FinishCancelled(job, "", "cancelled (worker gone)")
+		return true
+	}
+	if worker.Endpoint == "" {
+		return true
+	}
+	if err := s.signalCancel(worker, job); err != nil {
+		log.Printf("event=job_cancel_signal_failed job_id=%s worker_id=%s error=%v", job.ID, worker.ID, err)
+		s.FinishCancelled(job, "", "cancelled ("+err.Error()+")")
+	}
+	return true
+}
+
+// signal cancel posts the job id and attempt token to the push worker's /cancel. a worker the
+// attempt's /run has not reached yet answers 404 and refuses that /run when it comes.
+func (s *Scheduler) signalCancel(worker *models.Worker, job *models.Job) error {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(map[string]string{"job_id": job.ID, "attempt_token": job.AttemptToken})
+	ctx, cancel := context.WithTimeout(context.Background(), cancelSignalTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, worker.Endpoint+"/cancel", &buf)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("worker returned %s", resp.Status)
+	}
+	return nil
+}
+
+// finish cancelled records a running job as cancelled with the output it produced so far and frees
+// its worker slot. returns false when the job was written since it was read; nothing is changed then.
+func (s *Scheduler) FinishCancelled(job *models.Job, output, reason string) bool {
+	now := time.Now()
+	closeAttempt(job, now, reason, models.ErrorClassCancelled)
+	job.Status = models.JobStatusCancelled
+	job.Result = output
+	job.FinishedAt = &now
+	job.LeaseID = ""
+	job.LeaseExpiresAt = nil
+	if !s.store.Update(job) {
+		return false
+	}
+	s.OnJobComplete(job.ID, job.WorkerID)
+	log.Printf("event=job_cancelled job_id=%s worker_id=%s reason=%q", job.ID, job.WorkerID, reason)
+	s.OnJobCancelled(job)
+	return true
+}
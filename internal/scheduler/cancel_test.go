@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud/internal/storage"
+	"cloud/pkg/models"
+)
+
+func newSQLiteScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+	db, err := storage.OpenSQLite(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newTestSchedulerWithStore(t, models.NewJobStoreWithBackend(db.Jobs()))
+}
+
+// cancel writes the job cancelled through its own copy, the way the api does while the scheduler
+// holds the copy it dequeued
+func cancelQueued(t *testing.T, s *Scheduler, jobID string) {
+	t.Helper()
+	job, _ := s.store.Get(jobID)
+	job.Status = models.JobStatusCancelled
+	if !s.store.Update(job) {
+		t.Fatal("cancel was not written")
+	}
+}
+
+func assertCancelled(t *testing.T, s *Scheduler, jobID string) {
+	t.Helper()
+	job, _ := s.store.Get(jobID)
+	if job.Status != models.JobStatusCancelled {
+		t.Fatalf("job is %s after the stale write, want cancelled", job.Status)
+	}
+}
+
+func TestCancelWhileDispatchingIsNotUndone(t *testing.T) {
+	s := newSQLiteScheduler(t)
+	// never called: the dispatch must not get that far
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: "http://127.0.0.1:1", Capacity: 1})
+	job := submit(t, s, &models.Job{Payload: "p"})
+
+	dequeued, _ := s.dequeueRunnable(s.runningLimits())
+	cancelQueued(t, s, job.ID)
+	if err := s.dispatchNext(dequeued, s.workers.List()); err != errJobChanged {
+		t.Fatalf("dispatch of a cancelled job = %v, want errJobChanged", err)
+	}
+	assertCancelled(t, s, job.ID)
+	if w, _ := s.workers.Get("w1"); w.FreeSlots() != 1 {
+		t.Fatalf("worker slot not given back: running %v", w.RunningJobs)
+	}
+}
+
+func TestCancelWhileMarkingUnschedulableIsNotUndone(t *testing.T) {
+	s := newSQLiteScheduler(t)
+	job := submit(t, s, &models.Job{Payload: "p", Type: "gpu"})
+
+	dequeued, _ := s.dequeueRunnable(s.runningLimits())
+	cancelQueued(t, s, job.ID)
+	s.markUnschedulable(dequeued, s.workers.List())
+	assertCancelled(t, s, job.ID)
+}
+
+func TestCancelWhileLeasingIsNotUndone(t *testing.T) {
+	s := newSQLiteScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	job := submit(t, s, &models.Job{Payload: "p"})
+
+	dequeued, _ := s.dequeueRunnable(s.runningLimits())
+	cancelQueued(t, s, job.ID)
+	if lease := s.grantLease(dequeued, "w1", defaultVisibilityTimeout); lease != nil {
+		t.Fatalf("leased a cancelled job: %+v", lease)
+	}
+	assertCancelled(t, s, job.ID)
+	if w, _ := s.workers.Get("w1"); w.FreeSlots() != 1 {
+		t.Fatalf("worker slot taken by a cancelled job: %v", w.RunningJobs)
+	}
+}
+
+func TestCompleteReadBeforeCancelIsNotWritten(t *testing.T) {
+	s := newSQLiteScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submit(t, s, &models.Job{Payload: "p"})
+	job, _, err := s.Lease(t.Context(), "w1", 0, defaultVisibilityTimeout)
+	if err != nil || job == nil {
+		t.Fatalf("lease: %v %v", job, err)
+	}
+
+	running, _ := s.store.Get(job.ID)
+	if !s.CancelRunning(running) {
+		t.Fatal("cancel of a running job was not written")
+	}
+	// the worker's completion was read before the cancel went in
+	if s.Complete(job, "done") {
+		t.Fatal("complete of a copy read before the cancel reported written")
+	}
+	got, _ := s.store.Get(job.ID)
+	if got.Status != models.JobStatusRunning || !got.CancelRequested || got.Result != "" {
+		t.Fatalf("job = %s cancel_requested=%v %q, want the cancel kept and the late result dropped", got.Status, got.CancelRequested, got.Result)
+	}
+}
+
+func TestCancelBeforeRunReachesTheWorkerStaysCancelled(t *testing.T) {
+	s := newTestScheduler(t)
+	arrived, release := make(chan struct{}), make(chan struct{})
+	runs := make(chan RunJobRequest, 1)
+	cancels := make(chan map[string]string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/run":
+			// the /run is slow on the way; by the time it lands the attempt was cancelled
+			var req RunJobRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			close(arrived)
+			<-release
+			runs <- req
+			w.WriteHeader(http.StatusConflict)
+		case "/cancel":
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			cancels <- req
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: srv.URL, Capacity: 1})
+	job := submit(t, s, &models.Job{Payload: "p"})
+	s.tick()
+
+	<-arrived
+	running, _ := s.store.Get(job.ID)
+	token := running.AttemptToken
+	if !s.CancelRunning(running) {
+		t.Fatal("cancel was not written")
+	}
+	signal := <-cancels
+	if signal["job_id"] != job.ID || signal["attempt_token"] != token {
+		t.Fatalf("cancel signal = %v, want the job id and attempt token %s", signal, token)
+	}
+	close(release)
+	if req := <-runs; req.AttemptToken != token {
+		t.Fatalf("run token = %s", req.AttemptToken)
+	}
+
+	// the refused /run does not turn the cancelled job back into a retry
+	time.Sleep(50 * time.Millisecond)
+	got, _ := s.store.Get(job.ID)
+	if got.Status != models.JobStatusCancelled || len(got.Attempts) != 1 || s.queue.Depth() != 0 {
+		t.Fatalf("job = %s with %d attempts, depth %d; want it left cancelled", got.Status, len(got.Attempts), s.queue.Depth())
+	}
+	if w, _ := s.workers.Get("w1"); w.FreeSlots() != 1 {
+		t.Fatalf("worker slot not freed: %v", w.RunningJobs)
+	}
+}
+
+func TestDispatchSkipsAnAttemptCancelledSinceItWasAssigned(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 1)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1})
+	job := submit(t, s, &models.Job{Payload: "p"})
+	job, _ = s.store.Get(job.ID)
+	w, _ := s.workers.Get("w1")
+	startAttempt(job, "w1", "d1", time.Now())
+	s.store.Update(job)
+	assigned := *job
+
+	job.CancelRequested = true
+	s.store.Update(job)
+	s.dispatch(&assigned, w)
+	select {
+	case req := <-runs:
+		t.Fatalf("sent /run for %s after its cancel was requested", req.JobID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// delayed item is a job id that becomes runnable at a point in time
+type delayedItem struct {
+	jobID string
+	at    time.Time
+}
+
+// delayed heap is a min-heap by due time
+type delayedHeap []delayedItem
+
+func (h delayedHeap) Len() int            { return len(h) }
+func (h delayedHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h delayedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x interface{}) { *h = append(*h, x.(delayedItem)) }
+func (h *delayedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// delayed queue holds jobs that must not be queued before a given time: scheduled jobs
+// (run_at, delay_sec) and retries waiting out their backoff. like the main queue, removal
+// is lazy: due jobs are checked against the store before they are queued.
+type delayedQueue struct {
+	mu    sync.Mutex
+	items delayedHeap
+}
+
+func (d *delayedQueue) push(jobID string, at time.Time) {
+	d.mu.Lock()
+	heap.Push(&d.items, delayedItem{jobID: jobID, at: at})
+	d.mu.Unlock()
+}
+
+// pop due removes and returns the ids of jobs due at or before now
+func (d *delayedQueue) popDue(now time.Time) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var due []string
+	for d.items.Len() > 0 && !d.items[0].at.After(now) {
+		due = append(due, heap.Pop(&d.items).(delayedItem).jobID)
+	}
+	return due
+}
+
+func (d *delayedQueue) size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.items.Len()
+}
+
+// delayed returns the number of jobs waiting for their run time or retry backoff
+func (s *Scheduler) Delayed() int {
+	return s.delayed.size()
+}
+
+// promote due moves jobs whose time has come into the queue. scheduled jobs become queued;
+// retries are already queued and only need to go back in the heap. anything else was
+// cancelled or moved on while waiting and is dropped.
+func (s *Scheduler) promoteDue(now time.Time) {
+	for _, jobID := range s.delayed.popDue(now) {
+		job, ok := s.store.Get(jobID)
+		if !ok {
+			continue
+		}
+		switch job.Status {
+		case models.JobStatusScheduled:
+			job.Status = models.JobStatusQueued
+			if !s.store.Update(job) {
+				continue
+			}
+			log.Printf("event=job_due job_id=%s queue_depth=%d", job.ID, s.queue.Depth()+1)
+			s.publish(events.JobQueued, job, "run time reached")
+		case models.JobStatusQueued:
+		default:
+			continue
+		}
+		s.queue.Enqueue(job.ID, job.Tenant, job.Priority)
+	}
+}
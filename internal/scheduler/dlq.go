@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// err not dead lettered is returned when replaying or purging a job that is not in the dead-letter queue
+var ErrNotDeadLettered = errors.New("job is not in the dead-letter queue")
+
+// dead letter queue indexes the ids of failed jobs that ran out of retries. the failure details live
+// on the job itself (job.DeadLetter), so the index is rebuilt from the store on recover.
+type DeadLetterQueue struct {
+	mu  sync.RWMutex
+	ids map[string]struct{}
+}
+
+func newDeadLetterQueue() *DeadLetterQueue {
+	return &DeadLetterQueue{ids: make(map[string]struct{})}
+}
+
+func (q *DeadLetterQueue) add(jobID string) {
+	q.mu.Lock()
+	q.ids[jobID] = struct{}{}
+	q.mu.Unlock()
+}
+
+// remove drops the job id and reports whether it was present
+func (q *DeadLetterQueue) remove(jobID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.ids[jobID]; !ok {
+		return false
+	}
+	delete(q.ids, jobID)
+	return true
+}
+
+// size returns the number of dead-lettered jobs
+func (q *DeadLetterQueue) Size() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return len(q.ids)
+}
+
+func (q *DeadLetterQueue) snapshot() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	out := make([]string, 0, len(q.ids))
+	for id := range q.ids {
+		out = append(out, id)
+	}
+	return out
+}
+
+// replay options override fields of a dead-lettered job before it goes back to the queue
+type ReplayOptions struct {
+	Payload  *string
+	Priority *int
+}
+
+// dead letters returns the dead-letter queue
+func (s *Scheduler) DeadLetters() *DeadLetterQueue {
+	return s.dlq
+}
+
+// list dead letters returns dead-lettered jobs, most recently dead-lettered first
+func (s *Scheduler) ListDeadLetters() []*models.Job {
+	var jobs []*models.Job
+	for _, id := range s.dlq.snapshot() {
+		if job, ok := s.store.Get(id); ok && job.DeadLetter != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].DeadLetter.At.Equal(jobs[j].DeadLetter.At) {
+			return jobs[i].DeadLetter.At.After(jobs[j].DeadLetter.At)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// dead letter writes a job that just failed for good and moves it into the dead-letter queue.
+// returns false when the job was written since it was read, in which case it is left out.
+func (s *Scheduler) deadLetter(job *models.Job, reason, errClass string, now time.Time) bool {
+	job.DeadLetter = &models.DeadLetter{
+		Reason:     reason,
+		Error:      job.Error,
+		ErrorClass: errClass,
+		Attempts:   len(job.Attempts),
+		At:         now,
+	}
+	if !s.store.Update(job) {
+		return false
+	}
+	s.dlq.add(job.ID)
+	return true
+}
+
+// replay takes a job out of the dead-letter queue and re-queues it with a fresh retry budget.
+// its attempts history is kept, so earlier failures stay visible. like a submit it counts against
+// the tenant's queued quota and returns ErrTenantQueueFull when the tenant is at it.
+func (s *Scheduler) Replay(jobID string, opts ReplayOptions) (*models.Job, error) {
+	job, ok := s.store.Get(jobID)
+	if !ok || job.DeadLetter == nil {
+		return nil, ErrNotDeadLettered
+	}
+	s.admitMu.Lock()
+	if err := s.admit(job.Tenant, 1); err != nil {
+		s.admitMu.Unlock()
+		return nil, err
+	}
+	if !s.dlq.remove(jobID) {
+		s.admitMu.Unlock()
+		return nil, ErrNotDeadLettered
+	}
+	if opts.Payload != nil {
+		job.Payload = *opts.Payload
+	}
+	if opts.Priority != nil {
+		job.Priority = *opts.Priority
+	}
+	job.DeadLetter = nil
+	job.Replays++
+	job.RetryCount = 0
+	job.Error = ""
+	job.Result = ""
+	job.FinishedAt = nil
+	queued := s.requeue(job)
+	s.admitMu.Unlock()
+	if !queued {
+		return nil, ErrNotDeadLettered
+	}
+	log.Printf("event=job_replayed job_id=%s replays=%d priority=%d queue_depth=%d", job.ID, job.Replays, job.Priority, s.queue.Depth())
+	s.publish(events.JobReplayed, job, "")
+	// with on_failure=skip, descendants skipped because of this job become runnable again
+	s.jobFinished(job)
+	return job, nil
+}
+
+// purge removes a job from the dead-letter queue. the job itself stays in the store as failed.
+func (s *Scheduler) Purge(jobID string) error {
+	job, ok := s.store.Get(jobID)
+	if !ok || job.DeadLetter == nil || !s.dlq.remove(jobID) {
+		return ErrNotDeadLettered
+	}
+	job.DeadLetter = nil
+	s.store.Update(job)
+	log.Printf("event=dlq_purged job_id=%s", jobID)
+	return nil
+}
+
+// purge all empties the dead-letter queue and returns the number of jobs removed
+func (s *Scheduler) PurgeAll() int {
+	n := 0
+	for _, id := range s.dlq.snapshot() {
+		if s.Purge(id) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// recover dead letters rebuilds the dead-letter index from failed jobs in the store
+func (s *Scheduler) recoverDeadLetters() {
+	for _, job := range s.store.List(models.JobStatusFailed) {
+		if job.DeadLetter != nil {
+			s.dlq.add(job.ID)
+		}
+	}
+}
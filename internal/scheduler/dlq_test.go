@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+// dead lettered submits a job and fails its only attempt for good
+func deadLettered(t *testing.T, s *Scheduler, payload string) *models.Job {
+	t.Helper()
+	job := submit(t, s, &models.Job{Payload: payload})
+	job, retried := failAttempt(t, s, job.ID, models.ErrorClassValidation)
+	if retried || job.DeadLetter == nil {
+		t.Fatalf("job %s was not dead-lettered: %+v", job.ID, job)
+	}
+	return job
+}
+
+func TestDeadLettersListNewestFirstAndSurviveRecover(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	first := deadLettered(t, s, "a")
+	second := deadLettered(t, s, "b")
+
+	list := s.ListDeadLetters()
+	if len(list) != 2 || list[0].ID != second.ID || list[1].ID != first.ID {
+		t.Fatalf("dead letters = %v, want [%s %s]", jobIDList(list), second.ID, first.ID)
+	}
+	// a restarted scheduler on the same store rebuilds the index from the jobs
+	restarted := newTestSchedulerWithStore(t, s.store)
+	restarted.Recover()
+	if restarted.DeadLetters().Size() != 2 {
+		t.Fatalf("recovered %d dead letters, want 2", restarted.DeadLetters().Size())
+	}
+}
+
+func TestReplayRequeuesWithAFreshBudget(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	job := deadLettered(t, s, "old")
+
+	payload, priority := "new", 0
+	replayed, err := s.Replay(job.ID, ReplayOptions{Payload: &payload, Priority: &priority})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.store.Get(job.ID)
+	if got.Status != models.JobStatusQueued || got.DeadLetter != nil || got.Replays != 1 || got.RetryCount != 0 || got.Error != "" || got.FinishedAt != nil {
+		t.Fatalf("replayed job = %+v, want queued with a fresh budget", got)
+	}
+	if got.Payload != "new" || got.Priority != 0 || replayed.Payload != "new" {
+		t.Fatalf("replay overrides not applied: payload %q priority %d", got.Payload, got.Priority)
+	}
+	if len(got.Attempts) != 1 {
+		t.Fatalf("attempts = %d, want the failed one kept", len(got.Attempts))
+	}
+	if s.DeadLetters().Size() != 0 || s.queue.Depth() != 1 {
+		t.Fatalf("dlq size %d, queue depth %d; want 0 and 1", s.DeadLetters().Size(), s.queue.Depth())
+	}
+	if _, err := s.Replay(job.ID, ReplayOptions{}); err != ErrNotDeadLettered {
+		t.Fatalf("second replay = %v, want ErrNotDeadLettered", err)
+	}
+}
+
+func TestPurgeKeepsTheJobFailed(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	job := deadLettered(t, s, "a")
+	deadLettered(t, s, "b")
+	deadLettered(t, s, "c")
+
+	if err := s.Purge(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.store.Get(job.ID); got.Status != models.JobStatusFailed || got.DeadLetter != nil {
+		t.Fatalf("purged job = %s dead_letter=%v, want failed without a dead letter", got.Status, got.DeadLetter)
+	}
+	if err := s.Purge(job.ID); err != ErrNotDeadLettered {
+		t.Fatalf("second purge = %v, want ErrNotDeadLettered", err)
+	}
+	if n := s.PurgeAll(); n != 2 || s.DeadLetters().Size() != 0 {
+		t.Fatalf("purge all removed %d, left %d; want 2 and 0", n, s.DeadLetters().Size())
+	}
+}
+
+func jobIDList(jobs []*models.Job) []string {
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.ID
+	}
+	return ids
+}
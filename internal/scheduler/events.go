@@ -0,0 +1,33 @@
+package scheduler
+
+import (
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// number of recent events kept for clients that resume with last-event-id
+const eventBufferSize = 1000
+
+// events returns the bus that carries job and worker state changes
+func (s *Scheduler) Events() *events.Bus {
+	return s.events
+}
+
+// publish puts a job's state change on the event bus; msg carries the error or reason, if any
+func (s *Scheduler) publish(typ string, job *models.Job, msg string) {
+	s.events.Publish(events.Event{Type: typ, JobID: job.ID, JobType: job.Type, Status: string(job.Status), WorkerID: job.WorkerID, Tenant: models.TenantOrDefault(job.Tenant), Message: msg})
+}
+
+// on finish registers fn to be called whenever a job reaches a final status (completed, failed,
+// cancelled or skipped). fn gets its own deep copy of the job and must not block. register hooks before start.
+func (s *Scheduler) OnFinish(fn func(*models.Job)) {
+	s.finishHooks = append(s.finishHooks, fn)
+}
+
+// finished runs the finish hooks and wakes blocking waiters for a job that just reached a final status
+func (s *Scheduler) finished(job *models.Job) {
+	s.wakeWaiters(job.ID)
+	for _, fn := range s.finishHooks {
+		fn(job.Clone())
+	}
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+func TestJobLifecyclePublishesEvents(t *testing.T) {
+	s := newTestScheduler(t)
+	sub, _, _ := s.Events().Subscribe(0)
+	defer sub.Close()
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submitted := submit(t, s, &models.Job{Type: "email", Payload: "p", Tenant: "acme"})
+	job, _ := leaseNow(t, s, "w1", time.Minute)
+	s.Complete(job, "done")
+
+	for _, want := range []struct {
+		typ, status, worker string
+	}{
+		{events.JobSubmitted, "queued", ""},
+		{events.JobAssigned, "running", "w1"},
+		{events.JobCompleted, "completed", "w1"},
+	} {
+		e := <-sub.C
+		if e.Type != want.typ || e.Status != want.status || e.WorkerID != want.worker || e.JobID != submitted.ID || e.JobType != "email" || e.Tenant != "acme" {
+			t.Fatalf("event = %+v, want %s with status %s on %q", e, want.typ, want.status, want.worker)
+		}
+	}
+
+	// finish hooks get the final job, each its own copy down to the attempts and the retry policy
+	var hooked *models.Job
+	s.OnFinish(func(j *models.Job) {
+		j.Attempts[0].Error = "changed by a hook"
+		j.RetryPolicy.MaxAttempts = 9
+	})
+	s.OnFinish(func(j *models.Job) { hooked = j })
+	failed := submit(t, s, &models.Job{Payload: "p", RetryPolicy: &models.RetryPolicy{MaxAttempts: 1}})
+	job, _ = leaseNow(t, s, "w1", time.Minute)
+	s.FailAttempt(job, models.ErrorClassExecution, "boom")
+	if hooked == nil || hooked.ID != failed.ID || hooked.Status != models.JobStatusFailed || hooked == job {
+		t.Fatalf("finish hook got %+v, want a copy of the failed job", hooked)
+	}
+	if hooked.Attempts[0].Error != "boom" || hooked.RetryPolicy.MaxAttempts != 1 || job.Attempts[0].Error != "boom" || job.RetryPolicy.MaxAttempts != 1 {
+		t.Fatalf("a hook's change reached another hook or the caller: %+v / %+v", hooked.Attempts[0], job.Attempts[0])
+	}
+}
@@ -0,0 +1,261 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+const (
+	defaultVisibilityTimeout = 60 * time.Second
+	maxVisibilityTimeout     = 15 * time.Minute
+	maxLeaseWait             = 60 * time.Second
+	leasePollInterval        = 200 * time.Millisecond
+)
+
+var (
+	// err lease not found is returned when the job has no active lease (expired, acked or never leased)
+	ErrLeaseNotFound = errors.New("lease not found or expired")
+	// err lease mismatch is returned when the caller's lease id is not the job's current lease
+	ErrLeaseMismatch = errors.New("lease id does not match the job's current lease")
+)
+
+// lease is a pull worker's claim on a job. if it is not extended or acked before expires_at,
+// the job goes back to the queue and can be leased by another worker.
+type Lease struct {
+	ID        string    `json:"lease_id"`
+	JobID     string    `json:"job_id"`
+	WorkerID  string    `json:"worker_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// set in answers to extensions once the job was cancelled; the worker should stop it and nack
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+}
+
+func clampVisibility(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultVisibilityTimeout
+	}
+	if d > maxVisibilityTimeout {
+		return maxVisibilityTimeout
+	}
+	return d
+}
+
+// lease long-polls the queue for up to wait and claims the next job for workerID with the given
+// visibility timeout. returns nil, nil when nothing became available in time.
+func (s *Scheduler) Lease(ctx context.Context, workerID string, wait, visibility time.Duration) (*models.Job, *Lease, error) {
+	if wait > maxLeaseWait {
+		wait = maxLeaseWait
+	}
+	visibility = clampVisibility(visibility)
+	deadline := time.Now().Add(wait)
+	for {
+		// taken before looking, so a job enqueued in between still wakes us
+		ready := s.queue.Ready()
+		// a worker with every slot taken gets nothing until one frees up
+		if w, ok := s.workers.Get(workerID); ok && w.FreeSlots() > 0 {
+			if job := s.dequeueFor(w); job != nil {
+				if lease := s.grantLease(job, workerID, visibility); lease != nil {
+					return job, lease, nil
+				}
+				// the job changed after it was dequeued; look again
+				continue
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-s.stop:
+			return nil, nil, nil
+		case <-ready:
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// dequeue for returns the first runnable job the worker can run. jobs it can't run are put back
+// in the queue, and marked unschedulable if no other worker can run them either.
+func (s *Scheduler) dequeueFor(w *models.Worker) *models.Job {
+	var held []*queueItem
+	defer func() { s.queue.putBack(s.queuedPriority, held...) }()
+	var workers []*models.Worker
+	limits := s.runningLimits()
+	for {
+		job, item := s.dequeueRunnable(limits)
+		if job == nil {
+			return nil
+		}
+		if ok, _ := w.CanRun(job); ok {
+			s.recordWait(item, time.Now())
+			return job
+		}
+		held = append(held, item)
+		if workers == nil {
+			workers = s.workers.List()
+		}
+		s.markUnschedulable(job, workers)
+	}
+}
+
+// dequeue runnable takes queue items of tenants under their running limit until one refers to a job
+// that still needs to run, and returns the job with its item for putting it back
+func (s *Scheduler) dequeueRunnable(limits *runningLimits) (*models.Job, *queueItem) {
+	for {
+		item := s.queue.take(limits.allow)
+		if item == nil {
+			return nil, nil
+		}
+		job, ok := s.store.Get(item.jobID)
+		if ok && job.Status == models.JobStatusQueued {
+			return job, item
+		}
+	}
+}
+
+// grant lease starts the job's attempt under a new lease for workerID. returns nil when the job was
+// written since it was dequeued (e.g. cancelled), in which case it is left alone.
+func (s *Scheduler) grantLease(job *models.Job, workerID string, visibility time.Duration) *Lease {
+	now := time.Now()
+	lease := &Lease{ID: models.MustGenerateID(), JobID: job.ID, WorkerID: workerID, ExpiresAt: now.Add(visibility)}
+	startAttempt(job, workerID, lease.ID, now)
+	job.LeaseID = lease.ID
+	job.LeaseExpiresAt = &lease.ExpiresAt
+	if !s.store.Update(job) {
+		return nil
+	}
+
+	s.leaseMu.Lock()
+	s.leases[job.ID] = lease
+	s.leaseMu.Unlock()
+	s.queue.Charge(job.Tenant)
+
+	s.workers.Update(workerID, func(w *models.Worker) { w.Assign(job.ID) })
+	log.Printf("event=job_leased job_id=%s worker_id=%s lease_id=%s visibility_sec=%.0f queue_depth=%d", job.ID, workerID, lease.ID, visibility.Seconds(), s.queue.Depth())
+	s.publish(events.JobAssigned, job, "leased")
+	// extensions change the stored lease; the caller gets its own copy
+	copied := *lease
+	return &copied
+}
+
+// extend lease pushes the expiry of the job's lease to now + visibility. the expiry only moves in
+// memory: writing the job on every extension would race the worker's ack or nack for its revision.
+func (s *Scheduler) ExtendLease(jobID, leaseID string, visibility time.Duration) (*Lease, error) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	lease, err := s.checkLeaseLocked(jobID, leaseID)
+	if err != nil {
+		return nil, err
+	}
+	lease.ExpiresAt = time.Now().Add(clampVisibility(visibility))
+	copied := *lease
+	if job, ok := s.store.Get(jobID); ok {
+		copied.CancelRequested = job.CancelRequested
+	}
+	return &copied, nil
+}
+
+// lease expires at returns when the job's current lease runs out, extensions included
+func (s *Scheduler) LeaseExpiresAt(jobID string) (time.Time, bool) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	lease, ok := s.leases[jobID]
+	if !ok {
+		return time.Time{}, false
+	}
+	return lease.ExpiresAt, true
+}
+
+// leased job returns the job read while lease id is its current lease; used by ack and nack. the
+// lease is kept: finishing the job drops it once the outcome is written, and a finish that loses to
+// another write (e.g. a cancel) leaves it in place, to be tried again or to run out.
+func (s *Scheduler) LeasedJob(jobID, leaseID string) (*models.Job, error) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	if _, err := s.checkLeaseLocked(jobID, leaseID); err != nil {
+		return nil, err
+	}
+	job, ok := s.store.Get(jobID)
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	return job, nil
+}
+
+func (s *Scheduler) checkLeaseLocked(jobID, leaseID string) (*Lease, error) {
+	lease, ok := s.leases[jobID]
+	if !ok || time.Now().After(lease.ExpiresAt) {
+		return nil, ErrLeaseNotFound
+	}
+	if lease.ID != leaseID {
+		return nil, ErrLeaseMismatch
+	}
+	return lease, nil
+}
+
+func (s *Scheduler) dropLease(jobID string) {
+	s.leaseMu.Lock()
+	delete(s.leases, jobID)
+	s.leaseMu.Unlock()
+}
+
+// expire leases re-queues jobs whose lease ran out without an ack, nack or extension
+func (s *Scheduler) expireLeases() {
+	now := time.Now()
+	var expired []*Lease
+	s.leaseMu.Lock()
+	for jobID, lease := range s.leases {
+		if now.After(lease.ExpiresAt) {
+			expired = append(expired, lease)
+			delete(s.leases, jobID)
+		}
+	}
+	s.leaseMu.Unlock()
+	for _, lease := range expired {
+		job, ok := s.store.Get(lease.JobID)
+		if !ok || job.Status != models.JobStatusRunning || job.LeaseID != lease.ID {
+			continue
+		}
+		log.Printf("event=lease_expired job_id=%s worker_id=%s lease_id=%s", job.ID, lease.WorkerID, lease.ID)
+		s.FailAttempt(job, models.ErrorClassDispatch, "lease expired")
+	}
+}
+
+// requeue frees the job's worker and puts it back in the queue (e.g. after a nack with requeue).
+// a job cancelled while it ran is finished as cancelled instead. returns false when the job was
+// written since it was read; nothing is changed then.
+func (s *Scheduler) Requeue(job *models.Job) bool {
+	if job.CancelRequested {
+		return s.FinishCancelled(job, "", "cancelled")
+	}
+	closeAttempt(job, time.Now(), "released by worker", "")
+	if !s.requeue(job) {
+		return false
+	}
+	s.publish(events.JobQueued, job, "released by worker")
+	return true
+}
+
+// requeue puts a running job back in the queue with its worker and lease cleared, freeing its slot
+// before it can be leased again. returns false when the job was written since it was read, in which
+// case nothing is freed and it is not enqueued.
+func (s *Scheduler) requeue(job *models.Job) bool {
+	workerID := job.WorkerID
+	job.Status = models.JobStatusQueued
+	job.StartedAt = nil
+	job.WorkerID = ""
+	job.LeaseID = ""
+	job.LeaseExpiresAt = nil
+	if !s.store.Update(job) {
+		return false
+	}
+	s.OnJobComplete(job.ID, workerID)
+	s.queue.Enqueue(job.ID, job.Tenant, job.Priority)
+	return true
+}
@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+// lease now leases without waiting and fails the test when nothing is handed out
+func leaseNow(t *testing.T, s *Scheduler, workerID string, visibility time.Duration) (*models.Job, *Lease) {
+	t.Helper()
+	job, lease, err := s.Lease(t.Context(), workerID, 0, visibility)
+	if err != nil || job == nil || lease == nil {
+		t.Fatalf("lease for %s: %v %v %v", workerID, job, lease, err)
+	}
+	return job, lease
+}
+
+func TestLeaseClaimsJobAndTakesASlot(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submitted := submit(t, s, &models.Job{Payload: "p"})
+	submit(t, s, &models.Job{Payload: "q"})
+
+	job, lease := leaseNow(t, s, "w1", time.Minute)
+	if job.ID != submitted.ID || lease.JobID != job.ID || lease.WorkerID != "w1" {
+		t.Fatalf("leased %s with %+v, want %s for w1", job.ID, lease, submitted.ID)
+	}
+	stored, _ := s.store.Get(job.ID)
+	if stored.Status != models.JobStatusRunning || stored.LeaseID != lease.ID || stored.WorkerID != "w1" || stored.AttemptToken == "" {
+		t.Fatalf("stored job = %+v, want running under the lease", stored)
+	}
+	// the only slot is taken, so the second job stays queued
+	if job, _, _ := s.Lease(t.Context(), "w1", 0, time.Minute); job != nil {
+		t.Fatalf("a full worker leased %s", job.ID)
+	}
+	if s.queue.Depth() != 1 {
+		t.Fatalf("queue depth = %d, want 1", s.queue.Depth())
+	}
+}
+
+func TestLeaseWaitsForAJobToArrive(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Submit(&models.Job{Payload: "late"})
+	}()
+	start := time.Now()
+	job, _, err := s.Lease(t.Context(), "w1", 5*time.Second, time.Minute)
+	if err != nil || job == nil || job.Payload != "late" {
+		t.Fatalf("lease = %v, %v; want the late job", job, err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("lease took %v to see the enqueue", waited)
+	}
+	if job, _, _ := s.Lease(t.Context(), "w1", 10*time.Millisecond, time.Minute); job != nil {
+		t.Fatal("lease on an empty queue returned a job")
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submit(t, s, &models.Job{Payload: "p"})
+	job, lease := leaseNow(t, s, "w1", time.Minute)
+
+	if _, err := s.ExtendLease(job.ID, "other", time.Minute); err != ErrLeaseMismatch {
+		t.Fatalf("extend with another lease id = %v, want ErrLeaseMismatch", err)
+	}
+	extended, err := s.ExtendLease(job.ID, lease.ID, 10*time.Minute)
+	if err != nil || !extended.ExpiresAt.After(lease.ExpiresAt) {
+		t.Fatalf("extend = %+v, %v; want a later expiry than %v", extended, err, lease.ExpiresAt)
+	}
+	if expires, ok := s.LeaseExpiresAt(job.ID); !ok || !expires.Equal(extended.ExpiresAt) {
+		t.Fatalf("lease expires at %v, want %v", expires, extended.ExpiresAt)
+	}
+	// the job is not written, so an ack working from the copy read before stays current
+	if stored, _ := s.store.Get(job.ID); stored.Revision != job.Revision {
+		t.Fatalf("extension wrote the job: revision %d, want %d", stored.Revision, job.Revision)
+	}
+	if !s.Complete(job, "done") {
+		t.Fatal("complete after an extension was not written")
+	}
+	if _, err := s.ExtendLease(job.ID, lease.ID, time.Minute); err != ErrLeaseNotFound {
+		t.Fatalf("extend after complete = %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func TestExpiredLeaseRetriesTheJob(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submit(t, s, &models.Job{Payload: "p"})
+	job, lease := leaseNow(t, s, "w1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	s.expireLeases()
+	stored, _ := s.store.Get(job.ID)
+	if stored.Status != models.JobStatusQueued || stored.RetryCount != 1 || stored.LeaseID != "" || stored.WorkerID != "" {
+		t.Fatalf("job after expiry = %+v, want queued for a retry with the lease cleared", stored)
+	}
+	if a := stored.Attempts[0]; a.FinishedAt == nil || a.Error != "lease expired" || a.ErrorClass != models.ErrorClassDispatch {
+		t.Fatalf("attempt = %+v, want closed as lease expired", a)
+	}
+	if s.Delayed() != 1 {
+		t.Fatalf("delayed = %d, want the job waiting out its backoff", s.Delayed())
+	}
+	if w, _ := s.workers.Get("w1"); w.FreeSlots() != 1 {
+		t.Fatalf("slot not freed: %v", w.RunningJobs)
+	}
+	if _, err := s.ExtendLease(job.ID, lease.ID, time.Minute); err != ErrLeaseNotFound {
+		t.Fatalf("extend of an expired lease = %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func TestRequeueReturnsJobWithoutChargingARetry(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submit(t, s, &models.Job{Payload: "p"})
+	job, lease := leaseNow(t, s, "w1", time.Minute)
+	job, err := s.LeasedJob(job.ID, lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Requeue(job) {
+		t.Fatal("requeue was not written")
+	}
+	if _, err := s.LeasedJob(job.ID, lease.ID); err != ErrLeaseNotFound {
+		t.Fatalf("lease after requeue = %v, want ErrLeaseNotFound", err)
+	}
+	stored, _ := s.store.Get(job.ID)
+	if stored.Status != models.JobStatusQueued || stored.RetryCount != 0 || stored.WorkerID != "" {
+		t.Fatalf("job after requeue = %+v, want queued with no retry charged", stored)
+	}
+	if again, _ := leaseNow(t, s, "w1", time.Minute); again.ID != job.ID || len(again.Attempts) != 2 {
+		t.Fatalf("re-leased %s with %d attempts, want %s on its second attempt", again.ID, len(again.Attempts), job.ID)
+	}
+}
+
+func TestLeaseSkipsJobsTheWorkerCannotRun(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1, Labels: map[string]string{"zone": "a"}})
+	other := submit(t, s, &models.Job{Payload: "p", Constraints: &models.JobConstraints{NodeSelector: map[string]string{"zone": "b"}}})
+	mine := submit(t, s, &models.Job{Payload: "p", Constraints: &models.JobConstraints{NodeSelector: map[string]string{"zone": "a"}}})
+
+	if job, _ := leaseNow(t, s, "w1", time.Minute); job.ID != mine.ID {
+		t.Fatalf("leased %s, want the job for zone a", job.ID)
+	}
+	job, _ := s.store.Get(other.ID)
+	if job.Status != models.JobStatusQueued || job.UnschedulableReason != "no worker matches: label zone=b missing" {
+		t.Fatalf("zone b job = %s %q, want queued with a reason", job.Status, job.UnschedulableReason)
+	}
+	if got := s.queue.Dequeue(); got != other.ID {
+		t.Fatalf("queue holds %q, want the zone b job put back", got)
+	}
+}
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// weight of the newest run in the average run time
+const runAvgWeight = 0.2
+
+var (
+	// ErrJobStarted is returned when a job that has started or finished is reprioritized
+	ErrJobStarted = errors.New("job has already started")
+	// ErrJobChanged is returned when the job was written by someone else while it was being changed
+	ErrJobChanged = errors.New("job changed meanwhile, read it again")
+)
+
+// reprioritize changes the priority of a job that has not started. a queued job is moved in place
+// and keeps its place among jobs of its new priority submitted after it, also when a dispatch pass
+// holds it just then (see queued priority); a job that is not in the queue yet (pending, scheduled
+// or in retry backoff) goes in with the new priority.
+func (s *Scheduler) Reprioritize(job *models.Job, priority int) error {
+	if job.Status != models.JobStatusPending && job.Status != models.JobStatusQueued && job.Status != models.JobStatusScheduled {
+		return ErrJobStarted
+	}
+	old := job.Priority
+	job.Priority = priority
+	if !s.store.Update(job) {
+		job.Priority = old
+		return ErrJobChanged
+	}
+	if job.Status == models.JobStatusQueued {
+		s.queue.Update(job.ID, priority)
+	}
+	log.Printf("event=job_reprioritized job_id=%s status=%s priority_from=%d priority_to=%d", job.ID, job.Status, old, priority)
+	s.publish(events.JobReprioritized, job, "")
+	return nil
+}
+
+// queued priority returns the job's priority as stored and whether it is still queued, for putting
+// back the jobs a dispatch pass held: a reprioritize that found the job out of the queue wrote only
+// the store
+func (s *Scheduler) queuedPriority(jobID string) (int, bool) {
+	job, ok := s.store.Get(jobID)
+	if !ok || job.Status != models.JobStatusQueued {
+		return 0, false
+	}
+	return job.Priority, true
+}
+
+// position reports where a queued job stands and, once a job has completed to go by, when it
+// should start. returns false when the job is not in the queue.
+func (s *Scheduler) Position(job *models.Job) (*models.JobPosition, bool) {
+	pos, ok := s.queue.Position(job.ID)
+	if !ok {
+		return nil, false
+	}
+	out := &models.JobPosition{
+		JobID:             job.ID,
+		Position:          pos.Ahead + 1,
+		QueueDepth:        pos.Depth,
+		Priority:          job.Priority,
+		EffectivePriority: pos.EffectivePriority,
+	}
+	if at, ok := s.estimateStart(pos.Ahead, time.Now()); ok {
+		out.EstimatedStartAt = &at
+	}
+	return out, true
+}
+
+// estimate start guesses when a job with ahead jobs before it starts: every running job and every
+// job ahead needs a slot before it, and each slot frees up once per average run. it ignores job types,
+// constraints and jobs submitted later at a better priority, so it is a rough guide.
+func (s *Scheduler) estimateStart(ahead int, now time.Time) (time.Time, bool) {
+	s.runMu.Lock()
+	avg, runs := s.avgRun, s.runs
+	s.runMu.Unlock()
+	slots, busy := 0, 0
+	for _, w := range s.workers.List() {
+		slots += w.Slots()
+		busy += len(w.RunningJobs)
+	}
+	if runs == 0 || slots == 0 {
+		return time.Time{}, false
+	}
+	waiting := busy + ahead + 1 - slots
+	if waiting <= 0 {
+		return now, true
+	}
+	return now.Add(time.Duration(float64(avg) * float64(waiting) / float64(slots))), true
+}
+
+// record run folds the run time of a completed job into the moving average
+func (s *Scheduler) recordRun(job *models.Job, now time.Time) {
+	if job.StartedAt == nil {
+		return
+	}
+	d := now.Sub(*job.StartedAt)
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if s.runs == 0 {
+		s.avgRun = d
+	} else {
+		s.avgRun += time.Duration(runAvgWeight * float64(d-s.avgRun))
+	}
+	s.runs++
+}
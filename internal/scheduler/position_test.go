@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestReprioritizeWhileADispatchPassHoldsTheJob(t *testing.T) {
+	s := newTestScheduler(t)
+	job := submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityLow})
+	other := submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityNormal})
+
+	// the pass took the normal job and finds no worker for it
+	held, item := s.dequeueRunnable(nil)
+	if held.ID != other.ID {
+		t.Fatalf("dequeued %s, want the normal job", held.ID)
+	}
+	if err := s.Reprioritize(held, models.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	s.queue.putBack(s.queuedPriority, item)
+	if pos, _ := s.queue.Position(other.ID); pos.EffectivePriority != models.PriorityLow || pos.Ahead != 1 {
+		t.Fatalf("position after put back = %+v, want low priority behind %s", pos, job.ID)
+	}
+}
+
+func TestReprioritize(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	first := submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityNormal})
+	second := submit(t, s, &models.Job{Payload: "p", Priority: models.PriorityNormal})
+	if err := s.Reprioritize(second, models.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.store.Get(second.ID); got.Priority != models.PriorityHigh {
+		t.Fatalf("stored priority = %d, want high", got.Priority)
+	}
+	leased, _ := leaseNow(t, s, "w1", time.Minute)
+	if leased.ID != second.ID {
+		t.Fatalf("leased %s, want the reprioritized job", leased.ID)
+	}
+	if err := s.Reprioritize(leased, models.PriorityLow); !errors.Is(err, ErrJobStarted) {
+		t.Fatalf("reprioritize a running job = %v, want ErrJobStarted", err)
+	}
+
+	// a copy read before someone else wrote the job is refused
+	stale, _ := s.store.Get(first.ID)
+	fresh, _ := s.store.Get(first.ID)
+	if err := s.Reprioritize(fresh, models.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reprioritize(stale, models.PriorityHigh); !errors.Is(err, ErrJobChanged) || stale.Priority != models.PriorityNormal {
+		t.Fatalf("reprioritize a stale copy = %v with priority %d, want ErrJobChanged and it unchanged", err, stale.Priority)
+	}
+	if pos, _ := s.queue.Position(first.ID); pos.EffectivePriority != models.PriorityLow {
+		t.Fatalf("queued at %d, want low", pos.EffectivePriority)
+	}
+}
+
+func TestPositionEstimatesTheStart(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	var jobs []*models.Job
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, submit(t, s, &models.Job{Payload: "p"}))
+	}
+	pos, ok := s.Position(jobs[2])
+	if !ok || pos.Position != 3 || pos.QueueDepth != 3 || pos.EstimatedStartAt != nil {
+		t.Fatalf("position = %+v, want third with no estimate before any run", pos)
+	}
+
+	// one run of a minute: the third job waits for the running one and the one ahead of it
+	leased, _ := leaseNow(t, s, "w1", time.Minute)
+	started := time.Now().Add(-time.Minute)
+	leased.StartedAt = &started
+	s.Complete(leased, "done")
+	leaseNow(t, s, "w1", time.Minute)
+	pos, _ = s.Position(jobs[2])
+	if pos.Position != 1 || pos.EstimatedStartAt == nil {
+		t.Fatalf("position = %+v, want first with an estimate", pos)
+	}
+	if wait := time.Until(*pos.EstimatedStartAt); wait < 50*time.Second || wait > time.Minute {
+		t.Fatalf("estimated start in %s, want about a minute", wait)
+	}
+	if _, ok := s.Position(leased); ok {
+		t.Fatal("finished job has a position")
+	}
+}
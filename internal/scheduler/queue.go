@@ -2,93 +2,496 @@ package scheduler
 
 import (
    "container/heap"
+   "math"
+   "sort"
    "sync"
+   "time"
+
+   "cloud/pkg/models"
 )
 
-// queue item is one entry in the priority queue (min-heap by priority, then sequence)
+var timeNow = func() time.Time { return time.Now() }
+
+// queue item is one entry in a tenant's priority queue (min-heap by rank, then sequence)
 type queueItem struct {
-   jobID    string
-   priority int
-   sequence uint64
+   jobID      string
+   tenant     string
+   priority   int
+   sequence   uint64
+   enqueuedAt time.Time
+   // for a job that ages, its priority plus the aging steps taken before it was enqueued: every
+   // queued job takes its steps at the same moments, so at any moment rank minus the steps taken
+   // so far is the job's effective priority, and ordering by rank is ordering by it. for the others
+   // the effective priority itself, which no longer changes.
+   rank  int
+   fixed bool // no longer ages, and so sits in its tenant's fixed heap
+   index int  // position in its tenant's heap, -1 once out of it
 }
 
-// priority queue implements heap.interface; min by priority, then by sequence (fifo tie-break)
+// priority queue implements heap.interface; min by rank, then by sequence (fifo tie-break)
 type priorityQueue []*queueItem
 
 func (pq priorityQueue) Len() int { return len(pq) }
 func (pq priorityQueue) Less(i, j int) bool {
-   if pq[i].priority != pq[j].priority {
-       return pq[i].priority < pq[j].priority
+   if pq[i].rank != pq[j].rank {
+       return pq[i].rank < pq[j].rank
    }
    return pq[i].sequence < pq[j].sequence
 }
-func (pq priorityQueue) Swap(i, j int)       { pq[i], pq[j] = pq[j], pq[i] }
-func (pq *priorityQueue) Push(x interface{}) { *pq = append(*pq, x.(*queueItem)) }
+func (pq priorityQueue) Swap(i, j int) {
+   pq[i], pq[j] = pq[j], pq[i]
+   pq[i].index = i
+   pq[j].index = j
+}
+func (pq *priorityQueue) Push(x interface{}) {
+   item := x.(*queueItem)
+   item.index = len(*pq)
+   *pq = append(*pq, item)
+}
 func (pq *priorityQueue) Pop() interface{} {
    old := *pq
    n := len(old)
    item := old[n-1]
+   old[n-1] = nil
+   item.index = -1
    *pq = old[0 : n-1]
    return item
 }
 
-// queue is an in-memory priority queue of job ids (min-heap by priority, fifo tie-break).
-// cancel is lazy: removed ids are skipped when popping.
+// tenant queue holds one tenant's job ids in two heaps: heap for the jobs that age, fixed for those
+// at or above the highest priority aging reaches, which don't, and for those that aged all the way
+// up to it. both order by effective priority, then sequence. pass is the tenant's virtual time for
+// stride scheduling: every job it starts advances it by 1/weight, and among tenants waiting at the
+// same priority the one with the lowest pass goes next, so each gets dispatches in proportion to its
+// weight.
+type tenantQueue struct {
+   heap  priorityQueue
+   fixed priorityQueue
+   pass  float64
+}
+
+// heap of returns the heap the item belongs in
+func (tq *tenantQueue) heapOf(item *queueItem) *priorityQueue {
+   if item.fixed {
+       return &tq.fixed
+   }
+   return &tq.heap
+}
+
+func (tq *tenantQueue) len() int { return tq.heap.Len() + tq.fixed.Len() }
+
+// queue is an in-memory priority queue of job ids, min-heaps (by priority, fifo tie-break) per tenant.
+// strict priority holds across tenants; within the best waiting priority, tenants share dispatches by weight.
+// every item knows its heap index, so a job id is removed or moved in place in o(log n).
 type Queue struct {
-   mu        sync.Mutex
-   heap      priorityQueue
-   cancelled map[string]struct{}
-   sequence  uint64
-   activeCount int
+   mu       sync.Mutex
+   tenants  map[string]*tenantQueue
+   items    map[string]*queueItem // queued items by job id
+   sequence uint64
+   weight   func(tenant string) int
+   ready    chan struct{} // closed and replaced on every enqueue
+   aging    time.Duration // a waiting job's priority improves by one per aging; 0 turns aging off
+   highest  int           // aging stops at this priority
+   epoch    time.Time     // aging steps are counted in intervals from here
 }
 
 // new queue creates a new priority queue
 func NewQueue() *Queue {
-   q := &Queue{
-       heap:      make(priorityQueue, 0),
-       cancelled: make(map[string]struct{}),
+   return &Queue{
+       tenants: make(map[string]*tenantQueue),
+       items:   make(map[string]*queueItem),
+       ready:   make(chan struct{}),
+       epoch:   timeNow(),
    }
-   heap.Init(&q.heap)
-   return q
 }
 
-// enqueue adds a job id with the given priority (lower value = higher priority, dispatched first)
-func (q *Queue) Enqueue(jobID string, priority int) {
+// set aging makes a waiting job's effective priority improve by one level per interval it has
+// waited, down to highest, so a stream of urgent jobs can't starve the rest. 0 turns aging off.
+// the intervals are counted from the queue's creation and every waiting job steps up at their end,
+// so a job's first step comes within one interval of its enqueue, and jobs at the same effective
+// priority stay in fifo order. call it before anything is enqueued.
+func (q *Queue) SetAging(interval time.Duration, highest int) {
    q.mu.Lock()
    defer q.mu.Unlock()
-   q.sequence++
-   heap.Push(&q.heap, &queueItem{jobID: jobID, priority: priority, sequence: q.sequence})
-   q.activeCount++
+   q.aging = interval
+   q.highest = highest
 }
 
-// dequeue removes and returns the highest-priority job id (smallest priority value, oldest sequence on tie), or "" if empty.
-// cancelled ids are skipped (lazy removal).
-func (q *Queue) Dequeue() string {
+// effective priority locked returns the item's priority after aging
+func (q *Queue) effectivePriorityLocked(item *queueItem, now time.Time) int {
+   if item.fixed {
+       return item.rank
+   }
+   return max(item.rank-q.stepsLocked(now), q.highest)
+}
+
+// steps locked returns the aging steps every waiting job has taken by t
+func (q *Queue) stepsLocked(t time.Time) int {
+   if q.aging <= 0 || !t.After(q.epoch) {
+       return 0
+   }
+   return int(t.Sub(q.epoch) / q.aging)
+}
+
+// ready returns a channel that is closed the next time a job id is enqueued. fetch a new one after
+// each wakeup; any number of goroutines may wait on it.
+func (q *Queue) Ready() <-chan struct{} {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   return q.ready
+}
+
+// set weights sets the fair-share weight of each tenant (default 1 when nil or below 1)
+func (q *Queue) SetWeights(weight func(tenant string) int) {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   q.weight = weight
+}
+
+// enqueue adds a job id for the tenant with the given priority (lower value = higher priority, dispatched first)
+// and wakes whoever waits on ready. a job id already in the queue is moved to the new position.
+func (q *Queue) Enqueue(jobID, tenant string, priority int) {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   q.enqueueLocked(jobID, tenant, priority)
+   close(q.ready)
+   q.ready = make(chan struct{})
+}
+
+// put back returns items a dispatch pass took out and could not place to the exact position they
+// had, ahead of anything enqueued since at their priority, so fifo holds however often a job is
+// passed over. items whose job id was enqueued again meanwhile are dropped. it does not wake the
+// waiters, who would only find the same jobs with nowhere to go, and charges no fair share.
+// current, when set, returns a job's priority now and whether it still waits: a job reprioritized
+// while the pass held it goes back at its new priority, and one that no longer waits is dropped.
+// current is called with the queue locked and must not use the queue.
+func (q *Queue) putBack(current func(jobID string) (priority int, queued bool), items ...*queueItem) {
    q.mu.Lock()
    defer q.mu.Unlock()
-   for q.heap.Len() > 0 {
-       item := heap.Pop(&q.heap).(*queueItem)
-       if _, cancelled := q.cancelled[item.jobID]; cancelled {
-           delete(q.cancelled, item.jobID)
+   for _, item := range items {
+       if _, queued := q.items[item.jobID]; queued {
            continue
        }
-       q.activeCount--
+       if current != nil {
+           priority, queued := current(item.jobID)
+           if !queued {
+               continue
+           }
+           if priority != item.priority {
+               item.priority = priority
+               q.placeLocked(item, timeNow())
+           }
+       }
+       tq := q.tenants[item.tenant]
+       if tq == nil {
+           tq = &tenantQueue{pass: q.minPassLocked()}
+           q.tenants[item.tenant] = tq
+       }
+       heap.Push(tq.heapOf(item), item)
+       q.items[item.jobID] = item
+   }
+}
+
+func (q *Queue) enqueueLocked(jobID, tenant string, priority int) {
+   q.removeLocked(jobID)
+   tenant = models.TenantOrDefault(tenant)
+   tq := q.tenants[tenant]
+   if tq == nil {
+       tq = &tenantQueue{}
+       q.tenants[tenant] = tq
+   }
+   if tq.len() == 0 {
+       // a tenant that comes back starts level with the waiting ones instead of catching up on idle time
+       if min := q.minPassLocked(); tq.pass < min {
+           tq.pass = min
+       }
+   }
+   q.sequence++
+   now := timeNow()
+   item := &queueItem{jobID: jobID, tenant: tenant, priority: priority, sequence: q.sequence, enqueuedAt: now}
+   q.placeLocked(item, now)
+   heap.Push(tq.heapOf(item), item)
+   q.items[jobID] = item
+}
+
+// place locked sets the item's rank and heap for its priority: fixed unless it still has aging to do
+func (q *Queue) placeLocked(item *queueItem, now time.Time) {
+   item.fixed, item.rank = true, item.priority
+   if q.aging <= 0 || item.priority <= q.highest {
+       return
+   }
+   if rank := item.priority + q.stepsLocked(item.enqueuedAt); rank-q.stepsLocked(now) > q.highest {
+       item.fixed, item.rank = false, rank
+   } else {
+       item.rank = q.highest
+   }
+}
+
+// settle locked moves the tenant's jobs that aged all the way up since the last look from its aging
+// heap to its fixed heap, where they order by sequence among the others at the highest priority
+func (q *Queue) settleLocked(tq *tenantQueue, now time.Time) {
+   steps := q.stepsLocked(now)
+   for tq.heap.Len() > 0 && tq.heap[0].rank-steps <= q.highest {
+       item := heap.Pop(&tq.heap).(*queueItem)
+       item.fixed, item.rank = true, q.highest
+       heap.Push(&tq.fixed, item)
+   }
+}
+
+// head locked returns the tenant's next item and its effective priority, or nil if none is left:
+// the better head of its two heaps, the older one on a tie
+func (q *Queue) headLocked(tq *tenantQueue, now time.Time) (*queueItem, int) {
+   q.settleLocked(tq, now)
+   var best *queueItem
+   bestPriority := 0
+   for _, h := range []priorityQueue{tq.heap, tq.fixed} {
+       if h.Len() == 0 {
+           continue
+       }
+       p := q.effectivePriorityLocked(h[0], now)
+       if best == nil || p < bestPriority || p == bestPriority && h[0].sequence < best.sequence {
+           best, bestPriority = h[0], p
+       }
+   }
+   return best, bestPriority
+}
+
+// before locked reports whether a goes before b, both of one tenant: the better effective priority,
+// the older one on a tie. this is the order of each of the tenant's heaps.
+func (q *Queue) beforeLocked(a, b *queueItem, now time.Time) bool {
+   if pa, pb := q.effectivePriorityLocked(a, now), q.effectivePriorityLocked(b, now); pa != pb {
+       return pa < pb
+   }
+   return a.sequence < b.sequence
+}
+
+// update changes the priority of a queued job id in place. it keeps its sequence and the time it
+// was enqueued, so it goes ahead of the jobs enqueued after it at its new priority and keeps what
+// it has aged. returns false when the job id is not in the queue.
+func (q *Queue) Update(jobID string, priority int) bool {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   item, ok := q.items[jobID]
+   if !ok {
+       return false
+   }
+   tq := q.tenants[item.tenant]
+   old := tq.heapOf(item)
+   wasFixed := item.fixed
+   item.priority = priority
+   q.placeLocked(item, timeNow())
+   if item.fixed != wasFixed {
+       heap.Remove(old, item.index)
+       heap.Push(tq.heapOf(item), item)
+   } else {
+       heap.Fix(old, item.index)
+   }
+   return true
+}
+
+// dequeue removes and returns the next job id, or "" if empty: the highest effective priority (smallest
+// value, after aging) first, the tenant furthest behind its fair share among those at that priority,
+// oldest sequence on tie.
+func (q *Queue) Dequeue() string {
+   return q.DequeueWhere(nil)
+}
+
+// dequeue where is dequeue restricted to the tenants allow accepts (all when nil).
+// allow is called with the queue locked and must not use the queue.
+func (q *Queue) DequeueWhere(allow func(tenant string) bool) string {
+   if item := q.take(allow); item != nil {
        return item.jobID
    }
    return ""
 }
 
-// depth returns the number of job ids currently in the queue (excluding lazy-cancelled)
+// take is dequeue where returning the whole item, so it can be put back in place
+func (q *Queue) take(allow func(tenant string) bool) *queueItem {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   var best *tenantQueue
+   var bestItem *queueItem
+   bestPriority := 0
+   now := timeNow()
+   for name, tq := range q.tenants {
+       item, p := q.headLocked(tq, now)
+       if item == nil {
+           delete(q.tenants, name)
+           continue
+       }
+       if allow != nil && !allow(name) {
+           continue
+       }
+       if best == nil || p < bestPriority ||
+           p == bestPriority && (tq.pass < best.pass || tq.pass == best.pass && item.sequence < bestItem.sequence) {
+           best, bestItem, bestPriority = tq, item, p
+       }
+   }
+   if best == nil {
+       return nil
+   }
+   heap.Remove(best.heapOf(bestItem), bestItem.index)
+   delete(q.items, bestItem.jobID)
+   return bestItem
+}
+
+// charge counts a started job against the tenant's fair share. jobs that were dequeued but went
+// back because nothing could run them are not charged.
+func (q *Queue) Charge(tenant string) {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   tenant = models.TenantOrDefault(tenant)
+   if tq := q.tenants[tenant]; tq != nil {
+       tq.pass += 1 / float64(q.weightLocked(tenant))
+   }
+}
+
+// depth returns the number of job ids currently in the queue
 func (q *Queue) Depth() int {
    q.mu.Lock()
    defer q.mu.Unlock()
-   return q.activeCount
+   return len(q.items)
+}
+
+// depth of returns the number of the tenant's job ids currently in the queue
+func (q *Queue) DepthOf(tenant string) int {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   if tq := q.tenants[models.TenantOrDefault(tenant)]; tq != nil {
+       return tq.len()
+   }
+   return 0
+}
+
+// depths returns the queue depth of every tenant with queued job ids
+func (q *Queue) Depths() map[string]int {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   out := make(map[string]int, len(q.tenants))
+   for name, tq := range q.tenants {
+       if n := tq.len(); n > 0 {
+           out[name] = n
+       }
+   }
+   return out
 }
 
-// remove marks the job id as cancelled (lazy removal); it will be skipped when popped
+// oldest waits returns, by original priority, how long the oldest queued job has been waiting
+func (q *Queue) OldestWaits() map[int]time.Duration {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   now := timeNow()
+   out := make(map[int]time.Duration)
+   for _, item := range q.items {
+       if wait := now.Sub(item.enqueuedAt); wait > out[item.priority] {
+           out[item.priority] = wait
+       }
+   }
+   return out
+}
+
+// queue position is where a queued job id stands
+type QueuePosition struct {
+   Ahead             int // queued jobs expected to be dispatched before it
+   EffectivePriority int // its priority after aging
+   Depth             int // jobs in the queue, itself included
+}
+
+// position estimates how many queued job ids will be dispatched before jobID, by the rules take
+// follows: every job at a better effective priority goes first, and so do the jobs ahead of it in its
+// own tenant. of the other tenants' jobs at the same priority, each tenant gets the dispatches its
+// weight earns until the job's tenant reaches it. it assumes nothing new arrives and every job
+// finds a worker. returns false when the job id is not queued.
+func (q *Queue) Position(jobID string) (QueuePosition, bool) {
+   q.mu.Lock()
+   defer q.mu.Unlock()
+   item, ok := q.items[jobID]
+   if !ok {
+       return QueuePosition{}, false
+   }
+   now := timeNow()
+   p := q.effectivePriorityLocked(item, now)
+   pos := QueuePosition{EffectivePriority: p, Depth: len(q.items)}
+   own := q.tenants[item.tenant]
+   ownAhead := 0 // own tenant's jobs ahead, each advancing its pass
+   for _, h := range []priorityQueue{own.heap, own.fixed} {
+       for _, other := range h {
+           if other != item && q.beforeLocked(other, item, now) {
+               ownAhead++
+           }
+       }
+   }
+   pos.Ahead += ownAhead
+   // the pass the job's tenant is at when the job is dispatched
+   reached := own.pass + float64(ownAhead)/float64(q.weightLocked(item.tenant))
+   for name, tq := range q.tenants {
+       if tq == own {
+           continue
+       }
+       better := 0
+       var same []*queueItem
+       for _, h := range []priorityQueue{tq.heap, tq.fixed} {
+           for _, other := range h {
+               switch op := q.effectivePriorityLocked(other, now); {
+               case op < p:
+                   better++
+               case op == p:
+                   same = append(same, other)
+               }
+           }
+       }
+       pos.Ahead += better
+       // the jobs at a better priority advance its pass first; then it dispatches while its pass
+       // is below reached, a step of 1/weight each time. on a tie the older job goes first.
+       x := (reached-tq.pass)*float64(q.weightLocked(name)) - float64(better)
+       share := int(math.Ceil(x))
+       if x >= 0 && x == math.Trunc(x) && share < len(same) {
+           // not sort.Sort(priorityQueue): its swap would move the items' heap indexes
+           sort.Slice(same, func(i, j int) bool { return q.beforeLocked(same[i], same[j], now) })
+           if same[share].sequence < item.sequence {
+               share++
+           }
+       }
+       if share > 0 {
+           pos.Ahead += min(share, len(same))
+       }
+   }
+   return pos, true
+}
+
+// remove takes the job id out of the queue; a job id that is not queued is ignored
 func (q *Queue) Remove(jobID string) {
    q.mu.Lock()
    defer q.mu.Unlock()
-   q.cancelled[jobID] = struct{}{}
-   q.activeCount--
+   q.removeLocked(jobID)
+}
+
+func (q *Queue) removeLocked(jobID string) {
+   item, ok := q.items[jobID]
+   if !ok {
+       return
+   }
+   heap.Remove(q.tenants[item.tenant].heapOf(item), item.index)
+   delete(q.items, jobID)
+}
+
+func (q *Queue) weightLocked(tenant string) int {
+   if q.weight == nil {
+       return 1
+   }
+   if w := q.weight(tenant); w > 0 {
+       return w
+   }
+   return 1
+}
+
+// min pass locked returns the lowest pass among tenants with queued job ids, or 0 if there are none
+func (q *Queue) minPassLocked() float64 {
+   min, found := 0.0, false
+   for _, tq := range q.tenants {
+       if tq.len() > 0 && (!found || tq.pass < min) {
+           min, found = tq.pass, true
+       }
+   }
+   return min
 }
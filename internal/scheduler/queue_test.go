@@ -0,0 +1,327 @@
+package scheduler
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestEnqueueWakesReady(t *testing.T) {
+	q := NewQueue()
+	ready := q.Ready()
+	if closed(ready) {
+		t.Fatal("ready closed on an empty queue")
+	}
+	q.Enqueue("a", "", models.PriorityNormal)
+	if !closed(ready) || closed(q.Ready()) {
+		t.Fatal("enqueue did not close ready, or the next ready is closed already")
+	}
+
+	// a job put back by a dispatch pass wakes nobody
+	ready = q.Ready()
+	q.putBack(nil, q.take(nil))
+	if closed(ready) || q.Depth() != 1 {
+		t.Fatalf("put back closed ready (depth %d)", q.Depth())
+	}
+}
+
+// order dequeues everything left and returns the job ids concatenated
+func order(q *Queue) string {
+	var out string
+	for id := q.Dequeue(); id != ""; id = q.Dequeue() {
+		out += id
+	}
+	return out
+}
+
+func TestPutBackKeepsFIFOPosition(t *testing.T) {
+	q := NewQueue()
+	for _, id := range []string{"A", "B", "C"} {
+		q.Enqueue(id, "", models.PriorityNormal)
+	}
+	a, b := q.take(nil), q.take(nil)
+	q.putBack(nil, a, b)
+	// d arrives after the pass; a and b go ahead of it and of c, as if they had never left
+	q.Enqueue("D", "", models.PriorityNormal)
+	if got := order(q); got != "ABCD" {
+		t.Fatalf("order = %s, want ABCD", got)
+	}
+
+	// passed over any number of times, a job keeps its place
+	q.Enqueue("E", "", models.PriorityNormal)
+	q.Enqueue("F", "", models.PriorityNormal)
+	for i := 0; i < 3; i++ {
+		q.putBack(nil, q.take(nil))
+		q.Enqueue("G"+strconv.Itoa(i), "", models.PriorityNormal)
+	}
+	if got := order(q); got != "EFG0G1G2" {
+		t.Fatalf("order = %s, want EFG0G1G2", got)
+	}
+}
+
+func TestPutBackDropsAJobEnqueuedAgain(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue("A", "", models.PriorityLow)
+	q.Enqueue("B", "", models.PriorityNormal)
+	a := q.take(nil)
+	if a.jobID != "B" {
+		t.Fatalf("took %s, want B", a.jobID)
+	}
+	// e.g. a retry queued it while the pass held it; that entry is the current one
+	q.Enqueue("B", "", models.PriorityLow)
+	q.putBack(nil, a)
+	if q.Depth() != 2 {
+		t.Fatalf("depth = %d, want B once", q.Depth())
+	}
+	if got := order(q); got != "AB" {
+		t.Fatalf("order = %s, want the newer low priority B behind A", got)
+	}
+}
+
+func TestPutBackChargesNoFairShare(t *testing.T) {
+	q := NewQueue()
+	fill(q, "a", 4, models.PriorityNormal)
+	fill(q, "b", 4, models.PriorityNormal)
+	// a's jobs go out and come back several times without starting
+	for i := 0; i < 3; i++ {
+		item := q.take(nil)
+		q.putBack(nil, item)
+	}
+	if got := drain(q, 4); strings.Count(got, "a") != 2 || strings.Count(got, "b") != 2 {
+		t.Fatalf("order after jobs were put back = %s, want a and b level", got)
+	}
+}
+
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	saved := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = saved })
+	return &now
+}
+
+func TestAgingLetsAnOldJobOvertakeNewerUrgentOnes(t *testing.T) {
+	now := fakeClock(t)
+	q := NewQueue()
+	q.SetAging(time.Minute, models.PriorityHigh)
+	q.Enqueue("old", "", models.PriorityLow)
+
+	// one interval in, the old job has aged to normal: still behind a new high priority job
+	*now = now.Add(time.Minute)
+	q.Enqueue("new1", "", models.PriorityHigh)
+	if got := q.Dequeue(); got != "new1" {
+		t.Fatalf("after one interval dequeued %s, want new1", got)
+	}
+	// two intervals in it is high as well, and older
+	*now = now.Add(time.Minute)
+	q.Enqueue("new2", "", models.PriorityHigh)
+	if pos, _ := q.Position("old"); pos.EffectivePriority != models.PriorityHigh || pos.Ahead != 0 {
+		t.Fatalf("position of old = %+v, want first at high priority", pos)
+	}
+	if got := order(q); got != "oldnew2" {
+		t.Fatalf("order = %s, want old ahead of new2", got)
+	}
+
+	// without aging the urgent job always goes first
+	q = NewQueue()
+	q.Enqueue("old", "", models.PriorityLow)
+	*now = now.Add(time.Hour)
+	q.Enqueue("new", "", models.PriorityHigh)
+	if got := order(q); got != "newold" {
+		t.Fatalf("order without aging = %s, want newold", got)
+	}
+}
+
+func TestAgingStopsAtHighest(t *testing.T) {
+	now := fakeClock(t)
+	q := NewQueue()
+	q.SetAging(time.Minute, models.PriorityNormal)
+	q.Enqueue("low", "", models.PriorityLow)
+	q.Enqueue("high", "", models.PriorityHigh)
+	*now = now.Add(time.Hour)
+	for id, want := range map[string]int{"low": models.PriorityNormal, "high": models.PriorityHigh} {
+		if pos, _ := q.Position(id); pos.EffectivePriority != want {
+			t.Fatalf("effective priority of %s = %d, want %d", id, pos.EffectivePriority, want)
+		}
+	}
+	// an hour's wait does not take the low job past a fresh high one
+	q.Enqueue("fresh", "", models.PriorityHigh)
+	if got := order(q); got != "highfreshlow" {
+		t.Fatalf("order = %s, want highfreshlow", got)
+	}
+
+	// a job moved to a priority that doesn't age stops aging, and one moved out of it starts
+	q.Enqueue("a", "", models.PriorityLow)
+	q.Enqueue("b", "", models.PriorityHigh)
+	*now = now.Add(time.Hour)
+	q.Update("a", models.PriorityHigh)
+	q.Update("b", models.PriorityLow)
+	if got := order(q); got != "ab" {
+		t.Fatalf("order after the updates = %s, want ab", got)
+	}
+}
+
+func TestOldestWaitsByOriginalPriority(t *testing.T) {
+	now := fakeClock(t)
+	q := NewQueue()
+	q.SetAging(time.Minute, models.PriorityHigh)
+	q.Enqueue("a", "", models.PriorityLow)
+	*now = now.Add(time.Minute)
+	q.Enqueue("b", "", models.PriorityLow)
+	q.Enqueue("c", "t2", models.PriorityHigh)
+	*now = now.Add(4 * time.Minute)
+	want := map[int]time.Duration{models.PriorityLow: 5 * time.Minute, models.PriorityHigh: 4 * time.Minute}
+	if got := q.OldestWaits(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("oldest waits = %v, want %v", got, want)
+	}
+	q.Remove("a")
+	if got := q.OldestWaits()[models.PriorityLow]; got != 4*time.Minute {
+		t.Fatalf("oldest low wait after a left = %s, want b's 4m", got)
+	}
+}
+
+func TestPutBackTakesTheCurrentPriority(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue("A", "", models.PriorityNormal)
+	q.Enqueue("B", "", models.PriorityNormal)
+	q.Enqueue("C", "", models.PriorityNormal)
+	a, b := q.take(nil), q.take(nil)
+	// while the pass holds them, a was moved down and b cancelled
+	current := func(jobID string) (int, bool) {
+		return map[string]int{"A": models.PriorityLow}[jobID], jobID == "A"
+	}
+	q.putBack(current, a, b)
+	if got := order(q); got != "CA" {
+		t.Fatalf("order = %s, want C ahead of A at its new priority and B gone", got)
+	}
+}
+
+// assert heap indexes checks that every queued item knows where it sits in its tenant's heap
+func assertHeapIndexes(t *testing.T, q *Queue) {
+	t.Helper()
+	for id, item := range q.items {
+		h := *q.tenants[item.tenant].heapOf(item)
+		if item.index < 0 || item.index >= len(h) || h[item.index] != item {
+			t.Fatalf("%s has index %d, not its place in the heap", id, item.index)
+		}
+	}
+}
+
+func TestUpdateMovesAJobInPlace(t *testing.T) {
+	q := NewQueue()
+	fill(q, "a", 8, models.PriorityNormal)
+	if !q.Update("a5", models.PriorityHigh) || !q.Update("a2", models.PriorityLow) || q.Update("nope", models.PriorityHigh) {
+		t.Fatal("update reported the wrong jobs as queued")
+	}
+	assertHeapIndexes(t, q)
+	// a5 keeps its sequence: ahead of a high priority job enqueued after it
+	q.Enqueue("a9", "a", models.PriorityHigh)
+	if got := order(q); got != "a5a9a0a1a3a4a6a7a2" {
+		t.Fatalf("order = %s", got)
+	}
+}
+
+func TestRemoveTakesOutAJobFromTheMiddle(t *testing.T) {
+	q := NewQueue()
+	fill(q, "a", 5, models.PriorityNormal)
+	q.Remove("a2")
+	q.Remove("a2") // no longer queued: nothing happens
+	assertHeapIndexes(t, q)
+	if pos, _ := q.Position("a3"); q.Depth() != 4 || pos.Ahead != 2 {
+		t.Fatalf("depth %d, a3 has %d ahead; want 4 and 2", q.Depth(), pos.Ahead)
+	}
+	if _, ok := q.Position("a2"); ok {
+		t.Fatal("removed job still has a position")
+	}
+	if got := order(q); got != "a0a1a3a4" {
+		t.Fatalf("order = %s, want a0a1a3a4", got)
+	}
+}
+
+// assert positions checks every queued job's position against the order a drain dispatches them in
+func assertPositions(t *testing.T, q *Queue, ids []string) {
+	t.Helper()
+	ahead := map[string]int{}
+	for _, id := range ids {
+		pos, ok := q.Position(id)
+		if !ok || pos.Depth != len(ids) {
+			t.Fatalf("position of %s = %+v %v", id, pos, ok)
+		}
+		ahead[id] = pos.Ahead
+	}
+	for i := 0; i < len(ids); i++ {
+		id := q.Dequeue()
+		q.Charge(strings.TrimRight(id, "0123456789"))
+		if ahead[id] != i {
+			t.Fatalf("%s was dispatched after %d jobs, its position said %d", id, i, ahead[id])
+		}
+	}
+}
+
+func TestPositionCountsJobsAheadAcrossTenants(t *testing.T) {
+	q := NewQueue()
+	q.SetWeights(func(tenant string) int { return map[string]int{"a": 2}[tenant] })
+	fill(q, "a", 5, models.PriorityNormal)
+	fill(q, "b", 4, models.PriorityNormal)
+	fill(q, "c", 2, models.PriorityLow)
+	q.Enqueue("c9", "c", models.PriorityHigh)
+	assertPositions(t, q, []string{"a0", "a1", "a2", "a3", "a4", "b0", "b1", "b2", "b3", "c0", "c1", "c9"})
+}
+
+func TestPositionFollowsAging(t *testing.T) {
+	now := fakeClock(t)
+	q := NewQueue()
+	q.SetAging(time.Minute, models.PriorityHigh)
+	q.Enqueue("a0", "a", models.PriorityLow)
+	*now = now.Add(90 * time.Second)
+	fill(q, "b", 3, models.PriorityNormal)
+	q.Enqueue("a1", "a", models.PriorityHigh)
+	if pos, _ := q.Position("a0"); pos.EffectivePriority != models.PriorityNormal {
+		t.Fatalf("a0 effective priority = %d after one interval, want normal", pos.EffectivePriority)
+	}
+	assertPositions(t, q, []string{"a0", "a1", "b0", "b1", "b2"})
+}
+
+func TestAgedJobsAtOnePriorityGoInFIFOOrder(t *testing.T) {
+	now := fakeClock(t)
+	q := NewQueue()
+	q.SetAging(time.Minute, models.PriorityHigh)
+	inOrder := func(priority int, ids ...string) {
+		t.Helper()
+		for i, id := range ids {
+			if pos, _ := q.Position(id); pos.EffectivePriority != priority || pos.Ahead != i {
+				t.Fatalf("position of %s = %+v, want priority %d with %d ahead", id, pos, priority, i)
+			}
+		}
+		assertPositions(t, q, ids)
+	}
+
+	// a0 aged one step by the time a1 arrives: both are normal from then on, a0 first
+	*now = now.Add(10 * time.Second)
+	q.Enqueue("a0", "a", models.PriorityLow)
+	*now = now.Add(55 * time.Second)
+	q.Enqueue("a1", "a", models.PriorityNormal)
+	*now = now.Add(10 * time.Second)
+	inOrder(models.PriorityNormal, "a0", "a1")
+
+	// both aged all the way up: the older goes first though the newer started nearer the top
+	q.Enqueue("b0", "b", models.PriorityLow)
+	*now = now.Add(10 * time.Second)
+	q.Enqueue("b1", "b", models.PriorityNormal)
+	*now = now.Add(5 * time.Minute)
+	inOrder(models.PriorityHigh, "b0", "b1")
+}
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// policy for returns the job's retry policy, or the default for jobs submitted without one
+func policyFor(job *models.Job) *models.RetryPolicy {
+	if job.RetryPolicy != nil {
+		return job.RetryPolicy
+	}
+	return models.DefaultRetryPolicy()
+}
+
+// backoff returns the delay before the given retry (1 for the first retry). exponential backoff
+// starts at the initial backoff and doubles with every further retry.
+func backoff(p *models.RetryPolicy, retry int) time.Duration {
+	initial := time.Duration(p.InitialBackoffSec) * time.Second
+	max := time.Duration(p.MaxBackoffSec) * time.Second
+	if p.Backoff == models.BackoffFixed {
+		return min(initial, max)
+	}
+	delay := initial
+	for i := 1; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, max)
+	if p.Backoff == models.BackoffJitter && delay > 0 {
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
+
+// start attempt marks the job running on the worker, opens a new entry in its attempts history and
+// issues the attempt's token from its number and fence, the lease id or a fresh id per dispatch
+func startAttempt(job *models.Job, workerID, fence string, now time.Time) {
+	n := len(job.Attempts) + 1
+	job.Status = models.JobStatusRunning
+	job.StartedAt = &now
+	job.WorkerID = workerID
+	job.UnschedulableReason = ""
+	job.AttemptToken = strconv.Itoa(n) + "-" + fence
+	job.Attempts = append(job.Attempts, models.Attempt{Number: n, WorkerID: workerID, StartedAt: now})
+}
+
+// close attempt records the end of the job's current attempt; its token is no longer accepted
+func closeAttempt(job *models.Job, now time.Time, errMsg, errClass string) {
+	job.AttemptToken = ""
+	if n := len(job.Attempts); n > 0 && job.Attempts[n-1].FinishedAt == nil {
+		a := &job.Attempts[n-1]
+		a.FinishedAt = &now
+		a.Error = errMsg
+		a.ErrorClass = errClass
+	}
+}
+
+// complete marks a running job completed with its result and frees the worker. returns false when
+// the job was written since it was read; nothing is changed then and the worker keeps its slot.
+func (s *Scheduler) Complete(job *models.Job, result string) bool {
+	now := time.Now()
+	closeAttempt(job, now, "", "")
+	job.Status = models.JobStatusCompleted
+	job.Result = result
+	job.FinishedAt = &now
+	job.LeaseID = ""
+	job.LeaseExpiresAt = nil
+	if !s.store.Update(job) {
+		return false
+	}
+	s.OnJobComplete(job.ID, job.WorkerID)
+	s.recordRun(job, now)
+	log.Printf("event=job_completed job_id=%s worker_id=%s attempts=%d", job.ID, job.WorkerID, len(job.Attempts))
+	s.publish(events.JobCompleted, job, "")
+	s.finished(job)
+	s.jobFinished(job)
+	return true
+}
+
+// fail attempt frees the worker, closes the current attempt and either re-queues the job after
+// its policy's backoff or marks it failed and moves it to the dead-letter queue.
+// retried is true when a retry was scheduled. a job cancelled while it ran is finished as cancelled.
+// ok is false when the job was written since it was read; nothing is changed then.
+func (s *Scheduler) FailAttempt(job *models.Job, errClass, errMsg string) (retried, ok bool) {
+	if job.CancelRequested {
+		return false, s.FinishCancelled(job, "", "cancelled ("+errMsg+")")
+	}
+	now := time.Now()
+	closeAttempt(job, now, errMsg, errClass)
+	workerID := job.WorkerID
+	job.Error = errMsg
+	job.LeaseID = ""
+	job.LeaseExpiresAt = nil
+
+	policy := policyFor(job)
+	retryable := policy.Retries(errClass)
+	// retry count rather than len(attempts): attempts cut short by a restart or released by a
+	// worker are not failures, and a replay from the dead-letter queue starts a fresh budget
+	if retryable && job.RetryCount+1 < policy.MaxAttempts {
+		job.RetryCount++
+		job.Status = models.JobStatusQueued
+		job.StartedAt = nil
+		job.WorkerID = ""
+		if !s.store.Update(job) {
+			return false, false
+		}
+		s.OnJobComplete(job.ID, workerID)
+		delay := backoff(policy, job.RetryCount)
+		// the job stays queued but out of the queue until the backoff is over
+		s.delayed.push(job.ID, now.Add(delay))
+		log.Printf("event=job_retry_queued job_id=%s worker_id=%s retry_count=%d error_class=%s backoff_sec=%.1f error=%s", job.ID, workerID, job.RetryCount, errClass, delay.Seconds(), errMsg)
+		s.publish(events.JobRetrying, job, errMsg)
+		return true, true
+	}
+	reason := models.DeadLetterRetriesExhausted
+	if !retryable {
+		reason = models.DeadLetterNotRetryable
+	}
+	job.Status = models.JobStatusFailed
+	job.FinishedAt = &now
+	if !s.deadLetter(job, reason, errClass, now) {
+		return false, false
+	}
+	s.OnJobComplete(job.ID, workerID)
+	log.Printf("event=job_failed job_id=%s worker_id=%s attempts=%d dead_letter_reason=%s error_class=%s error=%s", job.ID, workerID, len(job.Attempts), reason, errClass, errMsg)
+	s.publish(events.JobFailed, job, errMsg)
+	s.finished(job)
+	s.jobFinished(job)
+	return false, true
+}
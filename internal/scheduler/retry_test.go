@@ -0,0 +1,132 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestBackoff(t *testing.T) {
+	exp := &models.RetryPolicy{Backoff: models.BackoffExponential, InitialBackoffSec: 2, MaxBackoffSec: 10}
+	for retry, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 4: 10 * time.Second, 10: 10 * time.Second} {
+		if got := backoff(exp, retry); got != want {
+			t.Errorf("exponential retry %d = %v, want %v", retry, got, want)
+		}
+	}
+	fixed := &models.RetryPolicy{Backoff: models.BackoffFixed, InitialBackoffSec: 3, MaxBackoffSec: 60}
+	if got := backoff(fixed, 5); got != 3*time.Second {
+		t.Errorf("fixed retry 5 = %v, want 3s", got)
+	}
+	jitter := &models.RetryPolicy{Backoff: models.BackoffJitter, InitialBackoffSec: 1, MaxBackoffSec: 4}
+	for i := 0; i < 100; i++ {
+		if got := backoff(jitter, 3); got < 0 || got > 4*time.Second {
+			t.Fatalf("jitter retry 3 = %v, want within [0, 4s]", got)
+		}
+	}
+}
+
+// fail attempt leases the job to w1 and fails the attempt with the given class
+func failAttempt(t *testing.T, s *Scheduler, jobID, errClass string) (*models.Job, bool) {
+	t.Helper()
+	job, ok := s.store.Get(jobID)
+	if !ok || job.Status != models.JobStatusQueued {
+		t.Fatalf("job %s is not queued: %+v", jobID, job)
+	}
+	// retries wait out their backoff in the delayed heap; put them straight back for the test
+	s.promoteDue(time.Now().Add(time.Hour))
+	job, _ = leaseNow(t, s, "w1", time.Minute)
+	s.dropLease(job.ID)
+	retried, ok := s.FailAttempt(job, errClass, "boom")
+	if !ok {
+		t.Fatalf("fail attempt of %s was not written", jobID)
+	}
+	job, _ = s.store.Get(jobID)
+	return job, retried
+}
+
+func TestFailAttemptRetriesUntilMaxAttempts(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	policy := &models.RetryPolicy{MaxAttempts: 3, Backoff: models.BackoffFixed, InitialBackoffSec: 1, MaxBackoffSec: 1, RetryOn: []string{models.ErrorClassExecution}}
+	job := submit(t, s, &models.Job{Payload: "p", RetryPolicy: policy})
+
+	for i := 1; i <= 2; i++ {
+		got, retried := failAttempt(t, s, job.ID, models.ErrorClassExecution)
+		if !retried || got.Status != models.JobStatusQueued || got.RetryCount != i || got.DeadLetter != nil {
+			t.Fatalf("failure %d: retried=%v %+v, want queued for retry %d", i, retried, got, i)
+		}
+		if s.Delayed() != 1 {
+			t.Fatalf("failure %d: retry not waiting out its backoff", i)
+		}
+	}
+	got, retried := failAttempt(t, s, job.ID, models.ErrorClassExecution)
+	if retried || got.Status != models.JobStatusFailed || got.DeadLetter == nil || got.DeadLetter.Reason != models.DeadLetterRetriesExhausted {
+		t.Fatalf("last failure: retried=%v %+v, want failed with retries exhausted", retried, got)
+	}
+	if len(got.Attempts) != 3 {
+		t.Fatalf("attempts = %d, want 3", len(got.Attempts))
+	}
+	for i, a := range got.Attempts {
+		if a.Number != i+1 || a.WorkerID != "w1" || a.FinishedAt == nil || a.Error != "boom" || a.ErrorClass != models.ErrorClassExecution {
+			t.Fatalf("attempt %d = %+v", i, a)
+		}
+	}
+}
+
+func TestFailAttemptDoesNotRetryOtherClasses(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	// the default policy only retries dispatch failures
+	job := submit(t, s, &models.Job{Payload: "p"})
+
+	got, retried := failAttempt(t, s, job.ID, models.ErrorClassValidation)
+	if retried || got.Status != models.JobStatusFailed || got.DeadLetter == nil || got.DeadLetter.Reason != models.DeadLetterNotRetryable {
+		t.Fatalf("retried=%v %+v, want failed as not retryable", retried, got)
+	}
+	if got.DeadLetter.ErrorClass != models.ErrorClassValidation || got.DeadLetter.Attempts != 1 {
+		t.Fatalf("dead letter = %+v", got.DeadLetter)
+	}
+}
+
+func TestFinishingAStaleCopyKeepsTheSlotAndTheLease(t *testing.T) {
+	finish := map[string]func(s *Scheduler, job *models.Job) bool{
+		"complete": func(s *Scheduler, job *models.Job) bool { return s.Complete(job, "done") },
+		"fail": func(s *Scheduler, job *models.Job) bool {
+			_, ok := s.FailAttempt(job, models.ErrorClassExecution, "boom")
+			return ok
+		},
+		"cancel":  func(s *Scheduler, job *models.Job) bool { return s.FinishCancelled(job, "", "cancelled") },
+		"requeue": func(s *Scheduler, job *models.Job) bool { return s.Requeue(job) },
+	}
+	for name, fn := range finish {
+		t.Run(name, func(t *testing.T) {
+			s := newTestScheduler(t)
+			s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+			submit(t, s, &models.Job{Payload: "p"})
+			stale, lease := leaseNow(t, s, "w1", time.Minute)
+			// someone else writes the job after the copy was read
+			current, _ := s.store.Get(stale.ID)
+			current.Result = "changed"
+			if !s.store.Update(current) {
+				t.Fatal("update of a fresh copy was refused")
+			}
+
+			if fn(s, stale) {
+				t.Fatal("finishing a stale copy reported written")
+			}
+			if w, _ := s.workers.Get("w1"); len(w.RunningJobs) != 1 {
+				t.Fatalf("worker running %v, want the job's slot kept", w.RunningJobs)
+			}
+			if _, err := s.ExtendLease(stale.ID, lease.ID, time.Minute); err != nil {
+				t.Fatalf("lease dropped: %v", err)
+			}
+			if got, _ := s.store.Get(stale.ID); got.Status != models.JobStatusRunning || got.Result != "changed" {
+				t.Fatalf("job = %s %q, want it running with the other write kept", got.Status, got.Result)
+			}
+			if d := s.queue.Depth(); d != 0 {
+				t.Fatalf("queue depth = %d, want 0", d)
+			}
+		})
+	}
+}
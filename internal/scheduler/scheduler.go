@@ -4,38 +4,94 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"cloud/internal/events"
 	"cloud/internal/loadbalancer"
 	"cloud/pkg/models"
 )
 
-const maxDispatchRetries = 3
+var (
+	// err no free worker is returned by dispatch next when no worker that can run the job has a free slot
+	errNoFreeWorker = errors.New("no free worker can run the job")
+	// err job changed is returned by dispatch next when the job was written since it was dequeued,
+	// e.g. cancelled; whoever changed it now owns it, so it is neither dispatched nor put back
+	errJobChanged = errors.New("job changed since it was dequeued")
+	// err not stored is returned by submit when the store failed to write the new job's status
+	errNotStored = errors.New("job could not be stored")
+)
 
 // scheduler assigns queued jobs to workers via http
 type Scheduler struct {
 	queue   *Queue
 	store   *models.JobStore
 	workers *models.WorkerRegistry
+	lb      loadbalancer.Balancer
 	client  *http.Client
 	stop    chan struct{}
 	done    sync.WaitGroup
+	wakeup  chan struct{} // buffered; a send makes the loop dispatch right away
+
+	leaseMu sync.Mutex
+	leases  map[string]*Lease // by job id, for pull workers
+
+	dlq         *DeadLetterQueue
+	events      *events.Bus
+	finishHooks []func(*models.Job)
+
+	waitMu  sync.Mutex
+	waiters map[string][]chan struct{} // by job id, for blocking waits
+
+	workflowMu sync.Mutex // serializes workflow advancement so a child is enqueued once
+
+	delayed    delayedQueue
+	schedules  *models.ScheduleStore
+	scheduleMu sync.Mutex
+
+	quotas  TenantQuotas
+	admitMu sync.Mutex // held from the queued quota check until the jobs are created
+
+	waitedMu sync.Mutex
+	waited   map[int]WaitStat // queue waits of dispatched jobs by priority
+
+	runMu  sync.Mutex
+	avgRun time.Duration // moving average run time of completed jobs, for start estimates
+	runs   int
 }
 
-// new creates a new scheduler
-func New(queue *Queue, store *models.JobStore, workers *models.WorkerRegistry) *Scheduler {
+// new creates a new scheduler. lb picks push workers; nil means round robin.
+func New(queue *Queue, store *models.JobStore, workers *models.WorkerRegistry, schedules *models.ScheduleStore, lb loadbalancer.Balancer) *Scheduler {
+	if lb == nil {
+		lb, _ = loadbalancer.New(loadbalancer.RoundRobin)
+	}
 	return &Scheduler{
-		queue:   queue,
-		store:   store,
-		workers: workers,
-		client:  &http.Client{Timeout: 30 * time.Second},
-		stop:    make(chan struct{}),
+		queue:     queue,
+		store:     store,
+		workers:   workers,
+		lb:        lb,
+		schedules: schedules,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		stop:      make(chan struct{}),
+		wakeup:    make(chan struct{}, 1),
+		leases:    make(map[string]*Lease),
+		waiters:   make(map[string][]chan struct{}),
+		waited:    make(map[int]WaitStat),
+		dlq:       newDeadLetterQueue(),
+		events:    events.NewBus(eventBufferSize),
 	}
 }
 
+// use transport sends dispatches to workers through t, e.g. one that presents a client certificate.
+// call it before start.
+func (s *Scheduler) UseTransport(t http.RoundTripper) {
+	s.client.Transport = t
+}
+
 // start runs the scheduler loop in a goroutine
 func (s *Scheduler) Start() {
 	s.done.Add(1)
@@ -48,15 +104,94 @@ func (s *Scheduler) Stop() {
 	s.done.Wait()
 }
 
-// on job complete is called when a worker finishes a job, marks the worker idle
+// submit creates the job and queues it, or holds it back until run_at when that is in the future.
+// returns ErrTenantQueueFull when the job's tenant is at its queued limit.
+func (s *Scheduler) Submit(job *models.Job) (*models.Job, error) {
+	s.admitMu.Lock()
+	if err := s.admit(job.Tenant, 1); err != nil {
+		s.admitMu.Unlock()
+		return nil, err
+	}
+	job, err := s.store.Create(job)
+	s.admitMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// persist the new status before enqueueing so the scheduler never reads a stale pending copy
+	if job.RunAt != nil && job.RunAt.After(time.Now()) {
+		job.Status = models.JobStatusScheduled
+		if !s.store.Update(job) {
+			return nil, errNotStored
+		}
+		s.delayed.push(job.ID, *job.RunAt)
+		s.publish(events.JobSubmitted, job, "")
+		return job, nil
+	}
+	job.Status = models.JobStatusQueued
+	if !s.store.Update(job) {
+		return nil, errNotStored
+	}
+	s.queue.Enqueue(job.ID, job.Tenant, job.Priority)
+	s.publish(events.JobSubmitted, job, "")
+	return job, nil
+}
+
+// on job complete is called when a worker finishes a job, frees the job's slot on the worker and drops any lease
 func (s *Scheduler) OnJobComplete(jobID, workerID string) {
-	w, ok := s.workers.Get(workerID)
-	if !ok {
+	s.dropLease(jobID)
+	if workerID == "" {
 		return
 	}
-	w.Status = models.WorkerStatusIdle
-	w.CurrentJobID = ""
-	s.workers.Register(w)
+	s.workers.Update(workerID, func(w *models.Worker) { w.Release(jobID) })
+	s.Wake()
+}
+
+// wake makes the loop run a dispatch pass now rather than at its next tick, e.g. because a worker
+// registered or a slot came free. wakeups that arrive during a pass are folded into one more pass.
+func (s *Scheduler) Wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// worker heartbeat records a heartbeat and the worker's own view of its slots. a positive capacity
+// replaces the registered one. when running is non-nil the slot set is reconciled with it: jobs the
+// worker reports keep their slot, and jobs it doesn't report keep theirs only while the store still
+// shows them running there (dispatched but not started yet). returns false for an unknown worker.
+func (s *Scheduler) WorkerHeartbeat(id string, capacity int, running []string) (*models.Worker, bool) {
+	// the heartbeat may raise the capacity or hand back slots
+	defer s.Wake()
+	return s.workers.Update(id, func(w *models.Worker) {
+		w.LastHeartbeat = time.Now()
+		if capacity > 0 {
+			w.Capacity = capacity
+		}
+		if running == nil {
+			return
+		}
+		slots := append([]string(nil), running...)
+		for _, jobID := range w.RunningJobs {
+			if contains(running, jobID) {
+				continue
+			}
+			if job, ok := s.store.Get(jobID); ok && job.Status == models.JobStatusRunning && job.WorkerID == w.ID {
+				slots = append(slots, jobID)
+			} else {
+				log.Printf("event=worker_slot_released worker_id=%s job_id=%s reason=not_reported", w.ID, jobID)
+			}
+		}
+		w.SetRunning(slots)
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 // reap stale workers unregisters workers that missed heartbeat beyond threshold and re-queues their job
@@ -66,76 +201,204 @@ func (s *Scheduler) ReapStaleWorkers(threshold time.Duration) {
 		if now.Sub(w.LastHeartbeat) <= threshold {
 			continue
 		}
-		if w.CurrentJobID != "" {
-			job, ok := s.store.Get(w.CurrentJobID)
-			if ok && job.Status == models.JobStatusRunning {
-				job.Status = models.JobStatusQueued
-				job.StartedAt = nil
-				job.WorkerID = ""
-				s.store.Update(job)
-               s.queue.Enqueue(job.ID, job.Priority)
-				log.Printf("event=worker_stale job_requeued worker_id=%s job_id=%s heartbeat_age_sec=%.0f", w.ID, job.ID, now.Sub(w.LastHeartbeat).Seconds())
+		for _, jobID := range w.RunningJobs {
+			job, ok := s.store.Get(jobID)
+			if ok && job.Status == models.JobStatusRunning && job.WorkerID == w.ID {
+				log.Printf("event=worker_stale worker_id=%s job_id=%s heartbeat_age_sec=%.0f", w.ID, job.ID, now.Sub(w.LastHeartbeat).Seconds())
+				s.FailAttempt(job, models.ErrorClassDispatch, "worker lost (missed heartbeats)")
 			}
 		}
 		s.workers.Unregister(w.ID)
 		log.Printf("event=worker_reaped worker_id=%s", w.ID)
+		s.events.Publish(events.Event{Type: events.WorkerReaped, WorkerID: w.ID, Message: "missed heartbeats"})
 	}
 }
 
+// recover re-enqueues jobs that were pending, queued or running when the api last stopped.
+// running jobs lost their dispatch with the restart, so they go back to queued and run again.
+// pending workflow jobs are left to their workflow, which enqueues them once their parents completed,
+// and scheduled jobs wait for their run time again.
+// the dead-letter index is rebuilt as well. returns the number of jobs re-enqueued.
+func (s *Scheduler) Recover() int {
+	s.recoverDeadLetters()
+	for _, job := range s.store.List(models.JobStatusScheduled) {
+		s.delayed.push(job.ID, *job.RunAt)
+	}
+	var jobs []*models.Job
+	for _, status := range []models.JobStatus{models.JobStatusPending, models.JobStatusQueued, models.JobStatusRunning} {
+		jobs = append(jobs, s.store.List(status)...)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	// a persisted registry may still show workers busy with jobs that are about to be re-queued
+	for _, w := range s.workers.List() {
+		if len(w.RunningJobs) > 0 {
+			s.workers.Update(w.ID, func(w *models.Worker) { w.SetRunning(nil) })
+		}
+	}
+	now := time.Now()
+	workflows := make(map[string]bool)
+	n := 0
+	for _, job := range jobs {
+		// pending workflow jobs wait for their parents; advancing the workflow below enqueues the ready ones
+		if job.Workflow != nil && job.Status == models.JobStatusPending {
+			workflows[job.Workflow.WorkflowID] = true
+			continue
+		}
+		if job.Status == models.JobStatusRunning && job.CancelRequested {
+			// its cancel was under way; the process it asked to stop is gone with the old dispatch
+			s.FinishCancelled(job, "", "cancelled (api restarted)")
+			continue
+		}
+		if job.Status == models.JobStatusRunning {
+			log.Printf("event=job_recovered job_id=%s previous_worker_id=%s", job.ID, job.WorkerID)
+			// not the job's fault, so this does not count against its retry policy
+			closeAttempt(job, now, "api restarted", "")
+		}
+		if !s.requeue(job) {
+			continue
+		}
+		s.publish(events.JobQueued, job, "recovered after restart")
+		n++
+	}
+	for id := range workflows {
+		s.advanceWorkflow(id)
+	}
+	return n
+}
+
+// run loop dispatches whenever a job is enqueued or a worker may have room (wake), draining as many
+// job/worker pairs as it can each time. the timer work, expired leases, due delayed jobs and
+// schedules, runs every half second, followed by a pass as a fallback.
 func (s *Scheduler) runLoop() {
 	defer s.done.Done()
 	tick := time.NewTicker(500 * time.Millisecond)
 	defer tick.Stop()
 	for {
+		// taken before the pass, so a job enqueued during or right after it still wakes us; the first
+		// pass dispatches what was queued before start
+		ready := s.queue.Ready()
+		s.tick()
 		select {
 		case <-s.stop:
 			return
 		case <-tick.C:
-			s.tick()
+			now := time.Now()
+			s.expireLeases()
+			s.promoteDue(now)
+			s.fireSchedules(now)
+		case <-ready:
+		case <-s.wakeup:
 		}
 	}
 }
 
+// tick dispatches queued jobs to push workers until the queue is empty or every worker is full.
+// jobs that no free worker can run are held back, so they don't block the jobs behind them, and put
+// back at their old position at the end. tenants at their running limit are skipped and keep their jobs queued.
 func (s *Scheduler) tick() {
-	jobID := s.queue.Dequeue()
-	if jobID == "" {
-		return
+	var held []*queueItem
+	limits := s.runningLimits()
+	for {
+		job, item := s.dequeueRunnable(limits)
+		if job == nil {
+			break
+		}
+		workers := s.workers.List()
+		switch err := s.dispatchNext(job, workers); err {
+		case nil:
+			s.recordWait(item, time.Now())
+			limits.add(job.Tenant)
+			s.queue.Charge(job.Tenant)
+			continue
+		case errJobChanged:
+			continue
+		}
+		held = append(held, item)
+		s.markUnschedulable(job, workers)
+		if !hasFreePushSlot(workers) {
+			break
+		}
 	}
-	job, ok := s.store.Get(jobID)
-	if !ok || job.Status == models.JobStatusCancelled {
+	s.queue.putBack(s.queuedPriority, held...)
+}
+
+// dispatch next hands the job to the worker the balancer picks among those that can run it and
+// takes one of its slots. returns errNoFreeWorker when no such worker has a free slot, and
+// errJobChanged, with the slot given back, when the job was written since it was read.
+func (s *Scheduler) dispatchNext(job *models.Job, workers []*models.Worker) error {
+	var eligible []*models.Worker
+	for _, w := range workers {
+		if ok, _ := w.CanRun(job); ok {
+			eligible = append(eligible, w)
+		}
+	}
+	picked := s.lb.Select(eligible)
+	if picked == nil {
+		return errNoFreeWorker
+	}
+	jobID := job.ID
+	assigned := false
+	worker, _ := s.workers.Update(picked.ID, func(w *models.Worker) { assigned = w.Assign(jobID) })
+	if !assigned {
+		// unregistered or filled up since the list was read
+		return errNoFreeWorker
+	}
+	startAttempt(job, worker.ID, models.MustGenerateID(), time.Now())
+	if !s.store.Update(job) {
+		s.workers.Update(worker.ID, func(w *models.Worker) { w.Release(jobID) })
+		return errJobChanged
+	}
+
+	log.Printf("event=worker_assigned worker_id=%s job_id=%s slots_used=%d/%d queue_depth=%d", worker.ID, jobID, len(worker.RunningJobs), worker.Slots(), s.queue.Depth())
+	s.publish(events.JobAssigned, job, "")
+	go s.dispatch(job, worker)
+	return nil
+}
+
+// mark unschedulable records on a queued job why no registered worker (push or pull) can run it,
+// or clears the reason once one can. the job is only written when the reason changes.
+func (s *Scheduler) markUnschedulable(job *models.Job, workers []*models.Worker) {
+	reason := models.UnschedulableReason(job, workers)
+	if reason == job.UnschedulableReason {
 		return
 	}
-	list := s.workers.List()
-	worker := loadbalancer.SelectWorker(list, loadbalancer.RoundRobin)
-	if worker == nil {
-       s.queue.Enqueue(jobID, job.Priority)
+	job.UnschedulableReason = reason
+	if !s.store.Update(job) {
 		return
 	}
-	now := time.Now()
-	job.Status = models.JobStatusRunning
-	job.StartedAt = &now
-	job.WorkerID = worker.ID
-	s.store.Update(job)
-
-	worker.Status = models.WorkerStatusBusy
-	worker.CurrentJobID = jobID
-	s.workers.Register(worker)
+	if reason != "" {
+		log.Printf("event=job_unschedulable job_id=%s type=%s reason=%q", job.ID, job.Type, reason)
+		s.publish(events.JobUnschedulable, job, reason)
+	}
+}
 
-	log.Printf("event=worker_assigned worker_id=%s job_id=%s queue_depth=%d", worker.ID, jobID, s.queue.Depth())
-	go s.dispatch(job, worker)
+func hasFreePushSlot(workers []*models.Worker) bool {
+	for _, w := range workers {
+		if w.Endpoint != "" && w.FreeSlots() > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // run job request is sent to the worker
 type RunJobRequest struct {
-	JobID      string `json:"job_id"`
-	Type       string `json:"type"`
-	Payload    string `json:"payload"`
-	TimeoutSec int    `json:"timeout_sec,omitempty"`
+	JobID        string `json:"job_id"`
+	Type         string `json:"type"`
+	Payload      string `json:"payload"`
+	TimeoutSec   int    `json:"timeout_sec,omitempty"`
+	AttemptToken string `json:"attempt_token"` // to be echoed in post /jobs/:id/complete
 }
 
 func (s *Scheduler) dispatch(job *models.Job, worker *models.Worker) {
+	// a cancel may have been recorded since the attempt started; the worker refuses the /run of
+	// a cancelled attempt anyway, this just saves the call
+	if current, ok := s.store.Get(job.ID); !ok || current.Status != models.JobStatusRunning || current.AttemptToken != job.AttemptToken || current.CancelRequested {
+		log.Printf("event=job_dispatch_skipped job_id=%s worker_id=%s reason=changed_since_assigned", job.ID, worker.ID)
+		return
+	}
 	url := worker.Endpoint + "/run"
-	body := RunJobRequest{JobID: job.ID, Type: job.Type, Payload: job.Payload, TimeoutSec: job.TimeoutSec}
+	body := RunJobRequest{JobID: job.ID, Type: job.Type, Payload: job.Payload, TimeoutSec: job.TimeoutSec, AttemptToken: job.AttemptToken}
 	var buf bytes.Buffer
 	_ = json.NewEncoder(&buf).Encode(body)
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, url, &buf)
@@ -151,32 +414,15 @@ func (s *Scheduler) dispatch(job *models.Job, worker *models.Worker) {
 		return
 	}
 	log.Printf("event=job_dispatched job_id=%s worker_id=%s", job.ID, worker.ID)
+	s.publish(events.JobDispatched, job, "")
    // worker will call back post /jobs/:id/complete when done
 }
 
 func (s *Scheduler) handleDispatchFailure(job *models.Job, worker *models.Worker, errMsg string) {
-	s.OnJobComplete(job.ID, worker.ID)
-	job.RetryCount++
-	if job.RetryCount < maxDispatchRetries {
-		job.Status = models.JobStatusQueued
-		job.StartedAt = nil
-		job.WorkerID = ""
-		s.store.Update(job)
-		backoffSec := 1 << uint(job.RetryCount)
-		if backoffSec > 60 {
-			backoffSec = 60
-		}
-		retryNum := job.RetryCount
-       jobPriority := job.Priority
-       go func(jobID string, priority int, delay time.Duration, retryCount int) {
-			time.Sleep(delay)
-           s.queue.Enqueue(jobID, priority)
-			log.Printf("event=job_retry_queued job_id=%s retry_count=%d backoff_sec=%.0f error=%s", jobID, retryCount, delay.Seconds(), errMsg)
-       }(job.ID, jobPriority, time.Duration(backoffSec)*time.Second, retryNum)
+	// re-read: the store may hand out copies, and the job may have been completed or reassigned meanwhile
+	current, ok := s.store.Get(job.ID)
+	if !ok || current.Status != models.JobStatusRunning || current.AttemptToken != job.AttemptToken {
 		return
 	}
-	job.Status = models.JobStatusFailed
-	job.Error = errMsg
-	s.store.Update(job)
-	log.Printf("event=job_failed job_id=%s retry_count=%d error=%s", job.ID, job.RetryCount, errMsg)
+	s.FailAttempt(current, models.ErrorClassDispatch, errMsg)
 }
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+// benchmark dispatch queues b.N jobs, registers fake push workers that accept every job and
+// complete it through the scheduler, and measures the time until every job has completed.
+//
+//	go test -bench Dispatch ./internal/scheduler
+func benchmarkDispatch(b *testing.B, workers, capacity int) {
+	s := New(NewQueue(), models.NewJobStore(), models.NewWorkerRegistry(), models.NewScheduleStore(), nil)
+	s.UseTransport(&http.Transport{MaxIdleConnsPerHost: capacity * 2})
+
+	var completed atomic.Int64
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		srv := httptest.NewServer(fakeWorker(s, func() {
+			if completed.Add(1) == int64(b.N) {
+				close(done)
+			}
+		}))
+		b.Cleanup(srv.Close)
+		s.workers.Register(&models.Worker{ID: fmt.Sprintf("bench-%d", i), Endpoint: srv.URL, Capacity: capacity, LastHeartbeat: time.Now()})
+	}
+	// the scheduler logs every dispatch, some of it after the last job completed; keep the report
+	// readable. benchmarks run after the tests, so nothing else loses its log.
+	log.SetOutput(io.Discard)
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Submit(&models.Job{Payload: "bench"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	s.Start()
+	<-done
+	b.StopTimer()
+	s.Stop()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "dispatches/s")
+}
+
+// fake worker answers post /run with 202 and completes the job through the scheduler, the way a
+// worker's callback would
+func fakeWorker(s *Scheduler, onDone func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RunJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			if job, ok := s.store.Get(req.JobID); ok && job.Status == models.JobStatusRunning && job.AttemptToken == req.AttemptToken {
+				s.Complete(job, "ok")
+				onDone()
+			}
+		}()
+	})
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	benchmarkDispatch(b, 50, 1)
+}
+
+func BenchmarkDispatchMultiSlot(b *testing.B) {
+	benchmarkDispatch(b, 10, 5)
+}
+
+func BenchmarkDispatchOneWorker(b *testing.B) {
+	benchmarkDispatch(b, 1, 1)
+}
@@ -0,0 +1,294 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud/internal/storage"
+	"cloud/pkg/models"
+)
+
+// new test scheduler returns a scheduler on an in-memory store that is not started, so tests drive
+// tick, lease and the queue themselves
+func newTestScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+	return newTestSchedulerWithStore(t, models.NewJobStore())
+}
+
+func newTestSchedulerWithStore(t *testing.T, store *models.JobStore) *Scheduler {
+	t.Helper()
+	return New(NewQueue(), store, models.NewWorkerRegistry(), models.NewScheduleStore(), nil)
+}
+
+func submit(t *testing.T, s *Scheduler, job *models.Job) *models.Job {
+	t.Helper()
+	job, err := s.Submit(job)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	return job
+}
+
+// push worker serves a worker's /run that answers status and passes every request it accepted to runs
+func pushWorker(t *testing.T, status int, runs chan<- RunJobRequest) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RunJobRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.WriteHeader(status)
+		if runs != nil {
+			runs <- req
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestRecoverRequeuesQueuedAndRunningJobsFromTheWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := storage.OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSchedulerWithStore(t, models.NewJobStoreWithBackend(wal))
+	queued := submit(t, s, &models.Job{Payload: "queued"})
+	running := submit(t, s, &models.Job{Payload: "running"})
+	done := submit(t, s, &models.Job{Payload: "done"})
+	now := time.Now()
+	running, _ = s.store.Get(running.ID)
+	startAttempt(running, "w1", "d1", now)
+	s.store.Update(running)
+	done, _ = s.store.Get(done.ID)
+	done.Status = models.JobStatusCompleted
+	s.store.Update(done)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the api restarts
+	wal, err = storage.OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	s = newTestSchedulerWithStore(t, models.NewJobStoreWithBackend(wal))
+	if n := s.Recover(); n != 2 {
+		t.Fatalf("recover re-enqueued %d jobs, want 2", n)
+	}
+	if got := []string{s.queue.Dequeue(), s.queue.Dequeue(), s.queue.Dequeue()}; got[0] != queued.ID || got[1] != running.ID || got[2] != "" {
+		t.Fatalf("queue after recover = %v, want [%s %s] in submit order", got, queued.ID, running.ID)
+	}
+	job, _ := s.store.Get(running.ID)
+	if job.Status != models.JobStatusQueued || job.WorkerID != "" || len(job.Attempts) != 1 || job.Attempts[0].FinishedAt == nil {
+		t.Fatalf("running job after recover = %+v, want queued with its attempt closed", job)
+	}
+	if job, _ := s.store.Get(done.ID); job.Status != models.JobStatusCompleted {
+		t.Fatalf("completed job changed on recover: %s", job.Status)
+	}
+}
+
+// full disk takes the first write of a job and fails every later one
+type fullDisk struct {
+	*storage.WALBackend
+}
+
+func (fullDisk) PutIf(*models.Job, int64) (bool, error) {
+	return false, errors.New("no space left on device")
+}
+
+func TestSubmitFailsWhenTheStatusIsNotStored(t *testing.T) {
+	wal, err := storage.OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	s := newTestSchedulerWithStore(t, models.NewJobStoreWithBackend(fullDisk{wal}))
+	if _, err := s.Submit(&models.Job{Payload: "p"}); err == nil {
+		t.Fatal("submit succeeded though the queued status was not stored")
+	}
+	if d := s.queue.Depth(); d != 0 {
+		t.Fatalf("queue depth = %d, want 0", d)
+	}
+}
+
+func TestTickDispatchesUpToCapacity(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 10)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 3})
+	for i := 0; i < 5; i++ {
+		submit(t, s, &models.Job{Payload: "p"})
+	}
+
+	s.tick()
+	w, _ := s.workers.Get("w1")
+	if len(w.RunningJobs) != 3 || w.Status != models.WorkerStatusBusy || s.queue.Depth() != 2 {
+		t.Fatalf("running %v status %s depth %d, want 3 slots taken and 2 jobs left queued", w.RunningJobs, w.Status, s.queue.Depth())
+	}
+	for i := 0; i < 3; i++ {
+		req := <-runs
+		job, _ := s.store.Get(req.JobID)
+		if job.Status != models.JobStatusRunning || job.WorkerID != "w1" || req.AttemptToken != job.AttemptToken {
+			t.Fatalf("dispatched job = %s on %s token %q, want running on w1 with token %q", job.Status, job.WorkerID, req.AttemptToken, job.AttemptToken)
+		}
+	}
+
+	// a slot coming free takes the next job
+	s.OnJobComplete(w.RunningJobs[0], "w1")
+	s.tick()
+	<-runs
+	if w, _ := s.workers.Get("w1"); len(w.RunningJobs) != 3 || s.queue.Depth() != 1 {
+		t.Fatalf("running %v depth %d after a slot came free, want 3 and 1", w.RunningJobs, s.queue.Depth())
+	}
+}
+
+func TestWorkerHeartbeatReconcilesSlots(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: "http://127.0.0.1:1", Capacity: 2})
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job := submit(t, s, &models.Job{Payload: "p"})
+		job, _ = s.store.Get(job.ID)
+		s.queue.Remove(job.ID)
+		startAttempt(job, "w1", "d", now)
+		s.store.Update(job)
+		ids = append(ids, job.ID)
+	}
+	reported, dispatched, finished := ids[0], ids[1], ids[2]
+	s.workers.Update("w1", func(w *models.Worker) { w.SetRunning([]string{dispatched, finished}) })
+	job, _ := s.store.Get(finished)
+	s.Complete(job, "done")
+	// the completion freed the slot; put it back as if the registry had missed it
+	s.workers.Update("w1", func(w *models.Worker) { w.SetRunning([]string{dispatched, finished}) })
+
+	// the worker runs reported and raised its capacity. dispatched has not reached it yet and is
+	// still running there per the store, so it keeps its slot; finished is done and gives its slot back.
+	w, ok := s.WorkerHeartbeat("w1", 4, []string{reported})
+	if !ok {
+		t.Fatal("heartbeat of a registered worker was refused")
+	}
+	if w.Capacity != 4 || len(w.RunningJobs) != 2 || !w.Running(reported) || !w.Running(dispatched) || w.Running(finished) {
+		t.Fatalf("after heartbeat: capacity %d running %v, want 4 and [%s %s]", w.Capacity, w.RunningJobs, reported, dispatched)
+	}
+
+	// no running list (an older worker): slots are left alone, a zero capacity keeps the registered one
+	w, _ = s.WorkerHeartbeat("w1", 0, nil)
+	if w.Capacity != 4 || len(w.RunningJobs) != 2 {
+		t.Fatalf("after a bare heartbeat: capacity %d running %v", w.Capacity, w.RunningJobs)
+	}
+	if _, ok := s.WorkerHeartbeat("nope", 1, nil); ok {
+		t.Fatal("heartbeat of an unknown worker was accepted")
+	}
+}
+
+func TestTickHoldsJobsNoWorkerCanRun(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 10)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 2, JobTypes: []string{"email"}})
+	gpu := submit(t, s, &models.Job{Type: "resize", Constraints: &models.JobConstraints{NodeSelector: map[string]string{"gpu": "1"}}})
+	email := submit(t, s, &models.Job{Type: "email"})
+
+	// the resize job is first in line but must not block the email job behind it
+	s.tick()
+	if req := <-runs; req.JobID != email.ID {
+		t.Fatalf("dispatched %s, want the email job", req.JobID)
+	}
+	job, _ := s.store.Get(gpu.ID)
+	if job.Status != models.JobStatusQueued || job.UnschedulableReason != "no worker matches: job type resize not supported" {
+		t.Fatalf("resize job = %s %q, want queued with a reason", job.Status, job.UnschedulableReason)
+	}
+	if s.queue.Depth() != 1 {
+		t.Fatalf("depth = %d, want the resize job kept in the queue", s.queue.Depth())
+	}
+
+	// a worker that can run it comes along; the reason is cleared as it is dispatched there
+	s.workers.Register(&models.Worker{ID: "w2", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1, Labels: map[string]string{"gpu": "1"}})
+	s.tick()
+	if req := <-runs; req.JobID != gpu.ID {
+		t.Fatalf("dispatched %s, want the resize job", req.JobID)
+	}
+	job, _ = s.store.Get(gpu.ID)
+	if job.Status != models.JobStatusRunning || job.WorkerID != "w2" || job.UnschedulableReason != "" {
+		t.Fatalf("resize job = %s on %s %q, want running on w2 without a reason", job.Status, job.WorkerID, job.UnschedulableReason)
+	}
+}
+
+func TestReapedAttemptsTokenIsNotReused(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 2)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1})
+	job := submit(t, s, &models.Job{Payload: "p", RetryPolicy: &models.RetryPolicy{MaxAttempts: 2, RetryOn: []string{models.ErrorClassDispatch}}})
+	s.tick()
+	first := <-runs
+
+	s.workers.Update("w1", func(w *models.Worker) { w.LastHeartbeat = time.Now().Add(-time.Hour) })
+	s.ReapStaleWorkers(time.Minute)
+	got, _ := s.store.Get(job.ID)
+	if got.Status != models.JobStatusQueued || got.AttemptToken != "" {
+		t.Fatalf("reaped job = %s token %q, want queued with no token accepted", got.Status, got.AttemptToken)
+	}
+
+	s.promoteDue(time.Now().Add(time.Hour))
+	s.workers.Register(&models.Worker{ID: "w2", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1})
+	s.tick()
+	second := <-runs
+	if second.JobID != job.ID || second.AttemptToken == first.AttemptToken || !strings.HasPrefix(second.AttemptToken, "2-") {
+		t.Fatalf("tokens %q then %q, want a new token for attempt 2", first.AttemptToken, second.AttemptToken)
+	}
+}
+
+func TestLoopDispatchesWithoutWaitingForTheTick(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 2)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1})
+	s.Start()
+	defer s.Stop()
+
+	// the timer fires every 500ms; an enqueue and a freed slot each start a pass at once
+	first := submit(t, s, &models.Job{Payload: "p"})
+	second := submit(t, s, &models.Job{Payload: "p"})
+	for _, want := range []*models.Job{first, second} {
+		select {
+		case req := <-runs:
+			if req.JobID != want.ID {
+				t.Fatalf("dispatched %s, want %s", req.JobID, want.ID)
+			}
+		case <-time.After(250 * time.Millisecond):
+			t.Fatalf("%s not dispatched before the tick", want.ID)
+		}
+		job, _ := s.store.Get(want.ID)
+		s.Complete(job, "done")
+	}
+}
+
+func TestTickKeepsFIFOWhileEveryWorkerIsBusy(t *testing.T) {
+	s := newTestScheduler(t)
+	runs := make(chan RunJobRequest, 10)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 1})
+	busy := submit(t, s, &models.Job{Payload: "p"})
+	s.tick()
+	<-runs
+
+	var want []string
+	for i := 0; i < 3; i++ {
+		want = append(want, submit(t, s, &models.Job{Payload: "p"}).ID)
+		// every pass finds the head with nowhere to go and puts it back
+		s.tick()
+	}
+	job, _ := s.store.Get(busy.ID)
+	s.Complete(job, "done")
+	for _, id := range want {
+		s.tick()
+		req := <-runs
+		if req.JobID != id {
+			t.Fatalf("dispatched %s, want %s: the order they were submitted in", req.JobID, id)
+		}
+		job, _ := s.store.Get(id)
+		s.Complete(job, "done")
+	}
+}
@@ -0,0 +1,239 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud/internal/cron"
+	"cloud/pkg/models"
+)
+
+const (
+	// a run that fell due longer ago than this was missed (the api was down) rather than just picked up late
+	missedRunGrace = time.Minute
+	// run_all catches up at most this many missed runs per schedule
+	maxCatchUpRuns = 100
+)
+
+// err schedule not found is returned for an unknown schedule id
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// create schedule validates the request and stores a new schedule. the job template's priority
+// must already be clamped; its retry policy is normalized here. the schedule and the jobs it
+// creates belong to tenant.
+func (s *Scheduler) CreateSchedule(req *models.CreateScheduleRequest, tenant string) (*models.Schedule, error) {
+	expr, err := cron.Parse(req.Cron)
+	if err != nil {
+		return nil, err
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(req.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", req.Timezone)
+	}
+	switch req.MissedRunPolicy {
+	case "":
+		req.MissedRunPolicy = models.MissedRunRunOnce
+	case models.MissedRunSkip, models.MissedRunRunOnce, models.MissedRunRunAll:
+	default:
+		return nil, fmt.Errorf("missed_run_policy must be skip, run_once or run_all")
+	}
+	if req.Job.RunAt != nil || req.Job.DelaySec != 0 {
+		return nil, fmt.Errorf("job.run_at and job.delay_sec are not supported in schedules")
+	}
+	if req.Job.Retry != nil {
+		if err := req.Job.Retry.Normalize(); err != nil {
+			return nil, err
+		}
+	}
+	if req.Job.Constraints != nil {
+		if err := req.Job.Constraints.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	sch := &models.Schedule{
+		ID:              models.MustGenerateID(),
+		Name:            req.Name,
+		Cron:            req.Cron,
+		Timezone:        req.Timezone,
+		MissedRunPolicy: req.MissedRunPolicy,
+		Job:             req.Job,
+		Paused:          req.Paused,
+		Tenant:          models.TenantOrDefault(tenant),
+		CreatedAt:       now,
+	}
+	if !sch.Paused {
+		if sch.NextRunAt, err = nextRun(expr, loc, now); err != nil {
+			return nil, err
+		}
+	}
+	s.schedules.Save(sch)
+	log.Printf("event=schedule_created schedule_id=%s cron=%q timezone=%s next_run_at=%s", sch.ID, sch.Cron, sch.Timezone, fmtTime(sch.NextRunAt))
+	return sch, nil
+}
+
+// schedules returns all schedules
+func (s *Scheduler) Schedules() []*models.Schedule {
+	return s.schedules.List()
+}
+
+// schedule returns a schedule by id
+func (s *Scheduler) Schedule(id string) (*models.Schedule, bool) {
+	return s.schedules.Get(id)
+}
+
+// delete schedule removes a schedule; jobs it already created are not touched
+func (s *Scheduler) DeleteSchedule(id string) error {
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	if _, ok := s.schedules.Get(id); !ok {
+		return ErrScheduleNotFound
+	}
+	s.schedules.Delete(id)
+	log.Printf("event=schedule_deleted schedule_id=%s", id)
+	return nil
+}
+
+// pause schedule stops a schedule from creating jobs until it is resumed
+func (s *Scheduler) PauseSchedule(id string) (*models.Schedule, error) {
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	sch, ok := s.schedules.Get(id)
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	sch.Paused = true
+	sch.NextRunAt = nil
+	s.schedules.Save(sch)
+	log.Printf("event=schedule_paused schedule_id=%s", id)
+	return sch, nil
+}
+
+// resume schedule restarts a paused schedule from now; runs that fell due while it was paused are not made up
+func (s *Scheduler) ResumeSchedule(id string) (*models.Schedule, error) {
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	sch, ok := s.schedules.Get(id)
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	if sch.Paused {
+		expr, loc, err := parseSchedule(sch)
+		if err != nil {
+			return nil, err
+		}
+		if sch.NextRunAt, err = nextRun(expr, loc, time.Now()); err != nil {
+			return nil, err
+		}
+		sch.Paused = false
+		s.schedules.Save(sch)
+		log.Printf("event=schedule_resumed schedule_id=%s next_run_at=%s", id, fmtTime(sch.NextRunAt))
+	}
+	return sch, nil
+}
+
+// fire schedules creates jobs for every schedule that fell due. runs due more than missedRunGrace ago
+// were missed while the api was down and are handled by the schedule's missed run policy.
+func (s *Scheduler) fireSchedules(now time.Time) {
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	for _, sch := range s.schedules.List() {
+		if sch.Paused || sch.NextRunAt == nil || sch.NextRunAt.After(now) {
+			continue
+		}
+		expr, loc, err := parseSchedule(sch)
+		if err != nil {
+			log.Printf("event=schedule_invalid schedule_id=%s error=%v", sch.ID, err)
+			continue
+		}
+		// every occurrence from next_run_at up to now
+		var due []time.Time
+		for t := sch.NextRunAt.In(loc); !t.IsZero() && !t.After(now) && len(due) < maxCatchUpRuns; t = expr.Next(t) {
+			due = append(due, t)
+		}
+		runs := 1
+		switch {
+		case now.Sub(due[len(due)-1]) <= missedRunGrace:
+			// the latest run is on time; older ones (if any) count as missed under run_all only
+			if sch.MissedRunPolicy == models.MissedRunRunAll {
+				runs = len(due)
+			}
+		case sch.MissedRunPolicy == models.MissedRunSkip:
+			runs = 0
+		case sch.MissedRunPolicy == models.MissedRunRunAll:
+			runs = len(due)
+		}
+		if len(due) > 1 || runs == 0 {
+			log.Printf("event=schedule_missed_runs schedule_id=%s missed=%d policy=%s runs=%d", sch.ID, len(due)-1, sch.MissedRunPolicy, runs)
+		}
+		// the runs made are the latest ones due
+		var pending *time.Time
+		for _, at := range due[len(due)-runs:] {
+			job, err := s.Submit(scheduledJob(sch))
+			if err != nil {
+				log.Printf("event=schedule_run_failed schedule_id=%s run_at=%s error=%v", sch.ID, at.Format(time.RFC3339), err)
+				pending = &at
+				break
+			}
+			sch.LastJobID = job.ID
+			sch.RunCount++
+			log.Printf("event=schedule_fired schedule_id=%s job_id=%s", sch.ID, job.ID)
+		}
+		last := now
+		sch.LastRunAt = &last
+		if pending != nil {
+			// the failed run and those after it stay due and are tried again on the next pass
+			sch.NextRunAt = pending
+		} else if sch.NextRunAt, err = nextRun(expr, loc, now); err != nil {
+			log.Printf("event=schedule_invalid schedule_id=%s error=%v", sch.ID, err)
+		}
+		s.schedules.Save(sch)
+	}
+}
+
+// scheduled job builds a new job from the schedule's template
+func scheduledJob(sch *models.Schedule) *models.Job {
+	t := sch.Job
+	job := &models.Job{Type: t.Type, Payload: t.Payload, TimeoutSec: t.TimeoutSec, Priority: models.PriorityNormal, ScheduleID: sch.ID, Constraints: t.Constraints, CallbackURL: t.CallbackURL, Tenant: sch.Tenant}
+	if t.Priority != nil {
+		job.Priority = *t.Priority
+	}
+	if t.Retry != nil {
+		policy := *t.Retry
+		job.RetryPolicy = &policy
+	}
+	return job
+}
+
+func parseSchedule(sch *models.Schedule) (*cron.Expression, *time.Location, error) {
+	expr, err := cron.Parse(sch.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(sch.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	return expr, loc, nil
+}
+
+// next run returns the first run after now in the schedule's timezone
+func nextRun(expr *cron.Expression, loc *time.Location, now time.Time) (*time.Time, error) {
+	next := expr.Next(now.In(loc))
+	if next.IsZero() {
+		return nil, fmt.Errorf("cron expression never fires")
+	}
+	return &next, nil
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return "none"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,224 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func createSchedule(t *testing.T, s *Scheduler, req *models.CreateScheduleRequest) *models.Schedule {
+	t.Helper()
+	sch, err := s.CreateSchedule(req, "")
+	if err != nil {
+		t.Fatalf("create schedule: %v", err)
+	}
+	return sch
+}
+
+// jobs of returns the jobs a schedule created
+func jobsOf(t *testing.T, s *Scheduler, scheduleID string) []*models.Job {
+	t.Helper()
+	all, _, err := s.store.Query(models.JobQuery{SortBy: models.SortByCreatedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []*models.Job
+	for _, j := range all {
+		if j.ScheduleID == scheduleID {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+func TestCreateScheduleValidates(t *testing.T) {
+	s := newTestScheduler(t)
+	runAt := time.Now().Add(time.Hour)
+	for name, req := range map[string]*models.CreateScheduleRequest{
+		"cron":        {Cron: "61 * * * *"},
+		"timezone":    {Cron: "@daily", Timezone: "Mars/Olympus"},
+		"policy":      {Cron: "@daily", MissedRunPolicy: "sometimes"},
+		"run_at":      {Cron: "@daily", Job: models.SubmitJobRequest{RunAt: &runAt}},
+		"delay_sec":   {Cron: "@daily", Job: models.SubmitJobRequest{DelaySec: 10}},
+		"never fires": {Cron: "0 0 30 feb *"},
+	} {
+		if _, err := s.CreateSchedule(req, ""); err == nil {
+			t.Errorf("%s: schedule was created, want an error", name)
+		}
+	}
+
+	sch := createSchedule(t, s, &models.CreateScheduleRequest{Cron: "@daily"})
+	if sch.Timezone != "UTC" || sch.MissedRunPolicy != models.MissedRunRunOnce || sch.Tenant != models.TenantOrDefault("") {
+		t.Fatalf("defaults = %q %q %q", sch.Timezone, sch.MissedRunPolicy, sch.Tenant)
+	}
+	if sch.NextRunAt == nil || !sch.NextRunAt.After(time.Now()) {
+		t.Fatalf("next_run_at = %v, want the next midnight", sch.NextRunAt)
+	}
+}
+
+func TestFireSchedulesCreatesAJobFromTheTemplate(t *testing.T) {
+	s := newTestScheduler(t)
+	priority := models.PriorityHigh
+	sch := createSchedule(t, s, &models.CreateScheduleRequest{
+		Cron: "0 * * * *",
+		Job: models.SubmitJobRequest{Type: "report", Payload: "p", Priority: &priority,
+			Retry: &models.RetryPolicy{MaxAttempts: 2}},
+	})
+	due := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	sch.NextRunAt = &due
+	s.schedules.Save(sch)
+
+	// not due yet
+	s.fireSchedules(due.Add(-time.Second))
+	if jobs := jobsOf(t, s, sch.ID); len(jobs) != 0 {
+		t.Fatalf("fired %d jobs before next_run_at", len(jobs))
+	}
+
+	s.fireSchedules(due.Add(10 * time.Second))
+	jobs := jobsOf(t, s, sch.ID)
+	if len(jobs) != 1 {
+		t.Fatalf("fired %d jobs, want 1", len(jobs))
+	}
+	job := jobs[0]
+	if job.Status != models.JobStatusQueued || job.Type != "report" || job.Payload != "p" || job.Priority != priority {
+		t.Fatalf("job = %s %q %q priority %d", job.Status, job.Type, job.Payload, job.Priority)
+	}
+	if job.RetryPolicy == nil || job.RetryPolicy.MaxAttempts != 2 {
+		t.Fatalf("retry policy = %+v, want the template's", job.RetryPolicy)
+	}
+
+	got, _ := s.Schedule(sch.ID)
+	if got.RunCount != 1 || got.LastJobID != job.ID {
+		t.Fatalf("run_count=%d last_job_id=%s, want 1 %s", got.RunCount, got.LastJobID, job.ID)
+	}
+	if want := due.Add(time.Hour); got.NextRunAt == nil || !got.NextRunAt.Equal(want) {
+		t.Fatalf("next_run_at = %v, want %s", got.NextRunAt, want)
+	}
+}
+
+func TestFireSchedulesAppliesTheMissedRunPolicy(t *testing.T) {
+	// hourly, last fired at 9:00 and picked up again at 12:30: 9, 10, 11 and 12 fell due
+	// while the api was down, the latest of them half an hour ago
+	first := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	for policy, want := range map[string]int{
+		models.MissedRunSkip:    0,
+		models.MissedRunRunOnce: 1,
+		models.MissedRunRunAll:  4,
+	} {
+		s := newTestScheduler(t)
+		sch := createSchedule(t, s, &models.CreateScheduleRequest{Cron: "@hourly", MissedRunPolicy: policy})
+		sch.NextRunAt = &first
+		s.schedules.Save(sch)
+
+		s.fireSchedules(now)
+		if jobs := jobsOf(t, s, sch.ID); len(jobs) != want {
+			t.Errorf("%s: fired %d jobs, want %d", policy, len(jobs), want)
+		}
+		got, _ := s.Schedule(sch.ID)
+		if want := now.Truncate(time.Hour).Add(time.Hour); got.NextRunAt == nil || !got.NextRunAt.Equal(want) {
+			t.Errorf("%s: next_run_at = %v, want %s", policy, got.NextRunAt, want)
+		}
+	}
+}
+
+func TestFireSchedulesKeepsRunsThatFailedToSubmitDue(t *testing.T) {
+	first := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	s := newTestScheduler(t)
+	s.SetTenantQuotas(TenantQuotas{Tenants: map[string]TenantQuota{"team-a": {MaxQueued: 2}}})
+	sch, err := s.CreateSchedule(&models.CreateScheduleRequest{Cron: "@hourly", MissedRunPolicy: models.MissedRunRunAll}, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch.NextRunAt = &first
+	s.schedules.Save(sch)
+
+	// 9 and 10 fit the quota; 11 is refused, so it and 12 stay due
+	s.fireSchedules(now)
+	if jobs := jobsOf(t, s, sch.ID); len(jobs) != 2 {
+		t.Fatalf("fired %d jobs, want 2", len(jobs))
+	}
+	got, _ := s.Schedule(sch.ID)
+	if want := first.Add(2 * time.Hour); got.NextRunAt == nil || !got.NextRunAt.Equal(want) {
+		t.Fatalf("next_run_at = %v, want the refused run at %s", got.NextRunAt, want)
+	}
+
+	s.SetTenantQuotas(TenantQuotas{})
+	s.fireSchedules(now)
+	if jobs := jobsOf(t, s, sch.ID); len(jobs) != 4 {
+		t.Fatalf("fired %d jobs after the quota was lifted, want all 4", len(jobs))
+	}
+	got, _ = s.Schedule(sch.ID)
+	if want := now.Truncate(time.Hour).Add(time.Hour); got.NextRunAt == nil || !got.NextRunAt.Equal(want) || got.RunCount != 4 {
+		t.Fatalf("next_run_at = %v run_count = %d, want %s and 4", got.NextRunAt, got.RunCount, want)
+	}
+}
+
+func TestPauseResumeAndDeleteSchedule(t *testing.T) {
+	s := newTestScheduler(t)
+	sch := createSchedule(t, s, &models.CreateScheduleRequest{Cron: "* * * * *"})
+
+	paused, err := s.PauseSchedule(sch.ID)
+	if err != nil || !paused.Paused || paused.NextRunAt != nil {
+		t.Fatalf("pause = %+v, %v", paused, err)
+	}
+	s.fireSchedules(time.Now().Add(time.Hour))
+	if jobs := jobsOf(t, s, sch.ID); len(jobs) != 0 {
+		t.Fatalf("a paused schedule fired %d jobs", len(jobs))
+	}
+
+	resumed, err := s.ResumeSchedule(sch.ID)
+	if err != nil || resumed.Paused || resumed.NextRunAt == nil || !resumed.NextRunAt.After(time.Now()) {
+		t.Fatalf("resume = %+v, %v; want next_run_at from now", resumed, err)
+	}
+
+	if err := s.DeleteSchedule(sch.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Schedule(sch.ID); ok {
+		t.Fatal("schedule still there after delete")
+	}
+	for _, err := range []error{s.DeleteSchedule(sch.ID), second(s.PauseSchedule(sch.ID)), second(s.ResumeSchedule(sch.ID))} {
+		if err != ErrScheduleNotFound {
+			t.Fatalf("err = %v, want ErrScheduleNotFound", err)
+		}
+	}
+}
+
+func second[T any](_ T, err error) error { return err }
+
+func TestScheduledJobIsQueuedAtItsRunTime(t *testing.T) {
+	s := newTestScheduler(t)
+	runAt := time.Now().Add(time.Hour)
+	job := submit(t, s, &models.Job{Payload: "p", RunAt: &runAt})
+	cancelled := submit(t, s, &models.Job{Payload: "p", RunAt: &runAt})
+	if job.Status != models.JobStatusScheduled || s.queue.Depth() != 0 || s.Delayed() != 2 {
+		t.Fatalf("status %s depth %d delayed %d, want scheduled outside the queue", job.Status, s.queue.Depth(), s.Delayed())
+	}
+	cancelQueued(t, s, cancelled.ID)
+
+	s.promoteDue(runAt.Add(-time.Second))
+	if s.queue.Depth() != 0 || s.Delayed() != 2 {
+		t.Fatalf("promoted before the run time: depth %d delayed %d", s.queue.Depth(), s.Delayed())
+	}
+	s.promoteDue(runAt)
+	if got, _ := s.store.Get(job.ID); got.Status != models.JobStatusQueued {
+		t.Fatalf("status = %s at the run time, want queued", got.Status)
+	}
+	// the cancelled one is dropped rather than queued
+	if s.queue.Depth() != 1 || s.Delayed() != 0 {
+		t.Fatalf("depth %d delayed %d, want only the live job queued", s.queue.Depth(), s.Delayed())
+	}
+	assertCancelled(t, s, cancelled.ID)
+}
+
+func TestSubmitWithAPastRunAtIsQueuedNow(t *testing.T) {
+	s := newTestScheduler(t)
+	runAt := time.Now().Add(-time.Minute)
+	job := submit(t, s, &models.Job{Payload: "p", RunAt: &runAt})
+	if job.Status != models.JobStatusQueued || s.queue.Depth() != 1 || s.Delayed() != 0 {
+		t.Fatalf("status %s depth %d delayed %d, want queued right away", job.Status, s.queue.Depth(), s.Delayed())
+	}
+}
@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud/pkg/models"
+)
+
+// err tenant queue full is returned by submit when the tenant already has max_queued jobs waiting
+var ErrTenantQueueFull = errors.New("tenant queue is full")
+
+// tenant quota limits what one tenant may have in flight; zero means no limit
+type TenantQuota struct {
+	MaxQueued  int `json:"max_queued,omitempty"`  // pending, scheduled and queued jobs; submits past it are refused
+	MaxRunning int `json:"max_running,omitempty"` // running jobs; the rest wait in the queue
+	Weight     int `json:"weight,omitempty"`      // share of dispatches among tenants waiting at the same priority, default 1
+}
+
+// tenant quotas is the default quota plus per-tenant overrides. fields an override leaves at zero
+// fall back to the default.
+type TenantQuotas struct {
+	Default TenantQuota
+	Tenants map[string]TenantQuota
+}
+
+// for returns the quota that applies to tenant
+func (q TenantQuotas) For(tenant string) TenantQuota {
+	out := q.Default
+	o, ok := q.Tenants[models.TenantOrDefault(tenant)]
+	if !ok {
+		return out
+	}
+	if o.MaxQueued != 0 {
+		out.MaxQueued = o.MaxQueued
+	}
+	if o.MaxRunning != 0 {
+		out.MaxRunning = o.MaxRunning
+	}
+	if o.Weight != 0 {
+		out.Weight = o.Weight
+	}
+	return out
+}
+
+func (q TenantQuotas) limitsRunning() bool {
+	if q.Default.MaxRunning > 0 {
+		return true
+	}
+	for _, o := range q.Tenants {
+		if o.MaxRunning > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// set tenant quotas sets the per-tenant limits and fair-share weights. call it before start.
+func (s *Scheduler) SetTenantQuotas(q TenantQuotas) {
+	s.quotas = q
+	s.queue.SetWeights(func(tenant string) int { return q.For(tenant).Weight })
+}
+
+// tenant quota returns the quota that applies to tenant
+func (s *Scheduler) TenantQuota(tenant string) TenantQuota {
+	return s.quotas.For(tenant)
+}
+
+// admit checks that the tenant can take n more waiting jobs. callers hold admitMu until the jobs
+// are created, so concurrent submits can't both squeeze under the limit.
+func (s *Scheduler) admit(tenant string, n int) error {
+	max := s.quotas.For(tenant).MaxQueued
+	if max <= 0 {
+		return nil
+	}
+	counts := s.store.CountByStatusFor(models.TenantOrDefault(tenant))
+	waiting := counts[models.JobStatusPending] + counts[models.JobStatusScheduled] + counts[models.JobStatusQueued]
+	if waiting+n > max {
+		return fmt.Errorf("%w: tenant %s has %d of %d jobs waiting", ErrTenantQueueFull, models.TenantOrDefault(tenant), waiting, max)
+	}
+	return nil
+}
+
+// running limits tracks running jobs per tenant through one dispatch pass so tenants at max_running
+// are passed over. a nil *runningLimits allows everything.
+type runningLimits struct {
+	quotas  TenantQuotas
+	running map[string]int
+}
+
+// running limits counts the running jobs per tenant, or returns nil when no tenant has a running limit
+func (s *Scheduler) runningLimits() *runningLimits {
+	if !s.quotas.limitsRunning() {
+		return nil
+	}
+	l := &runningLimits{quotas: s.quotas, running: make(map[string]int)}
+	for _, job := range s.store.List(models.JobStatusRunning) {
+		l.running[models.TenantOrDefault(job.Tenant)]++
+	}
+	return l
+}
+
+// allow reports whether the tenant may start another job
+func (l *runningLimits) allow(tenant string) bool {
+	if l == nil {
+		return true
+	}
+	max := l.quotas.For(tenant).MaxRunning
+	return max <= 0 || l.running[tenant] < max
+}
+
+// add counts a job the pass just started
+func (l *runningLimits) add(tenant string) {
+	if l != nil {
+		l.running[models.TenantOrDefault(tenant)]++
+	}
+}
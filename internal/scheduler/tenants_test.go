@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud/pkg/models"
+)
+
+func TestTenantQuotasFor(t *testing.T) {
+	q := TenantQuotas{
+		Default: TenantQuota{MaxQueued: 10, MaxRunning: 2, Weight: 1},
+		Tenants: map[string]TenantQuota{"big": {MaxQueued: 100, Weight: 4}, models.DefaultTenant: {MaxRunning: 5}},
+	}
+	if got := q.For("small"); got != q.Default {
+		t.Fatalf("For(small) = %+v, want the default", got)
+	}
+	// fields the override leaves at zero fall back to the default
+	if got := q.For("big"); got != (TenantQuota{MaxQueued: 100, MaxRunning: 2, Weight: 4}) {
+		t.Fatalf("For(big) = %+v", got)
+	}
+	if got := q.For(""); got.MaxRunning != 5 {
+		t.Fatalf("For(\"\") = %+v, want the default tenant's override", got)
+	}
+}
+
+func TestSubmitPastMaxQueuedIsRefused(t *testing.T) {
+	s := newTestScheduler(t)
+	s.SetTenantQuotas(TenantQuotas{Default: TenantQuota{MaxQueued: 2}, Tenants: map[string]TenantQuota{"big": {MaxQueued: 3}}})
+	first := submit(t, s, &models.Job{Tenant: "a", Payload: "p"})
+	submit(t, s, &models.Job{Tenant: "a", Payload: "p"})
+	if _, err := s.Submit(&models.Job{Tenant: "a", Payload: "p"}); !errors.Is(err, ErrTenantQueueFull) {
+		t.Fatalf("third submit = %v, want ErrTenantQueueFull", err)
+	}
+	// other tenants have their own room, and an override raises the limit
+	submit(t, s, &models.Job{Tenant: "b", Payload: "p"})
+	for i := 0; i < 3; i++ {
+		submit(t, s, &models.Job{Tenant: "big", Payload: "p"})
+	}
+
+	// a workflow is admitted whole or not at all
+	req := &models.SubmitWorkflowRequest{Jobs: []models.WorkflowJobRequest{step("x", "p"), step("y", "p", "x")}}
+	ordered, err := req.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SubmitWorkflow(req, ordered, "b"); !errors.Is(err, ErrTenantQueueFull) {
+		t.Fatalf("workflow past the limit = %v, want ErrTenantQueueFull", err)
+	}
+	if n := s.store.CountByStatusFor("b")[models.JobStatusQueued]; n != 1 {
+		t.Fatalf("tenant b has %d queued jobs after the refused workflow, want 1", n)
+	}
+
+	// a job that finishes no longer waits, which makes room
+	job, _ := s.store.Get(first.ID)
+	job.Status = models.JobStatusCompleted
+	s.store.Update(job)
+	submit(t, s, &models.Job{Tenant: "a", Payload: "p"})
+}
+
+func TestTickPassesOverTenantsAtMaxRunning(t *testing.T) {
+	s := newTestScheduler(t)
+	s.SetTenantQuotas(TenantQuotas{Tenants: map[string]TenantQuota{"a": {MaxRunning: 1}}})
+	runs := make(chan RunJobRequest, 10)
+	s.workers.Register(&models.Worker{ID: "w1", Endpoint: pushWorker(t, http.StatusAccepted, runs), Capacity: 4})
+	for i := 0; i < 3; i++ {
+		submit(t, s, &models.Job{Tenant: "a", Payload: "p"})
+	}
+	submit(t, s, &models.Job{Tenant: "b", Payload: "p"})
+
+	s.tick()
+	counts := map[string]int{}
+	for i := 0; i < 2; i++ {
+		job, _ := s.store.Get((<-runs).JobID)
+		counts[job.Tenant]++
+	}
+	if counts["a"] != 1 || counts["b"] != 1 || s.queue.DepthOf("a") != 2 {
+		t.Fatalf("dispatched %v with a's depth %d, want one job each and a's other 2 still queued", counts, s.queue.DepthOf("a"))
+	}
+	// the held jobs are not unschedulable, only waiting their turn
+	for _, job := range s.store.List(models.JobStatusQueued) {
+		if job.UnschedulableReason != "" {
+			t.Fatalf("job held by the running limit marked unschedulable: %s", job.UnschedulableReason)
+		}
+	}
+
+	// a's running job finishing lets the next one go
+	for _, job := range s.store.List(models.JobStatusRunning) {
+		job.Status = models.JobStatusCompleted
+		s.store.Update(job)
+		s.OnJobComplete(job.ID, "w1")
+	}
+	s.tick()
+	if job, _ := s.store.Get((<-runs).JobID); job.Tenant != "a" || s.queue.DepthOf("a") != 1 {
+		t.Fatalf("dispatched a job of %s with a's depth %d, want a's next job", job.Tenant, s.queue.DepthOf("a"))
+	}
+}
+
+// drain dequeues n job ids, charging each to its tenant as a dispatch would, and returns their
+// tenants in order. job ids are the tenant name followed by a number.
+func drain(q *Queue, n int) string {
+	var out []string
+	for i := 0; i < n; i++ {
+		id := q.Dequeue()
+		if id == "" {
+			break
+		}
+		tenant := strings.TrimRight(id, "0123456789")
+		q.Charge(tenant)
+		out = append(out, tenant)
+	}
+	return strings.Join(out, "")
+}
+
+func fill(q *Queue, tenant string, n, priority int) {
+	for i := 0; i < n; i++ {
+		q.Enqueue(tenant+strconv.Itoa(i), tenant, priority)
+	}
+}
+
+func TestFairShareByWeight(t *testing.T) {
+	q := NewQueue()
+	q.SetWeights(func(tenant string) int { return map[string]int{"a": 3}[tenant] })
+	fill(q, "a", 20, models.PriorityNormal)
+	fill(q, "b", 20, models.PriorityNormal)
+	got := drain(q, 16)
+	if strings.Count(got, "a") != 12 || strings.Count(got, "b") != 4 || strings.Contains(got, "aaaa") || strings.Contains(got, "bb") {
+		t.Fatalf("dispatch order %s, want a three times as often as b, interleaved", got)
+	}
+
+	// strict priority holds across tenants whatever their share
+	q.Enqueue("b99", "b", models.PriorityHigh)
+	if got := drain(q, 1); got != "b" {
+		t.Fatalf("next = %s, want b's high priority job", got)
+	}
+}
+
+func TestReturningTenantDoesNotCatchUpOnIdleTime(t *testing.T) {
+	q := NewQueue()
+	fill(q, "a", 30, models.PriorityNormal)
+	if got := drain(q, 10); got != strings.Repeat("a", 10) {
+		t.Fatalf("a alone: %s", got)
+	}
+	// b was idle while a ran 10 jobs; it starts level rather than getting the next 10
+	fill(q, "b", 10, models.PriorityNormal)
+	if got := drain(q, 6); strings.Count(got, "b") != 3 {
+		t.Fatalf("after b arrives: %s, want a and b taking turns", got)
+	}
+}
@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"context"
+
+	"cloud/pkg/models"
+)
+
+// wait for blocks until the job reaches a final status or ctx ends, and returns the job as it
+// is then. it is woken by the scheduler when the job finishes, not by polling the store.
+func (s *Scheduler) WaitFor(ctx context.Context, id string) (*models.Job, bool) {
+	ch := make(chan struct{})
+	s.waitMu.Lock()
+	s.waiters[id] = append(s.waiters[id], ch)
+	s.waitMu.Unlock()
+	defer s.dropWaiter(id, ch)
+
+	// registered first, so a job that finishes right after this check still wakes us
+	job, ok := s.store.Get(id)
+	if !ok || job.Status.Final() {
+		return job, ok
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+	return s.store.Get(id)
+}
+
+// wake waiters releases everyone waiting on a job that just reached a final status
+func (s *Scheduler) wakeWaiters(id string) {
+	s.waitMu.Lock()
+	defer s.waitMu.Unlock()
+	for _, ch := range s.waiters[id] {
+		close(ch)
+	}
+	delete(s.waiters, id)
+}
+
+func (s *Scheduler) dropWaiter(id string, ch chan struct{}) {
+	s.waitMu.Lock()
+	defer s.waitMu.Unlock()
+	list := s.waiters[id]
+	for i, c := range list {
+		if c == ch {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(s.waiters, id)
+	} else {
+		s.waiters[id] = list
+	}
+}
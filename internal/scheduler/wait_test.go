@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestWaitForWakesWhenTheJobFinishes(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	submitted := submit(t, s, &models.Job{Payload: "p"})
+	job, _ := leaseNow(t, s, "w1", time.Minute)
+
+	done := make(chan *models.Job)
+	for i := 0; i < 2; i++ {
+		go func() {
+			got, _ := s.WaitFor(context.Background(), submitted.ID)
+			done <- got
+		}()
+	}
+	// both waiters registered before the job finishes
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s.waitMu.Lock()
+		n := len(s.waiters[submitted.ID])
+		s.waitMu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters registered, want 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Complete(job, "done")
+	for i := 0; i < 2; i++ {
+		if got := <-done; got.Status != models.JobStatusCompleted || got.Result != "done" {
+			t.Fatalf("waiter got %s %q, want the completed job", got.Status, got.Result)
+		}
+	}
+	if len(s.waiters) != 0 {
+		t.Fatalf("waiters left behind: %v", s.waiters)
+	}
+
+	// a job that is already final returns at once
+	got, ok := s.WaitFor(context.Background(), submitted.ID)
+	if !ok || got.Status != models.JobStatusCompleted {
+		t.Fatalf("wait for a finished job = %v %v", got, ok)
+	}
+}
+
+func TestWaitForReturnsTheJobAsItIsWhenTheContextEnds(t *testing.T) {
+	s := newTestScheduler(t)
+	job := submit(t, s, &models.Job{Payload: "p"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	got, ok := s.WaitFor(ctx, job.ID)
+	if !ok || got.Status != models.JobStatusQueued {
+		t.Fatalf("wait = %v %v, want the job still queued", got, ok)
+	}
+	if len(s.waiters) != 0 {
+		t.Fatalf("waiter not dropped: %v", s.waiters)
+	}
+	if _, ok := s.WaitFor(context.Background(), "nope"); ok {
+		t.Fatal("waited for an unknown job")
+	}
+}
@@ -0,0 +1,214 @@
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"cloud/internal/events"
+	"cloud/pkg/models"
+)
+
+// err workflow not found is returned for an unknown workflow id
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+// submit workflow creates a validated workflow's jobs and enqueues the ones without dependencies.
+// the rest stay pending until their parents complete. every job belongs to tenant, and the whole
+// workflow is refused with ErrTenantQueueFull when its jobs don't fit in the tenant's queued limit.
+func (s *Scheduler) SubmitWorkflow(req *models.SubmitWorkflowRequest, ordered []*models.WorkflowJobRequest, tenant string) (*models.Workflow, error) {
+	s.admitMu.Lock()
+	if err := s.admit(tenant, len(ordered)); err != nil {
+		s.admitMu.Unlock()
+		return nil, err
+	}
+	workflowID := models.MustGenerateID()
+	if err := s.createWorkflowJobs(req, ordered, workflowID, tenant); err != nil {
+		s.admitMu.Unlock()
+		return nil, err
+	}
+	s.admitMu.Unlock()
+	log.Printf("event=workflow_submitted workflow_id=%s jobs=%d on_failure=%s tenant=%s", workflowID, len(ordered), req.OnFailure, models.TenantOrDefault(tenant))
+	s.advanceWorkflow(workflowID)
+	return s.Workflow(workflowID)
+}
+
+func (s *Scheduler) createWorkflowJobs(req *models.SubmitWorkflowRequest, ordered []*models.WorkflowJobRequest, workflowID, tenant string) error {
+	for _, r := range ordered {
+		priority := models.PriorityNormal
+		if r.Priority != nil {
+			priority = *r.Priority
+		}
+		job := &models.Job{
+			Type:        r.Type,
+			Payload:     r.Payload,
+			TimeoutSec:  r.TimeoutSec,
+			Priority:    priority,
+			RetryPolicy: r.Retry,
+			Constraints: r.Constraints,
+			CallbackURL: r.CallbackURL,
+			Tenant:      tenant,
+			Workflow: &models.WorkflowStep{
+				WorkflowID: workflowID,
+				Step:       r.Name,
+				DependsOn:  r.DependsOn,
+				OnFailure:  req.OnFailure,
+			},
+		}
+		if _, err := s.store.Create(job); err != nil {
+			return err
+		}
+		s.publish(events.JobSubmitted, job, "")
+	}
+	return nil
+}
+
+// workflow returns the combined view of a workflow's jobs
+func (s *Scheduler) Workflow(id string) (*models.Workflow, error) {
+	jobs, _, err := s.store.Query(models.JobQuery{WorkflowID: id, SortBy: models.SortByCreatedAt})
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, ErrWorkflowNotFound
+	}
+	wf := &models.Workflow{
+		ID:        id,
+		Status:    models.WorkflowStatusOf(jobs),
+		OnFailure: jobs[0].Workflow.OnFailure,
+		CreatedAt: jobs[0].CreatedAt,
+		Counts:    make(map[string]int),
+		Jobs:      jobs,
+	}
+	for _, j := range jobs {
+		wf.Counts[string(j.Status)]++
+		if wf.Status != models.WorkflowStatusRunning && j.FinishedAt != nil && (wf.FinishedAt == nil || j.FinishedAt.After(*wf.FinishedAt)) {
+			wf.FinishedAt = j.FinishedAt
+		}
+	}
+	return wf, nil
+}
+
+// job finished is called after a workflow job reached a final status (or was replayed)
+// so the rest of its workflow can move on
+func (s *Scheduler) jobFinished(job *models.Job) {
+	if job.Workflow != nil {
+		s.advanceWorkflow(job.Workflow.WorkflowID)
+	}
+}
+
+// on job cancelled is called when a job was cancelled through the api
+func (s *Scheduler) OnJobCancelled(job *models.Job) {
+	s.publish(events.JobCancelled, job, "")
+	s.finished(job)
+	s.jobFinished(job)
+}
+
+// advance workflow re-evaluates every job of the workflow that has not started until nothing changes:
+// pending jobs whose parents all completed are rendered and enqueued, jobs below a failed, cancelled or
+// skipped parent are skipped, and with on_failure=cancel a failed job cancels everything not yet started.
+// skipped jobs whose parents are runnable again (e.g. replayed from the dead-letter queue) go back to pending.
+func (s *Scheduler) advanceWorkflow(workflowID string) {
+	s.workflowMu.Lock()
+	defer s.workflowMu.Unlock()
+	jobs, _, err := s.store.Query(models.JobQuery{WorkflowID: workflowID, SortBy: models.SortByCreatedAt})
+	if err != nil {
+		log.Printf("event=workflow_advance_failed workflow_id=%s error=%v", workflowID, err)
+		return
+	}
+	steps := make(map[string]*models.Job, len(jobs))
+	for _, j := range jobs {
+		steps[j.Workflow.Step] = j
+	}
+	for changed := true; changed; {
+		changed = false
+		failedStep := ""
+		for _, j := range jobs {
+			if j.Status == models.JobStatusFailed {
+				failedStep = j.Workflow.Step
+				break
+			}
+		}
+		for _, j := range jobs {
+			switch j.Status {
+			case models.JobStatusPending, models.JobStatusQueued, models.JobStatusSkipped:
+			default:
+				continue
+			}
+			if failedStep != "" && j.Workflow.OnFailure == models.OnFailureCancel {
+				if j.Status != models.JobStatusSkipped {
+					s.finishStep(j, models.JobStatusCancelled, "workflow cancelled: job "+failedStep+" failed")
+					changed = true
+				}
+				continue
+			}
+			ready, blockedBy := true, ""
+			for _, dep := range j.Workflow.DependsOn {
+				switch steps[dep].Status {
+				case models.JobStatusCompleted:
+				case models.JobStatusFailed, models.JobStatusCancelled, models.JobStatusSkipped:
+					blockedBy = dep
+				default:
+					ready = false
+				}
+			}
+			switch {
+			case j.Status == models.JobStatusQueued:
+				// already enqueued, nothing to decide
+			case blockedBy != "":
+				if j.Status != models.JobStatusSkipped {
+					s.finishStep(j, models.JobStatusSkipped, "dependency "+blockedBy+" did not complete")
+					changed = true
+				}
+			case j.Status == models.JobStatusSkipped:
+				j.Status = models.JobStatusPending
+				j.Error = ""
+				j.FinishedAt = nil
+				if s.store.Update(j) {
+					log.Printf("event=workflow_job_unskipped workflow_id=%s job_id=%s step=%s", workflowID, j.ID, j.Workflow.Step)
+					changed = true
+				}
+			case ready:
+				s.enqueueStep(j, steps)
+				changed = true
+			}
+		}
+	}
+}
+
+// enqueue step renders the job's payload from its parents' results and puts it in the queue.
+// a payload that cannot be rendered fails the job as a validation error.
+func (s *Scheduler) enqueueStep(job *models.Job, steps map[string]*models.Job) {
+	parents := make(map[string]*models.Job, len(job.Workflow.DependsOn))
+	for _, dep := range job.Workflow.DependsOn {
+		parents[dep] = steps[dep]
+	}
+	payload, err := models.RenderPayload(job.Payload, parents)
+	if err != nil {
+		s.finishStep(job, models.JobStatusFailed, err.Error())
+		return
+	}
+	job.Payload = payload
+	if !s.requeue(job) {
+		return
+	}
+	log.Printf("event=workflow_job_enqueued workflow_id=%s job_id=%s step=%s queue_depth=%d", job.Workflow.WorkflowID, job.ID, job.Workflow.Step, s.queue.Depth())
+	s.publish(events.JobQueued, job, "workflow dependencies completed")
+}
+
+// finish step moves a job that has not started to a final status
+func (s *Scheduler) finishStep(job *models.Job, status models.JobStatus, reason string) {
+	now := time.Now()
+	queued := job.Status == models.JobStatusQueued
+	job.Status = status
+	job.Error = reason
+	job.FinishedAt = &now
+	if !s.store.Update(job) {
+		return
+	}
+	if queued {
+		s.queue.Remove(job.ID)
+	}
+	log.Printf("event=workflow_job_%s workflow_id=%s job_id=%s step=%s reason=%q", status, job.Workflow.WorkflowID, job.ID, job.Workflow.Step, reason)
+	s.publish("job."+string(status), job, reason)
+	s.finished(job)
+}
@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func submitWorkflow(t *testing.T, s *Scheduler, onFailure string, jobs ...models.WorkflowJobRequest) *models.Workflow {
+	t.Helper()
+	req := &models.SubmitWorkflowRequest{OnFailure: onFailure, Jobs: jobs}
+	ordered, err := req.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, err := s.SubmitWorkflow(req, ordered, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wf
+}
+
+func step(name, payload string, dependsOn ...string) models.WorkflowJobRequest {
+	return models.WorkflowJobRequest{Name: name, DependsOn: dependsOn, SubmitJobRequest: models.SubmitJobRequest{Payload: payload}}
+}
+
+// run step leases the next queued job, checks it is the named step and finishes it
+func runStep(t *testing.T, s *Scheduler, name, result string, ok bool) *models.Job {
+	t.Helper()
+	job, _ := leaseNow(t, s, "w1", time.Minute)
+	if job.Workflow == nil || job.Workflow.Step != name {
+		t.Fatalf("leased %+v, want step %s", job.Workflow, name)
+	}
+	s.dropLease(job.ID)
+	if ok {
+		s.Complete(job, result)
+	} else {
+		s.FailAttempt(job, models.ErrorClassValidation, "boom")
+	}
+	return job
+}
+
+func stepStatuses(t *testing.T, s *Scheduler, id string) map[string]models.JobStatus {
+	t.Helper()
+	wf, err := s.Workflow(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]models.JobStatus)
+	for _, j := range wf.Jobs {
+		out[j.Workflow.Step] = j.Status
+	}
+	return out
+}
+
+func TestWorkflowRunsStepsAfterTheirParents(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	wf := submitWorkflow(t, s, "",
+		step("fetch", "url"),
+		step("left", "{{jobs.fetch.result}}", "fetch"),
+		step("right", `{"in":{{jobs.fetch.result | json}}}`, "fetch"),
+		step("join", "{{jobs.left.id}}+{{jobs.right.result}}", "left", "right"),
+	)
+	if got := stepStatuses(t, s, wf.ID); got["fetch"] != models.JobStatusQueued || got["left"] != models.JobStatusPending || got["join"] != models.JobStatusPending {
+		t.Fatalf("after submit: %v", got)
+	}
+
+	runStep(t, s, "fetch", `say "hi"`, true)
+	left := runStep(t, s, "left", "L", true)
+	if left.Payload != `say "hi"` {
+		t.Fatalf("left payload = %q", left.Payload)
+	}
+	if got := stepStatuses(t, s, wf.ID)["join"]; got != models.JobStatusPending {
+		t.Fatalf("join is %s with one parent left", got)
+	}
+	right := runStep(t, s, "right", "R", true)
+	if right.Payload != `{"in":"say \"hi\""}` {
+		t.Fatalf("right payload = %q", right.Payload)
+	}
+	join := runStep(t, s, "join", "done", true)
+	if join.Payload != left.ID+"+R" {
+		t.Fatalf("join payload = %q", join.Payload)
+	}
+	done, _ := s.Workflow(wf.ID)
+	if done.Status != models.WorkflowStatusCompleted || done.Counts["completed"] != 4 || done.FinishedAt == nil {
+		t.Fatalf("workflow = %s %v", done.Status, done.Counts)
+	}
+}
+
+func TestWorkflowFailureCancelsTheRest(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	wf := submitWorkflow(t, s, models.OnFailureCancel, step("a", "p"), step("b", "p", "a"), step("c", "p"))
+
+	runStep(t, s, "a", "", false)
+	got := stepStatuses(t, s, wf.ID)
+	if got["a"] != models.JobStatusFailed || got["b"] != models.JobStatusCancelled || got["c"] != models.JobStatusCancelled {
+		t.Fatalf("after a failed: %v", got)
+	}
+	if s.queue.Depth() != 0 {
+		t.Fatalf("cancelled step c is still queued")
+	}
+	if done, _ := s.Workflow(wf.ID); done.Status != models.WorkflowStatusFailed {
+		t.Fatalf("workflow = %s, want failed", done.Status)
+	}
+}
+
+func TestWorkflowSkipPolicyKeepsOtherBranchesAndUnskipsOnReplay(t *testing.T) {
+	s := newTestScheduler(t)
+	s.workers.Register(&models.Worker{ID: "w1", Capacity: 1})
+	wf := submitWorkflow(t, s, models.OnFailureSkip, step("a", "p"), step("b", "p", "a"), step("c", "p"))
+
+	a := runStep(t, s, "a", "", false)
+	got := stepStatuses(t, s, wf.ID)
+	if got["b"] != models.JobStatusSkipped || got["c"] != models.JobStatusQueued {
+		t.Fatalf("after a failed: %v, want b skipped and c still queued", got)
+	}
+	runStep(t, s, "c", "", true)
+
+	if _, err := s.Replay(a.ID, ReplayOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stepStatuses(t, s, wf.ID)["b"]; got != models.JobStatusPending {
+		t.Fatalf("b after replaying a = %s, want pending", got)
+	}
+	runStep(t, s, "a", "", true)
+	runStep(t, s, "b", "", true)
+	if done, _ := s.Workflow(wf.ID); done.Status != models.WorkflowStatusCompleted {
+		t.Fatalf("workflow = %s, want completed", done.Status)
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cloud/pkg/models"
+)
+
+const apiKeysFile = "api_keys.json"
+
+// api key file keeps api keys (hashes, never the keys themselves) in memory and rewrites one
+// json file on every change, like webhook file; it is used next to the wal job store.
+type APIKeyFile struct {
+	mu   sync.RWMutex
+	keys map[string]*models.APIKey
+	path string
+}
+
+// open api key file loads api_keys.json from dir, creating the directory if needed
+func OpenAPIKeyFile(dir string) (*APIKeyFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &APIKeyFile{keys: make(map[string]*models.APIKey), path: filepath.Join(dir, apiKeysFile)}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*models.APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("api keys: corrupt %s: %w", apiKeysFile, err)
+	}
+	for _, k := range list {
+		f.keys[k.ID] = k
+	}
+	return f, nil
+}
+
+// put adds or replaces the key and rewrites the file
+func (f *APIKeyFile) Put(k *models.APIKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[k.ID] = k
+	return f.flushLocked()
+}
+
+// delete removes the key and rewrites the file
+func (f *APIKeyFile) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, id)
+	return f.flushLocked()
+}
+
+// get returns a key by id
+func (f *APIKeyFile) Get(id string) (*models.APIKey, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	k, ok := f.keys[id]
+	return k, ok
+}
+
+// get by hash returns the key whose hash matches
+func (f *APIKeyFile) GetByHash(hash string) (*models.APIKey, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, k := range f.keys {
+		if k.Hash == hash {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// list returns all keys
+func (f *APIKeyFile) List() []*models.APIKey {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make([]*models.APIKey, 0, len(f.keys))
+	for _, k := range f.keys {
+		out = append(out, k)
+	}
+	return out
+}
+
+func (f *APIKeyFile) flushLocked() error {
+	list := make([]*models.APIKey, 0, len(f.keys))
+	for _, k := range f.keys {
+		list = append(list, k)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+const idempotencyFile = "idempotency.log"
+
+// idempotency log keeps idempotency records in memory and appends every new one to a log file
+// (fsynced), so a retry after a restart still finds its job. the sweep rewrites the log with only
+// the live records. it is used next to the wal job store.
+type IdempotencyLog struct {
+	mu      sync.RWMutex
+	records map[string]*models.IdempotencyRecord
+	path    string
+	f       logFile
+	size    int64 // length of the log up to the last whole record
+	err     error // set when a failed append could not be cut off; the log takes no more records
+}
+
+// open idempotency log loads idempotency.log from dir, creating the directory if needed.
+// a torn final line (crash mid-append) is dropped.
+func OpenIdempotencyLog(dir string) (*IdempotencyLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &IdempotencyLog{records: make(map[string]*models.IdempotencyRecord), path: filepath.Join(dir, idempotencyFile)}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	// rewrite right away: drops the torn line and whatever expired while the api was down
+	if err := l.rewriteLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *IdempotencyLog) load() error {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		var rec models.IdempotencyRecord
+		if err != nil || json.Unmarshal(line, &rec) != nil {
+			log.Printf("event=idempotency_log_truncated path=%s", l.path)
+			return nil
+		}
+		l.records[rec.Key] = &rec
+	}
+}
+
+// put appends the record to the log and then updates the in-memory copy
+func (l *IdempotencyLog) Put(rec *models.IdempotencyRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if err := l.appendLocked(line); err != nil {
+		return err
+	}
+	l.size += int64(len(line))
+	l.records[rec.Key] = rec
+	return nil
+}
+
+// append locked writes and syncs one record. when either fails, whatever part of it reached the file
+// is cut off again, so load does not stop at a torn line and lose the records appended after it. if
+// the cut fails too the log is failed until the next rewrite.
+func (l *IdempotencyLog) appendLocked(line []byte) error {
+	_, err := l.f.Write(line)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if terr := l.f.Truncate(l.size); terr != nil {
+		l.err = fmt.Errorf("idempotency log: failed after a partial append: %v (cutting it off: %v)", err, terr)
+		log.Printf("event=idempotency_log_failed error=%v", l.err)
+		return l.err
+	}
+	return err
+}
+
+// get returns the record for key
+func (l *IdempotencyLog) Get(key string) (*models.IdempotencyRecord, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	rec, ok := l.records[key]
+	return rec, ok
+}
+
+// delete expired drops expired records and, when there were any, rewrites the log without them
+func (l *IdempotencyLog) DeleteExpired(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, rec := range l.records {
+		if !now.Before(rec.ExpiresAt) {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, l.rewriteLocked(now)
+}
+
+// close closes the log file
+func (l *IdempotencyLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// rewrite locked writes the live records to a new log (write temp, fsync, rename) and appends to it
+// from then on. the new log holds no torn record, so a log that failed takes records again.
+func (l *IdempotencyLog) rewriteLocked(now time.Time) error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for key, rec := range l.records {
+		if !now.Before(rec.ExpiresAt) {
+			delete(l.records, key)
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		n, err := w.Write(append(line, '\n'))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	l.size = size
+	l.err = nil
+	return nil
+}
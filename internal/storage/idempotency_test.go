@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func idemRecord(key, jobID string, expiresAt time.Time) *models.IdempotencyRecord {
+	return &models.IdempotencyRecord{Key: key, Fingerprint: "fp-" + jobID, JobID: jobID, CreatedAt: expiresAt.Add(-time.Hour), ExpiresAt: expiresAt}
+}
+
+// test idempotency backend runs the checks every models.IdempotencyBackend must pass
+func testIdempotencyBackend(t *testing.T, b models.IdempotencyBackend) {
+	t.Helper()
+	now := time.Now()
+	for _, rec := range []*models.IdempotencyRecord{
+		idemRecord("tenant:a/k1", "j1", now.Add(time.Hour)),
+		idemRecord("tenant:b/k1", "j2", now.Add(time.Hour)),
+		idemRecord("key:x/old", "j3", now.Add(-time.Second)),
+	} {
+		if err := b.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec, ok := b.Get("tenant:a/k1"); !ok || rec.JobID != "j1" || rec.Fingerprint != "fp-j1" || !rec.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("get = %+v %v", rec, ok)
+	}
+	if _, ok := b.Get("tenant:c/k1"); ok {
+		t.Fatal("got a record that was never put")
+	}
+	// a put under the same key replaces the record
+	if err := b.Put(idemRecord("tenant:b/k1", "j4", now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := b.Get("tenant:b/k1"); rec.JobID != "j4" {
+		t.Fatalf("replaced record = %+v, want j4", rec)
+	}
+
+	if n, err := b.DeleteExpired(now); n != 1 || err != nil {
+		t.Fatalf("delete expired = %d %v, want 1", n, err)
+	}
+	if _, ok := b.Get("key:x/old"); ok {
+		t.Fatal("expired record still there after delete expired")
+	}
+	if n, _ := b.DeleteExpired(now); n != 0 {
+		t.Fatalf("second delete expired = %d, want 0", n)
+	}
+}
+
+func TestIdempotencyLog(t *testing.T) {
+	l, err := OpenIdempotencyLog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	testIdempotencyBackend(t, l)
+}
+
+func TestIdempotencyLogSurvivesReopenAndATornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenIdempotencyLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.Put(idemRecord("k1", "j1", now.Add(time.Hour)))
+	l.Put(idemRecord("k2", "j2", now.Add(time.Hour)))
+	l.Put(idemRecord("k1", "j3", now.Add(time.Hour)))
+	l.Put(idemRecord("gone", "j4", now.Add(50*time.Millisecond)))
+	l.Close()
+	// a crash in the middle of an append leaves half a line
+	f, _ := os.OpenFile(filepath.Join(dir, idempotencyFile), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write([]byte(`{"key":"k5","job_`))
+	f.Close()
+	time.Sleep(60 * time.Millisecond)
+
+	l, err = OpenIdempotencyLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if rec, ok := l.Get("k1"); !ok || rec.JobID != "j3" {
+		t.Fatalf("k1 after reopen = %+v %v, want the last record put", rec, ok)
+	}
+	if _, ok := l.Get("k2"); !ok {
+		t.Fatal("k2 lost on reopen")
+	}
+	for _, key := range []string{"gone", "k5"} {
+		if _, ok := l.Get(key); ok {
+			t.Fatalf("%s loaded on reopen, want expired and torn records dropped", key)
+		}
+	}
+	// reopening compacted the log, which still takes appends
+	if err := l.Put(idemRecord("k6", "j6", now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, idempotencyFile))
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Fatalf("log holds %d lines after compaction and one put, want 3", lines)
+	}
+}
+
+func TestSQLiteIdempotency(t *testing.T) {
+	testIdempotencyBackend(t, openTestSQLite(t).Idempotency())
+
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Idempotency().Put(idemRecord("k1", "j1", time.Now().Add(time.Hour)))
+	db.Close()
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if rec, ok := db.Idempotency().Get("k1"); !ok || rec.JobID != "j1" {
+		t.Fatalf("k1 after reopen = %+v %v", rec, ok)
+	}
+}
+
+func TestIdempotencyLogCutsOffAFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenIdempotencyLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := l.Put(idemRecord("k1", "j1", now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	torn := &tornLog{logFile: l.f, failWrite: true}
+	l.f = torn
+	if err := l.Put(idemRecord("k2", "j2", now.Add(time.Hour))); err == nil {
+		t.Fatal("put succeeded on a failed write")
+	}
+	if err := l.Put(idemRecord("k3", "j3", now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = OpenIdempotencyLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, key := range []string{"k1", "k3"} {
+		if _, ok := l.Get(key); !ok {
+			t.Fatalf("%s put after the failed put was lost", key)
+		}
+	}
+	if _, ok := l.Get("k2"); ok {
+		t.Fatal("failed put came back on reopen")
+	}
+}
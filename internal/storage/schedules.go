@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cloud/pkg/models"
+)
+
+const schedulesFile = "schedules.json"
+
+// schedule file keeps schedules in memory and rewrites one json file on every change.
+// there are few schedules and they change at most once a minute each, so no log is needed;
+// it is used next to the wal job store.
+type ScheduleFile struct {
+	mu        sync.RWMutex
+	schedules map[string]*models.Schedule
+	path      string
+}
+
+// open schedule file loads schedules.json from dir, creating the directory if needed
+func OpenScheduleFile(dir string) (*ScheduleFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &ScheduleFile{schedules: make(map[string]*models.Schedule), path: filepath.Join(dir, schedulesFile)}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*models.Schedule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("schedules: corrupt %s: %w", schedulesFile, err)
+	}
+	for _, s := range list {
+		f.schedules[s.ID] = s
+	}
+	return f, nil
+}
+
+// put adds or replaces the schedule with a copy of it and rewrites the file
+func (f *ScheduleFile) Put(s *models.Schedule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedules[s.ID] = s.Clone()
+	return f.flushLocked()
+}
+
+// delete removes the schedule and rewrites the file
+func (f *ScheduleFile) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.schedules, id)
+	return f.flushLocked()
+}
+
+// get returns a copy of a schedule by id
+func (f *ScheduleFile) Get(id string) (*models.Schedule, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s, ok := f.schedules[id]
+	if !ok {
+		return nil, false
+	}
+	return s.Clone(), true
+}
+
+// list returns copies of all schedules
+func (f *ScheduleFile) List() []*models.Schedule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make([]*models.Schedule, 0, len(f.schedules))
+	for _, s := range f.schedules {
+		out = append(out, s.Clone())
+	}
+	return out
+}
+
+func (f *ScheduleFile) flushLocked() error {
+	list := make([]*models.Schedule, 0, len(f.schedules))
+	for _, s := range f.schedules {
+		list = append(list, s)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
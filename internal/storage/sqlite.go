@@ -0,0 +1,680 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud/pkg/models"
+
+	_ "modernc.org/sqlite" // pure-go driver, builds with CGO_ENABLED=0
+)
+
+// migrations are applied in order and recorded in schema_migrations; never edit a shipped entry,
+// append a new one instead. indexed columns are copied out of the job, the full job is kept as json.
+var migrations = []string{
+	`CREATE TABLE jobs (
+		id          TEXT PRIMARY KEY,
+		status      TEXT NOT NULL,
+		type        TEXT NOT NULL DEFAULT '',
+		priority    INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL,
+		finished_at INTEGER,
+		worker_id   TEXT NOT NULL DEFAULT '',
+		data        TEXT NOT NULL
+	);
+	CREATE INDEX jobs_status ON jobs(status);
+	CREATE INDEX jobs_type ON jobs(type);
+	CREATE INDEX jobs_priority ON jobs(priority);
+	CREATE INDEX jobs_created_at ON jobs(created_at);
+	CREATE TABLE workers (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE INDEX jobs_priority_created_at ON jobs(priority, created_at, id);
+	CREATE INDEX jobs_finished_at ON jobs(COALESCE(finished_at, 0), id);
+	CREATE INDEX jobs_worker_id ON jobs(worker_id);`,
+	`ALTER TABLE jobs ADD COLUMN workflow_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX jobs_workflow_id ON jobs(workflow_id);`,
+	`CREATE TABLE schedules (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE TABLE webhooks (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE TABLE api_keys (
+		id   TEXT PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		data TEXT NOT NULL
+	);`,
+	`ALTER TABLE jobs ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX jobs_tenant_status ON jobs(tenant, status);`,
+	`CREATE TABLE idempotency_keys (
+		key        TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);`,
+	`ALTER TABLE jobs ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// sort columns maps a sort field to the columns it orders by, matching models.Job.SortKeys
+func sortColumns(field models.JobSortField) []string {
+	switch field {
+	case models.SortByPriority:
+		return []string{"priority", "created_at"}
+	case models.SortByFinishedAt:
+		return []string{"COALESCE(finished_at, 0)"}
+	default:
+		return []string{"created_at"}
+	}
+}
+
+// sqlite is a job and worker store backed by a single sqlite database file
+type SQLite struct {
+	db *sql.DB
+}
+
+// open sqlite opens (or creates) the database at path and runs pending migrations
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows one writer at a time; a single connection avoids SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+	s := &SQLite{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLite) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for v := current + 1; v <= len(migrations); v++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite: migration %d: %w", v, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, v, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("event=schema_migrated backend=sqlite version=%d", v)
+	}
+	return nil
+}
+
+// close closes the database
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// jobs returns the job backend view of the database
+func (s *SQLite) Jobs() *SQLiteJobs {
+	return &SQLiteJobs{db: s.db}
+}
+
+// workers returns the worker backend view of the database
+func (s *SQLite) Workers() *SQLiteWorkers {
+	return &SQLiteWorkers{db: s.db}
+}
+
+// schedules returns the schedule backend view of the database
+func (s *SQLite) Schedules() *SQLiteSchedules {
+	return &SQLiteSchedules{db: s.db}
+}
+
+// webhooks returns the webhook subscription backend view of the database
+func (s *SQLite) Webhooks() *SQLiteWebhooks {
+	return &SQLiteWebhooks{db: s.db}
+}
+
+// api keys returns the api key backend view of the database
+func (s *SQLite) APIKeys() *SQLiteAPIKeys {
+	return &SQLiteAPIKeys{db: s.db}
+}
+
+// idempotency returns the idempotency record backend view of the database
+func (s *SQLite) Idempotency() *SQLiteIdempotency {
+	return &SQLiteIdempotency{db: s.db}
+}
+
+// sqlite jobs implements models.JobBackend and models.JobQuerier
+type SQLiteJobs struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the job by id
+func (j *SQLiteJobs) Put(job *models.Job) error {
+	cols, err := jobColumns(job)
+	if err != nil {
+		return err
+	}
+	_, err = j.db.Exec(`INSERT INTO jobs (status, type, priority, created_at, finished_at, worker_id, workflow_id, tenant, revision, data, id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET status = excluded.status, type = excluded.type, priority = excluded.priority,
+			created_at = excluded.created_at, finished_at = excluded.finished_at, worker_id = excluded.worker_id,
+			workflow_id = excluded.workflow_id, tenant = excluded.tenant, revision = excluded.revision, data = excluded.data`,
+		append(cols, job.ID)...)
+	return err
+}
+
+// put if replaces the job only while the stored row is still at the given revision
+func (j *SQLiteJobs) PutIf(job *models.Job, revision int64) (bool, error) {
+	cols, err := jobColumns(job)
+	if err != nil {
+		return false, err
+	}
+	res, err := j.db.Exec(`UPDATE jobs SET status = ?, type = ?, priority = ?, created_at = ?, finished_at = ?, worker_id = ?,
+			workflow_id = ?, tenant = ?, revision = ?, data = ?
+		WHERE id = ? AND revision = ?`,
+		append(cols, job.ID, revision)...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// job columns returns the values of every jobs column but id, in the order put and put if write them
+func jobColumns(job *models.Job) ([]any, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	var finishedAt sql.NullInt64
+	if job.FinishedAt != nil {
+		finishedAt = sql.NullInt64{Int64: job.FinishedAt.UnixNano(), Valid: true}
+	}
+	var workflowID string
+	if job.Workflow != nil {
+		workflowID = job.Workflow.WorkflowID
+	}
+	return []any{string(job.Status), job.Type, job.Priority, job.CreatedAt.UnixNano(), finishedAt, job.WorkerID, workflowID,
+		models.TenantOrDefault(job.Tenant), job.Revision, string(data)}, nil
+}
+
+// get returns a job by id
+func (j *SQLiteJobs) Get(id string) (*models.Job, bool) {
+	var data string
+	err := j.db.QueryRow(`SELECT data FROM jobs WHERE id = ?`, id).Scan(&data)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_job job_id=%s error=%v", id, err)
+		}
+		return nil, false
+	}
+	job, err := decodeJob(data)
+	if err != nil {
+		log.Printf("event=store_query_failed query=get_job job_id=%s error=%v", id, err)
+		return nil, false
+	}
+	return job, true
+}
+
+// list returns all jobs (optional filter by status)
+func (j *SQLiteJobs) List(status models.JobStatus) []*models.Job {
+	var rows *sql.Rows
+	var err error
+	if status == "" {
+		rows, err = j.db.Query(`SELECT data FROM jobs`)
+	} else {
+		rows, err = j.db.Query(`SELECT data FROM jobs WHERE status = ?`, string(status))
+	}
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_jobs error=%v", err)
+		return nil
+	}
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_jobs error=%v", err)
+	}
+	return jobs
+}
+
+// query filters, orders and pages in sql so only one page of rows is decoded.
+// cursors use a row-value comparison on the sort columns plus id (keyset pagination).
+func (j *SQLiteJobs) Query(q models.JobQuery) ([]*models.Job, int, error) {
+	var conds []string
+	var args []interface{}
+	if q.Status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, string(q.Status))
+	}
+	if q.Type != "" {
+		conds = append(conds, "type = ?")
+		args = append(args, q.Type)
+	}
+	if q.WorkerID != "" {
+		conds = append(conds, "worker_id = ?")
+		args = append(args, q.WorkerID)
+	}
+	if q.WorkflowID != "" {
+		conds = append(conds, "workflow_id = ?")
+		args = append(args, q.WorkflowID)
+	}
+	if q.Tenant != "" {
+		conds = append(conds, "tenant = ?")
+		args = append(args, q.Tenant)
+	}
+	if !q.CreatedAfter.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, q.CreatedAfter.UnixNano())
+	}
+	if !q.CreatedBefore.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, q.CreatedBefore.UnixNano())
+	}
+	var total int
+	if err := j.db.QueryRow(`SELECT COUNT(*) FROM jobs`+whereClause(conds), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	cols := append(sortColumns(q.SortBy), "id")
+	dir, op := "ASC", ">"
+	if q.Desc {
+		dir, op = "DESC", "<"
+	}
+	offset := q.Offset
+	if q.Cursor != nil {
+		if err := models.CheckCursor(q.Cursor, q.SortBy); err != nil {
+			return nil, 0, err
+		}
+		conds = append(conds, "("+strings.Join(cols, ", ")+") "+op+" ("+strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")+")")
+		for _, k := range q.Cursor.Keys {
+			args = append(args, k)
+		}
+		args = append(args, q.Cursor.ID)
+		offset = 0
+	}
+	order := make([]string, len(cols))
+	for i, c := range cols {
+		order[i] = c + " " + dir
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1 // sqlite: no limit
+	}
+	rows, err := j.db.Query(`SELECT data FROM jobs`+whereClause(conds)+` ORDER BY `+strings.Join(order, ", ")+` LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return jobs, total, nil
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// count by status returns the number of jobs in each status using the status index, or the
+// tenant and status index for one tenant
+func (j *SQLiteJobs) CountByStatus(tenant string) (map[models.JobStatus]int, error) {
+	var rows *sql.Rows
+	var err error
+	if tenant == "" {
+		rows, err = j.db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	} else {
+		rows, err = j.db.Query(`SELECT status, COUNT(*) FROM jobs WHERE tenant = ? GROUP BY status`, tenant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[models.JobStatus]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[models.JobStatus(status)] = n
+	}
+	return counts, rows.Err()
+}
+
+func scanJobs(rows *sql.Rows) ([]*models.Job, error) {
+	defer rows.Close()
+	var out []*models.Job
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return out, err
+		}
+		job, err := decodeJob(data)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, job)
+	}
+	return out, rows.Err()
+}
+
+func decodeJob(data string) (*models.Job, error) {
+	var job models.Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// sqlite workers implements models.WorkerBackend
+type SQLiteWorkers struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the worker by id
+func (w *SQLiteWorkers) Put(worker *models.Worker) error {
+	data, err := json.Marshal(worker)
+	if err != nil {
+		return err
+	}
+	_, err = w.db.Exec(`INSERT INTO workers (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data`,
+		worker.ID, string(data))
+	return err
+}
+
+// delete removes a worker by id
+func (w *SQLiteWorkers) Delete(id string) error {
+	_, err := w.db.Exec(`DELETE FROM workers WHERE id = ?`, id)
+	return err
+}
+
+// get returns a worker by id
+func (w *SQLiteWorkers) Get(id string) (*models.Worker, bool) {
+	var data string
+	if err := w.db.QueryRow(`SELECT data FROM workers WHERE id = ?`, id).Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_worker worker_id=%s error=%v", id, err)
+		}
+		return nil, false
+	}
+	var worker models.Worker
+	if err := json.Unmarshal([]byte(data), &worker); err != nil {
+		log.Printf("event=store_query_failed query=get_worker worker_id=%s error=%v", id, err)
+		return nil, false
+	}
+	return &worker, true
+}
+
+// list returns all workers ordered by id
+func (w *SQLiteWorkers) List() []*models.Worker {
+	rows, err := w.db.Query(`SELECT data FROM workers ORDER BY id`)
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_workers error=%v", err)
+		return nil
+	}
+	defer rows.Close()
+	out := make([]*models.Worker, 0)
+	for rows.Next() {
+		var data string
+		var worker models.Worker
+		if err := rows.Scan(&data); err != nil || json.Unmarshal([]byte(data), &worker) != nil {
+			log.Printf("event=store_query_failed query=list_workers error=%v", err)
+			continue
+		}
+		out = append(out, &worker)
+	}
+	return out
+}
+
+// sqlite schedules implements models.ScheduleBackend
+type SQLiteSchedules struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the schedule by id
+func (s *SQLiteSchedules) Put(sch *models.Schedule) error {
+	data, err := json.Marshal(sch)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO schedules (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data`,
+		sch.ID, string(data))
+	return err
+}
+
+// delete removes a schedule by id
+func (s *SQLiteSchedules) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	return err
+}
+
+// get returns a schedule by id
+func (s *SQLiteSchedules) Get(id string) (*models.Schedule, bool) {
+	var data string
+	if err := s.db.QueryRow(`SELECT data FROM schedules WHERE id = ?`, id).Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_schedule schedule_id=%s error=%v", id, err)
+		}
+		return nil, false
+	}
+	var sch models.Schedule
+	if err := json.Unmarshal([]byte(data), &sch); err != nil {
+		log.Printf("event=store_query_failed query=get_schedule schedule_id=%s error=%v", id, err)
+		return nil, false
+	}
+	return &sch, true
+}
+
+// list returns all schedules
+func (s *SQLiteSchedules) List() []*models.Schedule {
+	rows, err := s.db.Query(`SELECT data FROM schedules`)
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_schedules error=%v", err)
+		return nil
+	}
+	defer rows.Close()
+	out := make([]*models.Schedule, 0)
+	for rows.Next() {
+		var data string
+		var sch models.Schedule
+		if err := rows.Scan(&data); err != nil || json.Unmarshal([]byte(data), &sch) != nil {
+			log.Printf("event=store_query_failed query=list_schedules error=%v", err)
+			continue
+		}
+		out = append(out, &sch)
+	}
+	return out
+}
+
+// sqlite webhooks implements models.WebhookBackend
+type SQLiteWebhooks struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the subscription by id
+func (w *SQLiteWebhooks) Put(sub *models.WebhookSubscription) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	_, err = w.db.Exec(`INSERT INTO webhooks (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data`,
+		sub.ID, string(data))
+	return err
+}
+
+// delete removes a subscription by id
+func (w *SQLiteWebhooks) Delete(id string) error {
+	_, err := w.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	return err
+}
+
+// get returns a subscription by id
+func (w *SQLiteWebhooks) Get(id string) (*models.WebhookSubscription, bool) {
+	var data string
+	if err := w.db.QueryRow(`SELECT data FROM webhooks WHERE id = ?`, id).Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_webhook webhook_id=%s error=%v", id, err)
+		}
+		return nil, false
+	}
+	var sub models.WebhookSubscription
+	if err := json.Unmarshal([]byte(data), &sub); err != nil {
+		log.Printf("event=store_query_failed query=get_webhook webhook_id=%s error=%v", id, err)
+		return nil, false
+	}
+	return &sub, true
+}
+
+// list returns all subscriptions
+func (w *SQLiteWebhooks) List() []*models.WebhookSubscription {
+	rows, err := w.db.Query(`SELECT data FROM webhooks`)
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_webhooks error=%v", err)
+		return nil
+	}
+	defer rows.Close()
+	out := make([]*models.WebhookSubscription, 0)
+	for rows.Next() {
+		var data string
+		var sub models.WebhookSubscription
+		if err := rows.Scan(&data); err != nil || json.Unmarshal([]byte(data), &sub) != nil {
+			log.Printf("event=store_query_failed query=list_webhooks error=%v", err)
+			continue
+		}
+		out = append(out, &sub)
+	}
+	return out
+}
+
+// sqlite api keys implements models.APIKeyBackend. keys are looked up by their indexed hash.
+type SQLiteAPIKeys struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the key by id
+func (a *SQLiteAPIKeys) Put(k *models.APIKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec(`INSERT INTO api_keys (id, hash, data) VALUES (?, ?, ?) ON CONFLICT(id) DO UPDATE SET hash = excluded.hash, data = excluded.data`,
+		k.ID, k.Hash, string(data))
+	return err
+}
+
+// delete removes a key by id
+func (a *SQLiteAPIKeys) Delete(id string) error {
+	_, err := a.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	return err
+}
+
+// get returns a key by id
+func (a *SQLiteAPIKeys) Get(id string) (*models.APIKey, bool) {
+	return a.getOne(`SELECT data FROM api_keys WHERE id = ?`, id)
+}
+
+// get by hash returns the key whose hash matches
+func (a *SQLiteAPIKeys) GetByHash(hash string) (*models.APIKey, bool) {
+	return a.getOne(`SELECT data FROM api_keys WHERE hash = ?`, hash)
+}
+
+func (a *SQLiteAPIKeys) getOne(query, arg string) (*models.APIKey, bool) {
+	var data string
+	if err := a.db.QueryRow(query, arg).Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_api_key error=%v", err)
+		}
+		return nil, false
+	}
+	var k models.APIKey
+	if err := json.Unmarshal([]byte(data), &k); err != nil {
+		log.Printf("event=store_query_failed query=get_api_key error=%v", err)
+		return nil, false
+	}
+	return &k, true
+}
+
+// list returns all keys
+func (a *SQLiteAPIKeys) List() []*models.APIKey {
+	rows, err := a.db.Query(`SELECT data FROM api_keys`)
+	if err != nil {
+		log.Printf("event=store_query_failed query=list_api_keys error=%v", err)
+		return nil
+	}
+	defer rows.Close()
+	out := make([]*models.APIKey, 0)
+	for rows.Next() {
+		var data string
+		var k models.APIKey
+		if err := rows.Scan(&data); err != nil || json.Unmarshal([]byte(data), &k) != nil {
+			log.Printf("event=store_query_failed query=list_api_keys error=%v", err)
+			continue
+		}
+		out = append(out, &k)
+	}
+	return out
+}
+
+// sqlite idempotency implements models.IdempotencyBackend. expired records are deleted through the expires_at index.
+type SQLiteIdempotency struct {
+	db *sql.DB
+}
+
+// put inserts or replaces the record by key
+func (i *SQLiteIdempotency) Put(rec *models.IdempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = i.db.Exec(`INSERT INTO idempotency_keys (key, expires_at, data) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET expires_at = excluded.expires_at, data = excluded.data`,
+		rec.Key, rec.ExpiresAt.UnixNano(), string(data))
+	return err
+}
+
+// get returns the record for key
+func (i *SQLiteIdempotency) Get(key string) (*models.IdempotencyRecord, bool) {
+	var data string
+	if err := i.db.QueryRow(`SELECT data FROM idempotency_keys WHERE key = ?`, key).Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("event=store_query_failed query=get_idempotency_key error=%v", err)
+		}
+		return nil, false
+	}
+	var rec models.IdempotencyRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		log.Printf("event=store_query_failed query=get_idempotency_key error=%v", err)
+		return nil, false
+	}
+	return &rec, true
+}
+
+// delete expired removes every record that expired by now
+func (i *SQLiteIdempotency) DeleteExpired(now time.Time) (int, error) {
+	res, err := i.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
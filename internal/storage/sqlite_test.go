@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func openTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLitePutIfChecksRevision(t *testing.T) {
+	testPutIfChecksRevision(t, openTestSQLite(t).Jobs())
+}
+
+func TestSQLiteMigratesOnceAndKeepsJobsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := walJob("a", models.JobStatusCompleted)
+	job.Result = "ok"
+	if err := db.Jobs().Put(job); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var applied int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil || applied != len(migrations) {
+		t.Fatalf("schema_migrations has %d rows (%v), want %d", applied, err, len(migrations))
+	}
+	if got, ok := db.Jobs().Get("a"); !ok || got.Status != models.JobStatusCompleted || got.Result != "ok" {
+		t.Fatalf("job after reopen = %+v, %v", got, ok)
+	}
+}
+
+// the sql query must select and order exactly what the in-memory store does
+func TestSQLiteQueryMatchesMemoryStore(t *testing.T) {
+	db := openTestSQLite(t)
+	mem := models.NewJobStore()
+	sqlStore := models.NewJobStoreWithBackend(db.Jobs())
+	base := time.Now().Truncate(time.Second)
+	statuses := []models.JobStatus{models.JobStatusQueued, models.JobStatusRunning, models.JobStatusCompleted, models.JobStatusFailed}
+	for i := 0; i < 40; i++ {
+		finished := base.Add(time.Duration(i%7) * time.Minute)
+		job := &models.Job{
+			ID:        fmt.Sprintf("j%02d", i),
+			Type:      []string{"hash", "email"}[i%2],
+			Status:    statuses[i%len(statuses)],
+			Priority:  i % 3,
+			CreatedAt: base.Add(time.Duration(i%10) * time.Second), // ties broken by id
+			WorkerID:  []string{"", "w1", "w2"}[i%3],
+			Tenant:    []string{"default", "acme"}[i%2],
+		}
+		if job.Status == models.JobStatusCompleted {
+			job.FinishedAt = &finished
+		}
+		if i%5 == 0 {
+			job.Workflow = &models.WorkflowStep{WorkflowID: "wf"}
+		}
+		for _, s := range []*models.JobStore{mem, sqlStore} {
+			// create stamps the status and creation time, so set them again afterwards
+			c := job.Clone()
+			if _, err := s.Create(c); err != nil {
+				t.Fatal(err)
+			}
+			c.Status, c.CreatedAt = job.Status, job.CreatedAt
+			s.Update(c)
+		}
+	}
+	queries := []models.JobQuery{
+		{},
+		{Status: models.JobStatusCompleted, SortBy: models.SortByFinishedAt, Desc: true},
+		{Type: "email", SortBy: models.SortByPriority},
+		{WorkerID: "w1", Tenant: "acme"},
+		{WorkflowID: "wf", Desc: true},
+		{CreatedAfter: base.Add(3 * time.Second), CreatedBefore: base.Add(6 * time.Second)},
+		{SortBy: models.SortByPriority, Desc: true, Limit: 7, Offset: 5},
+	}
+	for _, q := range queries {
+		want, wantTotal, _ := mem.Query(q)
+		got, total, err := sqlStore.Query(q)
+		if err != nil {
+			t.Fatalf("%+v: %v", q, err)
+		}
+		if total != wantTotal || !reflect.DeepEqual(jobIDs(got), jobIDs(want)) {
+			t.Errorf("%+v:\n sqlite %d %v\n memory %d %v", q, total, jobIDs(got), wantTotal, jobIDs(want))
+		}
+	}
+	for _, tenant := range []string{"", "acme"} {
+		if got, want := sqlStore.CountByStatusFor(tenant), mem.CountByStatusFor(tenant); !reflect.DeepEqual(got, want) {
+			t.Errorf("count by status for %q = %v, want %v", tenant, got, want)
+		}
+	}
+}
+
+func TestSQLiteWorkers(t *testing.T) {
+	w := openTestSQLite(t).Workers()
+	if err := w.Put(&models.Worker{ID: "w1", Endpoint: "http://w1", Capacity: 2, Labels: map[string]string{"zone": "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put(&models.Worker{ID: "w1", Endpoint: "http://w1", Capacity: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put(&models.Worker{ID: "w2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := w.Get("w1"); !ok || got.Capacity != 4 || got.Labels != nil {
+		t.Fatalf("w1 = %+v, %v; want the second put", got, ok)
+	}
+	if err := w.Delete("w2"); err != nil {
+		t.Fatal(err)
+	}
+	if list := w.List(); len(list) != 1 || list[0].ID != "w1" {
+		t.Fatalf("workers = %+v, want only w1", list)
+	}
+}
+
+func jobIDs(jobs []*models.Job) []string {
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.ID
+	}
+	return ids
+}
+
+// put job creates the job in s and then writes the status, creation time and finish time it came with
+func putJob(t *testing.T, s *models.JobStore, job *models.Job) {
+	t.Helper()
+	c := job.Clone()
+	if _, err := s.Create(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Status, c.CreatedAt, c.FinishedAt = job.Status, job.CreatedAt, job.FinishedAt
+	s.Update(c)
+}
+
+// page ids follows next cursors from the first page to the last, calling between after each page
+func pageIDs(t *testing.T, s *models.JobStore, q models.JobQuery, between func()) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("pagination does not end")
+		}
+		jobs, _, err := s.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, jobIDs(jobs)...)
+		if len(jobs) < q.Limit {
+			return ids
+		}
+		q.Cursor = jobs[len(jobs)-1].Cursor(q.SortBy)
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestSQLiteCursorPages(t *testing.T) {
+	s := models.NewJobStoreWithBackend(openTestSQLite(t).Jobs())
+	base := time.Now().Truncate(time.Second)
+	for i := 0; i < 25; i++ {
+		job := &models.Job{ID: fmt.Sprintf("j%02d", i), Status: models.JobStatusQueued, Priority: i % 3, CreatedAt: base.Add(time.Duration(i/3) * time.Second)}
+		if i%2 == 0 {
+			finished := base.Add(time.Duration(i%4) * time.Minute)
+			job.Status, job.FinishedAt = models.JobStatusCompleted, &finished
+		}
+		putJob(t, s, job)
+	}
+	for _, sort := range []models.JobSortField{models.SortByCreatedAt, models.SortByPriority, models.SortByFinishedAt} {
+		for _, desc := range []bool{false, true} {
+			all, _, _ := s.Query(models.JobQuery{SortBy: sort, Desc: desc})
+			if got := pageIDs(t, s, models.JobQuery{SortBy: sort, Desc: desc, Limit: 4}, nil); !reflect.DeepEqual(got, jobIDs(all)) {
+				t.Errorf("sort=%s desc=%v pages:\n %v\nwant\n %v", sort, desc, got, jobIDs(all))
+			}
+		}
+	}
+
+	// created_at never changes, so its pages are stable while jobs change, finish and arrive
+	before, _, _ := s.Query(models.JobQuery{SortBy: models.SortByCreatedAt, Desc: true})
+	n := 0
+	got := pageIDs(t, s, models.JobQuery{SortBy: models.SortByCreatedAt, Desc: true, Limit: 4}, func() {
+		n++
+		for _, j := range s.List("") {
+			j.Priority = (j.Priority + 1) % 3
+			now := base.Add(time.Hour)
+			j.FinishedAt = &now
+			s.Update(j)
+		}
+		putJob(t, s, &models.Job{ID: fmt.Sprintf("new%d", n), Status: models.JobStatusQueued, CreatedAt: base.Add(time.Hour)})
+	})
+	if !reflect.DeepEqual(got, jobIDs(before)) {
+		t.Fatalf("pages while jobs changed:\n %v\nwant\n %v", got, jobIDs(before))
+	}
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+const (
+	walFile      = "jobs.wal"
+	snapshotFile = "jobs.snapshot"
+)
+
+// wal record is one line of the append-only log: the full job state after a write
+type walRecord struct {
+	LSN uint64      `json:"lsn"`
+	Job *models.Job `json:"job"`
+}
+
+// snapshot is the on-disk image of every job as of log sequence number lsn
+type snapshot struct {
+	LSN  uint64        `json:"lsn"`
+	Jobs []*models.Job `json:"jobs"`
+}
+
+// log file is what the wal and the idempotency log append to: an *os.File opened for appending
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// wal backend keeps jobs in memory and appends every write to a log file before returning.
+// a periodic snapshot captures all jobs and truncates the log, so startup only replays
+// the snapshot plus the records written after it. it keeps its own copy of every job and hands out
+// copies, so callers changing a job they read can't race the snapshot.
+type WALBackend struct {
+	mu   sync.RWMutex
+	jobs map[string]*models.Job
+	dir  string
+	wal  logFile
+	size int64 // length of the log up to the last whole record
+	lsn  uint64
+	err  error // set when a failed append could not be cut off; the log takes no more writes
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// open wal opens (or creates) the store in dir and replays the snapshot and log into memory
+func OpenWAL(dir string) (*WALBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &WALBackend{jobs: make(map[string]*models.Job), dir: dir, stop: make(chan struct{})}
+	if err := b.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := b.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.wal = f
+	b.size = info.Size()
+	log.Printf("event=store_recovered backend=wal dir=%s jobs=%d lsn=%d", dir, len(b.jobs), b.lsn)
+	return b, nil
+}
+
+func (b *WALBackend) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(b.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("wal: corrupt snapshot: %w", err)
+	}
+	for _, j := range snap.Jobs {
+		b.jobs[j.ID] = j
+	}
+	b.lsn = snap.LSN
+	return nil
+}
+
+// replay applies log records newer than the snapshot. a torn final record (crash mid-append)
+// is cut off so later appends start on a clean line.
+func (b *WALBackend) replay() error {
+	path := filepath.Join(b.dir, walFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		// every record ends in a newline, so a line without one was cut short by a crash
+		var rec walRecord
+		if err != nil || json.Unmarshal(line, &rec) != nil || rec.Job == nil {
+			log.Printf("event=wal_truncated offset=%d", offset)
+			return os.Truncate(path, offset)
+		}
+		offset += int64(len(line))
+		if rec.LSN > b.lsn {
+			b.jobs[rec.Job.ID] = rec.Job
+			b.lsn = rec.LSN
+		}
+	}
+}
+
+// put appends the job to the log (fsynced) and then stores a copy of it
+func (b *WALBackend) Put(job *models.Job) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.putLocked(job)
+}
+
+// put if writes the job like put, but only while the stored job is at the given revision
+func (b *WALBackend) PutIf(job *models.Job, revision int64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cur, ok := b.jobs[job.ID]; !ok || cur.Revision != revision {
+		return false, nil
+	}
+	return true, b.putLocked(job)
+}
+
+func (b *WALBackend) putLocked(job *models.Job) error {
+	line, err := json.Marshal(walRecord{LSN: b.lsn + 1, Job: job})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.append(line); err != nil {
+		return err
+	}
+	b.size += int64(len(line))
+	b.lsn++
+	b.jobs[job.ID] = job.Clone()
+	return nil
+}
+
+// append writes and syncs one record. when either fails, whatever part of it reached the file is cut
+// off again, so the next record neither follows a torn line, which replay would stop at and drop
+// everything after, nor reuses the lsn of one replay would apply. if the cut fails too the log is
+// failed and refuses further writes.
+func (b *WALBackend) append(line []byte) error {
+	_, err := b.wal.Write(line)
+	if err == nil {
+		err = b.wal.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if terr := b.wal.Truncate(b.size); terr != nil {
+		b.err = fmt.Errorf("wal: failed after a partial append: %v (cutting it off: %v)", err, terr)
+		log.Printf("event=wal_failed error=%v", b.err)
+		return b.err
+	}
+	return err
+}
+
+// get returns a copy of the job
+func (b *WALBackend) Get(id string) (*models.Job, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	j, ok := b.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return j.Clone(), true
+}
+
+// list returns copies of all jobs (optional filter by status)
+func (b *WALBackend) List(status models.JobStatus) []*models.Job {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var out []*models.Job
+	for _, j := range b.jobs {
+		if status == "" || j.Status == status {
+			out = append(out, j.Clone())
+		}
+	}
+	return out
+}
+
+// snapshot writes every job to a new snapshot file (write temp, fsync, rename) and truncates the log.
+// an empty log holds no torn record, so a log that failed takes writes again.
+func (b *WALBackend) Snapshot() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	snap := snapshot{LSN: b.lsn, Jobs: make([]*models.Job, 0, len(b.jobs))}
+	for _, j := range b.jobs {
+		snap.Jobs = append(snap.Jobs, j)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(b.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	// records up to snap.lsn are covered by the snapshot; if we crash before the truncate
+	// they are skipped on replay by lsn
+	if err := b.wal.Truncate(0); err != nil {
+		return err
+	}
+	b.size = 0
+	b.err = nil
+	return b.wal.Sync()
+}
+
+// write file atomic replaces path with data so readers see either the old or the new file, never a mix
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// start snapshots runs snapshot every interval until close
+func (b *WALBackend) StartSnapshots(interval time.Duration) {
+	b.done.Add(1)
+	go func() {
+		defer b.done.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-tick.C:
+				if err := b.Snapshot(); err != nil {
+					log.Printf("event=snapshot_failed error=%v", err)
+				}
+			}
+		}
+	}()
+}
+
+// close stops the snapshot loop, writes a final snapshot and closes the log
+func (b *WALBackend) Close() error {
+	close(b.stop)
+	b.done.Wait()
+	if err := b.Snapshot(); err != nil {
+		log.Printf("event=snapshot_failed error=%v", err)
+	}
+	return b.wal.Close()
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func walJob(id string, status models.JobStatus) *models.Job {
+	return &models.Job{ID: id, Payload: "p-" + id, Status: status, CreatedAt: time.Now()}
+}
+
+func mustPut(t *testing.T, b *WALBackend, job *models.Job) {
+	t.Helper()
+	if err := b.Put(job); err != nil {
+		t.Fatalf("put %s: %v", job.ID, err)
+	}
+}
+
+func TestWALRecoversSnapshotAndLogAfterTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	b, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, walJob("a", models.JobStatusQueued))
+	mustPut(t, b, walJob("b", models.JobStatusRunning))
+	if err := b.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	done := walJob("a", models.JobStatusCompleted)
+	done.Result = "ok"
+	mustPut(t, b, done)
+	mustPut(t, b, walJob("c", models.JobStatusQueued))
+	if err := b.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// crash halfway through the last record
+	path := filepath.Join(dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastStart := len(data) - 1
+	for lastStart > 0 && data[lastStart-1] != '\n' {
+		lastStart--
+	}
+	if err := os.Truncate(path, int64(lastStart+(len(data)-lastStart)/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := b.Get("a"); !ok || got.Status != models.JobStatusCompleted || got.Result != "ok" {
+		t.Fatalf("a = %+v, %v; want the completed job from the log", got, ok)
+	}
+	if got, ok := b.Get("b"); !ok || got.Status != models.JobStatusRunning {
+		t.Fatalf("b = %+v, %v; want the running job from the snapshot", got, ok)
+	}
+	if _, ok := b.Get("c"); ok {
+		t.Fatal("c was only half written and should be gone")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(lastStart) {
+		t.Fatalf("log not cut back to the last whole record: %v %v", info, err)
+	}
+
+	// appends after the cut start on a clean line
+	mustPut(t, b, walJob("d", models.JobStatusQueued))
+	if err := b.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got := len(b.List("")); got != 3 {
+		t.Fatalf("recovered %d jobs, want 3 (a, b, d)", got)
+	}
+	if _, ok := b.Get("d"); !ok {
+		t.Fatal("d written after recovery is missing")
+	}
+}
+
+// torn log writes half of the next record and fails, the way a full disk does
+type tornLog struct {
+	logFile
+	failWrite    bool
+	failTruncate bool
+}
+
+func (l *tornLog) Write(p []byte) (int, error) {
+	if !l.failWrite {
+		return l.logFile.Write(p)
+	}
+	l.failWrite = false
+	n, _ := l.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (l *tornLog) Truncate(size int64) error {
+	if l.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return l.logFile.Truncate(size)
+}
+
+func TestWALCutsOffAFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	b, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, walJob("a", models.JobStatusQueued))
+	torn := &tornLog{logFile: b.wal, failWrite: true}
+	b.wal = torn
+	if err := b.Put(walJob("b", models.JobStatusQueued)); err == nil {
+		t.Fatal("put succeeded on a failed write")
+	}
+	if _, ok := b.Get("b"); ok {
+		t.Fatal("failed put is visible")
+	}
+	mustPut(t, b, walJob("c", models.JobStatusQueued))
+	if err := torn.logFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, id := range []string{"a", "c"} {
+		if _, ok := b.Get(id); !ok {
+			t.Fatalf("job %s written after the failed put was lost", id)
+		}
+	}
+	if _, ok := b.Get("b"); ok {
+		t.Fatal("failed put came back on replay")
+	}
+}
+
+func TestWALFailsWhenAFailedAppendCannotBeCutOff(t *testing.T) {
+	b, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := &tornLog{logFile: b.wal, failWrite: true, failTruncate: true}
+	b.wal = torn
+	if err := b.Put(walJob("a", models.JobStatusQueued)); err == nil {
+		t.Fatal("put succeeded on a failed write")
+	}
+	// the torn record is still on disk; nothing may follow it
+	if err := b.Put(walJob("b", models.JobStatusQueued)); err == nil {
+		t.Fatal("put appended after a torn record")
+	}
+	torn.failTruncate = false
+	if err := b.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, walJob("c", models.JobStatusQueued))
+	torn.logFile.Close()
+}
+
+func TestWALHandsOutCopies(t *testing.T) {
+	b, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	job := walJob("a", models.JobStatusQueued)
+	mustPut(t, b, job)
+	job.Status = models.JobStatusRunning
+
+	got, _ := b.Get("a")
+	if got.Status != models.JobStatusQueued {
+		t.Fatalf("store saw a change that was never put: %s", got.Status)
+	}
+	got.Status = models.JobStatusFailed
+	got.Attempts = append(got.Attempts, models.Attempt{Number: 1})
+	again, _ := b.Get("a")
+	if again.Status != models.JobStatusQueued || len(again.Attempts) != 0 {
+		t.Fatalf("changing a copy from get changed the store: %+v", again)
+	}
+	for _, j := range b.List(models.JobStatusQueued) {
+		j.Status = models.JobStatusCancelled
+	}
+	if again, _ := b.Get("a"); again.Status != models.JobStatusQueued {
+		t.Fatal("changing a copy from list changed the store")
+	}
+}
+
+// run with -race: snapshots must not read jobs that callers are changing
+func TestWALSnapshotWhileCallersChangeJobs(t *testing.T) {
+	b, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	mustPut(t, b, walJob("a", models.JobStatusQueued))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			job, _ := b.Get("a")
+			job.Result = "step"
+			job.Attempts = append(job.Attempts, models.Attempt{Number: i})
+			if err := b.Put(job); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := b.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestWALPutIfChecksRevision(t *testing.T) {
+	b, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	testPutIfChecksRevision(t, b)
+}
+
+// test put if checks revision runs the compare-and-set contract against any job backend
+func testPutIfChecksRevision(t *testing.T, b models.JobBackend) {
+	t.Helper()
+	job := walJob("a", models.JobStatusQueued)
+	job.Revision = 1
+	if err := b.Put(job); err != nil {
+		t.Fatal(err)
+	}
+	running := job.Clone()
+	running.Status = models.JobStatusRunning
+	running.Revision = 2
+	if ok, err := b.PutIf(running, 1); err != nil || !ok {
+		t.Fatalf("put if at the stored revision = %v, %v; want written", ok, err)
+	}
+	stale := job.Clone()
+	stale.Status = models.JobStatusCancelled
+	stale.Revision = 2
+	if ok, err := b.PutIf(stale, 1); err != nil || ok {
+		t.Fatalf("put if at an old revision = %v, %v; want refused", ok, err)
+	}
+	if got, _ := b.Get("a"); got.Status != models.JobStatusRunning || got.Revision != 2 {
+		t.Fatalf("stored job = %s rev %d, want running rev 2", got.Status, got.Revision)
+	}
+	if ok, err := b.PutIf(walJob("missing", models.JobStatusQueued), 0); err != nil || ok {
+		t.Fatalf("put if of an unknown job = %v, %v; want refused", ok, err)
+	}
+}
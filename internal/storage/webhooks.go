@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cloud/pkg/models"
+)
+
+const webhooksFile = "webhooks.json"
+
+// webhook file keeps webhook subscriptions in memory and rewrites one json file on every change,
+// like schedule file; it is used next to the wal job store.
+type WebhookFile struct {
+	mu   sync.RWMutex
+	subs map[string]*models.WebhookSubscription
+	path string
+}
+
+// open webhook file loads webhooks.json from dir, creating the directory if needed
+func OpenWebhookFile(dir string) (*WebhookFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &WebhookFile{subs: make(map[string]*models.WebhookSubscription), path: filepath.Join(dir, webhooksFile)}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*models.WebhookSubscription
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("webhooks: corrupt %s: %w", webhooksFile, err)
+	}
+	for _, s := range list {
+		f.subs[s.ID] = s
+	}
+	return f, nil
+}
+
+// put adds or replaces the subscription and rewrites the file
+func (f *WebhookFile) Put(s *models.WebhookSubscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[s.ID] = s
+	return f.flushLocked()
+}
+
+// delete removes the subscription and rewrites the file
+func (f *WebhookFile) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, id)
+	return f.flushLocked()
+}
+
+// get returns a subscription by id
+func (f *WebhookFile) Get(id string) (*models.WebhookSubscription, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s, ok := f.subs[id]
+	return s, ok
+}
+
+// list returns all subscriptions
+func (f *WebhookFile) List() []*models.WebhookSubscription {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make([]*models.WebhookSubscription, 0, len(f.subs))
+	for _, s := range f.subs {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (f *WebhookFile) flushLocked() error {
+	list := make([]*models.WebhookSubscription, 0, len(f.subs))
+	for _, s := range f.subs {
+		list = append(list, s)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
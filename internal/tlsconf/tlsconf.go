@@ -0,0 +1,131 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// client auth modes for servers that have a ca (TLS_CLIENT_AUTH)
+const (
+	ClientAuthRequire       = "require"         // every client must present a certificate signed by the ca
+	ClientAuthVerifyIfGiven = "verify_if_given" // clients may connect without one; a given one must verify
+)
+
+// config is the tls setup of one process. the same certificate is served to clients and presented
+// to servers, and the same ca verifies peers in both directions, so one set of files per process
+// gives mutual tls.
+type Config struct {
+	CertFile   string // TLS_CERT_FILE, pem certificate (chain)
+	KeyFile    string // TLS_KEY_FILE, pem private key
+	CAFile     string // TLS_CA_FILE, pem ca that signs the peers; enables client certificate checks
+	ClientAuth string // TLS_CLIENT_AUTH, require (default) or verify_if_given
+}
+
+// from env reads TLS_CERT_FILE, TLS_KEY_FILE, TLS_CA_FILE and TLS_CLIENT_AUTH
+func FromEnv() Config {
+	return Config{
+		CertFile:   os.Getenv("TLS_CERT_FILE"),
+		KeyFile:    os.Getenv("TLS_KEY_FILE"),
+		CAFile:     os.Getenv("TLS_CA_FILE"),
+		ClientAuth: os.Getenv("TLS_CLIENT_AUTH"),
+	}
+}
+
+// enabled reports whether any tls setting is present
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// mutual reports whether peers are verified against a ca
+func (c Config) Mutual() bool {
+	return c.CAFile != ""
+}
+
+// server returns the config for serving https. with a ca, client certificates are checked
+// according to ClientAuth.
+func (c Config) Server() (*tls.Config, error) {
+	cert, err := c.certificate()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.CAFile == "" {
+		if c.ClientAuth != "" {
+			return nil, errors.New("TLS_CLIENT_AUTH needs TLS_CA_FILE")
+		}
+		return cfg, nil
+	}
+	pool, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	switch c.ClientAuth {
+	case "", ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthVerifyIfGiven:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be %s or %s, got %q", ClientAuthRequire, ClientAuthVerifyIfGiven, c.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// client returns the config for calling https peers: servers are verified against the ca (or the
+// system roots without one) and the certificate, when set, is presented as this process's identity.
+func (c Config) Client() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := c.certificate()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pool, err := c.pool()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// transport returns an http transport that uses the client config
+func (c Config) Transport() (*http.Transport, error) {
+	cfg, err := c.Client()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return t, nil
+}
+
+func (c Config) certificate() (tls.Certificate, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return tls.Certificate{}, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func (c Config) pool() (*x509.CertPool, error) {
+	data, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+	}
+	return pool, nil
+}
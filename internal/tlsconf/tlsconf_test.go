@@ -0,0 +1,196 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for tests and writes everything as pem files in dir
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return &testCA{dir: dir, cert: cert, key: key}
+}
+
+// issue writes name.pem and name-key.pem for a certificate valid for 127.0.0.1 on both ends
+func (ca *testCA) issue(t *testing.T, name string) Config {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	cfg := Config{
+		CertFile: filepath.Join(ca.dir, name+".pem"),
+		KeyFile:  filepath.Join(ca.dir, name+"-key.pem"),
+		CAFile:   filepath.Join(ca.dir, "ca.pem"),
+	}
+	writePEM(t, cfg.CertFile, "CERTIFICATE", der)
+	writePEM(t, cfg.KeyFile, "PRIVATE KEY", keyDER)
+	return cfg
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve starts an https server with cfg that answers with the verified client's common name
+func serve(t *testing.T, cfg Config) string {
+	t.Helper()
+	serverTLS, err := cfg.Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func get(t *testing.T, cfg Config, url string) (string, error) {
+	t.Helper()
+	transport, err := cfg.Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 64)
+	n, _ := resp.Body.Read(buf)
+	return string(buf[:n]), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	url := serve(t, ca.issue(t, "api"))
+
+	worker := ca.issue(t, "worker1")
+	if who, err := get(t, worker, url); err != nil || who != "worker1" {
+		t.Fatalf("call with a certificate signed by the ca = %q %v, want the server to see worker1", who, err)
+	}
+	// the server is verified against the ca alone; no client certificate is refused
+	if _, err := get(t, Config{CAFile: worker.CAFile}, url); err == nil {
+		t.Fatal("call without a client certificate succeeded")
+	}
+	other := newTestCA(t, t.TempDir())
+	if _, err := get(t, other.issue(t, "intruder"), url); err == nil {
+		t.Fatal("call from another ca's certificate succeeded")
+	}
+}
+
+func TestVerifyIfGiven(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	server := ca.issue(t, "api")
+	server.ClientAuth = ClientAuthVerifyIfGiven
+	url := serve(t, server)
+
+	if who, err := get(t, Config{CAFile: server.CAFile}, url); err != nil || who != "" {
+		t.Fatalf("call without a certificate = %q %v, want it accepted anonymously", who, err)
+	}
+	if who, err := get(t, ca.issue(t, "worker1"), url); err != nil || who != "worker1" {
+		t.Fatalf("call with a certificate = %q %v, want worker1", who, err)
+	}
+	other := newTestCA(t, t.TempDir())
+	if _, err := get(t, other.issue(t, "intruder"), url); err == nil {
+		t.Fatal("a certificate that does not verify was accepted")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	good := ca.issue(t, "api")
+	if !good.Enabled() || !good.Mutual() || (Config{}).Enabled() || (Config{CertFile: "x", KeyFile: "y"}).Mutual() {
+		t.Fatal("Enabled or Mutual misreport the config")
+	}
+
+	for name, cfg := range map[string]Config{
+		"cert without key":         {CertFile: good.CertFile},
+		"client auth without a ca": {CertFile: good.CertFile, KeyFile: good.KeyFile, ClientAuth: ClientAuthRequire},
+		"unknown client auth":      {CertFile: good.CertFile, KeyFile: good.KeyFile, CAFile: good.CAFile, ClientAuth: "sometimes"},
+		"missing ca":               {CertFile: good.CertFile, KeyFile: good.KeyFile, CAFile: filepath.Join(ca.dir, "nope.pem")},
+		"ca without certificates":  {CertFile: good.CertFile, KeyFile: good.KeyFile, CAFile: good.KeyFile},
+		"key of another cert":      {CertFile: good.CertFile, KeyFile: ca.issue(t, "other").KeyFile},
+	} {
+		if _, err := cfg.Server(); err == nil {
+			t.Errorf("%s: Server() succeeded, want an error", name)
+		}
+	}
+	if _, err := (Config{KeyFile: good.KeyFile}).Client(); err == nil {
+		t.Error("Client() with a key but no certificate succeeded")
+	}
+
+	// without a ca the client trusts the system roots and presents nothing
+	cfg, err := (Config{}).Client()
+	if err != nil || cfg.RootCAs != nil || len(cfg.Certificates) != 0 || cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("default client config = %+v %v", cfg, err)
+	}
+	server, err := Config{CertFile: good.CertFile, KeyFile: good.KeyFile}.Server()
+	if err != nil || server.ClientAuth != tls.NoClientCert {
+		t.Fatalf("server without a ca = %v %v, want no client certificates asked for", server.ClientAuth, err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "c")
+	t.Setenv("TLS_KEY_FILE", "k")
+	t.Setenv("TLS_CA_FILE", "ca")
+	t.Setenv("TLS_CLIENT_AUTH", ClientAuthVerifyIfGiven)
+	if got := FromEnv(); got != (Config{CertFile: "c", KeyFile: "k", CAFile: "ca", ClientAuth: ClientAuthVerifyIfGiven}) {
+		t.Fatalf("FromEnv = %+v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// err blocked address is returned when a delivery would connect to an internal address
+var errBlockedAddress = errors.New("private/internal address")
+
+// guard keeps deliveries away from loopback, private and link-local addresses, like the
+// runner's fetch check. hosts and networks on the allow list (WEBHOOK_ALLOW_HOSTS) are exempt,
+// for receivers on the internal network.
+type guard struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+// new guard parses allow, a list of hostnames, ip addresses and cidr ranges
+func newGuard(allow []string) (*guard, error) {
+	g := &guard{hosts: make(map[string]bool)}
+	for _, a := range allow {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == "":
+		case strings.Contains(a, "/"):
+			_, n, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, fmt.Errorf("webhook allow list: %w", err)
+			}
+			g.nets = append(g.nets, n)
+		default:
+			g.hosts[a] = true
+		}
+	}
+	return g, nil
+}
+
+func (g *guard) allowedHost(host string) bool {
+	return g.hosts[strings.ToLower(host)]
+}
+
+func (g *guard) allowedIP(ip net.IP) bool {
+	if g.hosts[ip.String()] {
+		return true
+	}
+	for _, n := range g.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// check url validates a target when it is registered: http or https, a host, and no literal
+// internal address. names are resolved again on every delivery by the dialer.
+func (g *guard) checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("only http and https urls are allowed, got %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("url has no host")
+	}
+	if g.allowedHost(host) {
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("%s is not allowed (loopback address)", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedIP(ip) && !g.allowedIP(ip) {
+		return fmt.Errorf("%s is not allowed (private/internal address)", host)
+	}
+	return nil
+}
+
+// dial context resolves the host itself and only connects to an address that passed the check,
+// so a name can't be re-pointed at an internal address between the check and the connection
+func (g *guard) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if g.allowedHost(host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if blockedIP(ip.IP) && !g.allowedIP(ip.IP) {
+			return nil, fmt.Errorf("%s (%s) is not allowed: %w", host, ip.IP, errBlockedAddress)
+		}
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+func TestCheckURL(t *testing.T) {
+	g, err := newGuard([]string{"hooks.internal", "10.1.0.0/16", "192.168.5.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for url, allowed := range map[string]bool{
+		"https://example.com/hook":   true,
+		"http://93.184.216.34:8080/": true,
+		"ftp://example.com/":         false,
+		"https:///nohost":            false,
+		"http://localhost:9000/":     false,
+		"http://LOCALHOST/":          false,
+		"http://127.0.0.1/":          false,
+		"http://[::1]/":              false,
+		"http://10.0.0.1/":           false,
+		"http://172.16.3.4/":         false,
+		"http://169.254.169.254/":    false,
+		"http://0.0.0.0/":            false,
+		"http://192.168.5.6/":        false,
+		// on the allow list
+		"http://hooks.internal/":  true,
+		"http://HOOKS.internal/":  true,
+		"http://10.1.200.3/":      true,
+		"http://192.168.5.5:80/x": true,
+	} {
+		if err := g.checkURL(url); (err == nil) != allowed {
+			t.Errorf("checkURL(%s) = %v, want allowed=%v", url, err, allowed)
+		}
+	}
+
+	if _, err := newGuard([]string{"10.0.0.0/99"}); err == nil {
+		t.Fatal("invalid cidr accepted on the allow list")
+	}
+}
+
+func TestDialRefusesNamesResolvingToInternalAddresses(t *testing.T) {
+	g, _ := newGuard(nil)
+	// localhost passes no registration check, but a name can point anywhere by the time it is dialled
+	_, err := g.dialContext(context.Background(), "tcp", "localhost:80")
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("dial localhost = %v, want errBlockedAddress", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	allowed, _ := newGuard([]string{"127.0.0.0/8"})
+	conn, err := allowed.dialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dial an allowed network: %v", err)
+	}
+	conn.Close()
+}
+
+func TestBlockedDeliveryIsNotRetried(t *testing.T) {
+	d, err := New(models.NewWebhookStore(), Config{Secret: "s", MaxAttempts: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	retried := false
+	saved := retryDelay
+	retryDelay = func(int) time.Duration { retried = true; return time.Millisecond }
+	defer func() { retryDelay = saved }()
+
+	// skips the registration check, as a name re-pointed after registration would
+	d.Notify(&models.Job{ID: "j1", Status: models.JobStatusCompleted, CallbackURL: "http://localhost:1/hook"})
+	log := settled(t, d, "j1", 1)
+	if outcomes(log) != OutcomeFailed || !strings.Contains(log[0].Error, "not allowed") || retried {
+		t.Fatalf("log = %+v, want one failed attempt", log)
+	}
+}
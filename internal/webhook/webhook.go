@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+const (
+	defaultMaxAttempts = 5
+	deliveryTimeout    = 10 * time.Second
+	initialBackoff     = 5 * time.Second
+	maxBackoff         = 5 * time.Minute
+	// the delivery log keeps this many jobs, and this many attempts per job
+	maxLoggedJobs       = 10000
+	maxDeliveriesPerJob = 50
+)
+
+// delivery outcomes
+const (
+	OutcomeDelivered = "delivered"
+	OutcomeRetrying  = "retrying"
+	OutcomeFailed    = "failed"
+)
+
+// err subscription not found is returned for an unknown webhook id
+var ErrSubscriptionNotFound = errors.New("webhook not found")
+
+// config configures a dispatcher
+type Config struct {
+	Secret      string   // signs deliveries to a job's callback_url (WEBHOOK_SECRET)
+	MaxAttempts int      // attempts per delivery; default 5 (WEBHOOK_MAX_ATTEMPTS)
+	AllowHosts  []string // hostnames, ips and cidrs exempt from the ssrf guard (WEBHOOK_ALLOW_HOSTS)
+}
+
+// delivery is one attempt to post a finished job to a receiver
+type Delivery struct {
+	ID             string     `json:"id"` // X-Webhook-ID; the same for every attempt of one delivery
+	Event          string     `json:"event"`
+	URL            string     `json:"url"`
+	SubscriptionID string     `json:"subscription_id,omitempty"` // empty for the job's callback_url
+	Attempt        int        `json:"attempt"`
+	Outcome        string     `json:"outcome"` // delivered, retrying or failed
+	StatusCode     int        `json:"status_code,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Time           time.Time  `json:"time"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// dispatcher posts finished jobs to their callback_url and to every matching subscription.
+// each delivery is signed and retried with exponential backoff on network errors, 5xx, 408 and
+// 429. retries are held in memory, so deliveries still pending at shutdown are dropped.
+type Dispatcher struct {
+	subs        *models.WebhookStore
+	secret      string
+	maxAttempts int
+	guard       *guard
+	client      *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	log   map[string][]Delivery // by job id
+	order []string              // logged job ids, oldest first
+}
+
+// new creates a dispatcher that sends to the subscriptions in subs
+func New(subs *models.WebhookStore, cfg Config) (*Dispatcher, error) {
+	g, err := newGuard(cfg.AllowHosts)
+	if err != nil {
+		return nil, err
+	}
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		subs:        subs,
+		secret:      cfg.Secret,
+		maxAttempts: maxAttempts,
+		guard:       g,
+		client: &http.Client{
+			Timeout: deliveryTimeout,
+			// no proxy: the guard has to see the address actually dialled
+			Transport: &http.Transport{DialContext: g.dialContext, TLSHandshakeTimeout: 5 * time.Second},
+			// a redirect could point anywhere; it counts as the receiver's answer
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		log:    make(map[string][]Delivery),
+	}, nil
+}
+
+// close abandons pending and in-flight deliveries and waits for them to return
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// check callback validates a job's callback_url
+func (d *Dispatcher) CheckCallback(url string) error {
+	if d.secret == "" {
+		return errors.New("callback_url requires WEBHOOK_SECRET to be set")
+	}
+	if err := d.guard.checkURL(url); err != nil {
+		return fmt.Errorf("callback_url: %w", err)
+	}
+	return nil
+}
+
+// subscribe creates a subscription. the secret is generated when not given and only returned here.
+func (d *Dispatcher) Subscribe(req *models.CreateWebhookRequest) (*models.WebhookSubscription, error) {
+	if err := d.guard.checkURL(req.URL); err != nil {
+		return nil, fmt.Errorf("url: %w", err)
+	}
+	for _, s := range req.Statuses {
+		if !models.JobStatus(s).Final() {
+			return nil, fmt.Errorf("statuses: %q is not a final status (want completed, failed, cancelled or skipped)", s)
+		}
+	}
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+	sub := &models.WebhookSubscription{
+		ID:        models.MustGenerateID(),
+		URL:       req.URL,
+		Statuses:  req.Statuses,
+		JobTypes:  req.JobTypes,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	d.subs.Save(sub)
+	log.Printf("event=webhook_created webhook_id=%s url=%s", sub.ID, sub.URL)
+	return sub, nil
+}
+
+// unsubscribe deletes a subscription
+func (d *Dispatcher) Unsubscribe(id string) error {
+	if _, ok := d.subs.Get(id); !ok {
+		return ErrSubscriptionNotFound
+	}
+	d.subs.Delete(id)
+	log.Printf("event=webhook_deleted webhook_id=%s", id)
+	return nil
+}
+
+// subscriptions lists the subscriptions without their secrets
+func (d *Dispatcher) Subscriptions() []*models.WebhookSubscription {
+	list := d.subs.List()
+	out := make([]*models.WebhookSubscription, len(list))
+	for i, s := range list {
+		out[i] = redact(s)
+	}
+	return out
+}
+
+// subscription returns one subscription without its secret
+func (d *Dispatcher) Subscription(id string) (*models.WebhookSubscription, bool) {
+	s, ok := d.subs.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return redact(s), true
+}
+
+// deliveries returns the logged delivery attempts for a job, oldest first
+func (d *Dispatcher) Deliveries(jobID string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Delivery{}, d.log[jobID]...)
+}
+
+// notify sends a job that reached a final status to its callback_url and the matching
+// subscriptions. it returns at once; deliveries run in the background.
+func (d *Dispatcher) Notify(job *models.Job) {
+	if !job.Status.Final() {
+		return
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("event=webhook_encode_failed job_id=%s error=%v", job.ID, err)
+		return
+	}
+	event := "job." + string(job.Status)
+	if job.CallbackURL != "" && d.secret != "" {
+		d.start(job.ID, event, body, job.CallbackURL, "", d.secret)
+	}
+	for _, sub := range d.subs.List() {
+		if sub.Matches(job) {
+			d.start(job.ID, event, body, sub.URL, sub.ID, sub.Secret)
+		}
+	}
+}
+
+func (d *Dispatcher) start(jobID, event string, body []byte, url, subID, secret string) {
+	if d.ctx.Err() != nil {
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(jobID, event, body, url, subID, secret)
+	}()
+}
+
+// deliver posts body to url until it is accepted, fails permanently or runs out of attempts
+func (d *Dispatcher) deliver(jobID, event string, body []byte, url, subID, secret string) {
+	id := models.MustGenerateID()
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(id, event, body, url, secret)
+		entry := Delivery{ID: id, Event: event, URL: url, SubscriptionID: subID, Attempt: attempt, StatusCode: status, Time: time.Now()}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		switch {
+		case err == nil && status >= 200 && status < 300:
+			entry.Outcome = OutcomeDelivered
+			d.record(jobID, entry)
+			log.Printf("event=webhook_delivered job_id=%s delivery_id=%s url=%s attempt=%d status=%d", jobID, id, url, attempt, status)
+			return
+		case retryable(status, err) && attempt < d.maxAttempts:
+			delay := retryDelay(attempt)
+			next := entry.Time.Add(delay)
+			entry.Outcome = OutcomeRetrying
+			entry.NextAttemptAt = &next
+			d.record(jobID, entry)
+			log.Printf("event=webhook_retry job_id=%s delivery_id=%s url=%s attempt=%d status=%d backoff_sec=%.0f error=%s", jobID, id, url, attempt, status, delay.Seconds(), entry.Error)
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-d.ctx.Done():
+				t.Stop()
+				log.Printf("event=webhook_abandoned job_id=%s delivery_id=%s url=%s attempt=%d reason=shutdown", jobID, id, url, attempt)
+				return
+			}
+		default:
+			entry.Outcome = OutcomeFailed
+			d.record(jobID, entry)
+			log.Printf("event=webhook_failed job_id=%s delivery_id=%s url=%s attempt=%d status=%d error=%s", jobID, id, url, attempt, status, entry.Error)
+			return
+		}
+	}
+}
+
+// post sends one signed attempt. the signature is the hex hmac-sha256 of "<timestamp>.<body>",
+// so a receiver can reject replays with an old timestamp.
+func (d *Dispatcher) post(id, event string, body []byte, url, secret string) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", id)
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(secret, ts, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// sign returns the hex hmac-sha256 of timestamp + "." + body under secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// record appends an attempt to the job's delivery log, forgetting the oldest jobs past the limit
+func (d *Dispatcher) record(jobID string, entry Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list, ok := d.log[jobID]
+	if !ok {
+		d.order = append(d.order, jobID)
+		if len(d.order) > maxLoggedJobs {
+			delete(d.log, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+	list = append(list, entry)
+	if len(list) > maxDeliveriesPerJob {
+		list = list[len(list)-maxDeliveriesPerJob:]
+	}
+	d.log[jobID] = list
+}
+
+// retryable reports whether a failed attempt may succeed later: network errors, 5xx, 408 and 429.
+// a target the guard refused stays refused.
+func retryable(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, errBlockedAddress)
+	}
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// backoff returns the delay after the given attempt: 5s doubling up to 5 minutes
+func backoff(attempt int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// retry delay is the wait before the next attempt; tests shorten it
+var retryDelay = backoff
+
+func redact(s *models.WebhookSubscription) *models.WebhookSubscription {
+	cp := *s
+	cp.Secret = ""
+	return &cp
+}
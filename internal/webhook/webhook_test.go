@@ -0,0 +1,233 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud/pkg/models"
+)
+
+// receiver is a webhook endpoint answering with the given status codes in turn, then 200
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+	t.Helper()
+	rec := &receiver{statuses: statuses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv.URL
+}
+
+// received returns the requests so far and their bodies
+func (rec *receiver) received() ([]*http.Request, [][]byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]*http.Request(nil), rec.requests...), append([][]byte(nil), rec.bodies...)
+}
+
+// new test dispatcher allows deliveries to the test receivers on loopback and retries without waiting
+func newTestDispatcher(t *testing.T, maxAttempts int) *Dispatcher {
+	t.Helper()
+	d, err := New(models.NewWebhookStore(), Config{Secret: "callback-secret", MaxAttempts: maxAttempts, AllowHosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	saved := retryDelay
+	retryDelay = func(int) time.Duration { return time.Millisecond }
+	t.Cleanup(func() { retryDelay = saved })
+	return d
+}
+
+// settled waits until the job's deliveries have all ended (delivered or failed) and returns the log
+func settled(t *testing.T, d *Dispatcher, jobID string, deliveries int) []Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		log := d.Deliveries(jobID)
+		done := 0
+		for _, e := range log {
+			if e.Outcome != OutcomeRetrying {
+				done++
+			}
+		}
+		if done == deliveries {
+			return log
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("deliveries of %s did not settle: %+v", jobID, d.Deliveries(jobID))
+	return nil
+}
+
+func outcomes(log []Delivery) string {
+	var out []string
+	for _, e := range log {
+		out = append(out, e.Outcome)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestDeliverySignsTheBody(t *testing.T) {
+	d := newTestDispatcher(t, 1)
+	rec, url := newReceiver(t)
+	job := &models.Job{ID: "j1", Type: "email", Status: models.JobStatusCompleted, Result: "ok", CallbackURL: url}
+	d.Notify(job)
+	log := settled(t, d, job.ID, 1)
+	if outcomes(log) != OutcomeDelivered || log[0].StatusCode != http.StatusOK || log[0].SubscriptionID != "" {
+		t.Fatalf("log = %+v", log)
+	}
+
+	requests, bodies := rec.received()
+	r, body := requests[0], bodies[0]
+	if r.Header.Get("X-Webhook-Event") != "job.completed" || r.Header.Get("X-Webhook-ID") != log[0].ID {
+		t.Fatalf("headers = %v", r.Header)
+	}
+	ts := r.Header.Get("X-Webhook-Timestamp")
+	if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+Sign("callback-secret", ts, body); got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+	var got models.Job
+	if err := json.Unmarshal(body, &got); err != nil || got.ID != job.ID || got.Result != "ok" {
+		t.Fatalf("body = %s", body)
+	}
+
+	// the signature covers the timestamp and every byte of the body
+	sig := Sign("callback-secret", ts, body)
+	if Sign("callback-secret", ts+"1", body) == sig || Sign("callback-secret", ts, append(body, ' ')) == sig || Sign("other", ts, body) == sig {
+		t.Fatal("signature does not depend on the timestamp, body and secret")
+	}
+}
+
+func TestDeliveryRetriesTransientFailures(t *testing.T) {
+	d := newTestDispatcher(t, 5)
+	rec, url := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusRequestTimeout)
+	d.Notify(&models.Job{ID: "j1", Status: models.JobStatusFailed, CallbackURL: url})
+	log := settled(t, d, "j1", 1)
+	if got := outcomes(log); got != "retrying,retrying,retrying,delivered" {
+		t.Fatalf("outcomes = %s", got)
+	}
+	for i, e := range log {
+		if e.ID != log[0].ID || e.Attempt != i+1 {
+			t.Fatalf("attempt %d = %+v, want the same delivery id throughout", i+1, e)
+		}
+		if e.Outcome == OutcomeRetrying && e.NextAttemptAt == nil {
+			t.Fatalf("attempt %d has no next attempt time", i+1)
+		}
+	}
+	if requests, _ := rec.received(); len(requests) != 4 || requests[0].Header.Get("X-Webhook-ID") != requests[3].Header.Get("X-Webhook-ID") {
+		t.Fatalf("receiver got %d requests, want 4 attempts of one delivery", len(requests))
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	d := newTestDispatcher(t, 3)
+	_, rejecting := newReceiver(t, http.StatusBadRequest)
+	_, failing := newReceiver(t, 500, 500, 500, 500)
+	d.Notify(&models.Job{ID: "rejected", Status: models.JobStatusCompleted, CallbackURL: rejecting})
+	d.Notify(&models.Job{ID: "exhausted", Status: models.JobStatusCompleted, CallbackURL: failing})
+
+	// a 4xx is the receiver's final answer
+	if got := outcomes(settled(t, d, "rejected", 1)); got != "failed" {
+		t.Fatalf("rejected: %s, want failed at once", got)
+	}
+	if got := outcomes(settled(t, d, "exhausted", 1)); got != "retrying,retrying,failed" {
+		t.Fatalf("exhausted: %s, want failed after 3 attempts", got)
+	}
+}
+
+func TestNotifyMatchesSubscriptions(t *testing.T) {
+	d := newTestDispatcher(t, 1)
+	all, allURL := newReceiver(t)
+	failedEmails, failedURL := newReceiver(t)
+	if _, err := d.Subscribe(&models.CreateWebhookRequest{URL: allURL}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := d.Subscribe(&models.CreateWebhookRequest{URL: failedURL, Statuses: []string{"failed"}, JobTypes: []string{"email"}, Secret: "mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Notify(&models.Job{ID: "running", Status: models.JobStatusRunning, Type: "email"})
+	d.Notify(&models.Job{ID: "done", Status: models.JobStatusCompleted, Type: "email"})
+	d.Notify(&models.Job{ID: "failed", Status: models.JobStatusFailed, Type: "email"})
+	settled(t, d, "done", 1)
+	log := settled(t, d, "failed", 2)
+	if len(d.Deliveries("running")) != 0 {
+		t.Fatal("a job that has not finished was delivered")
+	}
+	allRequests, _ := all.received()
+	requests, bodies := failedEmails.received()
+	if len(allRequests) != 2 || len(requests) != 1 {
+		t.Fatalf("receivers got %d and %d requests, want 2 and 1", len(allRequests), len(requests))
+	}
+	r := requests[0]
+	if r.Header.Get("X-Webhook-Signature") != "sha256="+Sign("mine", r.Header.Get("X-Webhook-Timestamp"), bodies[0]) {
+		t.Fatal("subscription delivery not signed with its own secret")
+	}
+	found := false
+	for _, e := range log {
+		found = found || e.SubscriptionID == sub.ID
+	}
+	if !found {
+		t.Fatalf("log %+v has no delivery for subscription %s", log, sub.ID)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := newTestDispatcher(t, 1)
+	if _, err := d.Subscribe(&models.CreateWebhookRequest{URL: "https://example.com/hook", Statuses: []string{"running"}}); err == nil {
+		t.Fatal("subscribed to a status that is not final")
+	}
+	sub, err := d.Subscribe(&models.CreateWebhookRequest{URL: "https://example.com/hook"})
+	if err != nil || len(sub.Secret) != 64 {
+		t.Fatalf("subscribe = %+v %v, want a generated secret", sub, err)
+	}
+	if got, _ := d.Subscription(sub.ID); got.Secret != "" {
+		t.Fatal("secret returned after creation")
+	}
+	if list := d.Subscriptions(); len(list) != 1 || list[0].Secret != "" {
+		t.Fatalf("subscriptions = %+v, want one without its secret", list)
+	}
+	if err := d.Unsubscribe(sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unsubscribe(sub.ID); err != ErrSubscriptionNotFound {
+		t.Fatalf("second unsubscribe = %v, want ErrSubscriptionNotFound", err)
+	}
+
+	noSecret, _ := New(models.NewWebhookStore(), Config{})
+	if err := noSecret.CheckCallback("https://example.com/hook"); err == nil {
+		t.Fatal("callback_url accepted without WEBHOOK_SECRET")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 3: 20 * time.Second, 7: 5 * time.Minute, 50: 5 * time.Minute} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud/internal/executor"
+)
+
+const (
+	leaseWaitSec       = 30
+	leaseVisibilitySec = 60
+	leaseRetryDelay    = 2 * time.Second
+)
+
+// leased job is the api's answer to post /workers/lease
+type leasedJob struct {
+	Job struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Payload    string `json:"payload"`
+		TimeoutSec int    `json:"timeout_sec,omitempty"`
+	} `json:"job"`
+	Lease struct {
+		ID string `json:"lease_id"`
+	} `json:"lease"`
+}
+
+// pull loop leases one job at a time from the api until shutdown; the worker runs one loop per slot
+func (w *Worker) pullLoop() {
+	defer w.pullDone.Done()
+	for w.pullCtx.Err() == nil {
+		leased, err := w.lease()
+		if err != nil {
+			if w.pullCtx.Err() != nil {
+				return
+			}
+			log.Printf("event=lease_failed worker_id=%s error=%v", w.workerID, err)
+			select {
+			case <-w.pullCtx.Done():
+				return
+			case <-time.After(leaseRetryDelay):
+			}
+			continue
+		}
+		if leased == nil {
+			continue
+		}
+		if ctx, err := w.acquire(leased.Job.ID, ""); err == nil {
+			w.runLeased(ctx, leased)
+			w.release(leased.Job.ID)
+		}
+	}
+}
+
+// lease long-polls the api for a job; returns nil, nil when none arrived within the wait
+func (w *Worker) lease() (*leasedJob, error) {
+	body := map[string]interface{}{"worker_id": w.workerID, "wait_sec": leaseWaitSec, "visibility_sec": leaseVisibilitySec}
+	resp, err := w.postJSON(w.pullCtx, "/workers/lease", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var leased leasedJob
+		if err := json.NewDecoder(resp.Body).Decode(&leased); err != nil {
+			return nil, err
+		}
+		return &leased, nil
+	default:
+		return nil, fmt.Errorf("lease: API returned %d", resp.StatusCode)
+	}
+}
+
+// run leased executes the job while extending its lease, then acks or nacks it. a job cancelled
+// through the api is stopped once a lease extension reports it, and nacked with its output so far.
+// the job is not interrupted by shutdown; shutdown waits for it instead.
+func (w *Worker) runLeased(ctx context.Context, leased *leasedJob) {
+	job := leased.Job
+	leaseID := leased.Lease.ID
+	done := make(chan struct{})
+	go w.extendLease(job.ID, leaseID, done)
+
+	log.Printf("event=job_exec_start job_id=%s worker_id=%s lease_id=%s", job.ID, w.workerID, leaseID)
+	result, err := w.exec.Run(ctx, job.ID, job.Type, job.Payload, job.TimeoutSec)
+	close(done)
+	if err != nil {
+		log.Printf("event=job_exec_error job_id=%s worker_id=%s error=%v", job.ID, w.workerID, err)
+		w.settle(job.ID, "nack", map[string]interface{}{"lease_id": leaseID, "error": err.Error(), "error_class": executor.ErrorClassExecution})
+		return
+	}
+	logResult(job.ID, w.workerID, result)
+	if result.Success {
+		w.settle(job.ID, "ack", map[string]interface{}{"lease_id": leaseID, "result": result.Output})
+	} else {
+		w.settle(job.ID, "nack", map[string]interface{}{"lease_id": leaseID, "result": result.Output, "error": result.Error, "error_class": result.ErrorClass})
+	}
+}
+
+// extend lease renews the lease at a third of the visibility timeout until done is closed, and
+// stops the job when the api answers that it was cancelled
+func (w *Worker) extendLease(jobID, leaseID string, done <-chan struct{}) {
+	tick := time.NewTicker(leaseVisibilitySec * time.Second / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			resp, err := w.postJSON(context.Background(), "/jobs/"+jobID+"/lease", map[string]interface{}{"lease_id": leaseID, "visibility_sec": leaseVisibilitySec})
+			if err != nil {
+				log.Printf("event=lease_extend_failed job_id=%s worker_id=%s error=%v", jobID, w.workerID, err)
+				continue
+			}
+			var lease struct {
+				CancelRequested bool `json:"cancel_requested"`
+			}
+			if resp.StatusCode == http.StatusOK {
+				_ = json.NewDecoder(resp.Body).Decode(&lease)
+			} else {
+				log.Printf("event=lease_extend_rejected job_id=%s worker_id=%s status=%d", jobID, w.workerID, resp.StatusCode)
+			}
+			resp.Body.Close()
+			if lease.CancelRequested {
+				w.cancel(jobID)
+			}
+		}
+	}
+}
+
+func (w *Worker) settle(jobID, action string, body map[string]interface{}) {
+	resp, err := w.postJSON(context.Background(), "/jobs/"+jobID+"/"+action, body)
+	if err != nil {
+		log.Printf("event=job_settle_failed job_id=%s action=%s error=%v", jobID, action, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("event=job_settle_rejected job_id=%s action=%s status=%d", jobID, action, resp.StatusCode)
+	}
+}
+
+func (w *Worker) postJSON(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.apiURL+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.apiKey)
+	}
+	return w.client.Do(req)
+}
@@ -1,28 +1,49 @@
 package worker
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"cloud/internal/executor"
+	"cloud/internal/tlsconf"
 )
 
-// worker registers with the api and runs jobs via the c++ executor
+// worker registers with the api and runs jobs via the c++ executor.
+// in push mode (default) the scheduler posts jobs to our /run endpoint; in pull mode
+// (WORKER_MODE=pull) we lease jobs from the api instead and need no inbound connectivity.
+// up to capacity (WORKER_CAPACITY, default 1) jobs run at once.
 type Worker struct {
 	apiURL     string
+	apiKey     string // sent as a bearer token when the api requires keys (API_KEY)
 	workerID   string
 	exec       *executor.Runner
 	server     *http.Server
+	client     *http.Client // calls to the api
+	tls        bool         // /run is served over https
+	pull       bool
+	capacity   int
+	slots      chan struct{} // one token per running job
+	jobs       sync.WaitGroup
 	mu         sync.Mutex
 	registered bool
+	running    map[string]context.CancelFunc // jobs in our slots, reported with every heartbeat; cancel stops one
+	cancelled  map[cancelKey]time.Time       // cancels for attempts that were not running here yet, by arrival
+
+	pullCtx  context.Context
+	stopPull context.CancelFunc
+	pullDone sync.WaitGroup
 }
 
 // new creates a new worker
@@ -30,14 +51,53 @@ func New(apiURL, workerID string, exec *executor.Runner) *Worker {
 	if workerID == "" {
 		workerID = "worker-" + randomID()
 	}
-	w := &Worker{apiURL: apiURL, workerID: workerID, exec: exec}
+	capacity, err := strconv.Atoi(getEnv("WORKER_CAPACITY", "1"))
+	if err != nil || capacity < 1 {
+		log.Printf("invalid WORKER_CAPACITY, using 1")
+		capacity = 1
+	}
+	w := &Worker{
+		apiURL:    apiURL,
+		apiKey:    os.Getenv("API_KEY"),
+		workerID:  workerID,
+		exec:      exec,
+		pull:      getEnv("WORKER_MODE", "push") == "pull",
+		capacity:  capacity,
+		slots:     make(chan struct{}, capacity),
+		running:   make(map[string]context.CancelFunc),
+		cancelled: make(map[cancelKey]time.Time),
+		client:    &http.Client{},
+	}
+	w.pullCtx, w.stopPull = context.WithCancel(context.Background())
 	mux := http.NewServeMux()
 	mux.HandleFunc("/run", w.handleRun)
+	mux.HandleFunc("/cancel", w.handleCancel)
 	mux.HandleFunc("/health", func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
 	w.server = &http.Server{Handler: mux}
 	return w
 }
 
+// enable tls serves /run over https and calls the api over https, verifying each side against the
+// ca in cfg. the worker's certificate is its identity to the api and the one the scheduler sees.
+// pull workers serve nothing and only need the ca, plus a certificate if the api asks for one.
+// call it before start.
+func (w *Worker) EnableTLS(cfg tlsconf.Config) error {
+	if !w.pull {
+		serverCfg, err := cfg.Server()
+		if err != nil {
+			return err
+		}
+		w.server.TLSConfig = serverCfg
+	}
+	transport, err := cfg.Transport()
+	if err != nil {
+		return err
+	}
+	w.client.Transport = transport
+	w.tls = true
+	return nil
+}
+
 func randomID() string {
 	const chars = "abcdef0123456789"
 	b := make([]byte, 8)
@@ -55,34 +115,91 @@ func (w *Worker) Run() error {
 	select {}
 }
 
-// start registers with the api and starts the http server in a goroutine
+// start registers with the api and starts the http server in a goroutine. a push worker binds its
+// port before registering: the scheduler dispatches as soon as a worker with free slots registers.
 func (w *Worker) Start() error {
+	if w.pull {
+		if err := w.register(); err != nil {
+			return err
+		}
+		go w.heartbeatLoop()
+		// one lease loop per slot
+		for i := 0; i < w.capacity; i++ {
+			w.pullDone.Add(1)
+			go w.pullLoop()
+		}
+		return nil
+	}
+	port := getEnv("WORKER_PORT", "9090")
+	w.server.Addr = ":" + port
+	ln, err := net.Listen("tcp", w.server.Addr)
+	if err != nil {
+		return err
+	}
 	if err := w.register(); err != nil {
+		ln.Close()
 		return err
 	}
 	go w.heartbeatLoop()
-	port := getEnv("WORKER_PORT", "9090")
-	w.server.Addr = ":" + port
 	go func() {
+		if w.tls {
+			log.Println("worker listening on :" + port + " (tls)")
+			_ = w.server.ServeTLS(ln, "", "")
+			return
+		}
 		log.Println("worker listening on :" + port)
-		_ = w.server.ListenAndServe()
+		_ = w.server.Serve(ln)
 	}()
 	return nil
 }
 
-// shutdown gracefully stops the worker server (drains in-flight requests)
+// shutdown gracefully stops the worker: it stops accepting (push) or leasing (pull) jobs
+// and waits for the running ones to finish.
 func (w *Worker) Shutdown(ctx context.Context) error {
-	return w.server.Shutdown(ctx)
+	if w.pull {
+		w.stopPull()
+		return waitCtx(ctx, &w.pullDone)
+	}
+	if err := w.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return waitCtx(ctx, &w.jobs)
+}
+
+func waitCtx(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // register posts to api /workers with this worker's id and endpoint.
 // we need our own url, in docker the api will reach us by hostname. for local dev we use a default.
+// pull workers register without an endpoint.
 func (w *Worker) register() error {
-	selfEndpoint := getEnv("WORKER_ENDPOINT", "http://localhost:9090")
-	body := map[string]string{"id": w.workerID, "endpoint": selfEndpoint}
-	var buf bytes.Buffer
-	_ = json.NewEncoder(&buf).Encode(body)
-	resp, err := http.Post(w.apiURL+"/workers", "application/json", &buf)
+	selfEndpoint := ""
+	if !w.pull {
+		scheme := "http"
+		if w.tls {
+			scheme = "https"
+		}
+		selfEndpoint = getEnv("WORKER_ENDPOINT", scheme+"://localhost:9090")
+	}
+	body := map[string]interface{}{"id": w.workerID, "endpoint": selfEndpoint, "capacity": w.capacity}
+	if weight, err := strconv.Atoi(getEnv("WORKER_WEIGHT", "")); err == nil {
+		body["weight"] = weight
+	}
+	for k, v := range capabilities() {
+		body[k] = v
+	}
+	resp, err := w.postJSON(context.Background(), "/workers", body)
 	if err != nil {
 		return err
 	}
@@ -93,10 +210,48 @@ func (w *Worker) register() error {
 	w.mu.Lock()
 	w.registered = true
 	w.mu.Unlock()
-	log.Println("Registered with API as", w.workerID, "at", selfEndpoint)
+	if w.pull {
+		log.Println("Registered with API as", w.workerID, "(pull mode, capacity", w.capacity, ")")
+	} else {
+		log.Println("Registered with API as", w.workerID, "at", selfEndpoint, "capacity", w.capacity)
+	}
 	return nil
 }
 
+// capabilities describes what this worker can run, from env: WORKER_JOB_TYPES (comma-separated,
+// empty means every type), WORKER_LABELS (k=v,k=v), WORKER_MEMORY_MB and WORKER_CPUS (default: cpu count)
+func capabilities() map[string]interface{} {
+	caps := map[string]interface{}{"cpus": runtime.NumCPU()}
+	if v := getEnv("WORKER_JOB_TYPES", ""); v != "" {
+		var types []string
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+		caps["job_types"] = types
+	}
+	if v := getEnv("WORKER_LABELS", ""); v != "" {
+		labels := make(map[string]string)
+		for _, kv := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(kv, "=")
+			if k = strings.TrimSpace(k); !ok || k == "" {
+				log.Printf("ignoring malformed WORKER_LABELS entry %q", kv)
+				continue
+			}
+			labels[k] = strings.TrimSpace(val)
+		}
+		caps["labels"] = labels
+	}
+	if n, err := strconv.Atoi(getEnv("WORKER_MEMORY_MB", "")); err == nil {
+		caps["memory_mb"] = n
+	}
+	if n, err := strconv.Atoi(getEnv("WORKER_CPUS", "")); err == nil {
+		caps["cpus"] = n
+	}
+	return caps
+}
+
 func getEnv(key, defaultVal string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -113,10 +268,8 @@ func (w *Worker) heartbeatLoop() {
 }
 
 func (w *Worker) sendHeartbeat() {
-	body := map[string]string{"id": w.workerID}
-	var buf bytes.Buffer
-	_ = json.NewEncoder(&buf).Encode(body)
-	resp, err := http.Post(w.apiURL+"/workers/heartbeat", "application/json", &buf)
+	body := map[string]interface{}{"id": w.workerID, "capacity": w.capacity, "running": w.runningJobs()}
+	resp, err := w.postJSON(context.Background(), "/workers/heartbeat", body)
 	if err != nil {
 		log.Printf("event=heartbeat_failed worker_id=%s error=%v", w.workerID, err)
 		return
@@ -129,12 +282,16 @@ func (w *Worker) sendHeartbeat() {
 
 // run request is the payload sent by the scheduler to post /run
 type RunRequest struct {
-	JobID      string `json:"job_id"`
-	Type       string `json:"type"`
-	Payload    string `json:"payload"`
-	TimeoutSec int    `json:"timeout_sec,omitempty"`
+	JobID        string `json:"job_id"`
+	Type         string `json:"type"`
+	Payload      string `json:"payload"`
+	TimeoutSec   int    `json:"timeout_sec,omitempty"`
+	AttemptToken string `json:"attempt_token"` // echoed back with the outcome
 }
 
+// handle run takes a free slot and runs the job in the background, answering 202 right away;
+// the outcome goes to the api via post /jobs/:id/complete. with every slot taken it answers 503,
+// and 409 for an attempt that was cancelled before it arrived.
 func (w *Worker) handleRun(rw http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
@@ -145,33 +302,168 @@ func (w *Worker) handleRun(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "bad request", http.StatusBadRequest)
 		return
 	}
-	log.Printf("event=job_exec_start job_id=%s worker_id=%s", req.JobID, w.workerID)
-	result, err := w.exec.Run(req.JobID, req.Type, req.Payload, req.TimeoutSec)
-	if err != nil {
-		log.Printf("event=job_exec_error job_id=%s worker_id=%s error=%v", req.JobID, w.workerID, err)
-		w.reportComplete(req.JobID, false, "", err.Error())
-		rw.WriteHeader(http.StatusInternalServerError)
+	ctx, err := w.acquire(req.JobID, req.AttemptToken)
+	switch err {
+	case errCancelled:
+		log.Printf("event=job_rejected job_id=%s worker_id=%s reason=cancelled", req.JobID, w.workerID)
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case errNoFreeSlot:
+		log.Printf("event=job_rejected job_id=%s worker_id=%s reason=no_free_slot", req.JobID, w.workerID)
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.jobs.Add(1)
+	go func() {
+		defer w.jobs.Done()
+		defer w.release(req.JobID)
+		log.Printf("event=job_exec_start job_id=%s worker_id=%s", req.JobID, w.workerID)
+		result, err := w.exec.Run(ctx, req.JobID, req.Type, req.Payload, req.TimeoutSec)
+		if err != nil {
+			log.Printf("event=job_exec_error job_id=%s worker_id=%s error=%v", req.JobID, w.workerID, err)
+			w.reportComplete(req, false, "", err.Error(), executor.ErrorClassExecution)
+			return
+		}
+		logResult(req.JobID, w.workerID, result)
+		w.reportComplete(req, result.Success, result.Output, result.Error, result.ErrorClass)
+	}()
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// handle cancel stops a job running here: post /cancel with the job id and attempt token. answers
+// 202 once the job has been signalled, and 404 when it isn't running here. the outcome is reported
+// like any other, as a failure with error class cancelled and the output so far. a cancel that
+// arrives before its /run is remembered, so the api can record the job cancelled and a late /run
+// for that attempt is refused.
+func (w *Worker) handleCancel(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	log.Printf("event=job_exec_done job_id=%s worker_id=%s success=%t", req.JobID, w.workerID, result.Success)
-	w.reportComplete(req.JobID, result.Success, result.Output, result.Error)
-	rw.WriteHeader(http.StatusOK)
+	var req struct {
+		JobID        string `json:"job_id"`
+		AttemptToken string `json:"attempt_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.JobID == "" {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !w.cancelAttempt(req.JobID, req.AttemptToken, true) {
+		log.Printf("event=job_cancel_before_run job_id=%s worker_id=%s", req.JobID, w.workerID)
+		http.Error(rw, "job not running here", http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+var (
+	errNoFreeSlot = errors.New("no free slot")
+	errCancelled  = errors.New("attempt was cancelled")
+)
+
+// cancelled attempts are remembered this long, well past any /run still on its way
+const cancelledTTL = 10 * time.Minute
+
+// cancel key is an attempt a cancel arrived for. an empty token stands for every attempt of the job.
+type cancelKey struct {
+	jobID, token string
+}
+
+// acquire takes a slot for the job's attempt without waiting. returns errNoFreeSlot if all slots are
+// in use and errCancelled if the attempt was cancelled before it got here. the context is cancelled
+// when the job is cancelled.
+func (w *Worker) acquire(jobID, token string) (context.Context, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, cancelled := w.cancelled[cancelKey{jobID, token}]
+	_, cancelledAll := w.cancelled[cancelKey{jobID, ""}]
+	if cancelled || cancelledAll {
+		return nil, errCancelled
+	}
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		return nil, errNoFreeSlot
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.running[jobID] = cancel
+	return ctx, nil
 }
 
-func (w *Worker) reportComplete(jobID string, success bool, result, errMsg string) {
+// release frees the job's slot
+func (w *Worker) release(jobID string) {
+	w.mu.Lock()
+	if cancel, ok := w.running[jobID]; ok {
+		cancel()
+		delete(w.running, jobID)
+	}
+	w.mu.Unlock()
+	<-w.slots
+}
+
+// cancel stops the job's process; returns false if the job isn't running here
+func (w *Worker) cancel(jobID string) bool {
+	return w.cancelAttempt(jobID, "", false)
+}
+
+// cancel attempt is cancel for a cancel the api sent. with remember, an attempt that isn't running
+// here is remembered as cancelled, in the same step, so a /run for it can't slip in between.
+func (w *Worker) cancelAttempt(jobID, token string, remember bool) bool {
+	w.mu.Lock()
+	cancel, ok := w.running[jobID]
+	if !ok && remember {
+		now := time.Now()
+		for k, at := range w.cancelled {
+			if now.Sub(at) > cancelledTTL {
+				delete(w.cancelled, k)
+			}
+		}
+		w.cancelled[cancelKey{jobID, token}] = now
+	}
+	w.mu.Unlock()
+	if !ok {
+		return false
+	}
+	log.Printf("event=job_cancel_received job_id=%s worker_id=%s", jobID, w.workerID)
+	cancel()
+	return true
+}
+
+func logResult(jobID, workerID string, result *executor.Result) {
+	if result.ErrorClass == executor.ErrorClassCancelled {
+		log.Printf("event=job_exec_cancelled job_id=%s worker_id=%s", jobID, workerID)
+		return
+	}
+	log.Printf("event=job_exec_done job_id=%s worker_id=%s success=%t", jobID, workerID, result.Success)
+}
+
+func (w *Worker) runningJobs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make([]string, 0, len(w.running))
+	for id := range w.running {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// report complete sends the job's outcome with the attempt token it was dispatched with. a 409
+// means the api gave the job to another attempt meanwhile, and the outcome was dropped.
+func (w *Worker) reportComplete(req RunRequest, success bool, result, errMsg, errClass string) {
 	body := map[string]interface{}{
-		"success": success,
-		"result":  result,
-		"error":   errMsg,
-	}
-	var buf bytes.Buffer
-	_ = json.NewEncoder(&buf).Encode(body)
-	req, _ := http.NewRequest(http.MethodPost, w.apiURL+"/jobs/"+jobID+"/complete", &buf)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+		"success":       success,
+		"result":        result,
+		"error":         errMsg,
+		"error_class":   errClass,
+		"attempt_token": req.AttemptToken,
+	}
+	resp, err := w.postJSON(context.Background(), "/jobs/"+req.JobID+"/complete", body)
 	if err != nil {
 		log.Printf("report complete failed: %v", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("event=job_complete_rejected job_id=%s worker_id=%s status=%d", req.JobID, w.workerID, resp.StatusCode)
+	}
 }
@@ -0,0 +1,157 @@
+//go:build unix
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud/internal/executor"
+)
+
+// completion is an outcome the worker reported to the api
+type completion struct {
+	JobID        string
+	Success      bool   `json:"success"`
+	Result       string `json:"result"`
+	ErrorClass   string `json:"error_class"`
+	AttemptToken string `json:"attempt_token"`
+}
+
+// new test worker returns a push worker with the given capacity that runs script as its executor
+// binary, and the outcomes it reports to a fake api
+func newTestWorker(t *testing.T, capacity int, script string) (*Worker, <-chan completion) {
+	t.Helper()
+	done := make(chan completion, 16)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c completion
+		_ = json.NewDecoder(r.Body).Decode(&c)
+		c.JobID = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/complete")
+		done <- c
+	}))
+	t.Cleanup(api.Close)
+
+	bin := filepath.Join(t.TempDir(), "runner")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WORKER_CAPACITY", fmt.Sprint(capacity))
+	w := New(api.URL, "w1", executor.NewRunner(bin))
+	t.Cleanup(func() { w.jobs.Wait() })
+	return w, done
+}
+
+// post sends a request to one of the worker's endpoints
+func post(t *testing.T, w *Worker, path, body string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	w.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return rec.Code
+}
+
+func run(t *testing.T, w *Worker, jobID string) int {
+	t.Helper()
+	return post(t, w, "/run", fmt.Sprintf(`{"job_id":%q,"payload":"p","attempt_token":"1-%s"}`, jobID, jobID))
+}
+
+func waitFor(t *testing.T, done <-chan completion) completion {
+	t.Helper()
+	select {
+	case c := <-done:
+		return c
+	case <-time.After(10 * time.Second):
+		t.Fatal("no outcome reported")
+		return completion{}
+	}
+}
+
+func TestRunsUpToCapacityConcurrently(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "go")
+	// every job blocks until the gate file exists, so they can only finish if they run side by side
+	w, done := newTestWorker(t, 2, fmt.Sprintf("while [ ! -e %s ]; do sleep 0.01; done\necho \"$2\"\n", gate))
+
+	for _, id := range []string{"a", "b"} {
+		if code := run(t, w, id); code != http.StatusAccepted {
+			t.Fatalf("run %s: %d, want 202", id, code)
+		}
+	}
+	if code := run(t, w, "c"); code != http.StatusServiceUnavailable {
+		t.Fatalf("run with every slot taken: %d, want 503", code)
+	}
+	// heartbeats report the jobs in our slots
+	running := w.runningJobs()
+	slices.Sort(running)
+	if !slices.Equal(running, []string{"a", "b"}) {
+		t.Fatalf("running = %v, want [a b]", running)
+	}
+
+	if err := os.WriteFile(gate, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]completion{}
+	for i := 0; i < 2; i++ {
+		c := waitFor(t, done)
+		got[c.JobID] = c
+	}
+	for _, id := range []string{"a", "b"} {
+		if c := got[id]; !c.Success || c.Result != id || c.AttemptToken != "1-"+id {
+			t.Fatalf("outcome of %s = %+v, want its output and attempt token", id, c)
+		}
+	}
+	w.jobs.Wait()
+	if code := run(t, w, "c"); code != http.StatusAccepted {
+		t.Fatalf("run after the slots came free: %d, want 202", code)
+	}
+	waitFor(t, done)
+}
+
+func TestCancelStopsARunningJob(t *testing.T) {
+	w, done := newTestWorker(t, 1, "echo partial\nexec sleep 60\n")
+	w.exec.GracePeriod = time.Second
+	if code := run(t, w, "a"); code != http.StatusAccepted {
+		t.Fatalf("run: %d", code)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if code := post(t, w, "/cancel", `{"job_id":"a","attempt_token":"1-a"}`); code != http.StatusAccepted {
+		t.Fatalf("cancel a running job: %d, want 202", code)
+	}
+	if c := waitFor(t, done); c.JobID != "a" || c.Success || c.ErrorClass != executor.ErrorClassCancelled || c.Result != "partial" {
+		t.Fatalf("outcome = %+v, want cancelled with the output so far", c)
+	}
+	w.jobs.Wait()
+	if len(w.runningJobs()) != 0 {
+		t.Fatal("cancelled job still holds its slot")
+	}
+}
+
+func TestCancelBeforeRunRefusesThatAttempt(t *testing.T) {
+	w, done := newTestWorker(t, 1, "echo ran\n")
+	if code := post(t, w, "/cancel", `{"job_id":"a","attempt_token":"1-a"}`); code != http.StatusNotFound {
+		t.Fatalf("cancel before run: %d, want 404", code)
+	}
+	// the /run of the cancelled attempt arrives late and is refused without running anything
+	if code := run(t, w, "a"); code != http.StatusConflict {
+		t.Fatalf("run of a cancelled attempt: %d, want 409", code)
+	}
+	if len(w.runningJobs()) != 0 {
+		t.Fatal("refused run took a slot")
+	}
+	// a later attempt of the same job (e.g. replayed) runs
+	if code := post(t, w, "/run", `{"job_id":"a","payload":"p","attempt_token":"2-a"}`); code != http.StatusAccepted {
+		t.Fatalf("run of a new attempt: %d, want 202", code)
+	}
+	if c := waitFor(t, done); !c.Success || c.AttemptToken != "2-a" {
+		t.Fatalf("outcome = %+v, want the new attempt to succeed", c)
+	}
+	if code := post(t, w, "/cancel", `{}`); code != http.StatusBadRequest {
+		t.Fatalf("cancel without a job id: %d, want 400", code)
+	}
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// role decides which endpoints an api key may call
+type Role string
+
+const (
+	RoleViewer    Role = "viewer"    // read jobs, workers, schedules, stats and events
+	RoleSubmitter Role = "submitter" // viewer, plus submit and cancel jobs, workflows and schedules
+	RoleAdmin     Role = "admin"     // everything except the worker endpoints, including key management
+	RoleWorker    Role = "worker"    // only register, heartbeat, lease and complete
+)
+
+// valid reports whether r is a known role
+func (r Role) Valid() bool {
+	switch r {
+	case RoleViewer, RoleSubmitter, RoleAdmin, RoleWorker:
+		return true
+	}
+	return false
+}
+
+// allows reports whether a key with role r may call an endpoint that needs role need.
+// admin includes submitter, which includes viewer; worker is kept apart from the rest.
+func (r Role) Allows(need Role) bool {
+	if r == need {
+		return true
+	}
+	switch need {
+	case RoleViewer:
+		return r == RoleSubmitter || r == RoleAdmin
+	case RoleSubmitter:
+		return r == RoleAdmin
+	}
+	return false
+}
+
+// api key identifies a client. only the sha-256 of the key is stored; the key itself is
+// returned once, when it is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Role      Role      `json:"role"`
+	Tenant    string    `json:"tenant,omitempty"` // confines viewer and submitter keys to one tenant's jobs
+	Prefix    string    `json:"prefix,omitempty"` // first characters of the key, to tell keys apart
+	Hash      string    `json:"hash,omitempty"`   // hex sha-256 of the key; never returned by the api
+	CreatedAt time.Time `json:"created_at"`
+	Key       string    `json:"key,omitempty"` // plaintext, only set in the create response; never stored
+}
+
+// create api key request is the body for post /keys
+type CreateAPIKeyRequest struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// validate checks the role and the tenant. only viewer and submitter keys can be confined to a
+// tenant; admin and worker keys serve every tenant.
+func (r *CreateAPIKeyRequest) Validate() error {
+	if !r.Role.Valid() {
+		return fmt.Errorf("role must be viewer, submitter, admin or worker, got %q", r.Role)
+	}
+	if r.Tenant == "" {
+		return nil
+	}
+	if r.Role != RoleViewer && r.Role != RoleSubmitter {
+		return fmt.Errorf("tenant can only be set on viewer and submitter keys")
+	}
+	return ValidateTenant(r.Tenant)
+}
+
+// hash api key returns the hex sha-256 of a plaintext key, the form keys are stored and looked up in.
+// keys are long and random, so a fast hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// api key backend is the storage behind an api key store. implementations must be safe for concurrent use.
+type APIKeyBackend interface {
+	Put(k *APIKey) error
+	Delete(id string) error
+	Get(id string) (*APIKey, bool)
+	GetByHash(hash string) (*APIKey, bool)
+	List() []*APIKey
+}
+
+// api key store holds api keys; persistence is delegated to a pluggable backend
+type APIKeyStore struct {
+	backend APIKeyBackend
+}
+
+// new api key store creates an in-memory api key store
+func NewAPIKeyStore() *APIKeyStore {
+	return NewAPIKeyStoreWithBackend(newMemoryAPIKeyBackend())
+}
+
+// new api key store with backend creates an api key store on top of the given backend
+func NewAPIKeyStoreWithBackend(backend APIKeyBackend) *APIKeyStore {
+	return &APIKeyStore{backend: backend}
+}
+
+// save adds or updates a key. the plaintext is dropped before it reaches the backend.
+func (s *APIKeyStore) Save(k *APIKey) error {
+	cp := *k
+	cp.Key = ""
+	if err := s.backend.Put(&cp); err != nil {
+		log.Printf("event=store_write_failed key_id=%s error=%v", k.ID, err)
+		return err
+	}
+	return nil
+}
+
+// delete removes a key
+func (s *APIKeyStore) Delete(id string) {
+	if err := s.backend.Delete(id); err != nil {
+		log.Printf("event=store_write_failed key_id=%s error=%v", id, err)
+	}
+}
+
+// get returns a key by id
+func (s *APIKeyStore) Get(id string) (*APIKey, bool) {
+	return s.backend.Get(id)
+}
+
+// get by hash returns the key whose hash matches
+func (s *APIKeyStore) GetByHash(hash string) (*APIKey, bool) {
+	return s.backend.GetByHash(hash)
+}
+
+// list returns all keys ordered by creation time
+func (s *APIKeyStore) List() []*APIKey {
+	out := s.backend.List()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// memory api key backend keeps keys in a map
+type memoryAPIKeyBackend struct {
+	keys map[string]*APIKey
+	mu   sync.RWMutex
+}
+
+func newMemoryAPIKeyBackend() *memoryAPIKeyBackend {
+	return &memoryAPIKeyBackend{keys: make(map[string]*APIKey)}
+}
+
+func (b *memoryAPIKeyBackend) Put(k *APIKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys[k.ID] = k
+	return nil
+}
+
+func (b *memoryAPIKeyBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.keys, id)
+	return nil
+}
+
+func (b *memoryAPIKeyBackend) Get(id string) (*APIKey, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	k, ok := b.keys[id]
+	return k, ok
+}
+
+func (b *memoryAPIKeyBackend) GetByHash(hash string) (*APIKey, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, k := range b.keys {
+		if k.Hash == hash {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (b *memoryAPIKeyBackend) List() []*APIKey {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]*APIKey, 0, len(b.keys))
+	for _, k := range b.keys {
+		out = append(out, k)
+	}
+	return out
+}
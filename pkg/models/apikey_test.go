@@ -0,0 +1,28 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRoleAllows(t *testing.T) {
+	roles := []Role{RoleViewer, RoleSubmitter, RoleAdmin, RoleWorker}
+	allowed := map[Role][]Role{
+		RoleViewer:    {RoleViewer},
+		RoleSubmitter: {RoleViewer, RoleSubmitter},
+		RoleAdmin:     {RoleViewer, RoleSubmitter, RoleAdmin},
+		// workers reach only the worker endpoints, and only workers reach those
+		RoleWorker: {RoleWorker},
+	}
+	for _, r := range roles {
+		for _, need := range roles {
+			want := slices.Contains(allowed[r], need)
+			if got := r.Allows(need); got != want {
+				t.Errorf("%s.Allows(%s) = %v, want %v", r, need, got, want)
+			}
+		}
+	}
+	if Role("root").Valid() || !RoleWorker.Valid() {
+		t.Fatal("Valid accepts unknown roles or refuses known ones")
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// job constraints restrict a job to workers with the given labels and resources
+type JobConstraints struct {
+	NodeSelector map[string]string `json:"node_selector,omitempty"` // every key=value must be among the worker's labels
+	MinMemoryMB  int               `json:"min_memory_mb,omitempty"`
+	MinCPUs      int               `json:"min_cpus,omitempty"`
+}
+
+// validate rejects negative resource minimums and empty selector keys
+func (c *JobConstraints) Validate() error {
+	if c.MinMemoryMB < 0 || c.MinCPUs < 0 {
+		return errors.New("constraints: min_memory_mb and min_cpus must not be negative")
+	}
+	for k := range c.NodeSelector {
+		if strings.TrimSpace(k) == "" {
+			return errors.New("constraints: node_selector keys must not be empty")
+		}
+	}
+	return nil
+}
+
+// can run reports whether the worker may run the job: it must support the job's type and meet
+// the job's constraints. when it can't, the reason says why.
+func (w *Worker) CanRun(job *Job) (bool, string) {
+	if len(w.JobTypes) > 0 && !containsString(w.JobTypes, job.Type) {
+		return false, fmt.Sprintf("job type %s not supported", job.Type)
+	}
+	c := job.Constraints
+	if c == nil {
+		return true, ""
+	}
+	keys := make([]string, 0, len(c.NodeSelector))
+	for k := range c.NodeSelector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := w.Labels[k]; !ok || v != c.NodeSelector[k] {
+			return false, fmt.Sprintf("label %s=%s missing", k, c.NodeSelector[k])
+		}
+	}
+	if w.MemoryMB < c.MinMemoryMB {
+		return false, fmt.Sprintf("needs %d MB memory", c.MinMemoryMB)
+	}
+	if w.CPUs < c.MinCPUs {
+		return false, fmt.Sprintf("needs %d cpus", c.MinCPUs)
+	}
+	return true, ""
+}
+
+// unschedulable reason returns why none of the workers can run the job, or "" if one can.
+// with no workers registered the job is simply waiting, so that is not reported either.
+func UnschedulableReason(job *Job, workers []*Worker) string {
+	if len(workers) == 0 {
+		return ""
+	}
+	var reasons []string
+	for _, w := range workers {
+		ok, reason := w.CanRun(job)
+		if ok {
+			return ""
+		}
+		if !containsString(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+	sort.Strings(reasons)
+	return "no worker matches: " + strings.Join(reasons, "; ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package models
+
+import "testing"
+
+func TestJobConstraintsValidate(t *testing.T) {
+	for _, c := range []*JobConstraints{
+		{MinMemoryMB: -1},
+		{MinCPUs: -1},
+		{NodeSelector: map[string]string{" ": "x"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want an error", c)
+		}
+	}
+	if err := (&JobConstraints{NodeSelector: map[string]string{"zone": ""}, MinCPUs: 2}).Validate(); err != nil {
+		t.Fatalf("valid constraints rejected: %v", err)
+	}
+}
+
+func TestWorkerCanRun(t *testing.T) {
+	w := &Worker{ID: "w", JobTypes: []string{"email"}, Labels: map[string]string{"zone": "a", "smtp": "yes"}, MemoryMB: 2048, CPUs: 4}
+	for _, tc := range []struct {
+		job    *Job
+		ok     bool
+		reason string
+	}{
+		{&Job{Type: "email"}, true, ""},
+		{&Job{Type: "resize"}, false, "job type resize not supported"},
+		{&Job{Type: "email", Constraints: &JobConstraints{NodeSelector: map[string]string{"zone": "a", "smtp": "yes"}, MinMemoryMB: 2048, MinCPUs: 4}}, true, ""},
+		// the first missing label in key order is reported
+		{&Job{Type: "email", Constraints: &JobConstraints{NodeSelector: map[string]string{"zone": "b", "gpu": "1"}}}, false, "label gpu=1 missing"},
+		{&Job{Type: "email", Constraints: &JobConstraints{MinMemoryMB: 4096}}, false, "needs 4096 MB memory"},
+		{&Job{Type: "email", Constraints: &JobConstraints{MinCPUs: 8}}, false, "needs 8 cpus"},
+	} {
+		ok, reason := w.CanRun(tc.job)
+		if ok != tc.ok || reason != tc.reason {
+			t.Errorf("CanRun(type %s, %+v) = %v %q, want %v %q", tc.job.Type, tc.job.Constraints, ok, reason, tc.ok, tc.reason)
+		}
+	}
+
+	// no job types means every type
+	if ok, _ := (&Worker{}).CanRun(&Job{Type: "anything"}); !ok {
+		t.Fatal("a worker without job types refused a job")
+	}
+}
+
+func TestUnschedulableReason(t *testing.T) {
+	job := &Job{Type: "resize", Constraints: &JobConstraints{MinCPUs: 8}}
+	if got := UnschedulableReason(job, nil); got != "" {
+		t.Fatalf("without workers: %q, want no reason", got)
+	}
+	small := &Worker{ID: "a", CPUs: 2}
+	emailOnly := &Worker{ID: "b", JobTypes: []string{"email"}}
+	other := &Worker{ID: "c", CPUs: 4}
+	want := "no worker matches: job type resize not supported; needs 8 cpus"
+	if got := UnschedulableReason(job, []*Worker{small, emailOnly, other}); got != want {
+		t.Fatalf("reason = %q, want %q", got, want)
+	}
+	if got := UnschedulableReason(job, []*Worker{small, {ID: "big", CPUs: 16}}); got != "" {
+		t.Fatalf("with a matching worker: %q, want no reason", got)
+	}
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// idempotency record remembers which job a submit with an idempotency key created, and a
+// fingerprint of that request so a different request reusing the key can be told apart
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`         // the client's key prefixed with its scope (tenant or api key)
+	Fingerprint string    `json:"fingerprint"` // hex sha-256 of the normalized request body
+	JobID       string    `json:"job_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// idempotency backend is the storage behind an idempotency store. implementations must be safe for concurrent use.
+type IdempotencyBackend interface {
+	Put(rec *IdempotencyRecord) error
+	Get(key string) (*IdempotencyRecord, bool)
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// idempotency store holds idempotency records; persistence is delegated to a pluggable backend
+type IdempotencyStore struct {
+	backend IdempotencyBackend
+}
+
+// new idempotency store creates an in-memory idempotency store
+func NewIdempotencyStore() *IdempotencyStore {
+	return NewIdempotencyStoreWithBackend(newMemoryIdempotencyBackend())
+}
+
+// new idempotency store with backend creates an idempotency store on top of the given backend
+func NewIdempotencyStoreWithBackend(backend IdempotencyBackend) *IdempotencyStore {
+	return &IdempotencyStore{backend: backend}
+}
+
+// save adds or replaces a record
+func (s *IdempotencyStore) Save(rec *IdempotencyRecord) error {
+	if err := s.backend.Put(rec); err != nil {
+		log.Printf("event=store_write_failed idempotency_key=%q error=%v", rec.Key, err)
+		return err
+	}
+	return nil
+}
+
+// get returns the record for key unless it has expired
+func (s *IdempotencyStore) Get(key string) (*IdempotencyRecord, bool) {
+	rec, ok := s.backend.Get(key)
+	if !ok || !time.Now().Before(rec.ExpiresAt) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// sweep deletes expired records and returns how many went
+func (s *IdempotencyStore) Sweep() int {
+	n, err := s.backend.DeleteExpired(time.Now())
+	if err != nil {
+		log.Printf("event=store_write_failed idempotency_sweep=true error=%v", err)
+	}
+	return n
+}
+
+// memory idempotency backend keeps records in a map
+type memoryIdempotencyBackend struct {
+	records map[string]*IdempotencyRecord
+	mu      sync.RWMutex
+}
+
+func newMemoryIdempotencyBackend() *memoryIdempotencyBackend {
+	return &memoryIdempotencyBackend{records: make(map[string]*IdempotencyRecord)}
+}
+
+func (b *memoryIdempotencyBackend) Put(rec *IdempotencyRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records[rec.Key] = rec
+	return nil
+}
+
+func (b *memoryIdempotencyBackend) Get(key string) (*IdempotencyRecord, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rec, ok := b.records[key]
+	return rec, ok
+}
+
+func (b *memoryIdempotencyBackend) DeleteExpired(now time.Time) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for key, rec := range b.records {
+		if !now.Before(rec.ExpiresAt) {
+			delete(b.records, key)
+			n++
+		}
+	}
+	return n, nil
+}
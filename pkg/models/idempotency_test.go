@@ -0,0 +1,30 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStoreHidesAndSweepsExpiredRecords(t *testing.T) {
+	s := NewIdempotencyStore()
+	now := time.Now()
+	s.Save(&IdempotencyRecord{Key: "live", JobID: "j1", ExpiresAt: now.Add(time.Hour)})
+	s.Save(&IdempotencyRecord{Key: "expired", JobID: "j2", ExpiresAt: now.Add(-time.Second)})
+
+	if rec, ok := s.Get("live"); !ok || rec.JobID != "j1" {
+		t.Fatalf("get live = %+v %v", rec, ok)
+	}
+	// an expired record not swept yet is already gone for callers
+	if _, ok := s.Get("expired"); ok {
+		t.Fatal("expired record returned")
+	}
+	if n := s.Sweep(); n != 1 {
+		t.Fatalf("sweep = %d, want 1", n)
+	}
+	if n := s.Sweep(); n != 0 {
+		t.Fatalf("second sweep = %d, want 0", n)
+	}
+	if _, ok := s.Get("live"); !ok {
+		t.Fatal("sweep removed a live record")
+	}
+}
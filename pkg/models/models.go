@@ -4,6 +4,7 @@ package models
 import (
     "crypto/rand"
     "encoding/hex"
+    "log"
     "sync"
     "time"
 )
@@ -15,13 +16,20 @@ type JobStatus string
 
 const (
     JobStatusPending   JobStatus = "pending"
+    JobStatusScheduled JobStatus = "scheduled" // waiting for run_at before it is queued
     JobStatusQueued    JobStatus = "queued"
     JobStatusRunning   JobStatus = "running"
     JobStatusCompleted JobStatus = "completed"
     JobStatusFailed    JobStatus = "failed"
     JobStatusCancelled JobStatus = "cancelled"
+    JobStatusSkipped   JobStatus = "skipped" // workflow job whose dependency failed or was cancelled
 )
 
+// final reports whether a job in this status is done for good
+func (s JobStatus) Final() bool {
+    return s == JobStatusCompleted || s == JobStatusFailed || s == JobStatusCancelled || s == JobStatusSkipped
+}
+
 // job priority: lower value = higher priority (dispatched first)
 const (
     PriorityHigh   = 0
@@ -29,6 +37,50 @@ const (
     PriorityLow    = 2
 )
 
+
+// priority range is the priorities the api accepts; others are clamped into it. the zero value is
+// the default range, 0 (high) to 2 (low).
+type PriorityRange struct {
+    Min int // highest priority
+    Max int // lowest priority
+}
+
+
+// bounds returns the range, or the default one for the zero value
+func (r PriorityRange) bounds() (int, int) {
+    if r == (PriorityRange{}) {
+        return PriorityHigh, PriorityLow
+    }
+    return r.Min, r.Max
+}
+
+
+// clamp returns p moved into the range
+func (r PriorityRange) Clamp(p int) int {
+    min, max := r.bounds()
+    if p < min {
+        return min
+    }
+    if p > max {
+        return max
+    }
+    return p
+}
+
+
+// default returns the priority of jobs submitted without one: the middle of the range, 1 by default
+func (r PriorityRange) Default() int {
+    min, max := r.bounds()
+    return min + (max-min)/2
+}
+
+
+// highest returns the range's highest priority (its smallest value)
+func (r PriorityRange) Highest() int {
+    min, _ := r.bounds()
+    return min
+}
+
 // job represents a compute workload submitted to the platform
 type Job struct {
     ID         string     `json:"id"`
@@ -44,15 +96,182 @@ type Job struct {
     Error      string     `json:"error,omitempty"`
     RetryCount int        `json:"retry_count,omitempty"`
     TimeoutSec int        `json:"timeout_sec,omitempty"`
+    // set while a pull worker holds a lease on the job. the stored expiry is the one the lease was
+    // granted with; extensions only move the lease, and get /jobs/:id shows where it is now.
+    LeaseID        string        `json:"lease_id,omitempty"`
+    LeaseExpiresAt *time.Time    `json:"lease_expires_at,omitempty"`
+    // fences the running attempt: "<attempt number>-<lease or dispatch id>". the worker echoes it when
+    // it completes the job, so a callback from an earlier attempt can't overwrite the result
+    AttemptToken string `json:"attempt_token,omitempty"`
+    // set when a running job is cancelled through the api, until its worker has stopped it
+    CancelRequested bool `json:"cancel_requested,omitempty"`
+    RetryPolicy    *RetryPolicy  `json:"retry_policy,omitempty"`
+    Attempts       []Attempt     `json:"attempts,omitempty"`
+    // set while the job sits in the dead-letter queue
+    DeadLetter     *DeadLetter   `json:"dead_letter,omitempty"`
+    Replays        int           `json:"replays,omitempty"` // times replayed out of the dead-letter queue
+    Workflow       *WorkflowStep `json:"workflow,omitempty"`
+    RunAt          *time.Time    `json:"run_at,omitempty"`      // not queued before this time
+    ScheduleID     string        `json:"schedule_id,omitempty"` // set on jobs created by a schedule
+    Constraints    *JobConstraints `json:"constraints,omitempty"`
+    CallbackURL    string        `json:"callback_url,omitempty"` // gets the final job posted to it
+    Tenant         string        `json:"tenant,omitempty"` // namespace the job belongs to, from the submitting api key
+    // set while the job is queued and no registered worker can run it
+    UnschedulableReason string `json:"unschedulable_reason,omitempty"`
+    // bumped on every write; a write based on an older revision is refused
+    Revision int64 `json:"revision"`
+}
+
+
+// clone returns a deep copy of the job, so a store can keep its own copy and hand out others that
+// callers may change freely until they write them back
+func (j *Job) Clone() *Job {
+    c := *j
+    c.StartedAt = cloneTime(j.StartedAt)
+    c.FinishedAt = cloneTime(j.FinishedAt)
+    c.LeaseExpiresAt = cloneTime(j.LeaseExpiresAt)
+    c.RunAt = cloneTime(j.RunAt)
+    c.RetryPolicy = cloneRetryPolicy(j.RetryPolicy)
+    if j.Attempts != nil {
+        c.Attempts = make([]Attempt, len(j.Attempts))
+        for i, a := range j.Attempts {
+            a.FinishedAt = cloneTime(a.FinishedAt)
+            c.Attempts[i] = a
+        }
+    }
+    if j.DeadLetter != nil {
+        d := *j.DeadLetter
+        c.DeadLetter = &d
+    }
+    if j.Workflow != nil {
+        w := *j.Workflow
+        w.DependsOn = append([]string(nil), j.Workflow.DependsOn...)
+        c.Workflow = &w
+    }
+    c.Constraints = cloneConstraints(j.Constraints)
+    return &c
+}
+
+
+func cloneTime(t *time.Time) *time.Time {
+    if t == nil {
+        return nil
+    }
+    c := *t
+    return &c
+}
+
+
+func cloneRetryPolicy(p *RetryPolicy) *RetryPolicy {
+    if p == nil {
+        return nil
+    }
+    c := *p
+    c.RetryOn = append([]string(nil), p.RetryOn...)
+    return &c
+}
+
+
+func cloneConstraints(k *JobConstraints) *JobConstraints {
+    if k == nil {
+        return nil
+    }
+    c := *k
+    if k.NodeSelector != nil {
+        c.NodeSelector = make(map[string]string, len(k.NodeSelector))
+        for key, v := range k.NodeSelector {
+            c.NodeSelector[key] = v
+        }
+    }
+    return &c
+}
+
+
+// error classes describe why an attempt failed; retry policies select which ones are retried
+const (
+    ErrorClassDispatch   = "dispatch"   // worker unreachable, rejected the job, or was lost mid-run
+    ErrorClassTimeout    = "timeout"    // job ran past its timeout
+    ErrorClassExecution  = "execution"  // job ran and failed (e.g. fetch error, smtp down)
+    ErrorClassValidation = "validation" // payload can never succeed
+    ErrorClassCancelled  = "cancelled"  // stopped by a cancel through the api; never retried
+)
+
+
+// backoff strategies for retries
+const (
+    BackoffExponential = "exponential" // initial * 2^retry, capped at max
+    BackoffFixed       = "fixed"       // always initial
+    BackoffJitter      = "jitter"      // random between 0 and the exponential delay
+)
+
+
+// retry policy controls how failed attempts are retried. jobs submitted without one only retry
+// dispatch failures (up to 3 attempts), which was the behaviour before policies existed.
+type RetryPolicy struct {
+    MaxAttempts       int      `json:"max_attempts,omitempty"`        // total attempts including the first; default 3
+    Backoff           string   `json:"backoff,omitempty"`             // exponential (default), fixed or jitter
+    InitialBackoffSec int      `json:"initial_backoff_sec,omitempty"` // default 1
+    MaxBackoffSec     int      `json:"max_backoff_sec,omitempty"`     // default 60
+    RetryOn           []string `json:"retry_on,omitempty"`            // error classes; default all but validation
+}
+
+
+// attempt is one try at running a job on a worker
+type Attempt struct {
+    Number     int        `json:"number"`
+    WorkerID   string     `json:"worker_id,omitempty"`
+    StartedAt  time.Time  `json:"started_at"`
+    FinishedAt *time.Time `json:"finished_at,omitempty"`
+    Error      string     `json:"error,omitempty"`
+    ErrorClass string     `json:"error_class,omitempty"`
+}
+
+
+// dead letter reasons
+const (
+    DeadLetterRetriesExhausted = "retries_exhausted" // every attempt the policy allows failed
+    DeadLetterNotRetryable     = "not_retryable"     // the policy does not retry the error class
+)
+
+
+// dead letter records why a failed job was moved to the dead-letter queue
+type DeadLetter struct {
+    Reason     string    `json:"reason"`
+    Error      string    `json:"error,omitempty"`
+    ErrorClass string    `json:"error_class,omitempty"`
+    Attempts   int       `json:"attempts"`
+    At         time.Time `json:"at"`
 }
 
 
 // submit job request is the body for post /jobs
 type SubmitJobRequest struct {
-    Type       string `json:"type,omitempty"`
-    Payload    string `json:"payload"`
-    TimeoutSec int    `json:"timeout_sec,omitempty"`
-    Priority   *int   `json:"priority,omitempty"` // optional; 0=high, 1=normal, 2=low; default 1
+    Type       string       `json:"type,omitempty"`
+    Payload    string       `json:"payload"`
+    TimeoutSec int          `json:"timeout_sec,omitempty"`
+    Priority   *int         `json:"priority,omitempty"` // optional; lower goes first; default the middle of the configured range (1)
+    Retry      *RetryPolicy `json:"retry,omitempty"`
+    RunAt      *time.Time   `json:"run_at,omitempty"`    // optional; queue the job at this time instead of now
+    DelaySec   int          `json:"delay_sec,omitempty"` // optional; queue the job this many seconds from now
+    Constraints *JobConstraints `json:"constraints,omitempty"` // optional; only run on matching workers
+    CallbackURL string          `json:"callback_url,omitempty"` // optional; the final job is posted here when it finishes
+}
+
+
+// update job request is the body for patch /jobs/:id
+type UpdateJobRequest struct {
+    Priority *int `json:"priority"` // new priority, clamped to the configured range
+}
+
+
+// job position is the answer to get /jobs/:id/position for a queued job
+type JobPosition struct {
+    JobID             string     `json:"job_id"`
+    Position          int        `json:"position"` // 1 for the next job to be dispatched
+    QueueDepth        int        `json:"queue_depth"`
+    Priority          int        `json:"priority"`
+    EffectivePriority int        `json:"effective_priority"`           // after aging
+    EstimatedStartAt  *time.Time `json:"estimated_start_at,omitempty"` // missing until a job has finished on a worker
 }
 
 
@@ -61,80 +280,245 @@ type WorkerStatus string
 
 
 const (
-    WorkerStatusIdle WorkerStatus = "idle"
-    WorkerStatusBusy WorkerStatus = "busy"
+    WorkerStatusIdle WorkerStatus = "idle" // at least one free slot
+    WorkerStatusBusy WorkerStatus = "busy" // every slot is running a job
 )
 
 
-// worker represents a containerized worker node
+// worker represents a containerized worker node. workers without an endpoint are pull workers:
+// they are never pushed jobs and instead lease them from the api.
+// a worker runs up to capacity jobs at once; running jobs holds the ids of the jobs in its slots.
 type Worker struct {
     ID            string        `json:"id"`
-    Endpoint      string        `json:"endpoint"`
+    Endpoint      string        `json:"endpoint,omitempty"`
     Status        WorkerStatus  `json:"status"`
-    CurrentJobID  string        `json:"current_job_id,omitempty"`
+    Capacity      int           `json:"capacity"`
+    RunningJobs   []string      `json:"running_jobs,omitempty"`
+    Weight        int           `json:"weight,omitempty"` // share of jobs under the weighted balancer, default 1
+    // capabilities: job types it runs (empty means all), key=value labels and resources
+    JobTypes      []string          `json:"job_types,omitempty"`
+    Labels        map[string]string `json:"labels,omitempty"`
+    MemoryMB      int               `json:"memory_mb,omitempty"`
+    CPUs          int               `json:"cpus,omitempty"`
     LastHeartbeat time.Time     `json:"last_heartbeat"`
 }
 
 
-// job store holds jobs in memory
-type JobStore struct {
-    jobs map[string]*Job
-    mu   sync.RWMutex
+// clone returns a deep copy of the worker, so the in-memory registry hands out copies the way the
+// job store does, and a dispatch pass reading one doesn't race with a slot being freed
+func (w *Worker) Clone() *Worker {
+    c := *w
+    c.RunningJobs = append([]string(nil), w.RunningJobs...)
+    c.JobTypes = append([]string(nil), w.JobTypes...)
+    if w.Labels != nil {
+        c.Labels = make(map[string]string, len(w.Labels))
+        for k, v := range w.Labels {
+            c.Labels[k] = v
+        }
+    }
+    return &c
 }
 
 
-// worker registry holds registered workers
-type WorkerRegistry struct {
-    workers map[string]*Worker
-    mu      sync.RWMutex
+// slots returns the worker's capacity, at least 1
+func (w *Worker) Slots() int {
+    if w.Capacity < 1 {
+        return 1
+    }
+    return w.Capacity
+}
+
+
+// free slots returns how many more jobs the worker can take
+func (w *Worker) FreeSlots() int {
+    if n := w.Slots() - len(w.RunningJobs); n > 0 {
+        return n
+    }
+    return 0
+}
+
+
+// assign puts the job in a free slot; returns false if the worker is full
+func (w *Worker) Assign(jobID string) bool {
+    if w.FreeSlots() == 0 {
+        return false
+    }
+    w.RunningJobs = append(w.RunningJobs, jobID)
+    w.updateStatus()
+    return true
+}
+
+
+// release frees the job's slot; returns false if the job was not running on the worker
+func (w *Worker) Release(jobID string) bool {
+    for i, id := range w.RunningJobs {
+        if id == jobID {
+            w.RunningJobs = append(w.RunningJobs[:i:i], w.RunningJobs[i+1:]...)
+            w.updateStatus()
+            return true
+        }
+    }
+    return false
+}
+
+
+// set running replaces the worker's running set, e.g. with the jobs the worker reported itself
+func (w *Worker) SetRunning(jobIDs []string) {
+    w.RunningJobs = jobIDs
+    w.updateStatus()
+}
+
+
+// running reports whether the job occupies one of the worker's slots
+func (w *Worker) Running(jobID string) bool {
+    for _, id := range w.RunningJobs {
+        if id == jobID {
+            return true
+        }
+    }
+    return false
+}
+
+
+func (w *Worker) updateStatus() {
+    if w.FreeSlots() == 0 {
+        w.Status = WorkerStatusBusy
+    } else {
+        w.Status = WorkerStatusIdle
+    }
+}
+
+
+// job backend is the storage behind a job store. implementations must be safe for concurrent use.
+// put is called for create, so it must insert or replace by id. put if replaces the job only while
+// the stored one is at the given revision and reports whether it did. get and list return copies,
+// so a caller changing a job can't change the stored one without writing it.
+type JobBackend interface {
+    Put(job *Job) error
+    PutIf(job *Job, revision int64) (bool, error)
+    Get(id string) (*Job, bool)
+    List(status JobStatus) []*Job
+}
+
+
+// job store is the api for jobs; persistence is delegated to a pluggable backend
+type JobStore struct {
+    backend JobBackend
 }
 
 
 // new job store creates an in-memory job store
 func NewJobStore() *JobStore {
-    return &JobStore{jobs: make(map[string]*Job)}
+    return NewJobStoreWithBackend(newMemoryJobBackend())
+}
+
+
+// new job store with backend creates a job store on top of the given backend (e.g. wal or sql)
+func NewJobStoreWithBackend(backend JobBackend) *JobStore {
+    return &JobStore{backend: backend}
 }
 
 
 // create creates a new job and returns it
 func (s *JobStore) Create(job *Job) (*Job, error) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
     if job.ID == "" {
         job.ID = mustGenerateID()
     }
     job.CreatedAt = time.Now()
     job.Status = JobStatusPending
-    s.jobs[job.ID] = job
+    job.Tenant = TenantOrDefault(job.Tenant)
+    job.Revision = 1
+    if err := s.backend.Put(job); err != nil {
+        return nil, err
+    }
     return job, nil
 }
 
 
-// get returns a job by id
+// get returns a copy of a job by id
 func (s *JobStore) Get(id string) (*Job, bool) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
-    j, ok := s.jobs[id]
-    return j, ok
+    return s.backend.Get(id)
 }
 
 
-// update updates a job (caller must hold a reference, we replace by id)
-func (s *JobStore) Update(job *Job) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    s.jobs[job.ID] = job
+// update writes back a job read from this store and bumps its revision. the write is a compare-and-set
+// on the revision the job was read at: if anyone wrote the job since (a cancel, a completion, a new
+// priority), the stale copy is not written and update returns false, so the caller must not act on
+// its change. a backend write error is logged and counts as not written too: the store still holds
+// the old job.
+func (s *JobStore) Update(job *Job) bool {
+    read := job.Revision
+    job.Revision++
+    ok, err := s.backend.PutIf(job, read)
+    if err != nil {
+        job.Revision = read
+        log.Printf("event=store_write_failed job_id=%s error=%v", job.ID, err)
+        return false
+    }
+    if !ok {
+        job.Revision = read
+        log.Printf("event=store_write_skipped job_id=%s status=%s revision=%d reason=changed_since_read", job.ID, job.Status, read)
+        return false
+    }
+    return true
 }
 
 
-// list returns all jobs (optional filter by status)
+// list returns copies of all jobs (optional filter by status)
 func (s *JobStore) List(status JobStatus) []*Job {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+    return s.backend.List(status)
+}
+
+
+// memory job backend keeps copies of jobs in a map; everything is lost on restart
+type memoryJobBackend struct {
+    jobs map[string]*Job
+    mu   sync.RWMutex
+}
+
+
+func newMemoryJobBackend() *memoryJobBackend {
+    return &memoryJobBackend{jobs: make(map[string]*Job)}
+}
+
+
+func (b *memoryJobBackend) Put(job *Job) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.jobs[job.ID] = job.Clone()
+    return nil
+}
+
+
+func (b *memoryJobBackend) PutIf(job *Job, revision int64) (bool, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if cur, ok := b.jobs[job.ID]; !ok || cur.Revision != revision {
+        return false, nil
+    }
+    b.jobs[job.ID] = job.Clone()
+    return true, nil
+}
+
+
+func (b *memoryJobBackend) Get(id string) (*Job, bool) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    j, ok := b.jobs[id]
+    if !ok {
+        return nil, false
+    }
+    return j.Clone(), true
+}
+
+
+func (b *memoryJobBackend) List(status JobStatus) []*Job {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
     var out []*Job
-    for _, j := range s.jobs {
+    for _, j := range b.jobs {
         if status == "" || j.Status == status {
-            out = append(out, j)
+            out = append(out, j.Clone())
         }
     }
     return out
@@ -154,50 +538,133 @@ func MustGenerateID() string {
 }
 
 
-// new worker registry creates a worker registry
+// worker backend is the storage behind a worker registry. implementations must be safe for concurrent use.
+type WorkerBackend interface {
+    Put(w *Worker) error
+    Delete(id string) error
+    Get(id string) (*Worker, bool)
+    List() []*Worker
+}
+
+
+// worker registry holds registered workers; persistence is delegated to a pluggable backend
+type WorkerRegistry struct {
+    backend WorkerBackend
+    mu      sync.Mutex // serializes update so concurrent slot changes are not lost
+}
+
+
+// new worker registry creates an in-memory worker registry
 func NewWorkerRegistry() *WorkerRegistry {
-    return &WorkerRegistry{workers: make(map[string]*Worker)}
+    return NewWorkerRegistryWithBackend(newMemoryWorkerBackend())
 }
 
 
-// register adds or updates a worker
+// new worker registry with backend creates a worker registry on top of the given backend
+func NewWorkerRegistryWithBackend(backend WorkerBackend) *WorkerRegistry {
+    return &WorkerRegistry{backend: backend}
+}
+
+
+// register adds a worker or replaces a registered one's details. a worker registering again (e.g.
+// after a restart of its process or a lost connection) keeps the slots of the jobs the api still
+// has running on it; they are freed when those jobs finish or the next heartbeat reports them gone.
 func (r *WorkerRegistry) Register(w *Worker) {
     r.mu.Lock()
     defer r.mu.Unlock()
     w.LastHeartbeat = time.Now()
-    r.workers[w.ID] = w
+    if old, ok := r.backend.Get(w.ID); ok {
+        w.SetRunning(old.RunningJobs)
+    }
+    if err := r.backend.Put(w); err != nil {
+        log.Printf("event=store_write_failed worker_id=%s error=%v", w.ID, err)
+    }
 }
 
 
-// unregister removes a worker
-func (r *WorkerRegistry) Unregister(id string) {
+// update applies fn to the stored worker and saves it, atomically with respect to other updates.
+// unlike register it leaves last heartbeat alone: slot changes say nothing about the worker being alive.
+// returns false if the worker is not registered.
+func (r *WorkerRegistry) Update(id string, fn func(w *Worker)) (*Worker, bool) {
     r.mu.Lock()
     defer r.mu.Unlock()
-    delete(r.workers, id)
+    w, ok := r.backend.Get(id)
+    if !ok {
+        return nil, false
+    }
+    fn(w)
+    if err := r.backend.Put(w); err != nil {
+        log.Printf("event=store_write_failed worker_id=%s error=%v", w.ID, err)
+    }
+    return w, true
+}
+
+
+// unregister removes a worker
+func (r *WorkerRegistry) Unregister(id string) {
+    if err := r.backend.Delete(id); err != nil {
+        log.Printf("event=store_write_failed worker_id=%s error=%v", id, err)
+    }
 }
 
 
 // get returns a worker by id
 func (r *WorkerRegistry) Get(id string) (*Worker, bool) {
-    r.mu.RLock()
-    defer r.mu.RUnlock()
-    w, ok := r.workers[id]
-    return w, ok
+    return r.backend.Get(id)
 }
 
 
 // list returns all workers
 func (r *WorkerRegistry) List() []*Worker {
-    r.mu.RLock()
-    defer r.mu.RUnlock()
-    out := make([]*Worker, 0, len(r.workers))
-    for _, w := range r.workers {
-        out = append(out, w)
-    }
-    return out
+    return r.backend.List()
+}
+
+
+// memory worker backend keeps workers in a map
+type memoryWorkerBackend struct {
+    workers map[string]*Worker
+    mu      sync.RWMutex
+}
+
+
+func newMemoryWorkerBackend() *memoryWorkerBackend {
+    return &memoryWorkerBackend{workers: make(map[string]*Worker)}
 }
 
 
+func (b *memoryWorkerBackend) Put(w *Worker) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.workers[w.ID] = w.Clone()
+    return nil
+}
+
 
+func (b *memoryWorkerBackend) Delete(id string) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    delete(b.workers, id)
+    return nil
+}
 
 
+func (b *memoryWorkerBackend) Get(id string) (*Worker, bool) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    w, ok := b.workers[id]
+    if !ok {
+        return nil, false
+    }
+    return w.Clone(), true
+}
+
+
+func (b *memoryWorkerBackend) List() []*Worker {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    out := make([]*Worker, 0, len(b.workers))
+    for _, w := range b.workers {
+        out = append(out, w.Clone())
+    }
+    return out
+}
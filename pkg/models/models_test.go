@@ -0,0 +1,214 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJobCloneIsDeep(t *testing.T) {
+	now := time.Now()
+	job := &Job{
+		ID:             "a",
+		Status:         JobStatusRunning,
+		StartedAt:      &now,
+		FinishedAt:     &now,
+		LeaseExpiresAt: &now,
+		RunAt:          &now,
+		RetryPolicy:    &RetryPolicy{MaxAttempts: 3, RetryOn: []string{ErrorClassTimeout}},
+		Attempts:       []Attempt{{Number: 1, FinishedAt: &now}},
+		DeadLetter:     &DeadLetter{Reason: DeadLetterNotRetryable},
+		Workflow:       &WorkflowStep{WorkflowID: "wf", DependsOn: []string{"x"}},
+		Constraints:    &JobConstraints{NodeSelector: map[string]string{"zone": "a"}},
+	}
+	c := job.Clone()
+	if !reflect.DeepEqual(job, c) {
+		t.Fatalf("clone differs:\n%+v\n%+v", job, c)
+	}
+
+	later := now.Add(time.Hour)
+	*c.StartedAt = later
+	*c.Attempts[0].FinishedAt = later
+	c.Attempts[0].Error = "changed"
+	c.RetryPolicy.RetryOn[0] = ErrorClassExecution
+	c.DeadLetter.Reason = DeadLetterRetriesExhausted
+	c.Workflow.DependsOn[0] = "y"
+	c.Constraints.NodeSelector["zone"] = "b"
+	if !job.StartedAt.Equal(now) || !job.Attempts[0].FinishedAt.Equal(now) || job.Attempts[0].Error != "" ||
+		job.RetryPolicy.RetryOn[0] != ErrorClassTimeout || job.DeadLetter.Reason != DeadLetterNotRetryable ||
+		job.Workflow.DependsOn[0] != "x" || job.Constraints.NodeSelector["zone"] != "a" {
+		t.Fatalf("changing the clone changed the original: %+v", job)
+	}
+}
+
+func TestJobStoreUpdateRefusesStaleCopies(t *testing.T) {
+	s := NewJobStore()
+	job, err := s.Create(&Job{Payload: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := s.Get(job.ID)
+	fresh, _ := s.Get(job.ID)
+	fresh.Status = JobStatusCancelled
+	if !s.Update(fresh) {
+		t.Fatal("update of a fresh copy was refused")
+	}
+	stale.Status = JobStatusRunning
+	if s.Update(stale) {
+		t.Fatal("update of a copy read before the last write went through")
+	}
+	if got, _ := s.Get(job.ID); got.Status != JobStatusCancelled {
+		t.Fatalf("status = %s, want cancelled", got.Status)
+	}
+	if stale.Revision != job.Revision {
+		t.Fatalf("refused copy's revision moved to %d", stale.Revision)
+	}
+	// the writer of the fresh copy can keep writing it
+	fresh.Result = "r"
+	if !s.Update(fresh) {
+		t.Fatal("second update of the same copy was refused")
+	}
+}
+
+// failing backend refuses every conditional write, the way a full disk does
+type failingBackend struct {
+	*memoryJobBackend
+}
+
+func (failingBackend) PutIf(*Job, int64) (bool, error) {
+	return false, errors.New("no space left on device")
+}
+
+func TestJobStoreUpdateReportsBackendErrors(t *testing.T) {
+	s := NewJobStoreWithBackend(failingBackend{newMemoryJobBackend()})
+	job, err := s.Create(&Job{Payload: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Status = JobStatusQueued
+	if s.Update(job) {
+		t.Fatal("update reported a failed write as written")
+	}
+	if job.Revision != 1 {
+		t.Fatalf("revision = %d after a failed write, want 1", job.Revision)
+	}
+}
+
+func TestJobStoreHandsOutCopies(t *testing.T) {
+	s := NewJobStore()
+	job, _ := s.Create(&Job{Payload: "p"})
+	job.Status = JobStatusRunning
+	got, _ := s.Get(job.ID)
+	if got.Status != JobStatusPending {
+		t.Fatalf("store saw a change that was never written: %s", got.Status)
+	}
+	got.Status = JobStatusFailed
+	for _, j := range s.List("") {
+		if j.Status != JobStatusPending {
+			t.Fatalf("list shows %s, want pending", j.Status)
+		}
+	}
+}
+
+func TestScheduleStoreHandsOutCopies(t *testing.T) {
+	s := NewScheduleStore()
+	next := time.Now()
+	at := next
+	priority := PriorityHigh
+	sch := &Schedule{ID: "s1", NextRunAt: &at, Job: SubmitJobRequest{Priority: &priority, Retry: &RetryPolicy{RetryOn: []string{ErrorClassExecution}}}}
+	s.Save(sch)
+	sch.RunCount = 5
+	*sch.NextRunAt = next.Add(time.Hour)
+	got, _ := s.Get("s1")
+	if got.RunCount != 0 || !got.NextRunAt.Equal(next) {
+		t.Fatalf("store saw a change that was never saved: run_count=%d next_run_at=%v", got.RunCount, got.NextRunAt)
+	}
+	*got.Job.Priority = PriorityLow
+	got.Job.Retry.RetryOn[0] = ErrorClassDispatch
+	for _, l := range s.List() {
+		if *l.Job.Priority != PriorityHigh || l.Job.Retry.RetryOn[0] != ErrorClassExecution {
+			t.Fatalf("list shows the template changed through a copy: %+v", l.Job)
+		}
+	}
+}
+
+func TestWorkerRegistryHandsOutCopies(t *testing.T) {
+	r := NewWorkerRegistry()
+	r.Register(&Worker{ID: "w", Capacity: 2, JobTypes: []string{"email"}, Labels: map[string]string{"zone": "a"}})
+	got, _ := r.Get("w")
+	got.Assign("a")
+	got.JobTypes[0] = "sms"
+	got.Labels["zone"] = "b"
+	for _, w := range append(r.List(), mustGetWorker(t, r, "w")) {
+		if len(w.RunningJobs) != 0 || w.JobTypes[0] != "email" || w.Labels["zone"] != "a" {
+			t.Fatalf("registry saw a change that was never written: %+v", w)
+		}
+	}
+	// update writes its change back
+	r.Update("w", func(w *Worker) { w.Assign("a") })
+	if w := mustGetWorker(t, r, "w"); !w.Running("a") {
+		t.Fatalf("update not kept: %v", w.RunningJobs)
+	}
+}
+
+func mustGetWorker(t *testing.T, r *WorkerRegistry, id string) *Worker {
+	t.Helper()
+	w, ok := r.Get(id)
+	if !ok {
+		t.Fatalf("worker %s not registered", id)
+	}
+	return w
+}
+
+func TestWorkerSlots(t *testing.T) {
+	w := &Worker{ID: "w", Capacity: 2}
+	if !w.Assign("a") || w.Status != WorkerStatusIdle || w.FreeSlots() != 1 {
+		t.Fatalf("after one job: status %s free %d, want idle with a slot left", w.Status, w.FreeSlots())
+	}
+	if !w.Assign("b") || w.Status != WorkerStatusBusy || w.FreeSlots() != 0 {
+		t.Fatalf("after two jobs: status %s free %d, want busy", w.Status, w.FreeSlots())
+	}
+	if w.Assign("c") {
+		t.Fatal("assigned a job to a full worker")
+	}
+	if w.Release("c") {
+		t.Fatal("released a job that was not running")
+	}
+	if !w.Release("a") || w.Running("a") || !w.Running("b") || w.Status != WorkerStatusIdle {
+		t.Fatalf("after release: running %v status %s", w.RunningJobs, w.Status)
+	}
+	w.SetRunning([]string{"x", "y", "z"})
+	if w.FreeSlots() != 0 || w.Status != WorkerStatusBusy {
+		t.Fatalf("reported over capacity: free %d status %s", w.FreeSlots(), w.Status)
+	}
+
+	// registered without a capacity: one slot
+	if w := (&Worker{}); w.Slots() != 1 || !w.Assign("a") || w.Assign("b") {
+		t.Fatalf("zero capacity gives %d slots", w.Slots())
+	}
+}
+
+func TestPriorityRange(t *testing.T) {
+	for _, tc := range []struct {
+		r                        PriorityRange
+		def, highest, low, upper int // default, highest, -100 clamped, 100 clamped
+	}{
+		{PriorityRange{}, PriorityNormal, PriorityHigh, PriorityHigh, PriorityLow},
+		{PriorityRange{Min: -10, Max: 10}, 0, -10, -10, 10},
+		{PriorityRange{Min: 1, Max: 4}, 2, 1, 1, 4},
+	} {
+		if got := tc.r.Default(); got != tc.def {
+			t.Errorf("%+v default = %d, want %d", tc.r, got, tc.def)
+		}
+		if got := tc.r.Highest(); got != tc.highest {
+			t.Errorf("%+v highest = %d, want %d", tc.r, got, tc.highest)
+		}
+		if lo, hi := tc.r.Clamp(-100), tc.r.Clamp(100); lo != tc.low || hi != tc.upper {
+			t.Errorf("%+v clamps to %d..%d, want %d..%d", tc.r, lo, hi, tc.low, tc.upper)
+		}
+		if got := tc.r.Clamp(tc.def); got != tc.def {
+			t.Errorf("%+v moved %d, which is in range, to %d", tc.r, tc.def, got)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// job sort field is a column jobs can be listed by
+type JobSortField string
+
+const (
+	SortByCreatedAt  JobSortField = "created_at"
+	SortByPriority   JobSortField = "priority"
+	SortByFinishedAt JobSortField = "finished_at"
+)
+
+// job cursor is the position of the last job on a page: its sort keys plus the id tie-break.
+// the next page starts strictly after it, so pages never overlap or skip jobs as long as the sort
+// keys don't change. created_at never does; priority (patch) and finished_at (a job finishing) can,
+// and a job whose keys move across the cursor between two pages is seen twice or not at all.
+type JobCursor struct {
+	Keys []int64 `json:"k"`
+	ID   string  `json:"id"`
+}
+
+// err cursor sort is returned by query when the cursor does not carry the keys of the query's sort
+var ErrCursorSort = errors.New("cursor does not match sort")
+
+// check cursor returns ErrCursorSort unless the cursor has one key per sort key of field
+func CheckCursor(c *JobCursor, field JobSortField) error {
+	if len(c.Keys) != len((&Job{}).SortKeys(field)) {
+		return fmt.Errorf("%w %q", ErrCursorSort, field)
+	}
+	return nil
+}
+
+// job query selects a page of jobs. zero values mean no filter; the default order is created_at desc.
+// when cursor is set, offset is ignored.
+type JobQuery struct {
+	Status        JobStatus
+	Type          string
+	WorkerID      string
+	WorkflowID    string
+	Tenant        string
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	SortBy        JobSortField
+	Desc          bool
+	Cursor        *JobCursor
+	Limit         int
+	Offset        int
+}
+
+// job querier is implemented by backends that can filter, order and page natively (e.g. sql).
+// backends without it are queried by listing and sorting in memory.
+type JobQuerier interface {
+	Query(q JobQuery) (jobs []*Job, total int, err error)
+	CountByStatus(tenant string) (map[JobStatus]int, error) // every tenant when empty
+}
+
+// sort keys returns the values a job is ordered by for field, before the id tie-break.
+// priority ties fall back to creation time; unfinished jobs sort as finished_at 0.
+func (j *Job) SortKeys(field JobSortField) []int64 {
+	switch field {
+	case SortByPriority:
+		return []int64{int64(j.Priority), j.CreatedAt.UnixNano()}
+	case SortByFinishedAt:
+		if j.FinishedAt == nil {
+			return []int64{0}
+		}
+		return []int64{j.FinishedAt.UnixNano()}
+	default:
+		return []int64{j.CreatedAt.UnixNano()}
+	}
+}
+
+// cursor returns the cursor positioned at this job for field
+func (j *Job) Cursor(field JobSortField) *JobCursor {
+	return &JobCursor{Keys: j.SortKeys(field), ID: j.ID}
+}
+
+// compare cursor orders two positions ascending: keys first, then id
+func compareCursor(a, b *JobCursor) int {
+	for i := 0; i < len(a.Keys) && i < len(b.Keys); i++ {
+		if a.Keys[i] != b.Keys[i] {
+			if a.Keys[i] < b.Keys[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// matches reports whether the job passes the query filters (not the cursor)
+func (q JobQuery) matches(j *Job) bool {
+	if q.Status != "" && j.Status != q.Status {
+		return false
+	}
+	if q.Type != "" && j.Type != q.Type {
+		return false
+	}
+	if q.WorkerID != "" && j.WorkerID != q.WorkerID {
+		return false
+	}
+	if q.WorkflowID != "" && (j.Workflow == nil || j.Workflow.WorkflowID != q.WorkflowID) {
+		return false
+	}
+	if q.Tenant != "" && TenantOrDefault(j.Tenant) != q.Tenant {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && j.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !j.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// query returns one page of jobs matching q and the total number of matches (ignoring cursor and paging)
+func (s *JobStore) Query(q JobQuery) ([]*Job, int, error) {
+	if qr, ok := s.backend.(JobQuerier); ok {
+		return qr.Query(q)
+	}
+	if q.Cursor != nil {
+		if err := CheckCursor(q.Cursor, q.SortBy); err != nil {
+			return nil, 0, err
+		}
+	}
+	var jobs []*Job
+	for _, j := range s.backend.List(q.Status) {
+		if q.matches(j) {
+			jobs = append(jobs, j)
+		}
+	}
+	total := len(jobs)
+	less := func(a, b *Job) bool {
+		c := compareCursor(a.Cursor(q.SortBy), b.Cursor(q.SortBy))
+		if q.Desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	sort.Slice(jobs, func(i, j int) bool { return less(jobs[i], jobs[j]) })
+	start := q.Offset
+	if q.Cursor != nil {
+		start = sort.Search(len(jobs), func(i int) bool {
+			c := compareCursor(jobs[i].Cursor(q.SortBy), q.Cursor)
+			if q.Desc {
+				return c < 0
+			}
+			return c > 0
+		})
+	}
+	if start >= len(jobs) {
+		return nil, total, nil
+	}
+	end := len(jobs)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	return jobs[start:end], total, nil
+}
+
+// count by status returns the number of jobs in each status
+func (s *JobStore) CountByStatus() map[JobStatus]int {
+	return s.CountByStatusFor("")
+}
+
+// count by status for returns the number of one tenant's jobs in each status; every tenant when empty
+func (s *JobStore) CountByStatusFor(tenant string) map[JobStatus]int {
+	if qr, ok := s.backend.(JobQuerier); ok {
+		counts, err := qr.CountByStatus(tenant)
+		if err == nil {
+			return counts
+		}
+		log.Printf("event=store_query_failed query=count_by_status tenant=%s error=%v", tenant, err)
+	}
+	counts := make(map[JobStatus]int)
+	for _, j := range s.backend.List("") {
+		if tenant == "" || TenantOrDefault(j.Tenant) == tenant {
+			counts[j.Status]++
+		}
+	}
+	return counts
+}
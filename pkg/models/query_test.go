@@ -0,0 +1,114 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seed jobs puts n jobs with few distinct created_at, priority and finished_at values, so every
+// sort has ties for the id to break
+func seedJobs(t *testing.T, s *JobStore, n int, base time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		job := &Job{
+			ID:        fmt.Sprintf("j%02d", i),
+			Status:    JobStatusQueued,
+			Priority:  i % 3,
+			CreatedAt: base.Add(time.Duration(i/3) * time.Second),
+		}
+		if i%2 == 0 {
+			finished := base.Add(time.Duration(i%4) * time.Minute)
+			job.Status, job.FinishedAt = JobStatusCompleted, &finished
+		}
+		if err := s.backend.Put(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// page all follows next cursors from the first page to the last, calling between after each page
+func pageAll(t *testing.T, s *JobStore, q JobQuery, between func()) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("pagination does not end")
+		}
+		jobs, _, err := s.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		if len(jobs) < q.Limit {
+			return ids
+		}
+		q.Cursor = jobs[len(jobs)-1].Cursor(q.SortBy)
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestCursorPagesMatchTheUnpagedOrder(t *testing.T) {
+	s := NewJobStore()
+	seedJobs(t, s, 25, time.Now())
+	for _, sort := range []JobSortField{SortByCreatedAt, SortByPriority, SortByFinishedAt} {
+		for _, desc := range []bool{false, true} {
+			all, _, _ := s.Query(JobQuery{SortBy: sort, Desc: desc})
+			want := make([]string, len(all))
+			for i, j := range all {
+				want[i] = j.ID
+			}
+			if got := pageAll(t, s, JobQuery{SortBy: sort, Desc: desc, Limit: 4}, nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("sort=%s desc=%v pages:\n %v\nwant\n %v", sort, desc, got, want)
+			}
+		}
+	}
+}
+
+func TestQueryRejectsACursorWithTheKeysOfAnotherSort(t *testing.T) {
+	s := NewJobStore()
+	seedJobs(t, s, 3, time.Now())
+	cursor := &JobCursor{Keys: []int64{1, 2}, ID: "j00"}
+	if _, _, err := s.Query(JobQuery{SortBy: SortByCreatedAt, Cursor: cursor}); !errors.Is(err, ErrCursorSort) {
+		t.Fatalf("query err = %v, want ErrCursorSort", err)
+	}
+	if _, _, err := s.Query(JobQuery{SortBy: SortByPriority, Cursor: cursor}); err != nil {
+		t.Fatalf("query with a priority cursor: %v", err)
+	}
+}
+
+// created_at never changes, so its pages are stable while jobs change, finish and arrive
+func TestCreatedAtPagesStayStableWhileJobsChange(t *testing.T) {
+	s := NewJobStore()
+	base := time.Now()
+	seedJobs(t, s, 25, base)
+	before, _, _ := s.Query(JobQuery{SortBy: SortByCreatedAt, Desc: true})
+	n := 0
+	got := pageAll(t, s, JobQuery{SortBy: SortByCreatedAt, Desc: true, Limit: 4}, func() {
+		n++
+		for _, j := range s.List("") {
+			j.Priority = (j.Priority + 1) % 3
+			now := base.Add(time.Hour)
+			j.FinishedAt = &now
+			s.Update(j)
+		}
+		// newer than every seeded job, so before the cursor in a newest-first walk
+		newer := &Job{ID: fmt.Sprintf("new%d", n), Status: JobStatusQueued, CreatedAt: base.Add(time.Hour)}
+		if err := s.backend.Put(newer); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := make([]string, len(before))
+	for i, j := range before {
+		want[i] = j.ID
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("pages while jobs changed:\n %v\nwant\n %v", got, want)
+	}
+}
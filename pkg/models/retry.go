@@ -0,0 +1,66 @@
+package models
+
+import "fmt"
+
+const (
+	maxRetryAttempts   = 20
+	maxRetryBackoffSec = 3600
+)
+
+// default retry policy applies to jobs submitted without one: dispatch failures only, 3 attempts
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:       3,
+		Backoff:           BackoffExponential,
+		InitialBackoffSec: 1,
+		MaxBackoffSec:     60,
+		RetryOn:           []string{ErrorClassDispatch},
+	}
+}
+
+// normalize fills in defaults and validates a client-supplied policy
+func (p *RetryPolicy) Normalize() error {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = 3
+	}
+	if p.MaxAttempts < 1 || p.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("retry.max_attempts must be between 1 and %d", maxRetryAttempts)
+	}
+	switch p.Backoff {
+	case "":
+		p.Backoff = BackoffExponential
+	case BackoffExponential, BackoffFixed, BackoffJitter:
+	default:
+		return fmt.Errorf("retry.backoff must be exponential, fixed or jitter")
+	}
+	if p.InitialBackoffSec == 0 {
+		p.InitialBackoffSec = 1
+	}
+	if p.MaxBackoffSec == 0 {
+		p.MaxBackoffSec = 60
+	}
+	if p.InitialBackoffSec < 0 || p.MaxBackoffSec < 0 || p.MaxBackoffSec > maxRetryBackoffSec {
+		return fmt.Errorf("retry backoff seconds must be between 0 and %d", maxRetryBackoffSec)
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = []string{ErrorClassDispatch, ErrorClassTimeout, ErrorClassExecution}
+	}
+	for _, class := range p.RetryOn {
+		switch class {
+		case ErrorClassDispatch, ErrorClassTimeout, ErrorClassExecution, ErrorClassValidation:
+		default:
+			return fmt.Errorf("retry.retry_on: unknown error class %q", class)
+		}
+	}
+	return nil
+}
+
+// retries reports whether failures of the given class are retried
+func (p *RetryPolicy) Retries(class string) bool {
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRetryPolicyNormalize(t *testing.T) {
+	p := &RetryPolicy{}
+	if err := p.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	want := &RetryPolicy{MaxAttempts: 3, Backoff: BackoffExponential, InitialBackoffSec: 1, MaxBackoffSec: 60,
+		RetryOn: []string{ErrorClassDispatch, ErrorClassTimeout, ErrorClassExecution}}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("defaults = %+v, want %+v", p, want)
+	}
+	if p.Retries(ErrorClassValidation) {
+		t.Fatal("validation errors are retried by default")
+	}
+
+	for name, bad := range map[string]RetryPolicy{
+		"too many attempts": {MaxAttempts: maxRetryAttempts + 1},
+		"negative attempts": {MaxAttempts: -1},
+		"unknown backoff":   {Backoff: "linear"},
+		"negative backoff":  {InitialBackoffSec: -1},
+		"backoff too long":  {MaxBackoffSec: maxRetryBackoffSec + 1},
+		"unknown class":     {RetryOn: []string{"oom"}},
+	} {
+		if err := bad.Normalize(); err == nil {
+			t.Errorf("%s: accepted %+v", name, bad)
+		}
+	}
+}
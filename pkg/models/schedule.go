@@ -0,0 +1,156 @@
+package models
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// missed run policies decide what a schedule does about runs that fell due while the api was down
+const (
+	MissedRunSkip    = "skip"     // drop them and wait for the next run
+	MissedRunRunOnce = "run_once" // run once to catch up, however many were missed (default)
+	MissedRunRunAll  = "run_all"  // run once per missed run, up to a cap
+)
+
+// schedule creates a job from its template every time its cron expression fires
+type Schedule struct {
+	ID              string           `json:"id"`
+	Name            string           `json:"name,omitempty"`
+	Cron            string           `json:"cron"`
+	Timezone        string           `json:"timezone"`
+	MissedRunPolicy string           `json:"missed_run_policy"`
+	Job             SubmitJobRequest `json:"job"`
+	Paused          bool             `json:"paused"`
+	Tenant          string           `json:"tenant,omitempty"` // owner of the schedule and of the jobs it creates
+	CreatedAt       time.Time        `json:"created_at"`
+	NextRunAt       *time.Time       `json:"next_run_at,omitempty"`
+	LastRunAt       *time.Time       `json:"last_run_at,omitempty"`
+	LastJobID       string           `json:"last_job_id,omitempty"`
+	RunCount        int              `json:"run_count"`
+}
+
+// clone returns a deep copy of the schedule. stores hand out copies, so the scheduler advancing a
+// schedule doesn't race with the api encoding it.
+func (s *Schedule) Clone() *Schedule {
+	c := *s
+	c.NextRunAt = cloneTime(s.NextRunAt)
+	c.LastRunAt = cloneTime(s.LastRunAt)
+	if s.Job.Priority != nil {
+		p := *s.Job.Priority
+		c.Job.Priority = &p
+	}
+	c.Job.Retry = cloneRetryPolicy(s.Job.Retry)
+	c.Job.RunAt = cloneTime(s.Job.RunAt)
+	c.Job.Constraints = cloneConstraints(s.Job.Constraints)
+	return &c
+}
+
+// create schedule request is the body for post /schedules
+type CreateScheduleRequest struct {
+	Name            string           `json:"name,omitempty"`
+	Cron            string           `json:"cron"`
+	Timezone        string           `json:"timezone,omitempty"`          // iana name, default utc
+	MissedRunPolicy string           `json:"missed_run_policy,omitempty"` // skip, run_once (default) or run_all
+	Job             SubmitJobRequest `json:"job"`
+	Paused          bool             `json:"paused,omitempty"`
+}
+
+// schedule backend is the storage behind a schedule store. implementations must be safe for concurrent use.
+type ScheduleBackend interface {
+	Put(s *Schedule) error
+	Delete(id string) error
+	Get(id string) (*Schedule, bool)
+	List() []*Schedule
+}
+
+// schedule store holds recurring job schedules; persistence is delegated to a pluggable backend
+type ScheduleStore struct {
+	backend ScheduleBackend
+}
+
+// new schedule store creates an in-memory schedule store
+func NewScheduleStore() *ScheduleStore {
+	return NewScheduleStoreWithBackend(newMemoryScheduleBackend())
+}
+
+// new schedule store with backend creates a schedule store on top of the given backend
+func NewScheduleStoreWithBackend(backend ScheduleBackend) *ScheduleStore {
+	return &ScheduleStore{backend: backend}
+}
+
+// save adds or updates a schedule
+func (s *ScheduleStore) Save(sch *Schedule) {
+	if err := s.backend.Put(sch); err != nil {
+		log.Printf("event=store_write_failed schedule_id=%s error=%v", sch.ID, err)
+	}
+}
+
+// delete removes a schedule
+func (s *ScheduleStore) Delete(id string) {
+	if err := s.backend.Delete(id); err != nil {
+		log.Printf("event=store_write_failed schedule_id=%s error=%v", id, err)
+	}
+}
+
+// get returns a schedule by id
+func (s *ScheduleStore) Get(id string) (*Schedule, bool) {
+	return s.backend.Get(id)
+}
+
+// list returns all schedules ordered by creation time
+func (s *ScheduleStore) List() []*Schedule {
+	out := s.backend.List()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// memory schedule backend keeps copies of schedules in a map
+type memoryScheduleBackend struct {
+	schedules map[string]*Schedule
+	mu        sync.RWMutex
+}
+
+func newMemoryScheduleBackend() *memoryScheduleBackend {
+	return &memoryScheduleBackend{schedules: make(map[string]*Schedule)}
+}
+
+func (b *memoryScheduleBackend) Put(s *Schedule) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.schedules[s.ID] = s.Clone()
+	return nil
+}
+
+func (b *memoryScheduleBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.schedules, id)
+	return nil
+}
+
+func (b *memoryScheduleBackend) Get(id string) (*Schedule, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	s, ok := b.schedules[id]
+	if !ok {
+		return nil, false
+	}
+	return s.Clone(), true
+}
+
+func (b *memoryScheduleBackend) List() []*Schedule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]*Schedule, 0, len(b.schedules))
+	for _, s := range b.schedules {
+		out = append(out, s.Clone())
+	}
+	return out
+}
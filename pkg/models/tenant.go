@@ -0,0 +1,27 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// default tenant owns jobs submitted without a tenant, and jobs stored before tenants existed
+const DefaultTenant = "default"
+
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenant or default returns t, or the default tenant when t is empty
+func TenantOrDefault(t string) string {
+	if t == "" {
+		return DefaultTenant
+	}
+	return t
+}
+
+// validate tenant checks a tenant name: lowercase letters, digits, - and _, at most 63 characters
+func ValidateTenant(t string) error {
+	if !tenantName.MatchString(t) {
+		return fmt.Errorf("invalid tenant %q: use lowercase letters, digits, - and _ (at most 63)", t)
+	}
+	return nil
+}
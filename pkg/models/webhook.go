@@ -0,0 +1,129 @@
+package models
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// webhook subscription posts every job that finishes in one of its statuses to url
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Statuses  []string  `json:"statuses,omitempty"`  // completed, failed, cancelled, skipped; empty means all
+	JobTypes  []string  `json:"job_types,omitempty"` // empty means all
+	Secret    string    `json:"secret,omitempty"`    // hmac key; only returned when the subscription is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// create webhook request is the body for post /webhooks
+type CreateWebhookRequest struct {
+	URL      string   `json:"url"`
+	Statuses []string `json:"statuses,omitempty"`
+	JobTypes []string `json:"job_types,omitempty"`
+	Secret   string   `json:"secret,omitempty"` // generated when empty
+}
+
+// matches reports whether the subscription wants the finished job
+func (s *WebhookSubscription) Matches(job *Job) bool {
+	if len(s.Statuses) > 0 && !containsString(s.Statuses, string(job.Status)) {
+		return false
+	}
+	return len(s.JobTypes) == 0 || containsString(s.JobTypes, job.Type)
+}
+
+// webhook backend is the storage behind a webhook store. implementations must be safe for concurrent use.
+type WebhookBackend interface {
+	Put(s *WebhookSubscription) error
+	Delete(id string) error
+	Get(id string) (*WebhookSubscription, bool)
+	List() []*WebhookSubscription
+}
+
+// webhook store holds webhook subscriptions; persistence is delegated to a pluggable backend
+type WebhookStore struct {
+	backend WebhookBackend
+}
+
+// new webhook store creates an in-memory webhook store
+func NewWebhookStore() *WebhookStore {
+	return NewWebhookStoreWithBackend(newMemoryWebhookBackend())
+}
+
+// new webhook store with backend creates a webhook store on top of the given backend
+func NewWebhookStoreWithBackend(backend WebhookBackend) *WebhookStore {
+	return &WebhookStore{backend: backend}
+}
+
+// save adds or updates a subscription
+func (s *WebhookStore) Save(sub *WebhookSubscription) {
+	if err := s.backend.Put(sub); err != nil {
+		log.Printf("event=store_write_failed webhook_id=%s error=%v", sub.ID, err)
+	}
+}
+
+// delete removes a subscription
+func (s *WebhookStore) Delete(id string) {
+	if err := s.backend.Delete(id); err != nil {
+		log.Printf("event=store_write_failed webhook_id=%s error=%v", id, err)
+	}
+}
+
+// get returns a subscription by id
+func (s *WebhookStore) Get(id string) (*WebhookSubscription, bool) {
+	return s.backend.Get(id)
+}
+
+// list returns all subscriptions ordered by creation time
+func (s *WebhookStore) List() []*WebhookSubscription {
+	out := s.backend.List()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// memory webhook backend keeps subscriptions in a map
+type memoryWebhookBackend struct {
+	subs map[string]*WebhookSubscription
+	mu   sync.RWMutex
+}
+
+func newMemoryWebhookBackend() *memoryWebhookBackend {
+	return &memoryWebhookBackend{subs: make(map[string]*WebhookSubscription)}
+}
+
+func (b *memoryWebhookBackend) Put(s *WebhookSubscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s.ID] = s
+	return nil
+}
+
+func (b *memoryWebhookBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, id)
+	return nil
+}
+
+func (b *memoryWebhookBackend) Get(id string) (*WebhookSubscription, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	s, ok := b.subs[id]
+	return s, ok
+}
+
+func (b *memoryWebhookBackend) List() []*WebhookSubscription {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]*WebhookSubscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		out = append(out, s)
+	}
+	return out
+}
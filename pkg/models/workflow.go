@@ -0,0 +1,192 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const maxWorkflowJobs = 100
+
+// what happens to the rest of a workflow when one of its jobs fails for good
+const (
+	OnFailureCancel = "cancel" // cancel every job that has not started yet (default)
+	OnFailureSkip   = "skip"   // skip only the failed job's descendants; other branches keep running
+)
+
+// workflow statuses, derived from the statuses of the workflow's jobs
+const (
+	WorkflowStatusRunning   = "running"
+	WorkflowStatusCompleted = "completed"
+	WorkflowStatusFailed    = "failed"
+	WorkflowStatusCancelled = "cancelled"
+)
+
+// workflow step places a job in a workflow. depends_on names other steps of the same workflow;
+// the job stays pending until all of them completed.
+type WorkflowStep struct {
+	WorkflowID string   `json:"workflow_id"`
+	Step       string   `json:"step"`
+	DependsOn  []string `json:"depends_on,omitempty"`
+	OnFailure  string   `json:"on_failure"`
+}
+
+// workflow job request is one job of a workflow submission
+type WorkflowJobRequest struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	SubmitJobRequest
+}
+
+// submit workflow request is the body for post /workflows
+type SubmitWorkflowRequest struct {
+	OnFailure string               `json:"on_failure,omitempty"` // cancel (default) or skip
+	Jobs      []WorkflowJobRequest `json:"jobs"`
+}
+
+// workflow is the combined view of a workflow's jobs returned by get /workflows/:id
+type Workflow struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	OnFailure  string         `json:"on_failure"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Counts     map[string]int `json:"jobs_by_status"`
+	Jobs       []*Job         `json:"jobs"`
+}
+
+// payload templates reference a parent's output: {{jobs.<step>.result}} inserts it as is,
+// {{jobs.<step>.result | json}} as a quoted json string, and {{jobs.<step>.id}} inserts its job id
+var templateRef = regexp.MustCompile(`\{\{\s*jobs\.([A-Za-z0-9_-]+)\.(result|id)\s*(\|\s*json\s*)?\}\}`)
+
+// validate fills in defaults and checks names, edges, templates and retry policies.
+// it returns the jobs in dependency order (every job after its parents).
+func (r *SubmitWorkflowRequest) Validate() ([]*WorkflowJobRequest, error) {
+	switch r.OnFailure {
+	case "":
+		r.OnFailure = OnFailureCancel
+	case OnFailureCancel, OnFailureSkip:
+	default:
+		return nil, fmt.Errorf("on_failure must be cancel or skip")
+	}
+	if len(r.Jobs) == 0 || len(r.Jobs) > maxWorkflowJobs {
+		return nil, fmt.Errorf("a workflow needs between 1 and %d jobs", maxWorkflowJobs)
+	}
+	byName := make(map[string]*WorkflowJobRequest, len(r.Jobs))
+	for i := range r.Jobs {
+		j := &r.Jobs[i]
+		if j.Name == "" {
+			return nil, fmt.Errorf("jobs[%d]: name required", i)
+		}
+		if _, dup := byName[j.Name]; dup {
+			return nil, fmt.Errorf("duplicate job name %q", j.Name)
+		}
+		byName[j.Name] = j
+		if j.RunAt != nil || j.DelaySec != 0 {
+			return nil, fmt.Errorf("job %q: run_at and delay_sec are not supported in workflows", j.Name)
+		}
+		if j.Retry != nil {
+			if err := j.Retry.Normalize(); err != nil {
+				return nil, fmt.Errorf("job %q: %w", j.Name, err)
+			}
+		}
+		if j.Constraints != nil {
+			if err := j.Constraints.Validate(); err != nil {
+				return nil, fmt.Errorf("job %q: %w", j.Name, err)
+			}
+		}
+	}
+	for _, j := range r.Jobs {
+		deps := make(map[string]bool, len(j.DependsOn))
+		for _, dep := range j.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("job %q depends on unknown job %q", j.Name, dep)
+			}
+			deps[dep] = true
+		}
+		for _, m := range templateRef.FindAllStringSubmatch(j.Payload, -1) {
+			if !deps[m[1]] {
+				return nil, fmt.Errorf("job %q references %q in its payload but does not depend on it", j.Name, m[1])
+			}
+		}
+	}
+
+	// kahn's algorithm: anything left over after the sort is on a cycle
+	indegree := make(map[string]int, len(r.Jobs))
+	children := make(map[string][]string)
+	for _, j := range r.Jobs {
+		indegree[j.Name] = len(j.DependsOn)
+		for _, dep := range j.DependsOn {
+			children[dep] = append(children[dep], j.Name)
+		}
+	}
+	var ready []string
+	for _, j := range r.Jobs {
+		if indegree[j.Name] == 0 {
+			ready = append(ready, j.Name)
+		}
+	}
+	ordered := make([]*WorkflowJobRequest, 0, len(r.Jobs))
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, byName[name])
+		for _, child := range children[name] {
+			if indegree[child]--; indegree[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	if len(ordered) != len(r.Jobs) {
+		return nil, fmt.Errorf("depends_on edges form a cycle")
+	}
+	return ordered, nil
+}
+
+// render payload substitutes parent outputs into a workflow job's payload. parents maps step
+// names to the (completed) parent jobs.
+func RenderPayload(payload string, parents map[string]*Job) (string, error) {
+	var err error
+	out := templateRef.ReplaceAllStringFunc(payload, func(ref string) string {
+		m := templateRef.FindStringSubmatch(ref)
+		parent, ok := parents[m[1]]
+		if !ok {
+			err = fmt.Errorf("payload references unknown job %q", m[1])
+			return ref
+		}
+		v := parent.Result
+		if m[2] == "id" {
+			v = parent.ID
+		}
+		if m[3] != "" {
+			quoted, _ := json.Marshal(v)
+			return string(quoted)
+		}
+		return v
+	})
+	return out, err
+}
+
+// workflow status combines job statuses: running while any job can still run, then failed if
+// any job failed, cancelled if any was cancelled or skipped, otherwise completed
+func WorkflowStatusOf(jobs []*Job) string {
+	var failed, cancelled bool
+	for _, j := range jobs {
+		switch j.Status {
+		case JobStatusPending, JobStatusQueued, JobStatusRunning:
+			return WorkflowStatusRunning
+		case JobStatusFailed:
+			failed = true
+		case JobStatusCancelled, JobStatusSkipped:
+			cancelled = true
+		}
+	}
+	switch {
+	case failed:
+		return WorkflowStatusFailed
+	case cancelled:
+		return WorkflowStatusCancelled
+	}
+	return WorkflowStatusCompleted
+}
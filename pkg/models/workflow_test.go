@@ -0,0 +1,84 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func wfJob(name, payload string, dependsOn ...string) WorkflowJobRequest {
+	return WorkflowJobRequest{Name: name, DependsOn: dependsOn, SubmitJobRequest: SubmitJobRequest{Payload: payload}}
+}
+
+func TestWorkflowValidateOrdersByDependency(t *testing.T) {
+	req := &SubmitWorkflowRequest{Jobs: []WorkflowJobRequest{
+		wfJob("d", "{{jobs.b.result}}", "b", "c"),
+		wfJob("b", "", "a"),
+		wfJob("c", "", "a"),
+		wfJob("a", ""),
+	}}
+	ordered, err := req.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.OnFailure != OnFailureCancel {
+		t.Fatalf("on_failure defaulted to %q", req.OnFailure)
+	}
+	pos := make(map[string]int)
+	for i, j := range ordered {
+		pos[j.Name] = i
+	}
+	if pos["a"] > pos["b"] || pos["a"] > pos["c"] || pos["b"] > pos["d"] || pos["c"] > pos["d"] {
+		t.Fatalf("order %v puts a job before its parents", pos)
+	}
+}
+
+func TestWorkflowValidateRejects(t *testing.T) {
+	for want, jobs := range map[string][]WorkflowJobRequest{
+		"cycle":             {wfJob("a", "", "c"), wfJob("b", "", "a"), wfJob("c", "", "b")},
+		"unknown job":       {wfJob("a", "", "zzz")},
+		"does not depend":   {wfJob("a", ""), wfJob("b", "{{jobs.a.result}}")},
+		"duplicate":         {wfJob("a", ""), wfJob("a", "")},
+		"name required":     {wfJob("", "")},
+		"between 1 and 100": {},
+	} {
+		_, err := (&SubmitWorkflowRequest{Jobs: jobs}).Validate()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v", want, err)
+		}
+	}
+	if _, err := (&SubmitWorkflowRequest{OnFailure: "retry", Jobs: []WorkflowJobRequest{wfJob("a", "")}}).Validate(); err == nil {
+		t.Error("unknown on_failure accepted")
+	}
+}
+
+func TestRenderPayload(t *testing.T) {
+	parents := map[string]*Job{"a": {ID: "id-a", Result: "line\n\"q\""}}
+	got, err := RenderPayload(`{"raw":"{{jobs.a.result}}","json":{{ jobs.a.result | json }},"id":"{{jobs.a.id}}"}`, parents)
+	want := `{"raw":"line` + "\n" + `"q"","json":"line\n\"q\"","id":"id-a"}`
+	if err != nil || got != want {
+		t.Fatalf("render = %q, %v\nwant %q", got, err, want)
+	}
+	if _, err := RenderPayload("{{jobs.b.result}}", parents); err == nil {
+		t.Fatal("reference to an unknown job rendered")
+	}
+}
+
+func TestWorkflowStatusOf(t *testing.T) {
+	jobs := func(statuses ...JobStatus) []*Job {
+		out := make([]*Job, len(statuses))
+		for i, s := range statuses {
+			out[i] = &Job{Status: s}
+		}
+		return out
+	}
+	for want, js := range map[string][]*Job{
+		WorkflowStatusRunning:   jobs(JobStatusCompleted, JobStatusFailed, JobStatusPending),
+		WorkflowStatusFailed:    jobs(JobStatusCompleted, JobStatusFailed, JobStatusSkipped),
+		WorkflowStatusCancelled: jobs(JobStatusCompleted, JobStatusSkipped),
+		WorkflowStatusCompleted: jobs(JobStatusCompleted, JobStatusCompleted),
+	} {
+		if got := WorkflowStatusOf(js); got != want {
+			t.Errorf("status = %s, want %s", got, want)
+		}
+	}
+}